@@ -4,6 +4,7 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -16,6 +17,10 @@ type PRStackSpec struct {
 	// If not specified, defaults to pr-{prNumber}
 	ImageTag string `json:"imageTag,omitempty"`
 
+	// ImagePullSecrets of the services, replacing the pull secret the operator creates from its
+	// registry credentials. The secrets must exist in the stack namespace.
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
 	// CustomDomain is a custom domain for the ingress (e.g., gyurushop.hu, magicshop.hu)
 	// If not specified, defaults to pr-{prNumber}.shop.pilab.hu
 	CustomDomain string `json:"customDomain,omitempty"`
@@ -27,7 +32,8 @@ type PRStackSpec struct {
 
 	// Active controls whether the stack is active (replicas > 0) or inactive (replicas = 0)
 	// When false, all deployments are scaled to 0 replicas
-	// When true, all deployments are scaled to 1 replica
+	// When true, deployments are scaled back to the replicas they had before, or to
+	// their replicas in serviceScaling (1 by default)
 	// +kubebuilder:default=true
 	Active bool `json:"active,omitempty"`
 
@@ -35,15 +41,29 @@ type PRStackSpec struct {
 	// Update this field to force a re-deployment of all services
 	DeployedAt *metav1.Time `json:"deployedAt,omitempty"`
 
+	// Paused stops the operator from changing the stack: no expiry, scaling, rollouts or drift
+	// correction. Status is still reported and the stack is still cleaned up on deletion.
+	// Setting the shop.pilab.hu/pause-reconcile annotation to "true" has the same effect.
+	Paused bool `json:"paused,omitempty"`
+
+	// MongoDB configuration
+	MongoDB *MongoDBConfig `json:"mongodb,omitempty"`
+
 	// MongoDB connection details
 	MongoURI      string `json:"mongoURI,omitempty"`
 	MongoUsername string `json:"mongoUsername,omitempty"`
 	MongoPassword string `json:"mongoPassword,omitempty"`
 
-	// NATS connection details
+	// NATS configuration
+	NATS *NATSSpec `json:"nats,omitempty"`
+
+	// NATS connection details, overrides the operator's shared NATS server in shared mode
 	NatsURL string `json:"natsURL,omitempty"`
 
-	// Redis connection details
+	// Redis configuration
+	Redis *RedisSpec `json:"redis,omitempty"`
+
+	// Redis connection details, overrides the operator's shared Redis server in shared mode
 	RedisURL string `json:"redisURL,omitempty"`
 
 	// Services to provision for this PR
@@ -55,8 +75,139 @@ type PRStackSpec struct {
 	// Resource limits for the PR environment
 	ResourceLimits *ResourceLimits `json:"resourceLimits,omitempty"`
 
+	// ServiceScaling overrides the replicas and autoscaling of individual services
+	// +listType=map
+	// +listMapKey=name
+	ServiceScaling []ServiceScaling `json:"serviceScaling,omitempty"`
+
 	// Backup configuration
 	BackupConfig *BackupConfig `json:"backupConfig,omitempty"`
+
+	// Credential rotation configuration for the per-PR MongoDB user
+	CredentialRotation *CredentialRotation `json:"credentialRotation,omitempty"`
+
+	// GitHub links the stack to its pull request for deployment statuses and comments
+	GitHub *GitHubSpec `json:"github,omitempty"`
+}
+
+// GitHubSpec identifies the pull request of a PR stack on GitHub
+type GitHubSpec struct {
+	// Repository of the pull request (owner/name), defaults to the operator repository
+	Repository string `json:"repository,omitempty"`
+	// SHA of the deployed commit, defaults to the head of the pull request
+	SHA string `json:"sha,omitempty"`
+}
+
+// MongoDBConfig defines how MongoDB is provided to the PR environment
+type MongoDBConfig struct {
+	// Mode selects between the shared MongoDB server (shared) and a single-node
+	// MongoDB running inside the PR namespace (dedicated)
+	// +kubebuilder:validation:Enum=shared;dedicated
+	// +kubebuilder:default=shared
+	Mode string `json:"mode,omitempty"`
+	// Image is the MongoDB image used in dedicated mode (defaults to mongo:7.0)
+	Image string `json:"image,omitempty"`
+}
+
+// NATSSpec defines how NATS is provided to the PR environment
+type NATSSpec struct {
+	// Mode selects between a NATS server running inside the PR namespace (dedicated)
+	// and a per-PR account on the shared NATS server (shared)
+	// +kubebuilder:validation:Enum=shared;dedicated
+	// +kubebuilder:default=dedicated
+	Mode string `json:"mode,omitempty"`
+	// JetStream storage and streams of the PR
+	JetStream *JetStreamSpec `json:"jetstream,omitempty"`
+}
+
+// JetStreamSpec defines JetStream storage and the streams the operator maintains
+type JetStreamSpec struct {
+	// StorageSize of the PVC backing JetStream in dedicated mode (e.g. "1Gi").
+	// When empty JetStream data is kept on an emptyDir and lost when NATS is scaled down.
+	StorageSize string `json:"storageSize,omitempty"`
+	// StorageClass of the JetStream PVC (defaults to the cluster default storage class)
+	StorageClass string `json:"storageClass,omitempty"`
+	// Streams created once NATS is ready and reconciled on drift
+	Streams []StreamSpec `json:"streams,omitempty"`
+}
+
+// StreamSpec defines a JetStream stream of the PR
+type StreamSpec struct {
+	// Name of the stream
+	// +kubebuilder:validation:Pattern=`^[A-Za-z0-9_-]+$`
+	Name string `json:"name"`
+	// Service owning the stream; the stream is only created when the service is deployed.
+	// Streams without a service belong to the whole stack.
+	Service string `json:"service,omitempty"`
+	// Subjects captured by the stream, relative to the PR subject prefix (e.g. "orders.>")
+	// +kubebuilder:validation:MinItems=1
+	Subjects []string `json:"subjects"`
+	// Storage backend of the stream
+	// +kubebuilder:validation:Enum=file;memory
+	// +kubebuilder:default=file
+	Storage string `json:"storage,omitempty"`
+	// Retention policy of the stream
+	// +kubebuilder:validation:Enum=limits;interest;workqueue
+	// +kubebuilder:default=limits
+	Retention string `json:"retention,omitempty"`
+	// MaxAge of messages in the stream (unlimited when not set)
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+	// MaxBytes stored in the stream (unlimited when not set)
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// MaxMsgs stored in the stream (unlimited when not set)
+	MaxMsgs int64 `json:"maxMsgs,omitempty"`
+	// Consumers are durable consumers of the stream
+	Consumers []ConsumerSpec `json:"consumers,omitempty"`
+}
+
+// ConsumerSpec defines a durable JetStream consumer
+type ConsumerSpec struct {
+	// Name of the durable consumer
+	// +kubebuilder:validation:Pattern=`^[A-Za-z0-9_-]+$`
+	Name string `json:"name"`
+	// FilterSubject relative to the PR subject prefix (all stream subjects when empty)
+	FilterSubject string `json:"filterSubject,omitempty"`
+	// DeliverPolicy of the consumer
+	// +kubebuilder:validation:Enum=all;new;last
+	// +kubebuilder:default=all
+	DeliverPolicy string `json:"deliverPolicy,omitempty"`
+	// AckPolicy of the consumer
+	// +kubebuilder:validation:Enum=explicit;none;all
+	// +kubebuilder:default=explicit
+	AckPolicy string `json:"ackPolicy,omitempty"`
+	// AckWait before a message is redelivered (server default when not set)
+	AckWait *metav1.Duration `json:"ackWait,omitempty"`
+	// MaxDeliver attempts of a message (unlimited when not set)
+	MaxDeliver int `json:"maxDeliver,omitempty"`
+}
+
+// RedisSpec defines how Redis is provided to the PR environment
+type RedisSpec struct {
+	// Mode selects between a Redis server running inside the PR namespace (dedicated)
+	// and an ACL user restricted to the PR key prefix on the shared Redis server (shared)
+	// +kubebuilder:validation:Enum=shared;dedicated
+	// +kubebuilder:default=dedicated
+	Mode string `json:"mode,omitempty"`
+	// Persistence of the dedicated Redis server
+	Persistence *RedisPersistenceSpec `json:"persistence,omitempty"`
+	// MaxMemory of the dedicated Redis server (e.g. "256mb")
+	MaxMemory string `json:"maxMemory,omitempty"`
+	// MaxMemoryPolicy is the eviction policy applied when MaxMemory is reached
+	// +kubebuilder:validation:Enum=noeviction;allkeys-lru;allkeys-lfu;allkeys-random;volatile-lru;volatile-lfu;volatile-random;volatile-ttl
+	MaxMemoryPolicy string `json:"maxMemoryPolicy,omitempty"`
+}
+
+// RedisPersistenceSpec defines how the dedicated Redis server persists its data
+type RedisPersistenceSpec struct {
+	// Mode selects append-only file (aof), snapshot (rdb), both or no persistence
+	// +kubebuilder:validation:Enum=none;rdb;aof;both
+	// +kubebuilder:default=aof
+	Mode string `json:"mode,omitempty"`
+	// StorageSize of the PVC holding the Redis data (e.g. "1Gi").
+	// When empty data is kept on an emptyDir and lost when Redis is scaled down.
+	StorageSize string `json:"storageSize,omitempty"`
+	// StorageClass of the Redis PVC (defaults to the cluster default storage class)
+	StorageClass string `json:"storageClass,omitempty"`
 }
 
 // ResourceLimits defines resource constraints for the PR environment
@@ -65,10 +216,46 @@ type ResourceLimits struct {
 	CPULimit string `json:"cpuLimit,omitempty"`
 	// Memory limit per service
 	MemoryLimit string `json:"memoryLimit,omitempty"`
-	// Storage limit for databases
+	// Storage limit of each volume of the stack, enforced by the namespace LimitRange
+	// In dedicated MongoDB mode this sizes the MongoDB data volume and cannot be changed later
 	StorageLimit string `json:"storageLimit,omitempty"`
 }
 
+// ServiceScaling defines the replicas and autoscaling of a service
+type ServiceScaling struct {
+	// Name of the service (e.g., product-service)
+	Name string `json:"name"`
+	// Replicas of the service while the stack is active, defaults to the stack replicas
+	// +kubebuilder:validation:Minimum=1
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Autoscaling creates a HorizontalPodAutoscaler for the service
+	Autoscaling *AutoscalingSpec `json:"autoscaling,omitempty"`
+}
+
+// AutoscalingSpec defines the HorizontalPodAutoscaler of a service.
+// Either TargetCPU or CustomMetric must be set.
+type AutoscalingSpec struct {
+	// MinReplicas of the service, defaults to the service replicas
+	// +kubebuilder:validation:Minimum=1
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+	// MaxReplicas of the service
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas"`
+	// TargetCPU is the average CPU usage per pod to scale at (e.g., 250m).
+	// An absolute value is used because services run without CPU requests.
+	TargetCPU string `json:"targetCPU,omitempty"`
+	// CustomMetric scales on a per-pod metric of the custom metrics API
+	CustomMetric *CustomMetricSpec `json:"customMetric,omitempty"`
+}
+
+// CustomMetricSpec defines a per-pod custom metric target
+type CustomMetricSpec struct {
+	// Name of the metric (e.g., http_requests_per_second)
+	Name string `json:"name"`
+	// TargetAverageValue of the metric per pod (e.g., 100)
+	TargetAverageValue string `json:"targetAverageValue"`
+}
+
 // BackupConfig defines backup configuration for the PR environment
 type BackupConfig struct {
 	// Enabled controls whether automatic backups are enabled
@@ -83,6 +270,15 @@ type BackupConfig struct {
 	StorageSize string `json:"storageSize,omitempty"`
 }
 
+// CredentialRotation defines how the per-PR MongoDB user password is rotated
+type CredentialRotation struct {
+	// Interval is how often the password is rotated automatically (e.g., 168h)
+	// If not specified, credentials are only rotated on demand
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// RequestedAt triggers an on-demand rotation when set to a time after the last rotation
+	RequestedAt *metav1.Time `json:"requestedAt,omitempty"`
+}
+
 // PRStackStatus defines the observed state of PRStack
 type PRStackStatus struct {
 	// Phase represents the current phase of the PR stack
@@ -91,6 +287,18 @@ type PRStackStatus struct {
 	// Message provides additional information about the current status
 	Message string `json:"message,omitempty"`
 
+	// ObservedGeneration is the generation of the spec the status was last reported for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// ReadyServices is the number of ready services out of the deployed ones (e.g. 4/5)
+	ReadyServices string `json:"readyServices,omitempty"`
+
+	// URL is the public address of the stack
+	URL string `json:"url,omitempty"`
+
+	// Endpoints lists the public addresses of the stack
+	Endpoints *StackEndpoints `json:"endpoints,omitempty"`
+
 	// CreatedAt is the timestamp when the stack was first created
 	CreatedAt *metav1.Time `json:"createdAt,omitempty"`
 
@@ -100,6 +308,9 @@ type PRStackStatus struct {
 	// LastDeployedAt is the timestamp when deployments were last rolled out
 	LastDeployedAt *metav1.Time `json:"lastDeployedAt,omitempty"`
 
+	// FirstRunningAt is the timestamp when the stack was first running
+	FirstRunningAt *metav1.Time `json:"firstRunningAt,omitempty"`
+
 	// MongoDB credentials for this PR
 	MongoDB *MongoDBCredentials `json:"mongodb,omitempty"`
 
@@ -112,11 +323,55 @@ type PRStackStatus struct {
 	// Deployed services
 	Services []ServiceStatus `json:"services,omitempty"`
 
+	// Deployment reports the wave being deployed, nil once all waves are deployed
+	Deployment *DeploymentProgress `json:"deployment,omitempty"`
+
 	// Conditions represent the latest available observations of the object's state
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
 
 	// Backup status
 	Backup *BackupStatus `json:"backup,omitempty"`
+
+	// GitHub reports the deployment and comment published on the pull request
+	GitHub *GitHubStatus `json:"github,omitempty"`
+}
+
+// GitHubStatus tracks what was published on the pull request of a PR stack
+type GitHubStatus struct {
+	// DeploymentID of the GitHub deployment of the current commit
+	DeploymentID int64 `json:"deploymentID,omitempty"`
+	// SHA of the commit the deployment was created for
+	SHA string `json:"sha,omitempty"`
+	// State last reported on the deployment
+	State string `json:"state,omitempty"`
+	// CommentID of the sticky pull request comment
+	CommentID int64 `json:"commentID,omitempty"`
+}
+
+// StackEndpoints are the addresses a stack is reachable at from outside the cluster, the
+// in-cluster address of each service is reported on its ServiceStatus
+type StackEndpoints struct {
+	// Public URLs served by the stack ingress
+	Public []string `json:"public,omitempty"`
+	// GraphQL is the URL of the GraphQL API
+	GraphQL string `json:"graphql,omitempty"`
+	// Playground is the URL of the GraphQL playground, empty when it is disabled
+	Playground string `json:"playground,omitempty"`
+}
+
+// DeploymentProgress reports the progress of a deployment. Services are deployed in waves,
+// each wave starts once the dependencies deployed by the previous wave are ready.
+type DeploymentProgress struct {
+	// Wave is the wave in progress, starting at 1 with MongoDB, NATS and Redis
+	Wave int32 `json:"wave,omitempty"`
+	// TotalWaves is the number of waves of the stack
+	TotalWaves int32 `json:"totalWaves,omitempty"`
+	// Services deployed in the wave in progress
+	Services []string `json:"services,omitempty"`
+	// BlockedBy is the dependency the next wave is waiting for
+	BlockedBy string `json:"blockedBy,omitempty"`
+	// StartedAt is when the wave in progress started waiting for its dependencies
+	StartedAt *metav1.Time `json:"startedAt,omitempty"`
 }
 
 // MongoDBCredentials contains MongoDB connection details for the PR
@@ -129,6 +384,10 @@ type MongoDBCredentials struct {
 	ConnectionString string `json:"connectionString,omitempty"`
 	// Databases lists the created databases
 	Databases []string `json:"databases,omitempty"`
+	// LastRotationTime is the timestamp when the password was last rotated
+	LastRotationTime *metav1.Time `json:"lastRotationTime,omitempty"`
+	// PendingPassword is the password of an unfinished rotation, reused when it is retried
+	PendingPassword string `json:"pendingPassword,omitempty"`
 }
 
 // NATSConfig contains NATS configuration for the PR
@@ -137,6 +396,10 @@ type NATSConfig struct {
 	SubjectPrefix string `json:"subjectPrefix,omitempty"`
 	// Connection string for NATS
 	ConnectionString string `json:"connectionString,omitempty"`
+	// Account is the public key of the PR account on the shared NATS server
+	Account string `json:"account,omitempty"`
+	// Streams lists the JetStream streams maintained by the operator
+	Streams []string `json:"streams,omitempty"`
 }
 
 // RedisConfig contains Redis configuration for the PR
@@ -145,6 +408,8 @@ type RedisConfig struct {
 	KeyPrefix string `json:"keyPrefix,omitempty"`
 	// Connection string for Redis
 	ConnectionString string `json:"connectionString,omitempty"`
+	// User is the ACL user of this PR on the shared Redis server
+	User string `json:"user,omitempty"`
 }
 
 // ServiceStatus represents the status of a deployed service
@@ -194,6 +459,8 @@ type BackupJobStatus struct {
 //+kubebuilder:resource:scope=Cluster
 //+kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
 //+kubebuilder:printcolumn:name="PR Number",type="string",JSONPath=".spec.prNumber"
+//+kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.readyServices"
+//+kubebuilder:printcolumn:name="URL",type="string",JSONPath=".status.url"
 //+kubebuilder:printcolumn:name="Environment",type="string",JSONPath=".spec.environment"
 //+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
@@ -0,0 +1,191 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TenantSpec defines the desired state of Tenant
+type TenantSpec struct {
+	// TenantID identifies the customer shop. It names the tenant namespace (tenant-{tenantID}),
+	// databases, users and prefixes and cannot be reused by another tenant.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=40
+	TenantID string `json:"tenantID"`
+
+	// DisplayName is the human readable name of the shop
+	DisplayName string `json:"displayName,omitempty"`
+
+	// ImageTag is the Docker image tag to use for services (e.g., v1.2.3)
+	// +kubebuilder:validation:MinLength=1
+	ImageTag string `json:"imageTag"`
+
+	// ImagePullSecrets of the services, replacing the pull secret the operator creates from its
+	// registry credentials. The secrets must exist in the stack namespace.
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// CustomDomain is the domain of the shop (e.g., gyurushop.hu)
+	// If not specified, defaults to {tenantID}.shop.pilab.hu
+	CustomDomain string `json:"customDomain,omitempty"`
+
+	// IngressTlsSecretName is the name of the Kubernetes secret containing the TLS certificate
+	// for the custom domain. The secret should contain 'tls.crt' and 'tls.key' keys.
+	IngressTlsSecretName string `json:"ingressTlsSecretName,omitempty"`
+
+	// Replicas of each service
+	// +kubebuilder:validation:Minimum=2
+	// +kubebuilder:default=2
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// DeployedAt is a timestamp that triggers a rollout of all deployments when changed
+	DeployedAt *metav1.Time `json:"deployedAt,omitempty"`
+
+	// Paused stops the operator from changing the tenant: no deployments, rollouts or drift
+	// correction. Status is still reported and deletion is still handled.
+	// Setting the shop.pilab.hu/pause-reconcile annotation to "true" has the same effect.
+	Paused bool `json:"paused,omitempty"`
+
+	// MongoDB configuration
+	MongoDB *MongoDBConfig `json:"mongodb,omitempty"`
+
+	// MongoDB connection details, overrides the operator's shared MongoDB server
+	MongoURI      string `json:"mongoURI,omitempty"`
+	MongoUsername string `json:"mongoUsername,omitempty"`
+	MongoPassword string `json:"mongoPassword,omitempty"`
+
+	// NATS configuration
+	NATS *NATSSpec `json:"nats,omitempty"`
+
+	// NATS connection details, overrides the operator's shared NATS server in shared mode
+	NatsURL string `json:"natsURL,omitempty"`
+
+	// Redis configuration
+	Redis *RedisSpec `json:"redis,omitempty"`
+
+	// Redis connection details, overrides the operator's shared Redis server in shared mode
+	RedisURL string `json:"redisURL,omitempty"`
+
+	// Services to deploy for this tenant
+	Services []string `json:"services,omitempty"`
+
+	// Environment configuration
+	Environment string `json:"environment,omitempty"`
+
+	// Resource limits for the tenant services
+	ResourceLimits *ResourceLimits `json:"resourceLimits,omitempty"`
+
+	// ServiceScaling overrides the replicas and autoscaling of individual services
+	// +listType=map
+	// +listMapKey=name
+	ServiceScaling []ServiceScaling `json:"serviceScaling,omitempty"`
+
+	// Backup configuration, scheduled backups are mandatory for tenants
+	Backup TenantBackupConfig `json:"backup"`
+
+	// DeletionProtection keeps the tenant and all of its data when the Tenant is deleted.
+	// It must be set to false before a tenant can be removed.
+	// +kubebuilder:default=true
+	DeletionProtection *bool `json:"deletionProtection,omitempty"`
+}
+
+// TenantBackupConfig defines the scheduled backups of a tenant
+type TenantBackupConfig struct {
+	// Schedule defines the backup schedule in cron format
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+	// RetentionDays defines how many days to keep backups
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=30
+	RetentionDays int `json:"retentionDays,omitempty"`
+	// StorageClass defines the storage class for the backup PVC
+	StorageClass string `json:"storageClass,omitempty"`
+	// StorageSize defines the size of the backup PVC
+	StorageSize string `json:"storageSize,omitempty"`
+}
+
+// TenantStatus defines the observed state of Tenant
+type TenantStatus struct {
+	// Phase represents the current phase of the tenant
+	Phase string `json:"phase,omitempty"`
+
+	// Message provides additional information about the current status
+	Message string `json:"message,omitempty"`
+
+	// ObservedGeneration is the generation of the spec that was last deployed
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// ReadyServices is the number of ready services out of the deployed ones (e.g. 4/5)
+	ReadyServices string `json:"readyServices,omitempty"`
+
+	// URL is the public address of the tenant shop
+	URL string `json:"url,omitempty"`
+
+	// Endpoints lists the public addresses of the tenant shop
+	Endpoints *StackEndpoints `json:"endpoints,omitempty"`
+
+	// Namespace holding the tenant resources
+	Namespace string `json:"namespace,omitempty"`
+
+	// CreatedAt is the timestamp when the tenant was first created
+	CreatedAt *metav1.Time `json:"createdAt,omitempty"`
+
+	// LastDeployedAt is the timestamp when deployments were last rolled out
+	LastDeployedAt *metav1.Time `json:"lastDeployedAt,omitempty"`
+
+	// FirstRunningAt is the timestamp when the tenant was first running
+	FirstRunningAt *metav1.Time `json:"firstRunningAt,omitempty"`
+
+	// MongoDB credentials for this tenant
+	MongoDB *MongoDBCredentials `json:"mongodb,omitempty"`
+
+	// NATS configuration for this tenant
+	NATS *NATSConfig `json:"nats,omitempty"`
+
+	// Redis configuration for this tenant
+	Redis *RedisConfig `json:"redis,omitempty"`
+
+	// Deployed services
+	Services []ServiceStatus `json:"services,omitempty"`
+
+	// Deployment reports the wave being deployed, nil once all waves are deployed
+	Deployment *DeploymentProgress `json:"deployment,omitempty"`
+
+	// Conditions represent the latest available observations of the object's state
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Backup status
+	Backup *BackupStatus `json:"backup,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+//+kubebuilder:printcolumn:name="Tenant",type="string",JSONPath=".spec.tenantID"
+//+kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.readyServices"
+//+kubebuilder:printcolumn:name="URL",type="string",JSONPath=".status.url"
+//+kubebuilder:printcolumn:name="Replicas",type="integer",JSONPath=".spec.replicas"
+//+kubebuilder:printcolumn:name="Protected",type="boolean",JSONPath=".spec.deletionProtection"
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// Tenant is the Schema for the tenants API
+type Tenant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TenantSpec   `json:"spec,omitempty"`
+	Status TenantStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TenantList contains a list of Tenant
+type TenantList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Tenant `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Tenant{}, &TenantList{})
+}
@@ -21,10 +21,36 @@ limitations under the License.
 package v1alpha1
 
 import (
-	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AutoscalingSpec) DeepCopyInto(out *AutoscalingSpec) {
+	*out = *in
+	if in.MinReplicas != nil {
+		in, out := &in.MinReplicas, &out.MinReplicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.CustomMetric != nil {
+		in, out := &in.CustomMetric, &out.CustomMetric
+		*out = new(CustomMetricSpec)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AutoscalingSpec.
+func (in *AutoscalingSpec) DeepCopy() *AutoscalingSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AutoscalingSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *BackupConfig) DeepCopyInto(out *BackupConfig) {
 	*out = *in
@@ -89,6 +115,156 @@ func (in *BackupStatus) DeepCopy() *BackupStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConsumerSpec) DeepCopyInto(out *ConsumerSpec) {
+	*out = *in
+	if in.AckWait != nil {
+		in, out := &in.AckWait, &out.AckWait
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsumerSpec.
+func (in *ConsumerSpec) DeepCopy() *ConsumerSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ConsumerSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CredentialRotation) DeepCopyInto(out *CredentialRotation) {
+	*out = *in
+	if in.Interval != nil {
+		in, out := &in.Interval, &out.Interval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.RequestedAt != nil {
+		in, out := &in.RequestedAt, &out.RequestedAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CredentialRotation.
+func (in *CredentialRotation) DeepCopy() *CredentialRotation {
+	if in == nil {
+		return nil
+	}
+	out := new(CredentialRotation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CustomMetricSpec) DeepCopyInto(out *CustomMetricSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomMetricSpec.
+func (in *CustomMetricSpec) DeepCopy() *CustomMetricSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CustomMetricSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeploymentProgress) DeepCopyInto(out *DeploymentProgress) {
+	*out = *in
+	if in.Services != nil {
+		in, out := &in.Services, &out.Services
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.StartedAt != nil {
+		in, out := &in.StartedAt, &out.StartedAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeploymentProgress.
+func (in *DeploymentProgress) DeepCopy() *DeploymentProgress {
+	if in == nil {
+		return nil
+	}
+	out := new(DeploymentProgress)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitHubSpec) DeepCopyInto(out *GitHubSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitHubSpec.
+func (in *GitHubSpec) DeepCopy() *GitHubSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(GitHubSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitHubStatus) DeepCopyInto(out *GitHubStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitHubStatus.
+func (in *GitHubStatus) DeepCopy() *GitHubStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(GitHubStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *JetStreamSpec) DeepCopyInto(out *JetStreamSpec) {
+	*out = *in
+	if in.Streams != nil {
+		in, out := &in.Streams, &out.Streams
+		*out = make([]StreamSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new JetStreamSpec.
+func (in *JetStreamSpec) DeepCopy() *JetStreamSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(JetStreamSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MongoDBConfig) DeepCopyInto(out *MongoDBConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MongoDBConfig.
+func (in *MongoDBConfig) DeepCopy() *MongoDBConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(MongoDBConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *MongoDBCredentials) DeepCopyInto(out *MongoDBCredentials) {
 	*out = *in
@@ -97,6 +273,10 @@ func (in *MongoDBCredentials) DeepCopyInto(out *MongoDBCredentials) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.LastRotationTime != nil {
+		in, out := &in.LastRotationTime, &out.LastRotationTime
+		*out = (*in).DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MongoDBCredentials.
@@ -112,6 +292,11 @@ func (in *MongoDBCredentials) DeepCopy() *MongoDBCredentials {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NATSConfig) DeepCopyInto(out *NATSConfig) {
 	*out = *in
+	if in.Streams != nil {
+		in, out := &in.Streams, &out.Streams
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NATSConfig.
@@ -124,6 +309,26 @@ func (in *NATSConfig) DeepCopy() *NATSConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NATSSpec) DeepCopyInto(out *NATSSpec) {
+	*out = *in
+	if in.JetStream != nil {
+		in, out := &in.JetStream, &out.JetStream
+		*out = new(JetStreamSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NATSSpec.
+func (in *NATSSpec) DeepCopy() *NATSSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NATSSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PRStack) DeepCopyInto(out *PRStack) {
 	*out = *in
@@ -186,10 +391,30 @@ func (in *PRStackList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PRStackSpec) DeepCopyInto(out *PRStackSpec) {
 	*out = *in
+	if in.ImagePullSecrets != nil {
+		in, out := &in.ImagePullSecrets, &out.ImagePullSecrets
+		*out = make([]v1.LocalObjectReference, len(*in))
+		copy(*out, *in)
+	}
 	if in.DeployedAt != nil {
 		in, out := &in.DeployedAt, &out.DeployedAt
 		*out = (*in).DeepCopy()
 	}
+	if in.MongoDB != nil {
+		in, out := &in.MongoDB, &out.MongoDB
+		*out = new(MongoDBConfig)
+		**out = **in
+	}
+	if in.NATS != nil {
+		in, out := &in.NATS, &out.NATS
+		*out = new(NATSSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Redis != nil {
+		in, out := &in.Redis, &out.Redis
+		*out = new(RedisSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Services != nil {
 		in, out := &in.Services, &out.Services
 		*out = make([]string, len(*in))
@@ -200,11 +425,28 @@ func (in *PRStackSpec) DeepCopyInto(out *PRStackSpec) {
 		*out = new(ResourceLimits)
 		**out = **in
 	}
+	if in.ServiceScaling != nil {
+		in, out := &in.ServiceScaling, &out.ServiceScaling
+		*out = make([]ServiceScaling, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.BackupConfig != nil {
 		in, out := &in.BackupConfig, &out.BackupConfig
 		*out = new(BackupConfig)
 		**out = **in
 	}
+	if in.CredentialRotation != nil {
+		in, out := &in.CredentialRotation, &out.CredentialRotation
+		*out = new(CredentialRotation)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.GitHub != nil {
+		in, out := &in.GitHub, &out.GitHub
+		*out = new(GitHubSpec)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PRStackSpec.
@@ -220,6 +462,11 @@ func (in *PRStackSpec) DeepCopy() *PRStackSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PRStackStatus) DeepCopyInto(out *PRStackStatus) {
 	*out = *in
+	if in.Endpoints != nil {
+		in, out := &in.Endpoints, &out.Endpoints
+		*out = new(StackEndpoints)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.CreatedAt != nil {
 		in, out := &in.CreatedAt, &out.CreatedAt
 		*out = (*in).DeepCopy()
@@ -232,6 +479,10 @@ func (in *PRStackStatus) DeepCopyInto(out *PRStackStatus) {
 		in, out := &in.LastDeployedAt, &out.LastDeployedAt
 		*out = (*in).DeepCopy()
 	}
+	if in.FirstRunningAt != nil {
+		in, out := &in.FirstRunningAt, &out.FirstRunningAt
+		*out = (*in).DeepCopy()
+	}
 	if in.MongoDB != nil {
 		in, out := &in.MongoDB, &out.MongoDB
 		*out = new(MongoDBCredentials)
@@ -240,7 +491,7 @@ func (in *PRStackStatus) DeepCopyInto(out *PRStackStatus) {
 	if in.NATS != nil {
 		in, out := &in.NATS, &out.NATS
 		*out = new(NATSConfig)
-		**out = **in
+		(*in).DeepCopyInto(*out)
 	}
 	if in.Redis != nil {
 		in, out := &in.Redis, &out.Redis
@@ -252,9 +503,14 @@ func (in *PRStackStatus) DeepCopyInto(out *PRStackStatus) {
 		*out = make([]ServiceStatus, len(*in))
 		copy(*out, *in)
 	}
+	if in.Deployment != nil {
+		in, out := &in.Deployment, &out.Deployment
+		*out = new(DeploymentProgress)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
-		*out = make([]v1.Condition, len(*in))
+		*out = make([]metav1.Condition, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
@@ -264,6 +520,11 @@ func (in *PRStackStatus) DeepCopyInto(out *PRStackStatus) {
 		*out = new(BackupStatus)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.GitHub != nil {
+		in, out := &in.GitHub, &out.GitHub
+		*out = new(GitHubStatus)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PRStackStatus.
@@ -291,6 +552,41 @@ func (in *RedisConfig) DeepCopy() *RedisConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RedisPersistenceSpec) DeepCopyInto(out *RedisPersistenceSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RedisPersistenceSpec.
+func (in *RedisPersistenceSpec) DeepCopy() *RedisPersistenceSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RedisPersistenceSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RedisSpec) DeepCopyInto(out *RedisSpec) {
+	*out = *in
+	if in.Persistence != nil {
+		in, out := &in.Persistence, &out.Persistence
+		*out = new(RedisPersistenceSpec)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RedisSpec.
+func (in *RedisSpec) DeepCopy() *RedisSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RedisSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ResourceLimits) DeepCopyInto(out *ResourceLimits) {
 	*out = *in
@@ -306,6 +602,31 @@ func (in *ResourceLimits) DeepCopy() *ResourceLimits {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceScaling) DeepCopyInto(out *ServiceScaling) {
+	*out = *in
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Autoscaling != nil {
+		in, out := &in.Autoscaling, &out.Autoscaling
+		*out = new(AutoscalingSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceScaling.
+func (in *ServiceScaling) DeepCopy() *ServiceScaling {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceScaling)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ServiceStatus) DeepCopyInto(out *ServiceStatus) {
 	*out = *in
@@ -320,3 +641,260 @@ func (in *ServiceStatus) DeepCopy() *ServiceStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StackEndpoints) DeepCopyInto(out *StackEndpoints) {
+	*out = *in
+	if in.Public != nil {
+		in, out := &in.Public, &out.Public
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StackEndpoints.
+func (in *StackEndpoints) DeepCopy() *StackEndpoints {
+	if in == nil {
+		return nil
+	}
+	out := new(StackEndpoints)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StreamSpec) DeepCopyInto(out *StreamSpec) {
+	*out = *in
+	if in.Subjects != nil {
+		in, out := &in.Subjects, &out.Subjects
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.MaxAge != nil {
+		in, out := &in.MaxAge, &out.MaxAge
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.Consumers != nil {
+		in, out := &in.Consumers, &out.Consumers
+		*out = make([]ConsumerSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StreamSpec.
+func (in *StreamSpec) DeepCopy() *StreamSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(StreamSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Tenant) DeepCopyInto(out *Tenant) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Tenant.
+func (in *Tenant) DeepCopy() *Tenant {
+	if in == nil {
+		return nil
+	}
+	out := new(Tenant)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *Tenant) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TenantBackupConfig) DeepCopyInto(out *TenantBackupConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TenantBackupConfig.
+func (in *TenantBackupConfig) DeepCopy() *TenantBackupConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(TenantBackupConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TenantList) DeepCopyInto(out *TenantList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]Tenant, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TenantList.
+func (in *TenantList) DeepCopy() *TenantList {
+	if in == nil {
+		return nil
+	}
+	out := new(TenantList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TenantList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TenantSpec) DeepCopyInto(out *TenantSpec) {
+	*out = *in
+	if in.ImagePullSecrets != nil {
+		in, out := &in.ImagePullSecrets, &out.ImagePullSecrets
+		*out = make([]v1.LocalObjectReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.DeployedAt != nil {
+		in, out := &in.DeployedAt, &out.DeployedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.MongoDB != nil {
+		in, out := &in.MongoDB, &out.MongoDB
+		*out = new(MongoDBConfig)
+		**out = **in
+	}
+	if in.NATS != nil {
+		in, out := &in.NATS, &out.NATS
+		*out = new(NATSSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Redis != nil {
+		in, out := &in.Redis, &out.Redis
+		*out = new(RedisSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Services != nil {
+		in, out := &in.Services, &out.Services
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ResourceLimits != nil {
+		in, out := &in.ResourceLimits, &out.ResourceLimits
+		*out = new(ResourceLimits)
+		**out = **in
+	}
+	if in.ServiceScaling != nil {
+		in, out := &in.ServiceScaling, &out.ServiceScaling
+		*out = make([]ServiceScaling, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	out.Backup = in.Backup
+	if in.DeletionProtection != nil {
+		in, out := &in.DeletionProtection, &out.DeletionProtection
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TenantSpec.
+func (in *TenantSpec) DeepCopy() *TenantSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TenantSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TenantStatus) DeepCopyInto(out *TenantStatus) {
+	*out = *in
+	if in.Endpoints != nil {
+		in, out := &in.Endpoints, &out.Endpoints
+		*out = new(StackEndpoints)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.CreatedAt != nil {
+		in, out := &in.CreatedAt, &out.CreatedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.LastDeployedAt != nil {
+		in, out := &in.LastDeployedAt, &out.LastDeployedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.FirstRunningAt != nil {
+		in, out := &in.FirstRunningAt, &out.FirstRunningAt
+		*out = (*in).DeepCopy()
+	}
+	if in.MongoDB != nil {
+		in, out := &in.MongoDB, &out.MongoDB
+		*out = new(MongoDBCredentials)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NATS != nil {
+		in, out := &in.NATS, &out.NATS
+		*out = new(NATSConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Redis != nil {
+		in, out := &in.Redis, &out.Redis
+		*out = new(RedisConfig)
+		**out = **in
+	}
+	if in.Services != nil {
+		in, out := &in.Services, &out.Services
+		*out = make([]ServiceStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Deployment != nil {
+		in, out := &in.Deployment, &out.Deployment
+		*out = new(DeploymentProgress)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Backup != nil {
+		in, out := &in.Backup, &out.Backup
+		*out = new(BackupStatus)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TenantStatus.
+func (in *TenantStatus) DeepCopy() *TenantStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TenantStatus)
+	in.DeepCopyInto(out)
+	return out
+}
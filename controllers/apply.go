@@ -0,0 +1,365 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/attribute"
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+const (
+	// FieldManager owns the fields of the objects managed by the operator
+	FieldManager = "pishop-operator"
+
+	// EventTypeApplyConflict is recorded on an object whose fields were changed by another manager
+	EventTypeApplyConflict = "ApplyConflict"
+)
+
+// ObjectDiff is the change the next reconcile would make to a managed object
+type ObjectDiff struct {
+	// Kind, Namespace and Name identify the object
+	Kind      string
+	Namespace string
+	Name      string
+	// Action is "create", "update" or "delete"
+	Action string
+	// Diff lists the changed fields, empty for deletions
+	Diff string
+	// SecretKeys lists the keys with changed values of a Secret
+	SecretKeys []string
+	// Paused is set when the object carries the pause-reconcile annotation, its drift is
+	// reported but not corrected
+	Paused bool
+}
+
+// String formats the diff for display
+func (d ObjectDiff) String() string {
+	header := fmt.Sprintf("%s %s/%s/%s", d.Action, d.Kind, d.Namespace, d.Name)
+	if d.Paused {
+		header += " (paused)"
+	}
+	if d.Diff == "" {
+		return header
+	}
+	return header + "\n" + d.Diff
+}
+
+// diffRecorder collects the diffs of a dry run
+type diffRecorder struct {
+	diffs []ObjectDiff
+}
+
+// Apply applies an object owned by a stack with server-side apply under the operator field
+// manager. Fields the operator does not set, like sidecars injected by admission webhooks, are
+// left to their managers. Replicas are left out for running autoscaled services, whose
+// HorizontalPodAutoscaler owns them, see getServiceReplicas. When another manager changed a field
+// the operator owns, the conflict is recorded as an event on the object and the operator takes
+// the field back. Objects carrying the pause-reconcile annotation are left alone.
+func (e *StackEngine) Apply(ctx context.Context, stack Stack, obj client.Object) (err error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	ctx, span := startSpan(ctx, "Apply",
+		attribute.String("k8s.namespace.name", obj.GetNamespace()),
+		attribute.String("k8s.object.name", obj.GetName()))
+	defer func() { endSpan(span, err) }()
+
+	if err := e.setStackOwner(stack, obj); err != nil {
+		return err
+	}
+
+	gvk, err := apiutil.GVKForObject(obj, e.Client.Scheme())
+	if err != nil {
+		return fmt.Errorf("failed to get kind of %s: %v", obj.GetName(), err)
+	}
+	span.SetName("Apply " + gvk.Kind)
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	obj.SetResourceVersion("")
+	obj.SetManagedFields(nil)
+
+	live, err := e.getLive(ctx, gvk, obj)
+	if err != nil {
+		return err
+	}
+
+	if e.diffs != nil {
+		return e.applyDryRun(ctx, obj, live)
+	}
+
+	if live != nil && isReconcilePaused(live) {
+		log.Info("Reconciliation paused, skipping apply", "kind", gvk.Kind, "namespace", obj.GetNamespace(), "name", obj.GetName())
+		return nil
+	}
+
+	err = e.Patch(ctx, obj, client.Apply, client.FieldOwner(FieldManager))
+	if !errors.IsConflict(err) {
+		return err
+	}
+
+	log.Info("Apply conflict, taking over fields", "kind", gvk.Kind, "namespace", obj.GetNamespace(), "name", obj.GetName(), "conflict", err.Error())
+	if e.Recorder != nil {
+		e.Recorder.Event(obj, corev1.EventTypeWarning, EventTypeApplyConflict, err.Error())
+	}
+
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	return e.Patch(ctx, obj, client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership)
+}
+
+// deleteManaged deletes a managed object that is no longer needed, missing objects and objects
+// carrying the pause-reconcile annotation are ignored
+func (e *StackEngine) deleteManaged(ctx context.Context, obj client.Object) error {
+	if err := e.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	if e.diffs != nil {
+		gvk, err := apiutil.GVKForObject(obj, e.Client.Scheme())
+		if err != nil {
+			return err
+		}
+		e.diffs.diffs = append(e.diffs.diffs, ObjectDiff{Kind: gvk.Kind, Namespace: obj.GetNamespace(), Name: obj.GetName(), Action: "delete", Paused: isReconcilePaused(obj)})
+		return nil
+	}
+
+	if isReconcilePaused(obj) {
+		return nil
+	}
+	return client.IgnoreNotFound(e.Delete(ctx, obj))
+}
+
+// getLive returns the current state of an object, nil when it does not exist
+func (e *StackEngine) getLive(ctx context.Context, gvk schema.GroupVersionKind, obj client.Object) (client.Object, error) {
+	var liveObj client.Object
+	if _, ok := obj.(*unstructured.Unstructured); ok {
+		// Kinds of optional CRDs, like ServiceMonitors, are not in the scheme
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(gvk)
+		liveObj = live
+	} else {
+		live, err := e.Client.Scheme().New(gvk)
+		if err != nil {
+			return nil, err
+		}
+		liveObj = live.(client.Object)
+	}
+	if err := e.Get(ctx, client.ObjectKeyFromObject(obj), liveObj); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get %s %s: %v", gvk.Kind, obj.GetName(), err)
+	}
+	return liveObj, nil
+}
+
+// applyDryRun applies an object with a dry run and records how it differs from the live
+// object, which is nil when the object does not exist
+func (e *StackEngine) applyDryRun(ctx context.Context, obj, liveObj client.Object) error {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	diff := ObjectDiff{Kind: gvk.Kind, Namespace: obj.GetNamespace(), Name: obj.GetName(), Action: "update"}
+	if liveObj == nil {
+		diff.Action = "create"
+	} else {
+		diff.Paused = isReconcilePaused(liveObj)
+	}
+
+	if err := e.Patch(ctx, obj, client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership, client.DryRunAll); err != nil {
+		return err
+	}
+
+	desired, err := comparableContent(obj)
+	if err != nil {
+		return err
+	}
+	current := map[string]interface{}{}
+	if liveObj != nil {
+		if current, err = comparableContent(liveObj); err != nil {
+			return err
+		}
+	}
+
+	if diff.Diff = cmp.Diff(current, desired); diff.Diff != "" {
+		if _, ok := obj.(*corev1.Secret); ok {
+			diff.SecretKeys = changedSecretKeys(current, desired)
+		}
+		e.diffs.diffs = append(e.diffs.diffs, diff)
+	}
+	return nil
+}
+
+// changedSecretKeys returns the keys of a Secret whose redacted values differ
+func changedSecretKeys(current, desired map[string]interface{}) []string {
+	changed := map[string]bool{}
+	for _, field := range []string{"data", "stringData"} {
+		currentValues, _ := current[field].(map[string]interface{})
+		desiredValues, _ := desired[field].(map[string]interface{})
+		for key, value := range desiredValues {
+			if currentValues[key] != value {
+				changed[key] = true
+			}
+		}
+		for key := range currentValues {
+			if _, ok := desiredValues[key]; !ok {
+				changed[key] = true
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(changed))
+	for key := range changed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// comparableContent returns the content of an object without the status and the metadata
+// maintained by the API server. The values of Secrets are redacted.
+func comparableContent(obj runtime.Object) (map[string]interface{}, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(content, "status")
+	delete(content, "apiVersion")
+	delete(content, "kind")
+	for _, field := range []string{"managedFields", "resourceVersion", "generation", "uid", "creationTimestamp"} {
+		unstructured.RemoveNestedField(content, "metadata", field)
+	}
+	if _, ok := obj.(*corev1.Secret); ok {
+		redactSecretContent(content)
+	}
+	return content, nil
+}
+
+// redactSecretContent replaces the values of a Secret with a hash, so diffs show which keys
+// changed without printing credentials
+func redactSecretContent(content map[string]interface{}) {
+	for _, field := range []string{"data", "stringData"} {
+		values, ok := content[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key, value := range values {
+			sum := sha256.Sum256([]byte(fmt.Sprint(value)))
+			values[key] = fmt.Sprintf("<redacted sha256:%x>", sum[:6])
+		}
+	}
+}
+
+// DiffStack returns the changes the next reconcile would make to the Kubernetes objects of a
+// deployed stack. Objects are applied with a dry run, nothing is written to the cluster.
+func (e *StackEngine) DiffStack(ctx context.Context, stack Stack) ([]ObjectDiff, error) {
+	// Stacks that are not provisioned yet have nothing to compare against
+	if stack.Status().MongoDB == nil {
+		return nil, nil
+	}
+
+	dryRun := *e
+	dryRun.Client = client.NewDryRunClient(e.Client)
+	dryRun.Recorder = nil
+	dryRun.diffs = &diffRecorder{}
+
+	if err := dryRun.applyStackObjects(ctx, stack); err != nil {
+		return nil, err
+	}
+
+	diffs := dryRun.diffs.diffs
+	sort.SliceStable(diffs, func(i, j int) bool {
+		if diffs[i].Kind != diffs[j].Kind {
+			return diffs[i].Kind < diffs[j].Kind
+		}
+		return diffs[i].Name < diffs[j].Name
+	})
+	return diffs, nil
+}
+
+// applyStackObjects applies the Kubernetes objects of a deployed stack
+func (e *StackEngine) applyStackObjects(ctx context.Context, stack Stack) error {
+	namespace := stack.Namespace()
+	if err := e.ensureResourceGuards(ctx, stack, namespace); err != nil {
+		return err
+	}
+	if err := e.createRegistrySecret(ctx, stack, namespace); err != nil {
+		return err
+	}
+	if isDedicatedMongoDB(stack) {
+		if err := e.createDedicatedMongoDBResources(ctx, stack, namespace); err != nil {
+			return err
+		}
+	}
+	if err := e.createMongoDBResources(ctx, stack, namespace); err != nil {
+		return err
+	}
+	if err := e.createNATSResources(ctx, stack, namespace); err != nil {
+		return err
+	}
+	if err := e.createRedisResources(ctx, stack, namespace); err != nil {
+		return err
+	}
+	for _, service := range stack.Services() {
+		if err := e.createServiceDeployment(ctx, stack, namespace, service); err != nil {
+			return err
+		}
+	}
+	return e.ensureMetricsMonitor(ctx, stack, namespace)
+}
+
+// WriteStackDiffs writes the changes the next reconcile would make to the objects of every
+// PRStack and Tenant
+func (e *StackEngine) WriteStackDiffs(ctx context.Context, w io.Writer) error {
+	var prStacks pishopv1alpha1.PRStackList
+	if err := e.List(ctx, &prStacks); err != nil {
+		return fmt.Errorf("failed to list PRStacks: %v", err)
+	}
+	for i := range prStacks.Items {
+		if err := e.writeStackDiff(ctx, w, "PRStack/"+prStacks.Items[i].Name, asStack(&prStacks.Items[i])); err != nil {
+			return err
+		}
+	}
+
+	var tenants pishopv1alpha1.TenantList
+	if err := e.List(ctx, &tenants); err != nil {
+		return fmt.Errorf("failed to list Tenants: %v", err)
+	}
+	for i := range tenants.Items {
+		if err := e.writeStackDiff(ctx, w, "Tenant/"+tenants.Items[i].Name, newTenantStack(&tenants.Items[i])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *StackEngine) writeStackDiff(ctx context.Context, w io.Writer, name string, stack Stack) error {
+	diffs, err := e.DiffStack(ctx, stack)
+	if err != nil {
+		return fmt.Errorf("failed to diff %s: %v", name, err)
+	}
+
+	if len(diffs) == 0 {
+		_, err = fmt.Fprintf(w, "%s: no changes\n", name)
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s: %d changes\n", name, len(diffs)); err != nil {
+		return err
+	}
+	for _, diff := range diffs {
+		if _, err := fmt.Fprintf(w, "%s\n", diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var _ = Describe("Server-side Apply", func() {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		reconciler *PRStackReconciler
+		fakeClient client.Client
+		recorder   *record.FakeRecorder
+		patches    []*client.PatchOptions
+		conflicts  int
+		prStack    *pishopv1alpha1.PRStack
+		namespace  string
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		patches = nil
+		conflicts = 0
+		fakeClient = newTestClient().
+			WithInterceptorFuncs(interceptor.Funcs{
+				Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+					patchOptions := &client.PatchOptions{}
+					patchOptions.ApplyOptions(opts)
+					patches = append(patches, patchOptions)
+
+					// Another manager owns the fields until the operator forces ownership
+					if conflicts > 0 && (patchOptions.Force == nil || !*patchOptions.Force) {
+						conflicts--
+						return apierrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, obj.GetName(),
+							fmt.Errorf(`Apply failed with 1 conflict: conflict with "kubectl-edit" using apps/v1: .spec.template.spec.containers[name="product-service"].image`))
+					}
+					return serverSideApply.Patch(ctx, c, obj, patch, opts...)
+				},
+			}).
+			Build()
+
+		reconciler = &PRStackReconciler{StackEngine: newTestEngine(fakeClient)}
+		recorder = reconciler.Recorder.(*record.FakeRecorder)
+
+		namespace = reconciler.getNamespaceName("123")
+		prStack = newTestPRStack()
+		prStack.Spec.Services = []string{"product-service"}
+		prStack.Status = pishopv1alpha1.PRStackStatus{
+			MongoDB: &pishopv1alpha1.MongoDBCredentials{ConnectionString: "mongodb://localhost:27017"},
+			NATS:    &pishopv1alpha1.NATSConfig{ConnectionString: "nats://nats:4222", SubjectPrefix: "pishop.pr.123"},
+			Redis:   &pishopv1alpha1.RedisConfig{ConnectionString: "redis://redis:6379", KeyPrefix: "pishop:pr:123:"},
+		}
+
+		ctx = ctrl.LoggerInto(ctx, zap.New(zap.UseDevMode(true)))
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	Context("Apply", func() {
+		It("should apply under the operator field manager", func() {
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")).To(Succeed())
+
+			Expect(patches).ToNot(BeEmpty())
+			for _, patchOptions := range patches {
+				Expect(patchOptions.FieldManager).To(Equal(FieldManager))
+				Expect(patchOptions.Force).To(BeNil())
+			}
+		})
+
+		It("should keep fields set by other managers", func() {
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")).To(Succeed())
+
+			deployment := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, deployment)).To(Succeed())
+			deployment.Spec.Template.Annotations = map[string]string{"sidecar.istio.io/status": "injected"}
+			Expect(fakeClient.Update(ctx, deployment)).To(Succeed())
+
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")).To(Succeed())
+
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, deployment)).To(Succeed())
+			Expect(deployment.Spec.Template.Annotations).To(HaveKeyWithValue("sidecar.istio.io/status", "injected"))
+		})
+
+		It("should report conflicts on the object and take the fields back", func() {
+			conflicts = 1
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")).To(Succeed())
+
+			Expect(recorder.Events).To(Receive(And(ContainSubstring(EventTypeApplyConflict), ContainSubstring("kubectl-edit"))))
+			Expect(patches[1].Force).ToNot(BeNil())
+			Expect(*patches[1].Force).To(BeTrue())
+
+			deployment := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, deployment)).To(Succeed())
+		})
+	})
+
+	Context("DiffStack", func() {
+		It("should report objects to create without writing them", func() {
+			diffs, err := reconciler.DiffStack(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(diffs).To(ContainElement(And(
+				HaveField("Kind", "Deployment"),
+				HaveField("Name", "product-service"),
+				HaveField("Action", "create"),
+			)))
+
+			err = fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, &appsv1.Deployment{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should report changed fields of deployed objects", func() {
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")).To(Succeed())
+
+			prStack.Spec.ImageTag = "v2.0.0"
+			diffs, err := reconciler.DiffStack(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+
+			var deploymentDiffs []ObjectDiff
+			for _, diff := range diffs {
+				if diff.Kind == "Deployment" && diff.Name == "product-service" {
+					deploymentDiffs = append(deploymentDiffs, diff)
+				}
+			}
+			Expect(deploymentDiffs).To(HaveLen(1))
+			Expect(deploymentDiffs[0].Action).To(Equal("update"))
+			Expect(deploymentDiffs[0].Diff).To(ContainSubstring("v2.0.0"))
+			Expect(deploymentDiffs[0].String()).To(HavePrefix("update Deployment/" + namespace + "/product-service"))
+
+			// The service did not change
+			Expect(diffs).ToNot(ContainElement(And(HaveField("Kind", "Service"), HaveField("Name", "product-service"))))
+
+			deployment := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "product-service", Namespace: namespace}, deployment)).To(Succeed())
+			Expect(deployment.Spec.Template.Spec.Containers[0].Image).To(Equal("ghcr.io/pilab-dev/product-service:pr-123"))
+		})
+
+		It("should redact the values of Secrets", func() {
+			prStack.Status.MongoDB.Password = "old-password"
+			Expect(reconciler.createMongoDBSecret(ctx, asStack(prStack))).To(Succeed())
+
+			prStack.Status.MongoDB.Password = "new-password"
+			diffs, err := reconciler.DiffStack(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+
+			var secretDiff *ObjectDiff
+			for i := range diffs {
+				if diffs[i].Kind == "Secret" && diffs[i].Name == "mongodb-secret" {
+					secretDiff = &diffs[i]
+				}
+			}
+			Expect(secretDiff).ToNot(BeNil())
+			Expect(secretDiff.Diff).To(ContainSubstring("<redacted sha256:"))
+			for _, value := range []string{"old-password", "new-password"} {
+				Expect(secretDiff.Diff).ToNot(ContainSubstring(value))
+				Expect(secretDiff.Diff).ToNot(ContainSubstring(base64.StdEncoding.EncodeToString([]byte(value))))
+			}
+		})
+
+		It("should skip stacks that are not provisioned", func() {
+			prStack.Status.MongoDB = nil
+			Expect(reconciler.DiffStack(ctx, asStack(prStack))).To(BeEmpty())
+		})
+	})
+})
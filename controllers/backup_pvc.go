@@ -13,18 +13,24 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// Defaults of the backup storage
+const (
+	DefaultBackupStorageClass = "standard"
+	DefaultBackupStorageSize  = "10Gi"
+)
+
 // createBackupPVC creates a PersistentVolumeClaim for backup storage
-func (r *PRStackReconciler) createBackupPVC(ctx context.Context, prStack *pishopv1alpha1.PRStack, namespace string) error {
+func (e *StackEngine) createBackupPVC(ctx context.Context, stack Stack, namespace string) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Creating backup PVC", "namespace", namespace, "prNumber", prStack.Spec.PRNumber)
+	log.Info("Creating backup PVC", "namespace", namespace, "stack", stack.ID())
 
 	// Default backup configuration if not specified
-	backupConfig := prStack.Spec.BackupConfig
+	backupConfig := stack.Spec().BackupConfig
 	if backupConfig == nil {
 		backupConfig = &pishopv1alpha1.BackupConfig{
 			Enabled:      false,
-			StorageClass: "standard",
-			StorageSize:  "10Gi",
+			StorageClass: DefaultBackupStorageClass,
+			StorageSize:  DefaultBackupStorageSize,
 		}
 	}
 
@@ -36,12 +42,12 @@ func (r *PRStackReconciler) createBackupPVC(ctx context.Context, prStack *pishop
 
 	storageSize := backupConfig.StorageSize
 	if storageSize == "" {
-		storageSize = "10Gi"
+		storageSize = DefaultBackupStorageSize
 	}
 
 	storageClass := backupConfig.StorageClass
 	if storageClass == "" {
-		storageClass = "standard"
+		storageClass = DefaultBackupStorageClass
 	}
 
 	// Parse storage size
@@ -56,7 +62,7 @@ func (r *PRStackReconciler) createBackupPVC(ctx context.Context, prStack *pishop
 			Namespace: namespace,
 			Labels: map[string]string{
 				"app":       "mongodb-backup",
-				"pr-number": prStack.Spec.PRNumber,
+				"pr-number": stack.ID(),
 				"component": "backup-storage",
 			},
 		},
@@ -75,27 +81,30 @@ func (r *PRStackReconciler) createBackupPVC(ctx context.Context, prStack *pishop
 
 	// Check if PVC already exists
 	existingPVC := &corev1.PersistentVolumeClaim{}
-	err = r.Get(ctx, client.ObjectKey{Name: pvc.Name, Namespace: namespace}, existingPVC)
+	err = e.Get(ctx, client.ObjectKey{Name: pvc.Name, Namespace: namespace}, existingPVC)
 	if err != nil {
 		if client.IgnoreNotFound(err) != nil {
 			return fmt.Errorf("failed to check existing PVC: %v", err)
 		}
 		// PVC doesn't exist, create it
-		if err := r.Create(ctx, pvc); err != nil {
+		if err := e.Create(ctx, pvc); err != nil {
 			return fmt.Errorf("failed to create backup PVC: %v", err)
 		}
 		log.Info("Successfully created backup PVC", "name", pvc.Name, "size", storageSize)
 	} else {
 		log.Info("Backup PVC already exists", "name", pvc.Name)
+		if err := e.releaseObject(ctx, stack, existingPVC); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// cleanupBackupPVC removes the backup PVC when cleaning up the PR stack
-func (r *PRStackReconciler) cleanupBackupPVC(ctx context.Context, prStack *pishopv1alpha1.PRStack, namespace string) error {
+// cleanupBackupPVC removes the backup PVC when cleaning up the stack
+func (e *StackEngine) cleanupBackupPVC(ctx context.Context, stack Stack, namespace string) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Cleaning up backup PVC", "namespace", namespace, "prNumber", prStack.Spec.PRNumber)
+	log.Info("Cleaning up backup PVC", "namespace", namespace, "stack", stack.ID())
 
 	pvc := &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
@@ -104,7 +113,7 @@ func (r *PRStackReconciler) cleanupBackupPVC(ctx context.Context, prStack *pisho
 		},
 	}
 
-	err := r.Delete(ctx, pvc)
+	err := e.Delete(ctx, pvc)
 	if err != nil {
 		if client.IgnoreNotFound(err) != nil {
 			return fmt.Errorf("failed to delete backup PVC: %v", err)
@@ -117,15 +126,42 @@ func (r *PRStackReconciler) cleanupBackupPVC(ctx context.Context, prStack *pisho
 	return nil
 }
 
-// ensureBackupStorage ensures backup storage is available for the PR stack
-func (r *PRStackReconciler) ensureBackupStorage(ctx context.Context, prStack *pishopv1alpha1.PRStack, namespace string) error {
+// ensureBackupStorage ensures backup storage is available for the stack
+func (e *StackEngine) ensureBackupStorage(ctx context.Context, stack Stack, namespace string) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Ensuring backup storage", "namespace", namespace, "prNumber", prStack.Spec.PRNumber)
+	log.Info("Ensuring backup storage", "namespace", namespace, "stack", stack.ID())
 
 	// Create backup PVC if backup is enabled
-	if err := r.createBackupPVC(ctx, prStack, namespace); err != nil {
+	if err := e.createBackupPVC(ctx, stack, namespace); err != nil {
 		return fmt.Errorf("failed to create backup PVC: %v", err)
 	}
 
 	return nil
 }
+
+// ensureBackupSchedule creates or updates the CronJob taking scheduled backups of the stack
+func (e *StackEngine) ensureBackupSchedule(ctx context.Context, stack Stack) error {
+	backupConfig := stack.Spec().BackupConfig
+	if backupConfig == nil || !backupConfig.Enabled || backupConfig.Schedule == "" {
+		return nil
+	}
+
+	if stack.Status().MongoDB == nil {
+		return fmt.Errorf("MongoDB status not available")
+	}
+
+	backupSpec := &BackupSpec{
+		PRNumber:    stack.ID(),
+		Namespace:   stack.Namespace(),
+		Databases:   stack.Status().MongoDB.Databases,
+		BackupName:  stack.Naming().BackupPrefix(stack.ID()),
+		Compression: true,
+	}
+
+	cronJob := e.BackupManager.createBackupCronJob(backupSpec, backupConfig.Schedule, backupConfig.RetentionDays)
+	if err := e.Apply(ctx, stack, cronJob); err != nil {
+		return fmt.Errorf("failed to create backup CronJob: %v", err)
+	}
+
+	return nil
+}
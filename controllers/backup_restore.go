@@ -3,18 +3,25 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
-	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// BackupCronJobName is the name of the CronJob taking scheduled backups of a stack
+const BackupCronJobName = "mongodb-backup"
+
+// BackupJobApp is the app label of backup Jobs and their pods
+const BackupJobApp = "mongodb-backup"
+
 // BackupRestoreManager handles database backup and restore operations
 type BackupRestoreManager struct {
 	client.Client
@@ -27,6 +34,7 @@ type BackupRestoreManager struct {
 // BackupSpec defines backup configuration
 type BackupSpec struct {
 	PRNumber    string
+	Namespace   string
 	Databases   []string
 	BackupName  string
 	Compression bool
@@ -35,28 +43,33 @@ type BackupSpec struct {
 // RestoreSpec defines restore configuration
 type RestoreSpec struct {
 	PRNumber   string
+	Namespace  string
 	BackupName string
 	Databases  []string
 }
 
-// CreateBackup creates a backup of all databases for a PR stack
-func (b *BackupRestoreManager) CreateBackup(ctx context.Context, prStack *pishopv1alpha1.PRStack) error {
+// CreateBackup creates a backup of all databases of a stack
+func (b *BackupRestoreManager) CreateBackup(ctx context.Context, stack Stack) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Creating backup for PR stack", "prNumber", prStack.Spec.PRNumber)
+	log.Info("Creating backup for stack", "stack", stack.ID())
 
-	if prStack.Status.MongoDB == nil {
+	if stack.Status().MongoDB == nil {
 		return fmt.Errorf("MongoDB status not available")
 	}
 
 	backupSpec := &BackupSpec{
-		PRNumber:    prStack.Spec.PRNumber,
-		Databases:   prStack.Status.MongoDB.Databases,
-		BackupName:  fmt.Sprintf("pr-%s-%s", prStack.Spec.PRNumber, time.Now().Format("20060102-150405")),
+		PRNumber:    stack.ID(),
+		Namespace:   stack.Namespace(),
+		Databases:   stack.Status().MongoDB.Databases,
+		BackupName:  fmt.Sprintf("%s-%s", stack.Naming().BackupPrefix(stack.ID()), time.Now().Format("20060102-150405")),
 		Compression: true,
 	}
 
 	// Create backup job
-	backupJob := b.createBackupJob(prStack, backupSpec)
+	backupJob := b.createBackupJob(backupSpec)
+	if err := controllerutil.SetControllerReference(stack.Object(), backupJob, b.Scheme()); err != nil {
+		return fmt.Errorf("failed to set owner of backup job: %v", err)
+	}
 	if err := b.Create(ctx, backupJob); err != nil {
 		return fmt.Errorf("failed to create backup job: %v", err)
 	}
@@ -65,23 +78,27 @@ func (b *BackupRestoreManager) CreateBackup(ctx context.Context, prStack *pishop
 	return nil
 }
 
-// RestoreBackup restores databases from a backup
-func (b *BackupRestoreManager) RestoreBackup(ctx context.Context, prStack *pishopv1alpha1.PRStack, backupName string) error {
+// RestoreBackup restores the databases of a stack from a backup
+func (b *BackupRestoreManager) RestoreBackup(ctx context.Context, stack Stack, backupName string) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Restoring backup for PR stack", "prNumber", prStack.Spec.PRNumber, "backupName", backupName)
+	log.Info("Restoring backup for stack", "stack", stack.ID(), "backupName", backupName)
 
-	if prStack.Status.MongoDB == nil {
+	if stack.Status().MongoDB == nil {
 		return fmt.Errorf("MongoDB status not available")
 	}
 
 	restoreSpec := &RestoreSpec{
-		PRNumber:   prStack.Spec.PRNumber,
+		PRNumber:   stack.ID(),
+		Namespace:  stack.Namespace(),
 		BackupName: backupName,
-		Databases:  prStack.Status.MongoDB.Databases,
+		Databases:  stack.Status().MongoDB.Databases,
 	}
 
 	// Create restore job
-	restoreJob := b.createRestoreJob(prStack, restoreSpec)
+	restoreJob := b.createRestoreJob(restoreSpec)
+	if err := controllerutil.SetControllerReference(stack.Object(), restoreJob, b.Scheme()); err != nil {
+		return fmt.Errorf("failed to set owner of restore job: %v", err)
+	}
 	if err := b.Create(ctx, restoreJob); err != nil {
 		return fmt.Errorf("failed to create restore job: %v", err)
 	}
@@ -91,8 +108,7 @@ func (b *BackupRestoreManager) RestoreBackup(ctx context.Context, prStack *pisho
 }
 
 // createBackupJob creates a Kubernetes Job for database backup
-func (b *BackupRestoreManager) createBackupJob(prStack *pishopv1alpha1.PRStack, spec *BackupSpec) *batchv1.Job {
-	namespace := fmt.Sprintf("pr-%s-shop-pilab-hu", prStack.Spec.PRNumber)
+func (b *BackupRestoreManager) createBackupJob(spec *BackupSpec) *batchv1.Job {
 	jobName := fmt.Sprintf("backup-%s", spec.BackupName)
 
 	// Create backup script
@@ -101,10 +117,10 @@ func (b *BackupRestoreManager) createBackupJob(prStack *pishopv1alpha1.PRStack,
 	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      jobName,
-			Namespace: namespace,
+			Namespace: spec.Namespace,
 			Labels: map[string]string{
-				"app":       "mongodb-backup",
-				"pr-number": prStack.Spec.PRNumber,
+				"app":       BackupJobApp,
+				"pr-number": spec.PRNumber,
 				"backup":    spec.BackupName,
 			},
 		},
@@ -113,8 +129,8 @@ func (b *BackupRestoreManager) createBackupJob(prStack *pishopv1alpha1.PRStack,
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: map[string]string{
-						"app":       "mongodb-backup",
-						"pr-number": prStack.Spec.PRNumber,
+						"app":       BackupJobApp,
+						"pr-number": spec.PRNumber,
 					},
 				},
 				Spec: corev1.PodSpec{
@@ -174,8 +190,8 @@ func (b *BackupRestoreManager) createBackupJob(prStack *pishopv1alpha1.PRStack,
 									corev1.ResourceMemory: resource.MustParse("0Mi"),
 								},
 								Limits: corev1.ResourceList{
-									corev1.ResourceCPU:    resource.MustParse("500m"),
-									corev1.ResourceMemory: resource.MustParse("1Gi"),
+									corev1.ResourceCPU:    resource.MustParse(BackupJobCPULimit),
+									corev1.ResourceMemory: resource.MustParse(BackupJobMemoryLimit),
 								},
 							},
 						},
@@ -198,9 +214,39 @@ func (b *BackupRestoreManager) createBackupJob(prStack *pishopv1alpha1.PRStack,
 	return job
 }
 
+// createBackupCronJob creates a Kubernetes CronJob taking scheduled backups with the
+// backup Job template. Each run names its backup {BackupName}-{timestamp} and removes
+// backups older than retentionDays.
+func (b *BackupRestoreManager) createBackupCronJob(spec *BackupSpec, schedule string, retentionDays int) *batchv1.CronJob {
+	job := b.createBackupJob(spec)
+	delete(job.Labels, "backup")
+
+	container := &job.Spec.Template.Spec.Containers[0]
+	container.Args = []string{b.generateScheduledBackupScript(spec, retentionDays)}
+
+	return &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      BackupCronJobName,
+			Namespace: spec.Namespace,
+			Labels:    job.Labels,
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:                   schedule,
+			ConcurrencyPolicy:          batchv1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: int32Ptr(3),
+			FailedJobsHistoryLimit:     int32Ptr(3),
+			JobTemplate: batchv1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: job.Labels,
+				},
+				Spec: job.Spec,
+			},
+		},
+	}
+}
+
 // createRestoreJob creates a Kubernetes Job for database restore
-func (b *BackupRestoreManager) createRestoreJob(prStack *pishopv1alpha1.PRStack, spec *RestoreSpec) *batchv1.Job {
-	namespace := fmt.Sprintf("pr-%s-shop-pilab-hu", prStack.Spec.PRNumber)
+func (b *BackupRestoreManager) createRestoreJob(spec *RestoreSpec) *batchv1.Job {
 	jobName := fmt.Sprintf("restore-%s", spec.BackupName)
 
 	// Create restore script
@@ -209,10 +255,10 @@ func (b *BackupRestoreManager) createRestoreJob(prStack *pishopv1alpha1.PRStack,
 	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      jobName,
-			Namespace: namespace,
+			Namespace: spec.Namespace,
 			Labels: map[string]string{
 				"app":       "mongodb-restore",
-				"pr-number": prStack.Spec.PRNumber,
+				"pr-number": spec.PRNumber,
 				"backup":    spec.BackupName,
 			},
 		},
@@ -222,7 +268,7 @@ func (b *BackupRestoreManager) createRestoreJob(prStack *pishopv1alpha1.PRStack,
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: map[string]string{
 						"app":       "mongodb-restore",
-						"pr-number": prStack.Spec.PRNumber,
+						"pr-number": spec.PRNumber,
 					},
 				},
 				Spec: corev1.PodSpec{
@@ -282,8 +328,8 @@ func (b *BackupRestoreManager) createRestoreJob(prStack *pishopv1alpha1.PRStack,
 									corev1.ResourceMemory: resource.MustParse("0Mi"),
 								},
 								Limits: corev1.ResourceList{
-									corev1.ResourceCPU:    resource.MustParse("500m"),
-									corev1.ResourceMemory: resource.MustParse("1Gi"),
+									corev1.ResourceCPU:    resource.MustParse(BackupJobCPULimit),
+									corev1.ResourceMemory: resource.MustParse(BackupJobMemoryLimit),
 								},
 							},
 						},
@@ -377,11 +423,32 @@ rm -rf "${BACKUP_NAME}"
 
 echo "Backup completed successfully: ${BACKUP_NAME}.tar.gz"
 echo "Backup size: $(du -h ${BACKUP_NAME}.tar.gz | cut -f1)"
+
+# Report the backup name and size in bytes to the operator
+echo "${BACKUP_NAME} $(stat -c %s ${BACKUP_NAME}.tar.gz)" > /dev/termination-log
 `
 
 	return script
 }
 
+// generateScheduledBackupScript creates the backup script of scheduled backups. The
+// BACKUP_NAME of the Job is used as prefix of the timestamped backup name.
+func (b *BackupRestoreManager) generateScheduledBackupScript(spec *BackupSpec, retentionDays int) string {
+	script := strings.Replace(b.generateBackupScript(spec), "set -e\n", `set -e
+
+BACKUP_NAME="${BACKUP_NAME}-$(date -u +%Y%m%d-%H%M%S)"
+`, 1)
+
+	if retentionDays > 0 {
+		script += fmt.Sprintf(`
+# Remove backups older than the retention period
+find /backup -maxdepth 1 -name "%s-*.tar.gz" -mtime +%d -print -delete
+`, spec.BackupName, retentionDays)
+	}
+
+	return script
+}
+
 // generateRestoreScript creates the restore script for mongorestore
 func (b *BackupRestoreManager) generateRestoreScript(spec *RestoreSpec) string {
 	script := `#!/bin/bash
@@ -41,6 +41,7 @@ var _ = Describe("Backup Restore Manager", func() {
 		
 		fakeClient = fake.NewClientBuilder().
 			WithScheme(scheme).
+			WithInterceptorFuncs(serverSideApply).
 			Build()
 		
 		backupManager = &BackupRestoreManager{
@@ -62,8 +63,7 @@ var _ = Describe("Backup Restore Manager", func() {
 		It("should create backup job successfully", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "test-pr",
-					Namespace: "default",
+					Name: "test-pr",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
@@ -78,7 +78,7 @@ var _ = Describe("Backup Restore Manager", func() {
 				},
 			}
 			
-			err := backupManager.CreateBackup(ctx, prStack)
+			err := backupManager.CreateBackup(ctx, asStack(prStack))
 			Expect(err).ToNot(HaveOccurred())
 			
 			// Check if backup job was created
@@ -91,8 +91,7 @@ var _ = Describe("Backup Restore Manager", func() {
 		It("should fail when MongoDB status is nil", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "test-pr",
-					Namespace: "default",
+					Name: "test-pr",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
@@ -102,7 +101,7 @@ var _ = Describe("Backup Restore Manager", func() {
 				},
 			}
 			
-			err := backupManager.CreateBackup(ctx, prStack)
+			err := backupManager.CreateBackup(ctx, asStack(prStack))
 			Expect(err).To(HaveOccurred())
 		})
 	})
@@ -111,8 +110,7 @@ var _ = Describe("Backup Restore Manager", func() {
 		It("should create restore job successfully", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "test-pr",
-					Namespace: "default",
+					Name: "test-pr",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
@@ -128,7 +126,7 @@ var _ = Describe("Backup Restore Manager", func() {
 			}
 			
 			backupName := "pr-123-20240101-120000"
-			err := backupManager.RestoreBackup(ctx, prStack, backupName)
+			err := backupManager.RestoreBackup(ctx, asStack(prStack), backupName)
 			Expect(err).ToNot(HaveOccurred())
 			
 			// Check if restore job was created
@@ -141,8 +139,7 @@ var _ = Describe("Backup Restore Manager", func() {
 		It("should fail when MongoDB status is nil", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "test-pr",
-					Namespace: "default",
+					Name: "test-pr",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
@@ -152,7 +149,7 @@ var _ = Describe("Backup Restore Manager", func() {
 				},
 			}
 			
-			err := backupManager.RestoreBackup(ctx, prStack, "test-backup")
+			err := backupManager.RestoreBackup(ctx, asStack(prStack), "test-backup")
 			Expect(err).To(HaveOccurred())
 		})
 	})
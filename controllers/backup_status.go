@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+// Status of backup jobs
+const (
+	BackupJobRunning   = "Running"
+	BackupJobCompleted = "Completed"
+	BackupJobFailed    = "Failed"
+)
+
+// recordBackupStatus updates the backup status of a stack from its backup Jobs and counts
+// the finished backups. Counted Jobs are annotated, so they are counted once even when the
+// status update fails. The name and size of a backup are read from the termination message
+// of the backup pod.
+func (e *StackEngine) recordBackupStatus(ctx context.Context, stack Stack) error {
+	jobs := &batchv1.JobList{}
+	if err := e.List(ctx, jobs, client.InNamespace(stack.Namespace()), client.MatchingLabels{"app": BackupJobApp}); err != nil {
+		return fmt.Errorf("failed to list backup jobs: %v", err)
+	}
+	if len(jobs.Items) == 0 {
+		return nil
+	}
+
+	status := stack.Status().Backup
+	if status == nil {
+		status = &pishopv1alpha1.BackupStatus{}
+	}
+	sort.Slice(jobs.Items, func(i, j int) bool {
+		return jobs.Items[i].CreationTimestamp.Before(&jobs.Items[j].CreationTimestamp)
+	})
+
+	var backupJobs []pishopv1alpha1.BackupJobStatus
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		jobStatus := pishopv1alpha1.BackupJobStatus{
+			Name:           job.Name,
+			Type:           "backup",
+			Status:         backupJobStatus(job),
+			StartTime:      job.Status.StartTime,
+			CompletionTime: job.Status.CompletionTime,
+		}
+
+		if jobStatus.Status != BackupJobRunning && job.Annotations[BackupCountedAnnotation] == "" {
+			patch := client.MergeFrom(job.DeepCopy())
+			if job.Annotations == nil {
+				job.Annotations = map[string]string{}
+			}
+			job.Annotations[BackupCountedAnnotation] = "true"
+			if err := e.Patch(ctx, job, patch); err != nil {
+				return fmt.Errorf("failed to mark backup job %s counted: %v", job.Name, err)
+			}
+
+			result := "success"
+			if jobStatus.Status == BackupJobFailed {
+				result = "failure"
+			}
+			backupsTotal.WithLabelValues(stackKind(stack), result).Inc()
+		}
+
+		if jobStatus.Status == BackupJobCompleted && job.Status.CompletionTime != nil &&
+			(status.LastBackupTime == nil || status.LastBackupTime.Before(job.Status.CompletionTime)) {
+			status.LastBackupTime = job.Status.CompletionTime
+			name, size, err := e.backupResult(ctx, job)
+			if err != nil {
+				return err
+			}
+			status.LastBackupName = name
+			status.LastBackupSize = size
+		}
+
+		backupJobs = append(backupJobs, jobStatus)
+	}
+
+	status.BackupJobs = backupJobs
+	stack.Status().Backup = status
+	return nil
+}
+
+// backupJobStatus returns whether a backup Job is running, completed or failed
+func backupJobStatus(job *batchv1.Job) string {
+	if job.Status.Succeeded > 0 {
+		return BackupJobCompleted
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			return BackupJobFailed
+		}
+	}
+	return BackupJobRunning
+}
+
+// backupResult returns the backup name and size reported by the succeeded pod of a backup Job
+func (e *StackEngine) backupResult(ctx context.Context, job *batchv1.Job) (string, string, error) {
+	pods := &corev1.PodList{}
+	if err := e.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"app": BackupJobApp, "job-name": job.Name}); err != nil {
+		return "", "", fmt.Errorf("failed to list pods of backup job %s: %v", job.Name, err)
+	}
+
+	for _, pod := range pods.Items {
+		for _, container := range pod.Status.ContainerStatuses {
+			terminated := container.State.Terminated
+			if terminated == nil || terminated.ExitCode != 0 {
+				continue
+			}
+			fields := strings.Fields(terminated.Message)
+			if len(fields) != 2 {
+				continue
+			}
+			bytes, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			return fields[0], resource.NewQuantity(bytes, resource.BinarySI).String(), nil
+		}
+	}
+
+	// Pods of finished Jobs may already be removed, the backup is still recorded
+	return "", "", nil
+}
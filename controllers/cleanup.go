@@ -2,9 +2,9 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
-	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -12,18 +12,17 @@ import (
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
-	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
 )
 
-func (r *PRStackReconciler) cleanupServices(ctx context.Context, prStack *pishopv1alpha1.PRStack) error {
+func (e *StackEngine) cleanupServices(ctx context.Context, stack Stack) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Cleaning up services for PR", "prNumber", prStack.Spec.PRNumber)
+	log.Info("Cleaning up services for PR", "stack", stack.ID())
 
 	// Delete the PR namespace
-	namespaceName := r.getNamespaceName(prStack.Spec.PRNumber)
+	namespaceName := stack.Namespace()
 	namespace := &corev1.Namespace{}
-	if err := r.Get(ctx, client.ObjectKey{Name: namespaceName}, namespace); err == nil {
-		if err := r.Delete(ctx, namespace); err != nil {
+	if err := e.Get(ctx, client.ObjectKey{Name: namespaceName}, namespace); err == nil {
+		if err := e.Delete(ctx, namespace); err != nil {
 			log.Error(err, "Failed to delete namespace", "namespace", namespaceName)
 			return err
 		}
@@ -33,14 +32,20 @@ func (r *PRStackReconciler) cleanupServices(ctx context.Context, prStack *pishop
 	return nil
 }
 
-func (r *PRStackReconciler) cleanupMongoDB(ctx context.Context, prStack *pishopv1alpha1.PRStack) error {
+func (e *StackEngine) cleanupMongoDB(ctx context.Context, stack Stack) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Cleaning up MongoDB for PR", "prNumber", prStack.Spec.PRNumber)
+	log.Info("Cleaning up MongoDB for PR", "stack", stack.ID())
+
+	// Dedicated MongoDB lives in the PR namespace and is removed with it
+	if isDedicatedMongoDB(stack) {
+		log.Info("Dedicated MongoDB is removed with the namespace, skipping database cleanup")
+		return nil
+	}
 
 	// Connect to MongoDB
-	mongoURI := r.MongoURI
-	if prStack.Spec.MongoURI != "" {
-		mongoURI = prStack.Spec.MongoURI
+	mongoURI, err := e.getAdminMongoURI(ctx, stack)
+	if err != nil {
+		return err
 	}
 
 	client, err := mongo.Connect(options.Client().ApplyURI(mongoURI))
@@ -54,11 +59,8 @@ func (r *PRStackReconciler) cleanupMongoDB(ctx context.Context, prStack *pishopv
 		return fmt.Errorf("failed to ping MongoDB: %v", err)
 	}
 
-	// Drop databases for each service (same logic as main.go)
-	services := DefaultServices
-
-	for _, service := range services {
-		dbName := fmt.Sprintf("pishop_%s_pr_%s", service, prStack.Spec.PRNumber)
+	// Drop the databases recorded when provisioning and those of the current services
+	for _, dbName := range stackDatabases(stack) {
 		log.Info("Dropping database", "database", dbName)
 
 		database := client.Database(dbName)
@@ -78,7 +80,7 @@ func (r *PRStackReconciler) cleanupMongoDB(ctx context.Context, prStack *pishopv
 	}
 
 	// Clean up the PR user (same logic as main.go)
-	prUser := fmt.Sprintf("pishop_pr_%s", prStack.Spec.PRNumber)
+	prUser := stack.Naming().User(stack.ID())
 	log.Info("Cleaning up PR user", "user", prUser)
 
 	adminDB := client.Database("admin")
@@ -99,99 +101,97 @@ func (r *PRStackReconciler) cleanupMongoDB(ctx context.Context, prStack *pishopv
 	return nil
 }
 
-func (r *PRStackReconciler) cleanupNATS(ctx context.Context, prStack *pishopv1alpha1.PRStack) error {
-	log := ctrl.LoggerFrom(ctx)
-	log.Info("Cleaning up NATS for PR", "prNumber", prStack.Spec.PRNumber)
-
-	namespaceName := fmt.Sprintf("pr-%s-shop-pilab-hu", prStack.Spec.PRNumber)
-
-	// Delete NATS deployment
-	natsDeployment := &appsv1.Deployment{}
-	if err := r.Get(ctx, client.ObjectKey{Name: "nats", Namespace: namespaceName}, natsDeployment); err == nil {
-		if err := r.Delete(ctx, natsDeployment); err != nil {
-			log.Error(err, "Failed to delete NATS deployment")
-			return err
+// stackDatabases returns the databases of a stack: the ones recorded in its status when they
+// were provisioned, followed by those of services added since
+func stackDatabases(stack Stack) []string {
+	var databases []string
+	if stack.Status().MongoDB != nil {
+		databases = append(databases, stack.Status().MongoDB.Databases...)
+	}
+	for _, service := range stack.Services() {
+		dbName := stack.Naming().Database(service, stack.ID())
+		if !containsString(databases, dbName) {
+			databases = append(databases, dbName)
 		}
-		log.Info("Successfully deleted NATS deployment")
 	}
+	return databases
+}
 
-	// Delete NATS service
-	natsService := &corev1.Service{}
-	if err := r.Get(ctx, client.ObjectKey{Name: "nats", Namespace: namespaceName}, natsService); err == nil {
-		if err := r.Delete(ctx, natsService); err != nil {
-			log.Error(err, "Failed to delete NATS service")
-			return err
-		}
-		log.Info("Successfully deleted NATS service")
+func (e *StackEngine) cleanupNATS(ctx context.Context, stack Stack) error {
+	log := ctrl.LoggerFrom(ctx)
+	log.Info("Cleaning up NATS for PR", "stack", stack.ID())
+
+	// Shared mode: remove streams and revoke the PR account on the shared server
+	if isSharedNATS(stack) {
+		return e.cleanupSharedNATS(ctx, stack)
 	}
 
-	subjectPrefix := fmt.Sprintf("pishop.pr.%s", prStack.Spec.PRNumber)
+	// The dedicated NATS server is owned by the stack and removed with the namespace
+
+	subjectPrefix := stack.Naming().NATSSubjectPrefix(stack.ID())
 	log.Info("NATS cleanup completed for subject prefix", "prefix", subjectPrefix)
 
 	return nil
 }
 
-func (r *PRStackReconciler) cleanupRedis(ctx context.Context, prStack *pishopv1alpha1.PRStack) error {
+func (e *StackEngine) cleanupRedis(ctx context.Context, stack Stack) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Cleaning up Redis for PR", "prNumber", prStack.Spec.PRNumber)
-
-	namespaceName := fmt.Sprintf("pr-%s-shop-pilab-hu", prStack.Spec.PRNumber)
+	log.Info("Cleaning up Redis for PR", "stack", stack.ID())
 
-	// Delete Redis deployment
-	redisDeployment := &appsv1.Deployment{}
-	if err := r.Get(ctx, client.ObjectKey{Name: "redis", Namespace: namespaceName}, redisDeployment); err == nil {
-		if err := r.Delete(ctx, redisDeployment); err != nil {
-			log.Error(err, "Failed to delete Redis deployment")
-			return err
-		}
-		log.Info("Successfully deleted Redis deployment")
+	// Shared mode: remove the PR user and keys from the shared server
+	if isSharedRedis(stack) {
+		return e.cleanupSharedRedis(ctx, stack)
 	}
 
-	// Delete Redis service
-	redisService := &corev1.Service{}
-	if err := r.Get(ctx, client.ObjectKey{Name: "redis", Namespace: namespaceName}, redisService); err == nil {
-		if err := r.Delete(ctx, redisService); err != nil {
-			log.Error(err, "Failed to delete Redis service")
-			return err
-		}
-		log.Info("Successfully deleted Redis service")
-	}
+	// The dedicated Redis server is owned by the stack and removed with the namespace
 
-	keyPrefix := fmt.Sprintf("pishop:pr:%s:", prStack.Spec.PRNumber)
+	keyPrefix := stack.Naming().RedisKeyPrefix(stack.ID())
 	log.Info("Redis cleanup completed for key prefix", "prefix", keyPrefix)
 
 	return nil
 }
 
 // cleanupAllResources performs complete cleanup of all PR resources
-func (r *PRStackReconciler) cleanupAllResources(ctx context.Context, prStack *pishopv1alpha1.PRStack) error {
+func (e *StackEngine) cleanupAllResources(ctx context.Context, stack Stack) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Starting complete cleanup for PR", "prNumber", prStack.Spec.PRNumber)
+	log.Info("Starting complete cleanup for PR", "stack", stack.ID())
 
 	// Clean up MongoDB databases and users
-	if err := r.cleanupMongoDB(ctx, prStack); err != nil {
+	if err := timeOperation(ctx, stack, OperationCleanup, "MongoDB", func(ctx context.Context) error {
+		return e.cleanupMongoDB(ctx, stack)
+	}); err != nil {
 		log.Error(err, "Failed to cleanup MongoDB")
 		// Continue with other cleanup even if MongoDB cleanup fails
 	}
 
-	// Clean up NATS
-	if err := r.cleanupNATS(ctx, prStack); err != nil {
+	// Clean up NATS and Redis. Their accounts and users outlive the namespace, so the namespace
+	// is kept until they are cleaned up and the cleanup is retried.
+	var errs []error
+	if err := timeOperation(ctx, stack, OperationCleanup, "NATS", func(ctx context.Context) error {
+		return e.cleanupNATS(ctx, stack)
+	}); err != nil {
 		log.Error(err, "Failed to cleanup NATS")
-		// Continue with other cleanup even if NATS cleanup fails
+		errs = append(errs, fmt.Errorf("NATS cleanup failed: %v", err))
 	}
 
-	// Clean up Redis
-	if err := r.cleanupRedis(ctx, prStack); err != nil {
+	if err := timeOperation(ctx, stack, OperationCleanup, "Redis", func(ctx context.Context) error {
+		return e.cleanupRedis(ctx, stack)
+	}); err != nil {
 		log.Error(err, "Failed to cleanup Redis")
-		// Continue with other cleanup even if Redis cleanup fails
+		errs = append(errs, fmt.Errorf("Redis cleanup failed: %v", err))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
 	}
 
 	// Clean up Kubernetes services and namespace
-	if err := r.cleanupServices(ctx, prStack); err != nil {
+	if err := timeOperation(ctx, stack, OperationCleanup, "Services", func(ctx context.Context) error {
+		return e.cleanupServices(ctx, stack)
+	}); err != nil {
 		log.Error(err, "Failed to cleanup services")
 		return err // This is critical, so we return the error
 	}
 
-	log.Info("Successfully completed cleanup for PR", "prNumber", prStack.Spec.PRNumber)
+	log.Info("Successfully completed cleanup for PR", "stack", stack.ID())
 	return nil
 }
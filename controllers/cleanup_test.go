@@ -39,17 +39,18 @@ var _ = Describe("Cleanup", func() {
 		
 		fakeClient = fake.NewClientBuilder().
 			WithScheme(scheme).
+			WithInterceptorFuncs(serverSideApply).
 			WithStatusSubresource(&pishopv1alpha1.PRStack{}).
 			Build()
 		
-		reconciler = &PRStackReconciler{
+		reconciler = &PRStackReconciler{StackEngine: &StackEngine{
 			Client:         fakeClient,
 			Scheme:         scheme,
 			MongoURI:       "mongodb://localhost:27017",
 			MongoUsername:  "admin",
 			MongoPassword:  "password",
 			BaseDomain:     "shop.pilab.hu",
-		}
+		}}
 		
 		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 	})
@@ -62,8 +63,7 @@ var _ = Describe("Cleanup", func() {
 		It("should delete namespace successfully", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "test-pr",
-					Namespace: "default",
+					Name: "test-pr",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
@@ -78,7 +78,7 @@ var _ = Describe("Cleanup", func() {
 			}
 			Expect(fakeClient.Create(ctx, namespace)).To(Succeed())
 			
-			err := reconciler.cleanupServices(ctx, prStack)
+			err := reconciler.cleanupServices(ctx, asStack(prStack))
 			Expect(err).ToNot(HaveOccurred())
 			
 			// Check if namespace was deleted
@@ -90,15 +90,14 @@ var _ = Describe("Cleanup", func() {
 		It("should not fail if namespace doesn't exist", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "test-pr",
-					Namespace: "default",
+					Name: "test-pr",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
 				},
 			}
 			
-			err := reconciler.cleanupServices(ctx, prStack)
+			err := reconciler.cleanupServices(ctx, asStack(prStack))
 			Expect(err).ToNot(HaveOccurred())
 		})
 	})
@@ -107,25 +106,49 @@ var _ = Describe("Cleanup", func() {
 		It("should complete cleanup successfully", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "test-pr",
-					Namespace: "default",
+					Name: "test-pr",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
 				},
 			}
 			
-			err := reconciler.cleanupAllResources(ctx, prStack)
+			err := reconciler.cleanupAllResources(ctx, asStack(prStack))
 			Expect(err).ToNot(HaveOccurred())
 		})
 	})
 
+	Context("stackDatabases", func() {
+		It("should drop the recorded databases and those of the current services", func() {
+			prStack := newTestPRStack()
+			prStack.Spec.Services = []string{"product-service", "review-service"}
+			stack := asStack(prStack)
+			naming := stack.Naming()
+			prStack.Status.MongoDB = &pishopv1alpha1.MongoDBCredentials{
+				Databases: []string{naming.Database("product-service", "123"), naming.Database("cart-service", "123")},
+			}
+
+			Expect(stackDatabases(stack)).To(Equal([]string{
+				naming.Database("product-service", "123"),
+				naming.Database("cart-service", "123"),
+				naming.Database("review-service", "123"),
+			}))
+		})
+
+		It("should fall back to the services without recorded databases", func() {
+			prStack := newTestPRStack()
+			prStack.Spec.Services = []string{"product-service"}
+			stack := asStack(prStack)
+
+			Expect(stackDatabases(stack)).To(Equal([]string{stack.Naming().Database("product-service", "123")}))
+		})
+	})
+
 	Context("cleanupBackupPVC", func() {
 		It("should delete backup PVC successfully", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "test-pr",
-					Namespace: "default",
+					Name: "test-pr",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
@@ -141,7 +164,7 @@ var _ = Describe("Cleanup", func() {
 			}
 			Expect(fakeClient.Create(ctx, pvc)).To(Succeed())
 			
-			err := reconciler.cleanupBackupPVC(ctx, prStack, "pr-123-shop-pilab-hu")
+			err := reconciler.cleanupBackupPVC(ctx, asStack(prStack), "pr-123-shop-pilab-hu")
 			Expect(err).ToNot(HaveOccurred())
 			
 			// Check if PVC was deleted
@@ -156,15 +179,14 @@ var _ = Describe("Cleanup", func() {
 		It("should not fail if PVC doesn't exist", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "test-pr",
-					Namespace: "default",
+					Name: "test-pr",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
 				},
 			}
 			
-			err := reconciler.cleanupBackupPVC(ctx, prStack, "pr-123-shop-pilab-hu")
+			err := reconciler.cleanupBackupPVC(ctx, asStack(prStack), "pr-123-shop-pilab-hu")
 			Expect(err).ToNot(HaveOccurred())
 		})
 	})
@@ -173,8 +195,7 @@ var _ = Describe("Cleanup", func() {
 		It("should create backup PVC when backup is enabled", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "test-pr",
-					Namespace: "default",
+					Name: "test-pr",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
@@ -186,7 +207,7 @@ var _ = Describe("Cleanup", func() {
 				},
 			}
 			
-			err := reconciler.ensureBackupStorage(ctx, prStack, "pr-123-shop-pilab-hu")
+			err := reconciler.ensureBackupStorage(ctx, asStack(prStack), "pr-123-shop-pilab-hu")
 			Expect(err).ToNot(HaveOccurred())
 			
 			// Check if PVC was created
@@ -200,8 +221,7 @@ var _ = Describe("Cleanup", func() {
 		It("should skip PVC creation when backup is disabled", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "test-pr",
-					Namespace: "default",
+					Name: "test-pr",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
@@ -211,7 +231,7 @@ var _ = Describe("Cleanup", func() {
 				},
 			}
 			
-			err := reconciler.ensureBackupStorage(ctx, prStack, "pr-123-shop-pilab-hu")
+			err := reconciler.ensureBackupStorage(ctx, asStack(prStack), "pr-123-shop-pilab-hu")
 			Expect(err).ToNot(HaveOccurred())
 			
 			// Check if PVC was not created
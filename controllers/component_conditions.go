@@ -0,0 +1,209 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// BackupStaleAfter is the age of the last successful backup after which backups of a stack
+	// are reported unhealthy
+	BackupStaleAfter = 48 * time.Hour
+
+	// IngressServiceName is the service exposed by the stack ingress
+	IngressServiceName = "graphql-service"
+)
+
+// stackExpired returns true when a stack was not active for longer than StackExpirationTime
+func stackExpired(stack Stack) bool {
+	lastActive := stack.Status().LastActiveAt
+	if lastActive == nil {
+		// Fallback to CreatedAt if LastActiveAt is not set
+		lastActive = stack.Status().CreatedAt
+	}
+	if lastActive == nil {
+		return false
+	}
+	return time.Since(lastActive.Time) > StackExpirationTime
+}
+
+// updateComponentConditions reports the health of each component of a stack as its own
+// condition, so clients can wait on a single component instead of the whole stack. The ready
+// services are summarized as "ready/total" for the printer column.
+func (e *StackEngine) updateComponentConditions(ctx context.Context, stack Stack) error {
+	stack.Status().ObservedGeneration = stack.Object().GetGeneration()
+
+	dependencies := []struct{ conditionType, dependency string }{
+		{ConditionTypeMongoDBReady, DependencyMongoDB},
+		{ConditionTypeNATSReady, DependencyNATS},
+		{ConditionTypeRedisReady, DependencyRedis},
+	}
+	for _, d := range dependencies {
+		ready, err := e.isDependencyReady(ctx, stack, d.dependency)
+		if err != nil {
+			return err
+		}
+		e.setComponentCondition(stack, d.conditionType, ready, d.dependency)
+	}
+
+	if err := e.setServicesReadyCondition(ctx, stack); err != nil {
+		return err
+	}
+	if err := e.setIngressReadyCondition(ctx, stack); err != nil {
+		return err
+	}
+	e.setBackupHealthyCondition(stack)
+
+	if stackKind(stack) == "PRStack" {
+		condition := metav1.Condition{
+			Type:    ConditionTypeExpired,
+			Status:  metav1.ConditionFalse,
+			Reason:  "Active",
+			Message: fmt.Sprintf("The stack expires after %v without activity", StackExpirationTime),
+		}
+		if stackExpired(stack) {
+			condition.Status = metav1.ConditionTrue
+			condition.Reason = "InactivityTimeout"
+			condition.Message = fmt.Sprintf("No activity for more than %v, the stack was scaled down", StackExpirationTime)
+		}
+		e.setCondition(stack, condition)
+	}
+	return nil
+}
+
+// setComponentCondition sets the ready condition of MongoDB, NATS or Redis
+func (e *StackEngine) setComponentCondition(stack Stack, conditionType string, ready bool, component string) {
+	condition := metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Ready",
+		Message: fmt.Sprintf("%s is ready", component),
+	}
+	switch {
+	case !stack.Spec().Active:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Inactive"
+		condition.Message = "The stack is scaled down"
+	case !ready:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "NotReady"
+		condition.Message = fmt.Sprintf("%s is not ready", component)
+	}
+	e.setCondition(stack, condition)
+}
+
+// setServicesReadyCondition reports whether every service of a stack has a ready replica
+func (e *StackEngine) setServicesReadyCondition(ctx context.Context, stack Stack) error {
+	services := stack.Services()
+	var notReady []string
+	for _, service := range services {
+		ready, err := e.isDeploymentReady(ctx, stack.Namespace(), service)
+		if err != nil {
+			return err
+		}
+		if !ready {
+			notReady = append(notReady, service)
+		}
+	}
+	stack.Status().ReadyServices = fmt.Sprintf("%d/%d", len(services)-len(notReady), len(services))
+
+	condition := metav1.Condition{
+		Type:    ConditionTypeServicesReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  "AllServicesReady",
+		Message: fmt.Sprintf("All %d services are ready", len(services)),
+	}
+	switch {
+	case !stack.Spec().Active:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Inactive"
+		condition.Message = "The stack is scaled down"
+	case len(notReady) > 0:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ServicesNotReady"
+		condition.Message = fmt.Sprintf("Not ready: %s", strings.Join(notReady, ", "))
+	}
+	e.setCondition(stack, condition)
+	return nil
+}
+
+// setIngressReadyCondition reports whether the ingress of a stack was given an address by the
+// ingress controller. Stacks without the GraphQL service have no ingress.
+func (e *StackEngine) setIngressReadyCondition(ctx context.Context, stack Stack) error {
+	condition := metav1.Condition{
+		Type:    ConditionTypeIngressReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  "NotRequired",
+		Message: "The stack has no ingress",
+	}
+
+	if containsString(stack.Services(), IngressServiceName) {
+		ingress := &networkingv1.Ingress{}
+		err := e.Get(ctx, client.ObjectKey{Name: IngressServiceName, Namespace: stack.Namespace()}, ingress)
+		switch {
+		case errors.IsNotFound(err):
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "NotFound"
+			condition.Message = "The ingress does not exist"
+		case err != nil:
+			return fmt.Errorf("failed to get ingress: %v", err)
+		case len(ingress.Status.LoadBalancer.Ingress) == 0:
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "AddressPending"
+			condition.Message = "Waiting for the ingress controller to assign an address"
+		default:
+			condition.Reason = "Admitted"
+			condition.Message = fmt.Sprintf("Serving %s", e.getDomain(stack))
+		}
+	}
+
+	e.setCondition(stack, condition)
+	return nil
+}
+
+// setBackupHealthyCondition reports whether the last backup of a stack succeeded recently
+func (e *StackEngine) setBackupHealthyCondition(stack Stack) {
+	condition := metav1.Condition{
+		Type:    ConditionTypeBackupHealthy,
+		Status:  metav1.ConditionTrue,
+		Reason:  "BackupSucceeded",
+		Message: "The last backup succeeded",
+	}
+
+	backup := stack.Status().Backup
+	var lastJob string
+	if backup != nil {
+		for _, job := range backup.BackupJobs {
+			if job.Status != BackupJobRunning {
+				lastJob = job.Status
+			}
+		}
+	}
+
+	switch {
+	case stack.Spec().BackupConfig == nil || !stack.Spec().BackupConfig.Enabled:
+		condition.Reason = "BackupsDisabled"
+		condition.Message = "Backups are not enabled"
+	case lastJob == BackupJobFailed:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "BackupFailed"
+		condition.Message = "The last backup failed"
+	case backup == nil || backup.LastBackupTime == nil:
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "NoBackup"
+		condition.Message = "No backup finished yet"
+	case time.Since(backup.LastBackupTime.Time) > BackupStaleAfter:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "BackupStale"
+		condition.Message = fmt.Sprintf("The last backup finished %v ago", time.Since(backup.LastBackupTime.Time).Round(time.Minute))
+	}
+
+	e.setCondition(stack, condition)
+}
@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+var _ = Describe("Component conditions", func() {
+	const namespace = testNamespace
+
+	var (
+		ctx        context.Context
+		engine     *StackEngine
+		fakeClient client.Client
+		prStack    *pishopv1alpha1.PRStack
+	)
+
+	readyDeployment := func(name string, ready int32) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Status:     appsv1.DeploymentStatus{ReadyReplicas: ready},
+		}
+	}
+
+	condition := func(conditionType string) *metav1.Condition {
+		return apimeta.FindStatusCondition(prStack.Status.Conditions, conditionType)
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		now := metav1.Now()
+		prStack = newTestPRStack()
+		prStack.Generation = 3
+		prStack.Spec.Services = []string{"cart-service", "graphql-service"}
+		prStack.Status = pishopv1alpha1.PRStackStatus{
+			Phase:        PhaseRunning,
+			CreatedAt:    &now,
+			LastActiveAt: &now,
+			MongoDB:      &pishopv1alpha1.MongoDBCredentials{User: "pishop_pr_123"},
+		}
+
+		fakeClient = newTestClient().
+			WithObjects(
+				readyDeployment("nats", 1),
+				readyDeployment("redis", 1),
+				readyDeployment("cart-service", 1),
+				readyDeployment("graphql-service", 0),
+			).
+			Build()
+
+		engine = newTestEngine(fakeClient)
+	})
+
+	It("should report each component and the ready services", func() {
+		Expect(engine.updateComponentConditions(ctx, asStack(prStack))).To(Succeed())
+
+		Expect(prStack.Status.ObservedGeneration).To(Equal(int64(3)))
+		Expect(prStack.Status.ReadyServices).To(Equal("1/2"))
+
+		for _, conditionType := range []string{ConditionTypeMongoDBReady, ConditionTypeNATSReady, ConditionTypeRedisReady} {
+			Expect(condition(conditionType).Status).To(Equal(metav1.ConditionTrue), conditionType)
+			Expect(condition(conditionType).ObservedGeneration).To(Equal(int64(3)))
+		}
+
+		servicesReady := condition(ConditionTypeServicesReady)
+		Expect(servicesReady.Status).To(Equal(metav1.ConditionFalse))
+		Expect(servicesReady.Reason).To(Equal("ServicesNotReady"))
+		Expect(servicesReady.Message).To(ContainSubstring("graphql-service"))
+
+		Expect(condition(ConditionTypeIngressReady).Reason).To(Equal("NotFound"))
+		Expect(condition(ConditionTypeBackupHealthy).Reason).To(Equal("BackupsDisabled"))
+		Expect(condition(ConditionTypeExpired).Status).To(Equal(metav1.ConditionFalse))
+	})
+
+	It("should report the ingress ready once it has an address", func() {
+		ingress := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: IngressServiceName, Namespace: namespace}}
+		Expect(fakeClient.Create(ctx, ingress)).To(Succeed())
+		Expect(engine.updateComponentConditions(ctx, asStack(prStack))).To(Succeed())
+		Expect(condition(ConditionTypeIngressReady).Reason).To(Equal("AddressPending"))
+
+		ingress.Status.LoadBalancer.Ingress = []networkingv1.IngressLoadBalancerIngress{{IP: "10.0.0.1"}}
+		Expect(fakeClient.Status().Update(ctx, ingress)).To(Succeed())
+		Expect(engine.updateComponentConditions(ctx, asStack(prStack))).To(Succeed())
+
+		ingressReady := condition(ConditionTypeIngressReady)
+		Expect(ingressReady.Status).To(Equal(metav1.ConditionTrue))
+		Expect(ingressReady.Message).To(ContainSubstring("pr-123.shop.pilab.hu"))
+	})
+
+	It("should report failed and stale backups", func() {
+		prStack.Spec.BackupConfig = &pishopv1alpha1.BackupConfig{Enabled: true}
+		Expect(engine.updateComponentConditions(ctx, asStack(prStack))).To(Succeed())
+		Expect(condition(ConditionTypeBackupHealthy).Status).To(Equal(metav1.ConditionUnknown))
+
+		prStack.Status.Backup = &pishopv1alpha1.BackupStatus{
+			LastBackupTime: &metav1.Time{Time: time.Now().Add(-72 * time.Hour)},
+			BackupJobs:     []pishopv1alpha1.BackupJobStatus{{Name: "backup-1", Status: BackupJobCompleted}},
+		}
+		Expect(engine.updateComponentConditions(ctx, asStack(prStack))).To(Succeed())
+		Expect(condition(ConditionTypeBackupHealthy).Reason).To(Equal("BackupStale"))
+
+		prStack.Status.Backup.BackupJobs = append(prStack.Status.Backup.BackupJobs,
+			pishopv1alpha1.BackupJobStatus{Name: "backup-2", Status: BackupJobFailed},
+			pishopv1alpha1.BackupJobStatus{Name: "backup-3", Status: BackupJobRunning})
+		Expect(engine.updateComponentConditions(ctx, asStack(prStack))).To(Succeed())
+		Expect(condition(ConditionTypeBackupHealthy).Reason).To(Equal("BackupFailed"))
+	})
+
+	It("should report expired and inactive stacks", func() {
+		lastActive := metav1.NewTime(time.Now().Add(-2 * StackExpirationTime))
+		prStack.Status.LastActiveAt = &lastActive
+		prStack.Spec.Active = false
+
+		Expect(engine.updateComponentConditions(ctx, asStack(prStack))).To(Succeed())
+
+		Expect(condition(ConditionTypeExpired).Status).To(Equal(metav1.ConditionTrue))
+		Expect(condition(ConditionTypeExpired).Reason).To(Equal("InactivityTimeout"))
+		Expect(condition(ConditionTypeServicesReady).Reason).To(Equal("Inactive"))
+		Expect(condition(ConditionTypeMongoDBReady).Reason).To(Equal("Inactive"))
+	})
+
+	It("should not report tenants as expired", func() {
+		tenant := &pishopv1alpha1.Tenant{Spec: pishopv1alpha1.TenantSpec{TenantID: "acme"}}
+		stack := newTenantStack(tenant)
+		Expect(engine.updateComponentConditions(ctx, stack)).To(Succeed())
+
+		Expect(apimeta.FindStatusCondition(stack.Status().Conditions, ConditionTypeExpired)).To(BeNil())
+		Expect(apimeta.FindStatusCondition(stack.ApplyStatus().(*pishopv1alpha1.Tenant).Status.Conditions, ConditionTypeBackupHealthy)).ToNot(BeNil())
+	})
+})
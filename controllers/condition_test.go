@@ -34,17 +34,18 @@ var _ = Describe("Condition and Status Management Tests", func() {
 
 		fakeClient = fake.NewClientBuilder().
 			WithScheme(scheme).
+			WithInterceptorFuncs(serverSideApply).
 			WithStatusSubresource(&pishopv1alpha1.PRStack{}).
 			Build()
 
-		reconciler = &PRStackReconciler{
+		reconciler = &PRStackReconciler{StackEngine: &StackEngine{
 			Client:        fakeClient,
 			Scheme:        scheme,
 			MongoURI:      "mongodb://localhost:27017",
 			MongoUsername: "admin",
 			MongoPassword: "password",
 			BaseDomain:    "shop.pilab.hu",
-		}
+		}}
 
 		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 	})
@@ -74,7 +75,7 @@ var _ = Describe("Condition and Status Management Tests", func() {
 		})
 
 		It("should set Ready condition when stack is healthy", func() {
-			reconciler.setReadyCondition(prStack, "StackRunning", "All services deployed")
+			reconciler.setReadyCondition(asStack(prStack), "StackRunning", "All services deployed")
 
 			Expect(prStack.Status.Conditions).To(HaveLen(2))
 
@@ -89,7 +90,7 @@ var _ = Describe("Condition and Status Management Tests", func() {
 		})
 
 		It("should set Progressing condition", func() {
-			reconciler.setProgressingCondition(prStack, "Deploying", "Deploying services")
+			reconciler.setProgressingCondition(asStack(prStack), "Deploying", "Deploying services")
 
 			Expect(prStack.Status.Conditions).To(HaveLen(1))
 
@@ -101,14 +102,14 @@ var _ = Describe("Condition and Status Management Tests", func() {
 
 		It("should update existing condition", func() {
 			// Set initial condition
-			reconciler.setReadyCondition(prStack, "Initial", "Initial message")
+			reconciler.setReadyCondition(asStack(prStack), "Initial", "Initial message")
 			Expect(prStack.Status.Conditions).To(HaveLen(2))
 
 			initialReady := findCondition(prStack.Status.Conditions, ConditionTypeReady)
 			initialTransitionTime := initialReady.LastTransitionTime
 
 			// Update condition with same status
-			reconciler.setReadyCondition(prStack, "Initial", "Updated message")
+			reconciler.setReadyCondition(asStack(prStack), "Initial", "Updated message")
 
 			updatedReady := findCondition(prStack.Status.Conditions, ConditionTypeReady)
 			Expect(updatedReady.LastTransitionTime).To(Equal(initialTransitionTime))
@@ -117,7 +118,7 @@ var _ = Describe("Condition and Status Management Tests", func() {
 		It("should update transition time when status changes", func() {
 			// Set initial Ready condition
 			now := metav1.Now()
-			reconciler.setCondition(prStack, metav1.Condition{
+			reconciler.setCondition(asStack(prStack), metav1.Condition{
 				Type:               ConditionTypeReady,
 				Status:             metav1.ConditionTrue,
 				Reason:             "Running",
@@ -130,7 +131,7 @@ var _ = Describe("Condition and Status Management Tests", func() {
 			Expect(initialCondition.Status).To(Equal(metav1.ConditionTrue))
 
 			// Change status to False (should update transition time)
-			reconciler.setCondition(prStack, metav1.Condition{
+			reconciler.setCondition(asStack(prStack), metav1.Condition{
 				Type:    ConditionTypeReady,
 				Status:  metav1.ConditionFalse,
 				Reason:  "Failed",
@@ -146,8 +147,8 @@ var _ = Describe("Condition and Status Management Tests", func() {
 		})
 
 		It("should preserve conditions when adding new ones", func() {
-			reconciler.setReadyCondition(prStack, "Ready", "Ready message")
-			reconciler.setProgressingCondition(prStack, "Progressing", "Progressing message")
+			reconciler.setReadyCondition(asStack(prStack), "Ready", "Ready message")
+			reconciler.setProgressingCondition(asStack(prStack), "Progressing", "Progressing message")
 
 			Expect(prStack.Status.Conditions).To(HaveLen(3)) // Ready, Degraded, Progressing
 		})
@@ -175,7 +176,7 @@ var _ = Describe("Condition and Status Management Tests", func() {
 		It("should set Failed phase and conditions on error", func() {
 			Expect(fakeClient.Create(ctx, prStack)).To(Succeed())
 
-			reconciler.updateStatusWithError(ctx, prStack, "MongoDB provisioning failed",
+			reconciler.updateStatusWithError(ctx, asStack(prStack), "MongoDB provisioning failed",
 				&mockError{message: "connection refused"})
 
 			Expect(prStack.Status.Phase).To(Equal(PhaseFailed))
@@ -216,14 +217,14 @@ var _ = Describe("Condition and Status Management Tests", func() {
 			}
 
 			// Simulate partial failure by setting conditions
-			reconciler.setCondition(prStack, metav1.Condition{
+			reconciler.setCondition(asStack(prStack), metav1.Condition{
 				Type:               ConditionTypeReady,
 				Status:             metav1.ConditionTrue,
 				Reason:             "PartiallyDegraded",
 				Message:            "2/3 services running",
 				LastTransitionTime: metav1.Now(),
 			})
-			reconciler.setCondition(prStack, metav1.Condition{
+			reconciler.setCondition(asStack(prStack), metav1.Condition{
 				Type:               ConditionTypeDegraded,
 				Status:             metav1.ConditionTrue,
 				Reason:             "ServiceFailures",
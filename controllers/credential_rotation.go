@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// shouldRotateCredentials checks if the PR MongoDB user password is due for rotation,
+// either because an on-demand rotation was requested or the rotation interval elapsed
+func (e *StackEngine) shouldRotateCredentials(stack Stack) bool {
+	if stack.Status().MongoDB == nil {
+		return false
+	}
+
+	// An unfinished rotation is retried
+	if stack.Status().MongoDB.PendingPassword != "" {
+		return true
+	}
+
+	rotation := stack.Spec().CredentialRotation
+	if rotation == nil {
+		return false
+	}
+
+	lastRotation := stack.Status().MongoDB.LastRotationTime
+	if lastRotation == nil {
+		// Fallback to CreatedAt if the credentials were never rotated
+		lastRotation = stack.Status().CreatedAt
+	}
+
+	// On-demand rotation requested after the last rotation
+	if rotation.RequestedAt != nil && (lastRotation == nil || rotation.RequestedAt.After(lastRotation.Time)) {
+		return true
+	}
+
+	// Scheduled rotation
+	if rotation.Interval != nil && rotation.Interval.Duration > 0 && lastRotation != nil {
+		return time.Since(lastRotation.Time) >= rotation.Interval.Duration
+	}
+
+	return false
+}
+
+// rotateMongoDBCredentials generates a new password for the PR user, updates it in MongoDB,
+// refreshes the credentials stored in the PR namespace and restarts all deployments.
+// The new password is saved as pending before MongoDB is changed, so a failed rotation is
+// retried with the same password and the status never loses the password of the user.
+func (e *StackEngine) rotateMongoDBCredentials(ctx context.Context, stack Stack) error {
+	log := ctrl.LoggerFrom(ctx)
+	log.Info("Rotating MongoDB credentials for PR", "stack", stack.ID())
+
+	if stack.Status().MongoDB == nil {
+		return fmt.Errorf("MongoDB credentials not available in status")
+	}
+
+	if stack.Status().MongoDB.PendingPassword == "" {
+		pendingPassword, err := generateSecurePassword()
+		if err != nil {
+			return fmt.Errorf("failed to generate secure password: %v", err)
+		}
+		stack.Status().MongoDB.PendingPassword = pendingPassword
+		if err := e.updateStackStatus(ctx, stack); err != nil {
+			return fmt.Errorf("failed to update stack status: %v", err)
+		}
+	}
+	newPassword := stack.Status().MongoDB.PendingPassword
+
+	// Connect to MongoDB
+	mongoURI, err := e.getAdminMongoURI(ctx, stack)
+	if err != nil {
+		return err
+	}
+
+	client, err := mongo.Connect(options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		return fmt.Errorf("failed to connect to MongoDB: %v", err)
+	}
+	defer client.Disconnect(ctx)
+
+	// Test connection
+	if err := client.Ping(ctx, nil); err != nil {
+		return fmt.Errorf("failed to ping MongoDB: %v", err)
+	}
+
+	prUser := stack.Status().MongoDB.User
+	connectionString, err := e.mongoConnectionString(stack, prUser, newPassword)
+	if err != nil {
+		return fmt.Errorf("failed to build connection string: %v", err)
+	}
+
+	// Update the user password in place, keeping its roles. Setting the pending password again
+	// when the rotation is retried is harmless.
+	if err := client.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "updateUser", Value: prUser},
+		{Key: "pwd", Value: newPassword},
+	}).Err(); err != nil {
+		return fmt.Errorf("failed to update user: %v", err)
+	}
+
+	now := metav1.Now()
+	stack.Status().MongoDB.Password = newPassword
+	stack.Status().MongoDB.ConnectionString = connectionString
+	stack.Status().MongoDB.LastRotationTime = &now
+	stack.Status().MongoDB.PendingPassword = ""
+
+	// Persist the new credentials before touching the namespace, a failed refresh of the
+	// namespace is corrected by the next reconcile
+	if err := e.updateStackStatus(ctx, stack); err != nil {
+		return fmt.Errorf("failed to update stack status: %v", err)
+	}
+
+	// Refresh mongodb-secret and mongodb-config in the PR namespace
+	namespaceName := stack.Namespace()
+	if err := e.createMongoDBResources(ctx, stack, namespaceName); err != nil {
+		return fmt.Errorf("failed to update MongoDB resources: %v", err)
+	}
+
+	// Restart services so they pick up the new credentials
+	if err := e.restartDeployments(ctx, namespaceName, now.Time); err != nil {
+		return fmt.Errorf("failed to restart deployments: %v", err)
+	}
+
+	log.Info("MongoDB credentials rotated successfully", "stack", stack.ID(), "user", prUser)
+	return nil
+}
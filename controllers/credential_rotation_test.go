@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("Credential Rotation", func() {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		reconciler *PRStackReconciler
+		fakeClient client.Client
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		fakeClient = newTestClient().Build()
+
+		reconciler = &PRStackReconciler{StackEngine: newTestEngine(fakeClient)}
+		reconciler.MongoUsername = "admin"
+		reconciler.MongoPassword = "password"
+
+		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	newPRStack := func() *pishopv1alpha1.PRStack {
+		createdAt := metav1.NewTime(time.Now().Add(-48 * time.Hour))
+		return &pishopv1alpha1.PRStack{
+			Spec: pishopv1alpha1.PRStackSpec{
+				PRNumber: "123",
+			},
+			Status: pishopv1alpha1.PRStackStatus{
+				CreatedAt: &createdAt,
+				MongoDB: &pishopv1alpha1.MongoDBCredentials{
+					User:     "pishop_pr_123",
+					Password: "old-password",
+				},
+			},
+		}
+	}
+
+	Context("shouldRotateCredentials", func() {
+		It("should return false when rotation is not configured", func() {
+			prStack := newPRStack()
+			Expect(reconciler.shouldRotateCredentials(asStack(prStack))).To(BeFalse())
+		})
+
+		It("should return false when MongoDB is not provisioned", func() {
+			prStack := newPRStack()
+			prStack.Status.MongoDB = nil
+			prStack.Spec.CredentialRotation = &pishopv1alpha1.CredentialRotation{
+				RequestedAt: &metav1.Time{Time: time.Now()},
+			}
+			Expect(reconciler.shouldRotateCredentials(asStack(prStack))).To(BeFalse())
+		})
+
+		It("should return true when rotation is requested after the last rotation", func() {
+			prStack := newPRStack()
+			lastRotation := metav1.NewTime(time.Now().Add(-time.Hour))
+			prStack.Status.MongoDB.LastRotationTime = &lastRotation
+			prStack.Spec.CredentialRotation = &pishopv1alpha1.CredentialRotation{
+				RequestedAt: &metav1.Time{Time: time.Now()},
+			}
+			Expect(reconciler.shouldRotateCredentials(asStack(prStack))).To(BeTrue())
+		})
+
+		It("should return false when the request was already handled", func() {
+			prStack := newPRStack()
+			lastRotation := metav1.Now()
+			prStack.Status.MongoDB.LastRotationTime = &lastRotation
+			prStack.Spec.CredentialRotation = &pishopv1alpha1.CredentialRotation{
+				RequestedAt: &metav1.Time{Time: time.Now().Add(-time.Hour)},
+			}
+			Expect(reconciler.shouldRotateCredentials(asStack(prStack))).To(BeFalse())
+		})
+
+		It("should return true when the interval elapsed since creation", func() {
+			prStack := newPRStack()
+			prStack.Spec.CredentialRotation = &pishopv1alpha1.CredentialRotation{
+				Interval: &metav1.Duration{Duration: 24 * time.Hour},
+			}
+			Expect(reconciler.shouldRotateCredentials(asStack(prStack))).To(BeTrue())
+		})
+
+		It("should return false when the interval has not elapsed since the last rotation", func() {
+			prStack := newPRStack()
+			lastRotation := metav1.NewTime(time.Now().Add(-time.Hour))
+			prStack.Status.MongoDB.LastRotationTime = &lastRotation
+			prStack.Spec.CredentialRotation = &pishopv1alpha1.CredentialRotation{
+				Interval: &metav1.Duration{Duration: 24 * time.Hour},
+			}
+			Expect(reconciler.shouldRotateCredentials(asStack(prStack))).To(BeFalse())
+		})
+	})
+
+	Context("rotateMongoDBCredentials", func() {
+		It("should fail when MongoDB status is nil", func() {
+			prStack := newPRStack()
+			prStack.Status.MongoDB = nil
+			err := reconciler.rotateMongoDBCredentials(ctx, asStack(prStack))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("MongoDB credentials not available"))
+		})
+
+		It("should save the new password before changing it and reuse it on retry", func() {
+			prStack := newPRStack()
+			prStack.Name = "pr-123"
+			prStack.Spec.MongoURI = "mongodb://localhost:1/?serverSelectionTimeoutMS=100"
+			status := prStack.Status
+			Expect(fakeClient.Create(ctx, prStack)).To(Succeed())
+			prStack.Status = status
+			Expect(fakeClient.Status().Update(ctx, prStack)).To(Succeed())
+
+			Expect(reconciler.rotateMongoDBCredentials(ctx, asStack(prStack))).To(MatchError(ContainSubstring("failed to ping MongoDB")))
+
+			stored := &pishopv1alpha1.PRStack{}
+			Expect(fakeClient.Get(ctx, client.ObjectKeyFromObject(prStack), stored)).To(Succeed())
+			Expect(stored.Status.MongoDB.Password).To(Equal("old-password"))
+			pendingPassword := stored.Status.MongoDB.PendingPassword
+			Expect(pendingPassword).NotTo(BeEmpty())
+			Expect(reconciler.shouldRotateCredentials(asStack(stored))).To(BeTrue())
+
+			Expect(reconciler.rotateMongoDBCredentials(ctx, asStack(stored))).To(HaveOccurred())
+			Expect(stored.Status.MongoDB.PendingPassword).To(Equal(pendingPassword))
+		})
+	})
+
+	Context("restartDeployments", func() {
+		It("should set the restart annotation on all deployments", func() {
+			namespace := testNamespace
+			replicas := int32(1)
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "cart-service",
+					Namespace: namespace,
+				},
+				Spec: appsv1.DeploymentSpec{
+					Replicas: &replicas,
+					Selector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"app": "cart-service"},
+					},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: map[string]string{"app": "cart-service"},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{Name: "cart-service", Image: "test:latest"}},
+						},
+					},
+				},
+			}
+			Expect(fakeClient.Create(ctx, deployment)).To(Succeed())
+
+			restartedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+			Expect(reconciler.restartDeployments(ctx, namespace, restartedAt)).To(Succeed())
+
+			updated := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "cart-service", Namespace: namespace}, updated)).To(Succeed())
+			Expect(updated.Spec.Template.Annotations).To(HaveKeyWithValue(RestartAnnotation, restartedAt.Format(time.RFC3339)))
+		})
+	})
+})
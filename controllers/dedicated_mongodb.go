@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// MongoDB modes
+	MongoDBModeShared    = "shared"
+	MongoDBModeDedicated = "dedicated"
+
+	// Dedicated MongoDB resources
+	DedicatedMongoDBName       = "mongodb"
+	DedicatedMongoDBRootSecret = "mongodb-root-secret"
+	DedicatedMongoDBRootUser   = "root"
+	DefaultDedicatedMongoImage = "mongo:7.0"
+)
+
+// isDedicatedMongoDB returns true if the stack runs its own MongoDB inside the PR namespace
+func isDedicatedMongoDB(stack Stack) bool {
+	return stack.Spec().MongoDB != nil && stack.Spec().MongoDB.Mode == MongoDBModeDedicated
+}
+
+// getDedicatedMongoDBHost returns the in-cluster address of the dedicated MongoDB
+func getDedicatedMongoDBHost(namespace string) string {
+	return fmt.Sprintf("%s.%s.svc.cluster.local:27017", DedicatedMongoDBName, namespace)
+}
+
+// createDedicatedMongoDBResources creates the root credentials, headless Service and
+// single-node StatefulSet of a dedicated MongoDB in the PR namespace
+func (e *StackEngine) createDedicatedMongoDBResources(ctx context.Context, stack Stack, namespace string) error {
+	log := ctrl.LoggerFrom(ctx)
+	log.Info("Creating dedicated MongoDB resources", "namespace", namespace)
+
+	if err := e.ensureDedicatedMongoDBRootSecret(ctx, stack, namespace); err != nil {
+		return err
+	}
+
+	labels := map[string]string{
+		"app": DedicatedMongoDBName,
+		"pr":  stack.ID(),
+	}
+
+	// Create headless service for the StatefulSet
+	mongoService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      DedicatedMongoDBName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  labels,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "mongodb",
+					Port:       27017,
+					TargetPort: intstr.FromInt(27017),
+					Protocol:   corev1.ProtocolTCP,
+				},
+			},
+		},
+	}
+
+	if err := e.Apply(ctx, stack, mongoService); err != nil {
+		return fmt.Errorf("failed to create dedicated MongoDB service: %v", err)
+	}
+
+	statefulSet, err := e.buildDedicatedMongoDBStatefulSet(stack, namespace, labels)
+	if err != nil {
+		return err
+	}
+
+	if err := e.keepDedicatedMongoDBDataVolume(ctx, stack, statefulSet, labels); err != nil {
+		return err
+	}
+
+	if err := e.Apply(ctx, stack, statefulSet); err != nil {
+		return fmt.Errorf("failed to create dedicated MongoDB StatefulSet: %v", err)
+	}
+
+	log.Info("Dedicated MongoDB resources created successfully", "namespace", namespace)
+	return nil
+}
+
+// keepDedicatedMongoDBDataVolume keeps the data volume of an existing StatefulSet when the
+// storage limit of the stack changed. Claim templates are immutable, so applying the new size
+// would fail on every reconcile; the change is reported instead.
+func (e *StackEngine) keepDedicatedMongoDBDataVolume(ctx context.Context, stack Stack, statefulSet *appsv1.StatefulSet, labels map[string]string) error {
+	existing := &appsv1.StatefulSet{}
+	err := e.Get(ctx, client.ObjectKeyFromObject(statefulSet), existing)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get dedicated MongoDB StatefulSet: %v", err)
+	}
+
+	desired := liveDedicatedMongoDBStorage(statefulSet)
+	live := liveDedicatedMongoDBStorage(existing)
+	if sameStorage(desired, live) {
+		return nil
+	}
+
+	ctrl.LoggerFrom(ctx).Info("Ignoring storage limit change of the dedicated MongoDB", "desired", formatStorage(desired), "current", formatStorage(live))
+	if e.Recorder != nil {
+		e.Recorder.Event(stack.Object(), corev1.EventTypeWarning, EventTypeStorageLimitIgnored,
+			fmt.Sprintf("The dedicated MongoDB keeps its %s data volume, the storage limit can only change when the stack is recreated", formatStorage(live)))
+	}
+	setDedicatedMongoDBDataVolume(statefulSet, labels, live)
+	return nil
+}
+
+// formatStorage formats a data volume size, nil meaning an emptyDir
+func formatStorage(storage *resource.Quantity) string {
+	if storage == nil {
+		return "emptyDir"
+	}
+	return storage.String()
+}
+
+// ensureDedicatedMongoDBRootSecret creates the root credentials once; they are never
+// regenerated because MongoDB only applies them when initializing its data directory
+func (e *StackEngine) ensureDedicatedMongoDBRootSecret(ctx context.Context, stack Stack, namespace string) error {
+	existing := &corev1.Secret{}
+	err := e.Get(ctx, client.ObjectKey{Name: DedicatedMongoDBRootSecret, Namespace: namespace}, existing)
+	if err == nil {
+		return e.adoptObject(ctx, stack, existing)
+	}
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to get dedicated MongoDB root secret: %v", err)
+	}
+
+	rootPassword, err := generateSecurePassword()
+	if err != nil {
+		return fmt.Errorf("failed to generate secure password: %v", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      DedicatedMongoDBRootSecret,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app": DedicatedMongoDBName,
+				"pr":  stack.ID(),
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"username": []byte(DedicatedMongoDBRootUser),
+			"password": []byte(rootPassword),
+		},
+	}
+
+	if err := e.setStackOwner(stack, secret); err != nil {
+		return err
+	}
+	if err := e.Create(ctx, secret); err != nil {
+		return fmt.Errorf("failed to create dedicated MongoDB root secret: %v", err)
+	}
+
+	return nil
+}
+
+// buildDedicatedMongoDBStatefulSet builds the single-node MongoDB StatefulSet.
+// Data is kept on a PVC sized by ResourceLimits.StorageLimit when set, otherwise on an emptyDir.
+func (e *StackEngine) buildDedicatedMongoDBStatefulSet(stack Stack, namespace string, labels map[string]string) (*appsv1.StatefulSet, error) {
+	image := DefaultDedicatedMongoImage
+	if stack.Spec().MongoDB.Image != "" {
+		image = stack.Spec().MongoDB.Image
+	}
+
+	replicas := int32(1)
+	if !stack.Spec().Active {
+		replicas = 0
+	}
+
+	rootSecretEnv := func(name, key string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: DedicatedMongoDBRootSecret},
+					Key:                  key,
+				},
+			},
+		}
+	}
+
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      DedicatedMongoDBName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: DedicatedMongoDBName,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  "mongodb",
+							Image: image,
+							Ports: []corev1.ContainerPort{
+								{
+									ContainerPort: 27017,
+									Name:          "mongodb",
+								},
+							},
+							Env: []corev1.EnvVar{
+								rootSecretEnv("MONGO_INITDB_ROOT_USERNAME", "username"),
+								rootSecretEnv("MONGO_INITDB_ROOT_PASSWORD", "password"),
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "data",
+									MountPath: "/data/db",
+								},
+							},
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									Exec: &corev1.ExecAction{
+										Command: []string{"mongosh", "--quiet", "--eval", "db.adminCommand('ping')"},
+									},
+								},
+								InitialDelaySeconds: 5,
+								PeriodSeconds:       10,
+							},
+							Resources: corev1.ResourceRequirements{
+								Requests: corev1.ResourceList{
+									corev1.ResourceCPU:    resource.MustParse("0m"),
+									corev1.ResourceMemory: resource.MustParse("0Mi"),
+								},
+								Limits: corev1.ResourceList{
+									corev1.ResourceCPU:    resource.MustParse(MongoDBCPULimit),
+									corev1.ResourceMemory: resource.MustParse(MongoDBMemoryLimit),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	storage, err := dedicatedMongoDBStorage(stack)
+	if err != nil {
+		return nil, err
+	}
+	setDedicatedMongoDBDataVolume(statefulSet, labels, storage)
+
+	return statefulSet, nil
+}
+
+// dedicatedMongoDBStorage returns the size of the data PVC of a dedicated MongoDB, or nil
+// when its data is kept on an emptyDir
+func dedicatedMongoDBStorage(stack Stack) (*resource.Quantity, error) {
+	if stack.Spec().ResourceLimits == nil || stack.Spec().ResourceLimits.StorageLimit == "" {
+		return nil, nil
+	}
+	storage, err := resource.ParseQuantity(stack.Spec().ResourceLimits.StorageLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage limit %s: %v", stack.Spec().ResourceLimits.StorageLimit, err)
+	}
+	return &storage, nil
+}
+
+// setDedicatedMongoDBDataVolume keeps the data of the StatefulSet on a claim template of the
+// given size, or on an emptyDir when storage is nil
+func setDedicatedMongoDBDataVolume(statefulSet *appsv1.StatefulSet, labels map[string]string, storage *resource.Quantity) {
+	if storage == nil {
+		statefulSet.Spec.VolumeClaimTemplates = nil
+		statefulSet.Spec.Template.Spec.Volumes = []corev1.Volume{
+			{
+				Name: "data",
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{},
+				},
+			},
+		}
+		return
+	}
+
+	statefulSet.Spec.Template.Spec.Volumes = nil
+	statefulSet.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "data",
+				Labels: labels,
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{
+					corev1.ReadWriteOnce,
+				},
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: *storage,
+					},
+				},
+			},
+		},
+	}
+}
+
+// liveDedicatedMongoDBStorage returns the size of the data claim template of an existing
+// StatefulSet, or nil when it keeps its data on an emptyDir
+func liveDedicatedMongoDBStorage(statefulSet *appsv1.StatefulSet) *resource.Quantity {
+	for _, template := range statefulSet.Spec.VolumeClaimTemplates {
+		if template.Name == "data" {
+			storage := template.Spec.Resources.Requests[corev1.ResourceStorage]
+			return &storage
+		}
+	}
+	return nil
+}
+
+// sameStorage reports whether two data volume sizes are equal, nil meaning an emptyDir
+func sameStorage(a, b *resource.Quantity) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Cmp(*b) == 0
+}
+
+// isDedicatedMongoDBReady checks if the dedicated MongoDB StatefulSet has a ready replica
+func (e *StackEngine) isDedicatedMongoDBReady(ctx context.Context, namespace string) (bool, error) {
+	statefulSet := &appsv1.StatefulSet{}
+	if err := e.Get(ctx, client.ObjectKey{Name: DedicatedMongoDBName, Namespace: namespace}, statefulSet); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return statefulSet.Status.ReadyReplicas > 0, nil
+}
+
+// scaleDedicatedMongoDB scales the dedicated MongoDB StatefulSet if it exists
+func (e *StackEngine) scaleDedicatedMongoDB(ctx context.Context, namespace string, replicas int32) error {
+	statefulSet := &appsv1.StatefulSet{}
+	if err := e.Get(ctx, client.ObjectKey{Name: DedicatedMongoDBName, Namespace: namespace}, statefulSet); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	if statefulSet.Spec.Replicas != nil && *statefulSet.Spec.Replicas == replicas {
+		return nil
+	}
+
+	statefulSet.Spec.Replicas = &replicas
+	if err := e.Update(ctx, statefulSet, client.FieldOwner(FieldManager)); err != nil {
+		return fmt.Errorf("failed to scale dedicated MongoDB: %v", err)
+	}
+
+	return nil
+}
+
+// getDedicatedMongoDBAdminURI returns the root connection string of the dedicated MongoDB
+func (e *StackEngine) getDedicatedMongoDBAdminURI(ctx context.Context, namespace string) (string, error) {
+	secret := &corev1.Secret{}
+	if err := e.Get(ctx, client.ObjectKey{Name: DedicatedMongoDBRootSecret, Namespace: namespace}, secret); err != nil {
+		return "", fmt.Errorf("failed to get dedicated MongoDB root secret: %v", err)
+	}
+
+	parts := &mongoURIParts{scheme: mongoScheme, hosts: getDedicatedMongoDBHost(namespace)}
+	return parts.withCredentials(string(secret.Data["username"]), string(secret.Data["password"])).build(""), nil
+}
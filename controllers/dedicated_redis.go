@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Redis persistence modes
+	RedisPersistenceNone = "none"
+	RedisPersistenceRDB  = "rdb"
+	RedisPersistenceAOF  = "aof"
+	RedisPersistenceBoth = "both"
+
+	// RedisDataPVCName is the PVC holding the data of the dedicated Redis server
+	RedisDataPVCName = "redis-data"
+
+	// Defaults of the dedicated Redis server
+	DefaultRedisMaxMemory       = "256mb"
+	DefaultRedisMaxMemoryPolicy = "allkeys-lru"
+
+	// redisRDBSavePoints snapshots after 1h with 1 change, 5min with 100 changes or 1min with 10000 changes
+	redisRDBSavePoints = "3600 1 300 100 60 10000"
+)
+
+// getRedisPersistence returns the persistence settings of the dedicated Redis server
+func getRedisPersistence(stack Stack) pishopv1alpha1.RedisPersistenceSpec {
+	persistence := pishopv1alpha1.RedisPersistenceSpec{Mode: RedisPersistenceAOF}
+	if stack.Spec().Redis != nil && stack.Spec().Redis.Persistence != nil {
+		persistence = *stack.Spec().Redis.Persistence
+		if persistence.Mode == "" {
+			persistence.Mode = RedisPersistenceAOF
+		}
+	}
+	return persistence
+}
+
+// hasRedisStorage returns true if the data of the dedicated Redis server is kept on a PVC
+func hasRedisStorage(stack Stack) bool {
+	persistence := getRedisPersistence(stack)
+	return persistence.Mode != RedisPersistenceNone && persistence.StorageSize != ""
+}
+
+// redisServerArgs returns the redis-server arguments of the dedicated Redis server.
+// The password is read from the REDIS_PASSWORD environment variable of the container.
+func redisServerArgs(stack Stack) []string {
+	maxMemory := DefaultRedisMaxMemory
+	maxMemoryPolicy := DefaultRedisMaxMemoryPolicy
+	if stack.Spec().Redis != nil {
+		if stack.Spec().Redis.MaxMemory != "" {
+			maxMemory = stack.Spec().Redis.MaxMemory
+		}
+		if stack.Spec().Redis.MaxMemoryPolicy != "" {
+			maxMemoryPolicy = stack.Spec().Redis.MaxMemoryPolicy
+		}
+	}
+
+	args := []string{
+		"redis-server",
+		"--requirepass", "$(REDIS_PASSWORD)",
+		"--maxmemory", maxMemory,
+		"--maxmemory-policy", maxMemoryPolicy,
+	}
+
+	switch getRedisPersistence(stack).Mode {
+	case RedisPersistenceNone:
+		args = append(args, "--appendonly", "no", "--save", "")
+	case RedisPersistenceRDB:
+		args = append(args, "--appendonly", "no", "--save", redisRDBSavePoints)
+	case RedisPersistenceBoth:
+		args = append(args, "--appendonly", "yes", "--save", redisRDBSavePoints)
+	default:
+		args = append(args, "--appendonly", "yes", "--save", "")
+	}
+
+	return args
+}
+
+// getDedicatedRedisURL returns the URL services use to connect to the dedicated Redis server
+func getDedicatedRedisURL(namespace, password string) string {
+	u := url.URL{
+		Scheme: "redis",
+		User:   url.UserPassword("default", password),
+		Host:   fmt.Sprintf("redis.%s.svc.cluster.local:6379", namespace),
+	}
+	return u.String()
+}
+
+// getOrCreateDedicatedRedisPassword returns the password of the dedicated Redis server,
+// generating one on first use so it stays stable across scale-downs
+func (e *StackEngine) getOrCreateDedicatedRedisPassword(ctx context.Context, namespace string) (string, error) {
+	secret := &corev1.Secret{}
+	if err := e.Get(ctx, client.ObjectKey{Name: RedisSecretName, Namespace: namespace}, secret); err == nil {
+		if password := string(secret.Data["password"]); password != "" {
+			return password, nil
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return "", fmt.Errorf("failed to get Redis secret: %v", err)
+	}
+
+	password, err := generateSecurePassword()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate secure password: %v", err)
+	}
+	return password, nil
+}
+
+// ensureRedisDataPVC creates the PVC of the dedicated Redis server. An existing PVC is left
+// untouched so data survives scale-downs and changes of the requested size.
+func (e *StackEngine) ensureRedisDataPVC(ctx context.Context, stack Stack, namespace string) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	persistence := getRedisPersistence(stack)
+	quantity, err := resource.ParseQuantity(persistence.StorageSize)
+	if err != nil {
+		return fmt.Errorf("invalid Redis storage size %s: %v", persistence.StorageSize, err)
+	}
+
+	existingPVC := &corev1.PersistentVolumeClaim{}
+	err = e.Get(ctx, client.ObjectKey{Name: RedisDataPVCName, Namespace: namespace}, existingPVC)
+	if err == nil {
+		log.Info("Redis PVC already exists", "pvc", RedisDataPVCName)
+		return e.releaseObject(ctx, stack, existingPVC)
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get Redis PVC: %v", err)
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      RedisDataPVCName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app": "redis",
+				"pr":  stack.ID(),
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				corev1.ReadWriteOnce,
+			},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: quantity,
+				},
+			},
+		},
+	}
+	if persistence.StorageClass != "" {
+		pvc.Spec.StorageClassName = &persistence.StorageClass
+	}
+
+	if err := e.Create(ctx, pvc); err != nil {
+		return fmt.Errorf("failed to create Redis PVC: %v", err)
+	}
+
+	log.Info("Redis PVC created", "pvc", RedisDataPVCName, "size", persistence.StorageSize)
+	return nil
+}
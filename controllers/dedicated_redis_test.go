@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("Dedicated Redis", func() {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		reconciler *PRStackReconciler
+		fakeClient client.Client
+		prStack    *pishopv1alpha1.PRStack
+		namespace  string
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		fakeClient = newTestClient().Build()
+
+		reconciler = &PRStackReconciler{StackEngine: newTestEngine(fakeClient)}
+
+		namespace = reconciler.getNamespaceName("123")
+		prStack = newTestPRStack()
+
+		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	Context("redisServerArgs", func() {
+		It("should default to AOF with LRU eviction and a password", func() {
+			args := redisServerArgs(asStack(prStack))
+			Expect(args).To(ContainElements("--requirepass", "$(REDIS_PASSWORD)"))
+			Expect(args).To(ContainElements("--maxmemory", DefaultRedisMaxMemory, "--maxmemory-policy", DefaultRedisMaxMemoryPolicy))
+			Expect(args).To(ContainElements("--appendonly", "yes"))
+		})
+
+		It("should apply memory settings and RDB snapshots", func() {
+			prStack.Spec.Redis = &pishopv1alpha1.RedisSpec{
+				MaxMemory:       "1gb",
+				MaxMemoryPolicy: "noeviction",
+				Persistence:     &pishopv1alpha1.RedisPersistenceSpec{Mode: RedisPersistenceRDB},
+			}
+			args := redisServerArgs(asStack(prStack))
+			Expect(args).To(ContainElements("1gb", "noeviction", redisRDBSavePoints))
+			Expect(args).To(ContainElements("--appendonly", "no"))
+		})
+
+		It("should disable persistence", func() {
+			prStack.Spec.Redis = &pishopv1alpha1.RedisSpec{
+				Persistence: &pishopv1alpha1.RedisPersistenceSpec{Mode: RedisPersistenceNone, StorageSize: "1Gi"},
+			}
+			Expect(redisServerArgs(asStack(prStack))).To(ContainElements("--appendonly", "no", "--save", ""))
+			Expect(hasRedisStorage(asStack(prStack))).To(BeFalse())
+		})
+	})
+
+	Context("createRedisResources", func() {
+		It("should generate a password and keep it across reconciles", func() {
+			Expect(reconciler.createRedisResources(ctx, asStack(prStack), namespace)).To(Succeed())
+
+			secret := &corev1.Secret{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: RedisSecretName, Namespace: namespace}, secret)).To(Succeed())
+			password := string(secret.Data["password"])
+			Expect(password).ToNot(BeEmpty())
+			Expect(string(secret.Data["url"])).To(Equal(getDedicatedRedisURL(namespace, password)))
+
+			Expect(reconciler.createRedisResources(ctx, asStack(prStack), namespace)).To(Succeed())
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: RedisSecretName, Namespace: namespace}, secret)).To(Succeed())
+			Expect(string(secret.Data["password"])).To(Equal(password))
+		})
+
+		It("should pass the password to the Redis server", func() {
+			Expect(reconciler.createRedisResources(ctx, asStack(prStack), namespace)).To(Succeed())
+
+			deployment := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "redis", Namespace: namespace}, deployment)).To(Succeed())
+			container := deployment.Spec.Template.Spec.Containers[0]
+			Expect(container.Env).To(ContainElement(HaveField("ValueFrom.SecretKeyRef.Key", "password")))
+			Expect(deployment.Spec.Template.Spec.Volumes[0].EmptyDir).ToNot(BeNil())
+		})
+
+		It("should back Redis with a PVC", func() {
+			prStack.Spec.Redis = &pishopv1alpha1.RedisSpec{
+				Persistence: &pishopv1alpha1.RedisPersistenceSpec{StorageSize: "2Gi", StorageClass: "fast"},
+			}
+			Expect(reconciler.createRedisResources(ctx, asStack(prStack), namespace)).To(Succeed())
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: RedisDataPVCName, Namespace: namespace}, pvc)).To(Succeed())
+			storage := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+			Expect(storage.String()).To(Equal("2Gi"))
+			Expect(*pvc.Spec.StorageClassName).To(Equal("fast"))
+
+			deployment := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "redis", Namespace: namespace}, deployment)).To(Succeed())
+			Expect(deployment.Spec.Strategy.Type).To(Equal(appsv1.RecreateDeploymentStrategyType))
+			Expect(deployment.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal(RedisDataPVCName))
+		})
+	})
+})
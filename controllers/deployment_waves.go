@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// DefaultWaveTimeout is how long a deployment wave may wait for its dependencies before the
+	// stack is degraded
+	DefaultWaveTimeout = 15 * time.Minute
+)
+
+// Dependencies every service waits for before it is deployed
+const (
+	DependencyMongoDB = "mongodb"
+	DependencyNATS    = "nats"
+	DependencyRedis   = "redis"
+)
+
+// infrastructureDependencies are deployed in the first wave, every service depends on them
+var infrastructureDependencies = []string{DependencyMongoDB, DependencyNATS, DependencyRedis}
+
+// gatewayServices route requests to the backend services and depend on all other services
+// of their stack
+var gatewayServices = map[string]bool{
+	"graphql-service": true,
+}
+
+// serviceDependencies returns the stack services a service waits for, on top of the
+// infrastructure dependencies
+func serviceDependencies(service string, services []string) []string {
+	if !gatewayServices[service] {
+		return nil
+	}
+
+	var dependencies []string
+	for _, other := range services {
+		if other != service && !gatewayServices[other] {
+			dependencies = append(dependencies, other)
+		}
+	}
+	return dependencies
+}
+
+// deploymentWaves orders the infrastructure and the services of a stack into waves. The first
+// wave holds the infrastructure, each service is deployed in the wave after its last dependency.
+func deploymentWaves(services []string) [][]string {
+	waves := [][]string{infrastructureDependencies}
+
+	waveOf := make(map[string]int, len(services))
+	remaining := services
+	for len(remaining) > 0 {
+		var wave, blocked []string
+		for _, service := range remaining {
+			ready := true
+			for _, dependency := range serviceDependencies(service, services) {
+				if _, ok := waveOf[dependency]; !ok {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				wave = append(wave, service)
+			} else {
+				blocked = append(blocked, service)
+			}
+		}
+
+		// Services depending on each other cannot be ordered, start them together
+		if len(wave) == 0 {
+			wave, blocked = blocked, nil
+		}
+
+		for _, service := range wave {
+			waveOf[service] = len(waves)
+		}
+		waves = append(waves, wave)
+		remaining = blocked
+	}
+
+	return waves
+}
+
+// firstUnreadyDependency returns the first member of a wave that is not ready, empty when the
+// whole wave is ready. Services that failed to deploy are skipped, waiting for them would block
+// the stack forever.
+func (e *StackEngine) firstUnreadyDependency(ctx context.Context, stack Stack, wave []string, failed map[string]bool) (string, error) {
+	for _, dependency := range wave {
+		if failed[dependency] {
+			continue
+		}
+
+		ready, err := e.isDependencyReady(ctx, stack, dependency)
+		if err != nil {
+			return "", err
+		}
+		if !ready {
+			return dependency, nil
+		}
+	}
+	return "", nil
+}
+
+// isDependencyReady checks if an infrastructure dependency or a service of a stack is ready
+func (e *StackEngine) isDependencyReady(ctx context.Context, stack Stack, dependency string) (bool, error) {
+	namespace := stack.Namespace()
+
+	switch dependency {
+	case DependencyMongoDB:
+		if isDedicatedMongoDB(stack) {
+			return e.isDedicatedMongoDBReady(ctx, namespace)
+		}
+		// Shared and external MongoDB was reached when the databases and users were provisioned
+		return stack.Status().MongoDB != nil, nil
+	case DependencyNATS:
+		return e.isNATSReady(ctx, stack, namespace)
+	case DependencyRedis:
+		if isSharedRedis(stack) {
+			return true, nil
+		}
+		return e.isDeploymentReady(ctx, namespace, "redis")
+	default:
+		return e.isDeploymentReady(ctx, namespace, dependency)
+	}
+}
+
+// isDeploymentReady checks if a deployment has a ready replica
+func (e *StackEngine) isDeploymentReady(ctx context.Context, namespace, name string) (bool, error) {
+	deployment := &appsv1.Deployment{}
+	if err := e.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, deployment); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get deployment %s: %v", name, err)
+	}
+
+	return deployment.Status.ReadyReplicas > 0, nil
+}
+
+// describeWave returns a short description of a wave for status messages
+func describeWave(wave []string) string {
+	if len(wave) > 3 {
+		return fmt.Sprintf("%s and %d more", strings.Join(wave[:3], ", "), len(wave)-3)
+	}
+	return strings.Join(wave, ", ")
+}
+
+// waveTimeout returns how long a deployment wave may wait for its dependencies
+func (e *StackEngine) waveTimeout() time.Duration {
+	if e.WaveTimeout > 0 {
+		return e.WaveTimeout
+	}
+	return DefaultWaveTimeout
+}
@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+var _ = Describe("Deployment Waves", func() {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		reconciler *PRStackReconciler
+		fakeClient client.Client
+		prStack    *pishopv1alpha1.PRStack
+		namespace  string
+	)
+
+	setReady := func(name string, ready bool) {
+		deployment := &appsv1.Deployment{}
+		Expect(fakeClient.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, deployment)).To(Succeed())
+		deployment.Status.ReadyReplicas = 0
+		if ready {
+			deployment.Status.ReadyReplicas = 1
+		}
+		Expect(fakeClient.Status().Update(ctx, deployment)).To(Succeed())
+	}
+
+	deploymentExists := func(name string) bool {
+		err := fakeClient.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, &appsv1.Deployment{})
+		if apierrors.IsNotFound(err) {
+			return false
+		}
+		Expect(err).ToNot(HaveOccurred())
+		return true
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		fakeClient = newTestClient().
+			WithStatusSubresource(&pishopv1alpha1.PRStack{}, &appsv1.Deployment{}).
+			Build()
+
+		reconciler = &PRStackReconciler{StackEngine: newTestEngine(fakeClient)}
+
+		namespace = reconciler.getNamespaceName("123")
+		prStack = newTestPRStack()
+		prStack.Spec.Services = []string{"graphql-service", "product-service", "order-service"}
+		prStack.Status = pishopv1alpha1.PRStackStatus{
+			Phase: PhaseDeploying,
+			MongoDB: &pishopv1alpha1.MongoDBCredentials{
+				ConnectionString: "mongodb://localhost:27017",
+			},
+			NATS:  &pishopv1alpha1.NATSConfig{ConnectionString: "nats://nats:4222", SubjectPrefix: "pishop.pr.123"},
+			Redis: &pishopv1alpha1.RedisConfig{ConnectionString: "redis://redis:6379", KeyPrefix: "pishop:pr:123:"},
+		}
+		Expect(fakeClient.Create(ctx, prStack)).To(Succeed())
+
+		ctx = ctrl.LoggerInto(ctx, zap.New(zap.UseDevMode(true)))
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	Context("deploymentWaves", func() {
+		It("should deploy the gateway after the backend services", func() {
+			waves := deploymentWaves([]string{"graphql-service", "product-service", "order-service"})
+			Expect(waves).To(Equal([][]string{
+				{DependencyMongoDB, DependencyNATS, DependencyRedis},
+				{"product-service", "order-service"},
+				{"graphql-service"},
+			}))
+		})
+
+		It("should deploy a lone gateway right after the infrastructure", func() {
+			Expect(deploymentWaves([]string{"graphql-service"})).To(HaveLen(2))
+		})
+	})
+
+	Context("handleDeployment", func() {
+		It("should wait for the infrastructure", func() {
+			_, err := reconciler.handleDeployment(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(prStack.Status.Phase).To(Equal(PhaseDeploying))
+			Expect(prStack.Status.Deployment.StartedAt).ToNot(BeNil())
+			prStack.Status.Deployment.StartedAt = nil
+			Expect(prStack.Status.Deployment).To(Equal(&pishopv1alpha1.DeploymentProgress{
+				Wave:       1,
+				TotalWaves: 3,
+				Services:   []string{DependencyMongoDB, DependencyNATS, DependencyRedis},
+				BlockedBy:  DependencyNATS,
+			}))
+			Expect(prStack.Status.Message).To(ContainSubstring("waiting for nats"))
+			Expect(deploymentExists("product-service")).To(BeFalse())
+
+			condition := apimeta.FindStatusCondition(prStack.Status.Conditions, ConditionTypeProgressing)
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.Reason).To(Equal("WaitingForDependency"))
+		})
+
+		It("should degrade the stack when a wave waits too long", func() {
+			_, err := reconciler.handleDeployment(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+			startedAt := *prStack.Status.Deployment.StartedAt
+			Expect(apimeta.IsStatusConditionTrue(prStack.Status.Conditions, ConditionTypeDegraded)).To(BeFalse())
+
+			// The wave keeps the time it started waiting
+			_, err = reconciler.handleDeployment(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prStack.Status.Deployment.StartedAt.Equal(&startedAt)).To(BeTrue())
+
+			longAgo := metav1.NewTime(time.Now().Add(-DefaultWaveTimeout - time.Minute))
+			prStack.Status.Deployment.StartedAt = &longAgo
+			_, err = reconciler.handleDeployment(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(prStack.Status.Phase).To(Equal(PhaseDeploying))
+			Expect(prStack.Status.Deployment.BlockedBy).To(Equal(DependencyNATS))
+			condition := apimeta.FindStatusCondition(prStack.Status.Conditions, ConditionTypeDegraded)
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition.Reason).To(Equal("WaveTimeout"))
+			Expect(condition.Message).To(ContainSubstring(DependencyNATS))
+
+			recorder := reconciler.Recorder.(*record.FakeRecorder)
+			var events []string
+			for len(recorder.Events) > 0 {
+				events = append(events, <-recorder.Events)
+			}
+			Expect(events).To(ContainElement(ContainSubstring(EventTypeWaveTimeout)))
+		})
+
+		It("should use the configured wave timeout", func() {
+			reconciler.WaveTimeout = time.Minute
+			_, err := reconciler.handleDeployment(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+
+			twoMinutesAgo := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+			prStack.Status.Deployment.StartedAt = &twoMinutesAgo
+			_, err = reconciler.handleDeployment(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(apimeta.IsStatusConditionTrue(prStack.Status.Conditions, ConditionTypeDegraded)).To(BeTrue())
+		})
+
+		It("should deploy the services wave by wave", func() {
+			_, err := reconciler.handleDeployment(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+			setReady("nats", true)
+			setReady("redis", true)
+
+			_, err = reconciler.handleDeployment(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deploymentExists("product-service")).To(BeTrue())
+			Expect(deploymentExists("order-service")).To(BeTrue())
+			Expect(deploymentExists("graphql-service")).To(BeFalse())
+			Expect(prStack.Status.Deployment.Wave).To(Equal(int32(2)))
+			Expect(prStack.Status.Deployment.BlockedBy).To(Equal("product-service"))
+
+			setReady("product-service", true)
+			setReady("order-service", true)
+
+			_, err = reconciler.handleDeployment(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deploymentExists("graphql-service")).To(BeTrue())
+			Expect(prStack.Status.Phase).To(Equal(PhaseRunning))
+			Expect(prStack.Status.Deployment).To(BeNil())
+			Expect(prStack.Status.Services).To(HaveLen(3))
+		})
+
+		It("should deploy inactive stacks at once", func() {
+			prStack.Spec.Active = false
+
+			_, err := reconciler.handleDeployment(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deploymentExists("graphql-service")).To(BeTrue())
+			Expect(prStack.Status.Phase).To(Equal(PhaseRunning))
+		})
+	})
+})
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// isReconcilePaused checks if an object asks the operator to leave it alone
+func isReconcilePaused(obj client.Object) bool {
+	return obj.GetAnnotations()[PauseReconcileAnnotation] == "true"
+}
+
+// reconcileDrift compares the managed objects of a running stack with their desired state.
+// Every drifted object is reported as an event and in the Drifted condition, and corrected by
+// applying the desired state again unless it carries the pause-reconcile annotation.
+func (e *StackEngine) reconcileDrift(ctx context.Context, stack Stack) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	diffs, err := e.DiffStack(ctx, stack)
+	if err != nil {
+		return fmt.Errorf("failed to detect drift: %v", err)
+	}
+
+	var corrected, paused []string
+	for _, diff := range diffs {
+		name := fmt.Sprintf("%s/%s", diff.Kind, diff.Name)
+		if diff.Kind == "Secret" {
+			// Only the names of the keys are logged, the values are credentials
+			log.Info("Drift detected", "object", name, "action", diff.Action, "paused", diff.Paused, "changedKeys", diff.SecretKeys)
+		} else {
+			log.Info("Drift detected", "object", name, "action", diff.Action, "paused", diff.Paused, "diff", diff.Diff)
+		}
+
+		if diff.Paused {
+			paused = append(paused, name)
+			e.Recorder.Event(stack.Object(), corev1.EventTypeWarning, EventTypeDriftDetected,
+				fmt.Sprintf("%s drifted from its desired state, not corrected because reconciliation is paused", name))
+			continue
+		}
+		corrected = append(corrected, name)
+		e.Recorder.Event(stack.Object(), corev1.EventTypeWarning, EventTypeDriftCorrected,
+			fmt.Sprintf("%s drifted from its desired state (%s), correcting", name, diff.Action))
+	}
+
+	if len(corrected) > 0 {
+		if err := e.applyStackObjects(ctx, stack); err != nil {
+			return fmt.Errorf("failed to correct drift: %v", err)
+		}
+	}
+
+	e.setDriftedCondition(stack, corrected, paused)
+	return nil
+}
+
+// setDriftedCondition reports the outcome of the last drift check
+func (e *StackEngine) setDriftedCondition(stack Stack, corrected, paused []string) {
+	condition := metav1.Condition{
+		Type:               ConditionTypeDrifted,
+		Status:             metav1.ConditionFalse,
+		Reason:             "InSync",
+		Message:            "All managed objects match their desired state",
+		LastTransitionTime: metav1.Now(),
+	}
+
+	switch {
+	case len(paused) > 0:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "ReconcilePaused"
+		condition.Message = fmt.Sprintf("Drifted objects with paused reconciliation: %s", strings.Join(paused, ", "))
+		if len(corrected) > 0 {
+			condition.Message += fmt.Sprintf("; corrected: %s", strings.Join(corrected, ", "))
+		}
+	case len(corrected) > 0:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "DriftCorrected"
+		condition.Message = fmt.Sprintf("Corrected drifted objects: %s", strings.Join(corrected, ", "))
+	}
+
+	e.setCondition(stack, condition)
+}
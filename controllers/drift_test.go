@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/go-logr/logr/funcr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Drift Detection", func() {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		reconciler *PRStackReconciler
+		fakeClient client.Client
+		recorder   *record.FakeRecorder
+		prStack    *pishopv1alpha1.PRStack
+		namespace  string
+	)
+
+	getDeployment := func() *appsv1.Deployment {
+		deployment := &appsv1.Deployment{}
+		Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, deployment)).To(Succeed())
+		return deployment
+	}
+
+	// editImage changes the image of the product service like a manual kubectl edit
+	editImage := func(annotations map[string]string) {
+		deployment := getDeployment()
+		deployment.Annotations = annotations
+		deployment.Spec.Template.Spec.Containers[0].Image = "ghcr.io/pilab-dev/product-service:debug"
+		Expect(fakeClient.Update(ctx, deployment)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		fakeClient = newTestClient().Build()
+
+		reconciler = &PRStackReconciler{StackEngine: newTestEngine(fakeClient)}
+		recorder = reconciler.Recorder.(*record.FakeRecorder)
+
+		namespace = reconciler.getNamespaceName("123")
+		prStack = newTestPRStack()
+		prStack.Spec.Services = []string{"product-service"}
+		prStack.Status = pishopv1alpha1.PRStackStatus{
+			Phase:   PhaseRunning,
+			MongoDB: &pishopv1alpha1.MongoDBCredentials{ConnectionString: "mongodb://localhost:27017"},
+			NATS:    &pishopv1alpha1.NATSConfig{ConnectionString: "nats://nats:4222", SubjectPrefix: "pishop.pr.123"},
+			Redis:   &pishopv1alpha1.RedisConfig{ConnectionString: "redis://redis:6379", KeyPrefix: "pishop:pr:123:"},
+		}
+
+		ctx = ctrl.LoggerInto(ctx, zap.New(zap.UseDevMode(true)))
+		Expect(reconciler.applyStackObjects(ctx, asStack(prStack))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("should report a stack in sync", func() {
+		Expect(reconciler.reconcileDrift(ctx, asStack(prStack))).To(Succeed())
+
+		condition := apimeta.FindStatusCondition(prStack.Status.Conditions, ConditionTypeDrifted)
+		Expect(condition).ToNot(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(recorder.Events).To(BeEmpty())
+	})
+
+	It("should correct objects edited by hand", func() {
+		editImage(nil)
+
+		Expect(reconciler.reconcileDrift(ctx, asStack(prStack))).To(Succeed())
+
+		Expect(getDeployment().Spec.Template.Spec.Containers[0].Image).To(Equal("ghcr.io/pilab-dev/product-service:pr-123"))
+		Expect(recorder.Events).To(Receive(And(ContainSubstring(EventTypeDriftCorrected), ContainSubstring("Deployment/product-service"))))
+
+		condition := apimeta.FindStatusCondition(prStack.Status.Conditions, ConditionTypeDrifted)
+		Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+		Expect(condition.Reason).To(Equal("DriftCorrected"))
+	})
+
+	It("should only log the changed keys of Secrets", func() {
+		secret := &corev1.Secret{}
+		Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "mongodb-secret", Namespace: namespace}, secret)).To(Succeed())
+		secret.StringData["password"] = "edited-password"
+		Expect(fakeClient.Update(ctx, secret)).To(Succeed())
+
+		var logs []string
+		ctx = ctrl.LoggerInto(ctx, funcr.New(func(prefix, args string) { logs = append(logs, args) }, funcr.Options{}))
+		Expect(reconciler.reconcileDrift(ctx, asStack(prStack))).To(Succeed())
+
+		Expect(logs).To(ContainElement(And(ContainSubstring("Secret/mongodb-secret"), ContainSubstring(`"changedKeys"=["password"]`))))
+		for _, line := range logs {
+			Expect(line).ToNot(ContainSubstring("edited-password"))
+			Expect(line).ToNot(ContainSubstring(base64.StdEncoding.EncodeToString([]byte("edited-password"))))
+		}
+	})
+
+	It("should recreate deleted objects", func() {
+		Expect(fakeClient.Delete(ctx, getDeployment())).To(Succeed())
+
+		Expect(reconciler.reconcileDrift(ctx, asStack(prStack))).To(Succeed())
+
+		getDeployment()
+		Expect(recorder.Events).To(Receive(ContainSubstring("create")))
+	})
+
+	It("should only report drift of paused objects", func() {
+		editImage(map[string]string{PauseReconcileAnnotation: "true"})
+
+		Expect(reconciler.reconcileDrift(ctx, asStack(prStack))).To(Succeed())
+
+		Expect(getDeployment().Spec.Template.Spec.Containers[0].Image).To(Equal("ghcr.io/pilab-dev/product-service:debug"))
+		Expect(recorder.Events).To(Receive(ContainSubstring(EventTypeDriftDetected)))
+
+		condition := apimeta.FindStatusCondition(prStack.Status.Conditions, ConditionTypeDrifted)
+		Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+		Expect(condition.Reason).To(Equal("ReconcilePaused"))
+		Expect(condition.Message).To(ContainSubstring("Deployment/product-service"))
+	})
+})
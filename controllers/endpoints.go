@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+// GraphQLPath is the path of the GraphQL API on the stack ingress, browsers get the
+// playground on the same path when it is enabled
+const GraphQLPath = "/graphql"
+
+// serviceURL returns the in-cluster address of a service of a stack
+func serviceURL(namespace, service string) string {
+	return fmt.Sprintf("http://%s.%s.svc.cluster.local:8080", service, namespace)
+}
+
+// updateStatusSummary reports the health of the components of a stack and the addresses it
+// is reachable at
+func (e *StackEngine) updateStatusSummary(ctx context.Context, stack Stack) {
+	log := ctrl.LoggerFrom(ctx)
+	if err := e.updateComponentConditions(ctx, stack); err != nil {
+		log.Error(err, "Failed to update component conditions")
+	}
+	if err := e.updateEndpoints(ctx, stack); err != nil {
+		log.Error(err, "Failed to update endpoints")
+	}
+}
+
+// updateEndpoints records the public URLs of a stack read from its ingress and the in-cluster
+// address of each service. The scheme of a public URL is https when the ingress has TLS for
+// its host.
+func (e *StackEngine) updateEndpoints(ctx context.Context, stack Stack) error {
+	status := stack.Status()
+	for i := range status.Services {
+		status.Services[i].URL = serviceURL(stack.Namespace(), status.Services[i].Name)
+	}
+
+	ingress := &networkingv1.Ingress{}
+	if err := e.Get(ctx, client.ObjectKey{Name: IngressServiceName, Namespace: stack.Namespace()}, ingress); err != nil {
+		if errors.IsNotFound(err) {
+			status.URL = ""
+			status.Endpoints = nil
+			return nil
+		}
+		return fmt.Errorf("failed to get ingress: %v", err)
+	}
+
+	endpoints := &pishopv1alpha1.StackEndpoints{}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host == "" {
+			continue
+		}
+		url := ingressScheme(ingress, rule.Host) + "://" + rule.Host
+		if !slices.Contains(endpoints.Public, url) {
+			endpoints.Public = append(endpoints.Public, url)
+		}
+	}
+	if len(endpoints.Public) > 0 {
+		endpoints.GraphQL = endpoints.Public[0] + GraphQLPath
+		if graphQL := GetServiceConfig(IngressServiceName, stack.ID()).GraphQLConfig; graphQL != nil && graphQL.PlaygroundEnabled == "true" {
+			endpoints.Playground = endpoints.GraphQL
+		}
+		status.URL = endpoints.Public[0]
+	}
+	status.Endpoints = endpoints
+	return nil
+}
+
+// ingressScheme returns https when the ingress terminates TLS for host
+func ingressScheme(ingress *networkingv1.Ingress, host string) string {
+	for _, tls := range ingress.Spec.TLS {
+		if slices.Contains(tls.Hosts, host) {
+			return "https"
+		}
+	}
+	return "http"
+}
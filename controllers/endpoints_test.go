@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+var _ = Describe("Endpoints", func() {
+	var (
+		ctx        context.Context
+		engine     *StackEngine
+		fakeClient client.Client
+		prStack    *pishopv1alpha1.PRStack
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		prStack = newTestPRStack()
+		prStack.Status.Services = []pishopv1alpha1.ServiceStatus{{Name: "cart-service", Status: "Running"}}
+
+		fakeClient = newTestClient().Build()
+		engine = newTestEngine(fakeClient)
+	})
+
+	applyIngress := func() {
+		ingress := engine.createIngress(asStack(prStack), testNamespace, IngressServiceName, "graphql")
+		Expect(engine.Apply(ctx, asStack(prStack), ingress)).To(Succeed())
+	}
+
+	It("should report https URLs when the ingress terminates TLS", func() {
+		engine.CertManagerIssuer = "letsencrypt"
+		applyIngress()
+
+		Expect(engine.updateEndpoints(ctx, asStack(prStack))).To(Succeed())
+
+		Expect(prStack.Status.URL).To(Equal("https://pr-123.shop.pilab.hu"))
+		Expect(prStack.Status.Endpoints).To(Equal(&pishopv1alpha1.StackEndpoints{
+			Public:     []string{"https://pr-123.shop.pilab.hu"},
+			GraphQL:    "https://pr-123.shop.pilab.hu/graphql",
+			Playground: "https://pr-123.shop.pilab.hu/graphql",
+		}))
+	})
+
+	It("should report http URLs for custom domains without TLS", func() {
+		prStack.Spec.CustomDomain = "preview.example.com"
+		applyIngress()
+
+		Expect(engine.updateEndpoints(ctx, asStack(prStack))).To(Succeed())
+
+		Expect(prStack.Status.URL).To(Equal("http://preview.example.com"))
+	})
+
+	It("should report the in-cluster address of each service", func() {
+		Expect(engine.updateEndpoints(ctx, asStack(prStack))).To(Succeed())
+
+		Expect(prStack.Status.Services[0].URL).To(Equal("http://cart-service.pr-123-shop-pilab-hu.svc.cluster.local:8080"))
+		Expect(prStack.Status.URL).To(BeEmpty())
+		Expect(prStack.Status.Endpoints).To(BeNil())
+	})
+})
@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultGitHubAPIURL is the GitHub REST API used unless a GitHub Enterprise URL is configured
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// GitHubClient is a minimal client of the GitHub REST API covering pull requests, deployments
+// and issue comments
+type GitHubClient struct {
+	// BaseURL of the REST API, DefaultGitHubAPIURL when empty
+	BaseURL string
+	// Token authenticates the requests, it needs the deployments and pull requests scopes
+	Token string
+	// HTTPClient sends the requests, a client with a 30s timeout is used when nil
+	HTTPClient *http.Client
+}
+
+// GitHubDeployment is the part of a GitHub deployment used by the operator
+type GitHubDeployment struct {
+	ID int64 `json:"id"`
+}
+
+// GitHubComment is the part of an issue comment used by the operator
+type GitHubComment struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+// do sends a request to the API and decodes the JSON response into out, if not nil
+func (c *GitHubClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultGitHubAPIURL
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// PullRequestHeadSHA returns the commit at the head of a pull request
+func (c *GitHubClient) PullRequestHeadSHA(ctx context.Context, repository, number string) (string, error) {
+	var pr struct {
+		Head struct {
+			SHA string `json:"sha"`
+		} `json:"head"`
+	}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/pulls/%s", repository, number), nil, &pr); err != nil {
+		return "", err
+	}
+	return pr.Head.SHA, nil
+}
+
+// OpenPullRequests returns the numbers of the open pull requests of a repository
+func (c *GitHubClient) OpenPullRequests(ctx context.Context, repository string) ([]string, error) {
+	var numbers []string
+	for page := 1; ; page++ {
+		var prs []struct {
+			Number int `json:"number"`
+		}
+		path := fmt.Sprintf("/repos/%s/pulls?state=open&per_page=100&page=%d", repository, page)
+		if err := c.do(ctx, http.MethodGet, path, nil, &prs); err != nil {
+			return nil, err
+		}
+		for _, pr := range prs {
+			numbers = append(numbers, strconv.Itoa(pr.Number))
+		}
+		if len(prs) < 100 {
+			return numbers, nil
+		}
+	}
+}
+
+// CreateDeployment creates a transient deployment of ref to environment. Commit status checks
+// are not required, the PR environment is deployed whatever their state.
+func (c *GitHubClient) CreateDeployment(ctx context.Context, repository, ref, environment, description string) (*GitHubDeployment, error) {
+	request := map[string]interface{}{
+		"ref":                    ref,
+		"environment":            environment,
+		"description":            description,
+		"auto_merge":             false,
+		"required_contexts":      []string{},
+		"transient_environment":  true,
+		"production_environment": false,
+	}
+	deployment := &GitHubDeployment{}
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/deployments", repository), request, deployment); err != nil {
+		return nil, err
+	}
+	return deployment, nil
+}
+
+// CreateDeploymentStatus reports the state of a deployment: in_progress, success, failure or
+// inactive. The environment URL is linked from the pull request.
+func (c *GitHubClient) CreateDeploymentStatus(ctx context.Context, repository string, deploymentID int64, state, environmentURL, description string) error {
+	request := map[string]interface{}{
+		"state":           state,
+		"environment_url": environmentURL,
+		"description":     description,
+	}
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/deployments/%d/statuses", repository, deploymentID), request, nil)
+}
+
+// ListComments returns the first 100 comments of a pull request
+func (c *GitHubClient) ListComments(ctx context.Context, repository, number string) ([]GitHubComment, error) {
+	var comments []GitHubComment
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/issues/%s/comments?per_page=100", repository, number), nil, &comments); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// CreateComment posts a comment on a pull request
+func (c *GitHubClient) CreateComment(ctx context.Context, repository, number, body string) (*GitHubComment, error) {
+	comment := &GitHubComment{}
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/issues/%s/comments", repository, number), map[string]string{"body": body}, comment); err != nil {
+		return nil, err
+	}
+	return comment, nil
+}
+
+// UpdateComment replaces the body of a comment
+func (c *GitHubClient) UpdateComment(ctx context.Context, repository string, commentID int64, body string) error {
+	return c.do(ctx, http.MethodPatch, fmt.Sprintf("/repos/%s/issues/comments/%d", repository, commentID), map[string]string{"body": body}, nil)
+}
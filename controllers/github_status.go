@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+const (
+	// GitHubCommentMarker identifies the sticky comment of the operator on a pull request
+	GitHubCommentMarker = "<!-- pishop-operator -->"
+
+	// States of GitHub deployment statuses
+	GitHubStateInProgress = "in_progress"
+	GitHubStateSuccess    = "success"
+	GitHubStateFailure    = "failure"
+	GitHubStateInactive   = "inactive"
+)
+
+// GitHubReporter publishes the state of PR stacks on their pull requests
+type GitHubReporter struct {
+	// Client of the GitHub API
+	Client *GitHubClient
+	// Repository (owner/name) of the pull requests unless set on the PRStack
+	Repository string
+	// Comments enables the sticky pull request comment
+	Comments bool
+}
+
+// deploymentState returns the GitHub deployment state of a stack phase, empty when the phase
+// is not reported
+func deploymentState(phase string) string {
+	switch phase {
+	case PhaseProvisioning, PhaseDeploying:
+		return GitHubStateInProgress
+	case PhaseRunning:
+		return GitHubStateSuccess
+	case PhaseDegraded, PhaseFailed:
+		return GitHubStateFailure
+	case PhaseInactive, PhaseCleaning, PhaseCleaned:
+		return GitHubStateInactive
+	default:
+		return ""
+	}
+}
+
+// reportToGitHub publishes a GitHub deployment status, and updates the sticky comment, when
+// the deployment state of a PR stack or its commit changed. A deployment is created for each
+// commit. Failures are recorded as events and never fail the reconcile.
+func (r *PRStackReconciler) reportToGitHub(ctx context.Context, prStack *pishopv1alpha1.PRStack) {
+	if r.GitHub == nil {
+		return
+	}
+	repository := r.GitHub.Repository
+	var sha string
+	if prStack.Spec.GitHub != nil {
+		if prStack.Spec.GitHub.Repository != "" {
+			repository = prStack.Spec.GitHub.Repository
+		}
+		sha = prStack.Spec.GitHub.SHA
+	}
+	state := deploymentState(prStack.Status.Phase)
+	if repository == "" || state == "" {
+		return
+	}
+
+	base := prStack.DeepCopy()
+	status := prStack.Status.GitHub
+	if status == nil {
+		status = &pishopv1alpha1.GitHubStatus{}
+	}
+	shaChanged := sha != "" && sha != status.SHA
+	if state == status.State && !shaChanged {
+		return
+	}
+
+	prStack.Status.GitHub = status
+	if err := r.publishDeploymentStatus(ctx, prStack, repository, sha, state, status); err != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "Failed to report to GitHub", "prNumber", prStack.Spec.PRNumber)
+		r.Recorder.Event(prStack, corev1.EventTypeWarning, EventTypeGitHubReportFailed, err.Error())
+	}
+
+	if err := r.Status().Patch(ctx, prStack, client.MergeFrom(base)); client.IgnoreNotFound(err) != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "Failed to record GitHub status", "prNumber", prStack.Spec.PRNumber)
+	}
+}
+
+// publishDeploymentStatus creates the deployment of the commit if needed, reports its state
+// and updates the sticky comment, recording them in status
+func (r *PRStackReconciler) publishDeploymentStatus(ctx context.Context, prStack *pishopv1alpha1.PRStack, repository, sha, state string, status *pishopv1alpha1.GitHubStatus) error {
+	gh := r.GitHub.Client
+	prNumber := prStack.Spec.PRNumber
+
+	if status.DeploymentID == 0 || (sha != "" && sha != status.SHA) {
+		// Stacks that were never deployed have nothing to deactivate
+		if state == GitHubStateInactive {
+			return nil
+		}
+		if sha == "" {
+			headSHA, err := gh.PullRequestHeadSHA(ctx, repository, prNumber)
+			if err != nil {
+				return fmt.Errorf("failed to get head of PR #%s: %v", prNumber, err)
+			}
+			sha = headSHA
+		}
+		deployment, err := gh.CreateDeployment(ctx, repository, sha, fmt.Sprintf("pr-%s", prNumber), fmt.Sprintf("PR #%s environment", prNumber))
+		if err != nil {
+			return fmt.Errorf("failed to create deployment: %v", err)
+		}
+		status.DeploymentID = deployment.ID
+		status.SHA = sha
+	}
+
+	if err := gh.CreateDeploymentStatus(ctx, repository, status.DeploymentID, state, prStack.Status.URL, deploymentDescription(prStack)); err != nil {
+		return fmt.Errorf("failed to create deployment status: %v", err)
+	}
+	status.State = state
+
+	if r.GitHub.Comments {
+		commentID, err := r.upsertComment(ctx, repository, prNumber, status.CommentID, renderStackComment(prStack))
+		if err != nil {
+			return fmt.Errorf("failed to update PR comment: %v", err)
+		}
+		status.CommentID = commentID
+	}
+	return nil
+}
+
+// upsertComment updates the sticky comment of a pull request, or posts it when it does not
+// exist yet. The comment is found by its marker when its ID is not known.
+func (r *PRStackReconciler) upsertComment(ctx context.Context, repository, prNumber string, commentID int64, body string) (int64, error) {
+	gh := r.GitHub.Client
+	if commentID == 0 {
+		comments, err := gh.ListComments(ctx, repository, prNumber)
+		if err != nil {
+			return 0, err
+		}
+		for _, comment := range comments {
+			if strings.HasPrefix(comment.Body, GitHubCommentMarker) {
+				commentID = comment.ID
+				break
+			}
+		}
+	}
+
+	if commentID != 0 {
+		return commentID, gh.UpdateComment(ctx, repository, commentID, body)
+	}
+	comment, err := gh.CreateComment(ctx, repository, prNumber, body)
+	if err != nil {
+		return 0, err
+	}
+	return comment.ID, nil
+}
+
+// deploymentDescription returns the status message of a stack within the 140 characters
+// allowed for deployment status descriptions
+func deploymentDescription(prStack *pishopv1alpha1.PRStack) string {
+	description := prStack.Status.Message
+	if len(description) > 140 {
+		description = description[:137] + "..."
+	}
+	return description
+}
+
+// renderStackComment renders the sticky pull request comment with the phase, service health
+// and links of a stack
+func renderStackComment(prStack *pishopv1alpha1.PRStack) string {
+	status := prStack.Status
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n### PR environment: %s\n\n", GitHubCommentMarker, status.Phase)
+	if status.Message != "" {
+		fmt.Fprintf(&b, "%s\n\n", status.Message)
+	}
+
+	b.WriteString("| | |\n|---|---|\n")
+	if status.ReadyServices != "" {
+		fmt.Fprintf(&b, "| Ready services | %s |\n", status.ReadyServices)
+	}
+	if status.URL != "" {
+		fmt.Fprintf(&b, "| URL | %s |\n", status.URL)
+	}
+	if status.Endpoints != nil {
+		if status.Endpoints.GraphQL != "" {
+			fmt.Fprintf(&b, "| GraphQL | %s |\n", status.Endpoints.GraphQL)
+		}
+		if status.Endpoints.Playground != "" {
+			fmt.Fprintf(&b, "| Playground | %s |\n", status.Endpoints.Playground)
+		}
+	}
+	if status.GitHub != nil && status.GitHub.SHA != "" {
+		fmt.Fprintf(&b, "| Commit | %s |\n", status.GitHub.SHA)
+	}
+
+	if len(status.Services) > 0 {
+		b.WriteString("\n<details><summary>Services</summary>\n\n| Service | Status |\n|---|---|\n")
+		for _, service := range status.Services {
+			fmt.Fprintf(&b, "| %s | %s |\n", service.Name, service.Status)
+		}
+		b.WriteString("\n</details>\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,197 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+// gitHubStub is a local stand-in for the GitHub REST API recording deployments, deployment
+// statuses and comments
+type gitHubStub struct {
+	mu          sync.Mutex
+	deployments []map[string]interface{}
+	statuses    []map[string]interface{}
+	comments    map[int64]string
+	requests    []string
+}
+
+func (s *gitHubStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body map[string]interface{}
+	if r.Body != nil {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/repos/pilab-dev/pishop/pulls/123":
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"head": map[string]string{"sha": "headsha"}})
+	case r.Method == http.MethodPost && r.URL.Path == "/repos/pilab-dev/pishop/deployments":
+		s.deployments = append(s.deployments, body)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": len(s.deployments)})
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/statuses"):
+		body["path"] = r.URL.Path
+		s.statuses = append(s.statuses, body)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("{}"))
+	case r.Method == http.MethodGet && r.URL.Path == "/repos/pilab-dev/pishop/issues/123/comments":
+		var comments []GitHubComment
+		for id, text := range s.comments {
+			comments = append(comments, GitHubComment{ID: id, Body: text})
+		}
+		_ = json.NewEncoder(w).Encode(comments)
+	case r.Method == http.MethodPost && r.URL.Path == "/repos/pilab-dev/pishop/issues/123/comments":
+		id := int64(len(s.comments) + 100)
+		s.comments[id] = body["body"].(string)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(GitHubComment{ID: id, Body: s.comments[id]})
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/repos/pilab-dev/pishop/issues/comments/"):
+		var id int64
+		_ = json.Unmarshal([]byte(strings.TrimPrefix(r.URL.Path, "/repos/pilab-dev/pishop/issues/comments/")), &id)
+		s.comments[id] = body["body"].(string)
+		_, _ = w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var _ = Describe("GitHub reporting", func() {
+	var (
+		ctx        context.Context
+		reconciler *PRStackReconciler
+		fakeClient client.Client
+		stub       *gitHubStub
+		server     *httptest.Server
+		prStack    *pishopv1alpha1.PRStack
+	)
+
+	setPhase := func(phase, message string) {
+		Expect(fakeClient.Get(ctx, client.ObjectKeyFromObject(prStack), prStack)).To(Succeed())
+		prStack.Status.Phase = phase
+		prStack.Status.Message = message
+		Expect(fakeClient.Status().Update(ctx, prStack)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		prStack = newTestPRStack()
+		fakeClient = newTestClient().WithObjects(prStack).Build()
+
+		stub = &gitHubStub{comments: map[int64]string{}}
+		server = httptest.NewServer(stub)
+
+		reconciler = &PRStackReconciler{
+			StackEngine: newTestEngine(fakeClient),
+			GitHub: &GitHubReporter{
+				Client:     &GitHubClient{BaseURL: server.URL, Token: "test-token"},
+				Repository: "pilab-dev/pishop",
+				Comments:   true,
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should publish a deployment of the PR head and its statuses on transitions", func() {
+		setPhase(PhaseProvisioning, "Provisioning")
+		reconciler.reportToGitHub(ctx, prStack)
+
+		Expect(stub.deployments).To(HaveLen(1))
+		Expect(stub.deployments[0]).To(HaveKeyWithValue("ref", "headsha"))
+		Expect(stub.deployments[0]).To(HaveKeyWithValue("environment", "pr-123"))
+		Expect(stub.statuses).To(HaveLen(1))
+		Expect(stub.statuses[0]).To(HaveKeyWithValue("state", GitHubStateInProgress))
+
+		// Reconciles within the same phase publish nothing
+		reconciler.reportToGitHub(ctx, prStack)
+		Expect(stub.statuses).To(HaveLen(1))
+
+		setPhase(PhaseRunning, "Stack is running")
+		prStack.Status.URL = "https://pr-123.shop.pilab.hu"
+		reconciler.reportToGitHub(ctx, prStack)
+
+		Expect(stub.deployments).To(HaveLen(1))
+		Expect(stub.statuses).To(HaveLen(2))
+		Expect(stub.statuses[1]).To(HaveKeyWithValue("state", GitHubStateSuccess))
+		Expect(stub.statuses[1]).To(HaveKeyWithValue("environment_url", "https://pr-123.shop.pilab.hu"))
+		Expect(stub.statuses[1]).To(HaveKeyWithValue("path", "/repos/pilab-dev/pishop/deployments/1/statuses"))
+
+		updated := &pishopv1alpha1.PRStack{}
+		Expect(fakeClient.Get(ctx, client.ObjectKeyFromObject(prStack), updated)).To(Succeed())
+		Expect(updated.Status.GitHub).To(Equal(&pishopv1alpha1.GitHubStatus{
+			DeploymentID: 1,
+			SHA:          "headsha",
+			State:        GitHubStateSuccess,
+			CommentID:    100,
+		}))
+	})
+
+	It("should keep a single sticky comment up to date", func() {
+		stub.comments[42] = GitHubCommentMarker + "\nold"
+
+		setPhase(PhaseDeploying, "Deploying")
+		reconciler.reportToGitHub(ctx, prStack)
+		setPhase(PhaseFailed, "All 5 services failed to deploy")
+		reconciler.reportToGitHub(ctx, prStack)
+
+		Expect(stub.comments).To(HaveLen(1))
+		Expect(stub.comments[42]).To(ContainSubstring("PR environment: Failed"))
+		Expect(stub.comments[42]).To(ContainSubstring("All 5 services failed to deploy"))
+		Expect(prStack.Status.GitHub.State).To(Equal(GitHubStateFailure))
+	})
+
+	It("should create a deployment for each new commit", func() {
+		prStack.Spec.GitHub = &pishopv1alpha1.GitHubSpec{SHA: "first"}
+		Expect(fakeClient.Update(ctx, prStack)).To(Succeed())
+		setPhase(PhaseRunning, "Stack is running")
+		reconciler.reportToGitHub(ctx, prStack)
+
+		prStack.Spec.GitHub.SHA = "second"
+		reconciler.reportToGitHub(ctx, prStack)
+
+		Expect(stub.deployments).To(HaveLen(2))
+		Expect(stub.deployments[1]).To(HaveKeyWithValue("ref", "second"))
+		Expect(stub.requests).ToNot(ContainElement("GET /repos/pilab-dev/pishop/pulls/123"))
+	})
+
+	It("should mark the deployment inactive when the stack is scaled down", func() {
+		setPhase(PhaseRunning, "Stack is running")
+		reconciler.reportToGitHub(ctx, prStack)
+		setPhase(PhaseInactive, "Stack is inactive")
+		reconciler.reportToGitHub(ctx, prStack)
+
+		Expect(stub.statuses[len(stub.statuses)-1]).To(HaveKeyWithValue("state", GitHubStateInactive))
+	})
+
+	It("should record failed reports as events", func() {
+		reconciler.GitHub.Client.Token = "wrong"
+		setPhase(PhaseRunning, "Stack is running")
+		reconciler.reportToGitHub(ctx, prStack)
+
+		recorder := reconciler.Recorder.(*record.FakeRecorder)
+		Expect(recorder.Events).To(Receive(ContainSubstring(EventTypeGitHubReportFailed)))
+		Expect(prStack.Status.GitHub.State).To(BeEmpty())
+	})
+})
@@ -0,0 +1,330 @@
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+const (
+	// GitHubWebhookPath is the path GitHub delivers webhook events to
+	GitHubWebhookPath = "/github/webhook"
+
+	// maxGitHubPayloadSize is the largest webhook payload read, GitHub caps them at 25MB
+	maxGitHubPayloadSize = 25 << 20
+)
+
+// GitHubWebhookReceiver manages the lifecycle of PRStacks from GitHub webhook events. Opened or
+// labeled pull requests get a PRStack, new commits and published images roll it out again, and
+// closed pull requests have it deleted.
+type GitHubWebhookReceiver struct {
+	client.Client
+	// BindAddress the webhook endpoint is served on
+	BindAddress string
+	// Secret the webhook payloads are signed with
+	Secret []byte
+	// Labels opting a pull request in to a PRStack, every pull request gets one when empty
+	Labels []string
+	// Repository (owner/name) the events are accepted from, any repository when empty
+	Repository string
+}
+
+// gitHubPullRequestEvent is the part of a pull_request event used by the receiver
+type gitHubPullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Head struct {
+			SHA string `json:"sha"`
+		} `json:"head"`
+		Labels []gitHubLabel `json:"labels"`
+	} `json:"pull_request"`
+	Label      *gitHubLabel     `json:"label"`
+	Repository gitHubRepository `json:"repository"`
+}
+
+// gitHubRegistryPackageEvent is the part of a registry_package event used by the receiver
+type gitHubRegistryPackageEvent struct {
+	Action          string `json:"action"`
+	RegistryPackage struct {
+		PackageVersion struct {
+			ContainerMetadata struct {
+				Tag struct {
+					Name string `json:"name"`
+				} `json:"tag"`
+			} `json:"container_metadata"`
+		} `json:"package_version"`
+	} `json:"registry_package"`
+	Repository gitHubRepository `json:"repository"`
+}
+
+type gitHubLabel struct {
+	Name string `json:"name"`
+}
+
+type gitHubRepository struct {
+	FullName string `json:"full_name"`
+}
+
+// Start serves the webhook endpoint until the context is cancelled
+func (r *GitHubWebhookReceiver) Start(ctx context.Context) error {
+	log := ctrl.Log.WithName("github-webhook")
+
+	mux := http.NewServeMux()
+	mux.Handle(GitHubWebhookPath, r)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctrl.LoggerInto(ctx, log) },
+	}
+	listener, err := net.Listen("tcp", r.BindAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", r.BindAddress, err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Error(err, "Failed to shut down GitHub webhook server")
+		}
+	}()
+
+	log.Info("Serving GitHub webhooks", "address", listener.Addr().String(), "path", GitHubWebhookPath)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// NeedLeaderElection lets every replica of the operator receive webhooks
+func (r *GitHubWebhookReceiver) NeedLeaderElection() bool {
+	return false
+}
+
+// ServeHTTP verifies the signature of a webhook delivery and handles its event
+func (r *GitHubWebhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(req.Body, maxGitHubPayloadSize))
+	if err != nil {
+		http.Error(w, "failed to read payload", http.StatusBadRequest)
+		return
+	}
+	if !validGitHubSignature(r.Secret, payload, req.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := req.Context()
+	log := ctrl.LoggerFrom(ctx).WithValues("event", req.Header.Get("X-GitHub-Event"), "delivery", req.Header.Get("X-GitHub-Delivery"))
+	ctx = ctrl.LoggerInto(ctx, log)
+
+	switch req.Header.Get("X-GitHub-Event") {
+	case "pull_request":
+		event := &gitHubPullRequestEvent{}
+		if err := json.Unmarshal(payload, event); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		err = r.handlePullRequest(ctx, event)
+	case "registry_package":
+		event := &gitHubRegistryPackageEvent{}
+		if err := json.Unmarshal(payload, event); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		err = r.handleRegistryPackage(ctx, event)
+	}
+	if err != nil {
+		log.Error(err, "Failed to handle GitHub webhook")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validGitHubSignature checks the HMAC-SHA256 signature GitHub sends in X-Hub-Signature-256
+func validGitHubSignature(secret, payload []byte, signature string) bool {
+	hexDigest, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	digest, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hmac.Equal(digest, mac.Sum(nil))
+}
+
+// handlePullRequest creates the PRStack of an opted in pull request when it is opened or
+// labeled, rolls it out on new commits and deletes it once the pull request is closed
+func (r *GitHubWebhookReceiver) handlePullRequest(ctx context.Context, event *gitHubPullRequestEvent) error {
+	if !r.acceptsRepository(event.Repository.FullName) {
+		return nil
+	}
+	prNumber := strconv.Itoa(event.Number)
+	repository := event.Repository.FullName
+	sha := event.PullRequest.Head.SHA
+
+	switch event.Action {
+	case "opened", "reopened":
+		if !r.optedIn(event.PullRequest.Labels) {
+			return nil
+		}
+		return r.createStack(ctx, repository, prNumber, sha)
+	case "labeled":
+		if event.Label == nil || !r.optedIn([]gitHubLabel{*event.Label}) {
+			return nil
+		}
+		return r.createStack(ctx, repository, prNumber, sha)
+	case "synchronize":
+		prStack, err := r.stackOf(ctx, repository, prNumber)
+		if err != nil || prStack == nil {
+			return err
+		}
+		return r.redeployStack(ctx, prStack, sha)
+	case "closed":
+		prStack, err := r.stackOf(ctx, repository, prNumber)
+		if err != nil || prStack == nil {
+			return err
+		}
+		ctrl.LoggerFrom(ctx).Info("Deleting PRStack of closed pull request", "prNumber", prNumber)
+		return client.IgnoreNotFound(r.Delete(ctx, prStack))
+	}
+	return nil
+}
+
+// handleRegistryPackage rolls out the PRStacks running a container image tag once a new image
+// is published with that tag
+func (r *GitHubWebhookReceiver) handleRegistryPackage(ctx context.Context, event *gitHubRegistryPackageEvent) error {
+	tag := event.RegistryPackage.PackageVersion.ContainerMetadata.Tag.Name
+	if event.Action != "published" || tag == "" || !r.acceptsRepository(event.Repository.FullName) {
+		return nil
+	}
+
+	prStacks := &pishopv1alpha1.PRStackList{}
+	if err := r.List(ctx, prStacks); err != nil {
+		return fmt.Errorf("failed to list PRStacks: %v", err)
+	}
+	for i := range prStacks.Items {
+		prStack := &prStacks.Items[i]
+		if prStackImageTag(prStack) != tag || !belongsTo(prStack, event.Repository.FullName) {
+			continue
+		}
+		if err := r.redeployStack(ctx, prStack, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createStack creates the PRStack of a pull request unless it already exists
+func (r *GitHubWebhookReceiver) createStack(ctx context.Context, repository, prNumber, sha string) error {
+	now := metav1.Now()
+	prStack := &pishopv1alpha1.PRStack{
+		ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pr-%s", prNumber)},
+		Spec: pishopv1alpha1.PRStackSpec{
+			PRNumber:   prNumber,
+			Active:     true,
+			DeployedAt: &now,
+			GitHub:     &pishopv1alpha1.GitHubSpec{Repository: repository, SHA: sha},
+		},
+	}
+	if err := r.Create(ctx, prStack); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to create PRStack: %v", err)
+	}
+	ctrl.LoggerFrom(ctx).Info("Created PRStack for pull request", "prNumber", prNumber, "repository", repository)
+	return nil
+}
+
+// redeployStack bumps the deployedAt of a PRStack to roll out its services, recording the
+// deployed commit when known
+func (r *GitHubWebhookReceiver) redeployStack(ctx context.Context, prStack *pishopv1alpha1.PRStack, sha string) error {
+	base := prStack.DeepCopy()
+	now := metav1.Now()
+	prStack.Spec.DeployedAt = &now
+	if sha != "" {
+		if prStack.Spec.GitHub == nil {
+			prStack.Spec.GitHub = &pishopv1alpha1.GitHubSpec{}
+		}
+		prStack.Spec.GitHub.SHA = sha
+	}
+	if err := r.Patch(ctx, prStack, client.MergeFrom(base)); client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("failed to redeploy PRStack %s: %v", prStack.Name, err)
+	}
+	ctrl.LoggerFrom(ctx).Info("Redeploying PRStack", "prNumber", prStack.Spec.PRNumber, "sha", sha)
+	return nil
+}
+
+// stackOf returns the PRStack of a pull request, nil when there is none or it belongs to a
+// pull request of another repository
+func (r *GitHubWebhookReceiver) stackOf(ctx context.Context, repository, prNumber string) (*pishopv1alpha1.PRStack, error) {
+	prStack := &pishopv1alpha1.PRStack{}
+	if err := r.Get(ctx, client.ObjectKey{Name: fmt.Sprintf("pr-%s", prNumber)}, prStack); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get PRStack: %v", err)
+	}
+	if !belongsTo(prStack, repository) {
+		return nil, nil
+	}
+	return prStack, nil
+}
+
+// acceptsRepository reports whether events of a repository are handled
+func (r *GitHubWebhookReceiver) acceptsRepository(repository string) bool {
+	return r.Repository == "" || strings.EqualFold(r.Repository, repository)
+}
+
+// optedIn reports whether one of the labels opts a pull request in to a PRStack
+func (r *GitHubWebhookReceiver) optedIn(labels []gitHubLabel) bool {
+	if len(r.Labels) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(labels, func(label gitHubLabel) bool {
+		return slices.Contains(r.Labels, label.Name)
+	})
+}
+
+// belongsTo reports whether a PRStack was created for a pull request of repository; stacks
+// without a repository are assumed to belong to any
+func belongsTo(prStack *pishopv1alpha1.PRStack, repository string) bool {
+	if prStack.Spec.GitHub == nil || prStack.Spec.GitHub.Repository == "" {
+		return true
+	}
+	return strings.EqualFold(prStack.Spec.GitHub.Repository, repository)
+}
+
+// prStackImageTag returns the image tag the services of a PRStack run
+func prStackImageTag(prStack *pishopv1alpha1.PRStack) string {
+	if prStack.Spec.ImageTag != "" {
+		return prStack.Spec.ImageTag
+	}
+	return "pr-" + prStack.Spec.PRNumber
+}
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+var _ = Describe("GitHub webhooks", func() {
+	var (
+		ctx        context.Context
+		receiver   *GitHubWebhookReceiver
+		fakeClient client.Client
+	)
+
+	deliver := func(event string, payload interface{}, secret string) int {
+		body, err := json.Marshal(payload)
+		Expect(err).NotTo(HaveOccurred())
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+
+		req := httptest.NewRequest(http.MethodPost, GitHubWebhookPath, strings.NewReader(string(body)))
+		req.Header.Set("X-GitHub-Event", event)
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		receiver.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	pullRequest := func(action string, labels ...string) map[string]interface{} {
+		prLabels := []map[string]string{}
+		for _, label := range labels {
+			prLabels = append(prLabels, map[string]string{"name": label})
+		}
+		event := map[string]interface{}{
+			"action": action,
+			"number": 123,
+			"pull_request": map[string]interface{}{
+				"head":   map[string]string{"sha": "abc123"},
+				"labels": prLabels,
+			},
+			"repository": map[string]string{"full_name": "pilab-dev/pishop"},
+		}
+		if len(labels) > 0 {
+			event["label"] = prLabels[len(prLabels)-1]
+		}
+		return event
+	}
+
+	getStack := func() (*pishopv1alpha1.PRStack, error) {
+		prStack := &pishopv1alpha1.PRStack{}
+		return prStack, fakeClient.Get(ctx, client.ObjectKey{Name: "pr-123"}, prStack)
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		fakeClient = newTestClient().Build()
+		receiver = &GitHubWebhookReceiver{
+			Client: fakeClient,
+			Secret: []byte("webhook-secret"),
+			Labels: []string{"preview"},
+		}
+	})
+
+	It("should reject deliveries with an invalid signature", func() {
+		Expect(deliver("pull_request", pullRequest("opened", "preview"), "wrong-secret")).To(Equal(http.StatusUnauthorized))
+
+		_, err := getStack()
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should create a PRStack for pull requests opened with an opt-in label", func() {
+		Expect(deliver("pull_request", pullRequest("opened", "bug"), "webhook-secret")).To(Equal(http.StatusNoContent))
+		_, err := getStack()
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+
+		Expect(deliver("pull_request", pullRequest("labeled", "bug", "preview"), "webhook-secret")).To(Equal(http.StatusNoContent))
+
+		prStack, err := getStack()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prStack.Spec.PRNumber).To(Equal("123"))
+		Expect(prStack.Spec.Active).To(BeTrue())
+		Expect(prStack.Spec.DeployedAt).NotTo(BeNil())
+		Expect(prStack.Spec.GitHub).To(Equal(&pishopv1alpha1.GitHubSpec{Repository: "pilab-dev/pishop", SHA: "abc123"}))
+	})
+
+	It("should redeploy the PRStack on new commits and published images", func() {
+		old := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+		Expect(fakeClient.Create(ctx, &pishopv1alpha1.PRStack{
+			ObjectMeta: metav1.ObjectMeta{Name: "pr-123"},
+			Spec:       pishopv1alpha1.PRStackSpec{PRNumber: "123", Active: true, DeployedAt: &old},
+		})).To(Succeed())
+
+		Expect(deliver("pull_request", pullRequest("synchronize"), "webhook-secret")).To(Equal(http.StatusNoContent))
+
+		prStack, err := getStack()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prStack.Spec.DeployedAt.After(old.Time)).To(BeTrue())
+		Expect(prStack.Spec.GitHub.SHA).To(Equal("abc123"))
+
+		prStack.Spec.DeployedAt = &old
+		Expect(fakeClient.Update(ctx, prStack)).To(Succeed())
+		published := func(tag string) map[string]interface{} {
+			return map[string]interface{}{
+				"action": "published",
+				"registry_package": map[string]interface{}{
+					"package_version": map[string]interface{}{
+						"container_metadata": map[string]interface{}{"tag": map[string]string{"name": tag}},
+					},
+				},
+				"repository": map[string]string{"full_name": "pilab-dev/pishop"},
+			}
+		}
+
+		Expect(deliver("registry_package", published("pr-456"), "webhook-secret")).To(Equal(http.StatusNoContent))
+		prStack, _ = getStack()
+		Expect(prStack.Spec.DeployedAt.Equal(&old)).To(BeTrue())
+
+		Expect(deliver("registry_package", published("pr-123"), "webhook-secret")).To(Equal(http.StatusNoContent))
+		prStack, _ = getStack()
+		Expect(prStack.Spec.DeployedAt.After(old.Time)).To(BeTrue())
+	})
+
+	It("should delete the PRStack when the pull request is closed", func() {
+		Expect(deliver("pull_request", pullRequest("opened", "preview"), "webhook-secret")).To(Equal(http.StatusNoContent))
+		Expect(deliver("pull_request", pullRequest("closed", "preview"), "webhook-secret")).To(Equal(http.StatusNoContent))
+
+		_, err := getStack()
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should leave PRStacks of other repositories alone", func() {
+		Expect(fakeClient.Create(ctx, &pishopv1alpha1.PRStack{
+			ObjectMeta: metav1.ObjectMeta{Name: "pr-123"},
+			Spec: pishopv1alpha1.PRStackSpec{
+				PRNumber: "123",
+				GitHub:   &pishopv1alpha1.GitHubSpec{Repository: "pilab-dev/pishop-admin"},
+			},
+		})).To(Succeed())
+
+		Expect(deliver("pull_request", pullRequest("closed"), "webhook-secret")).To(Equal(http.StatusNoContent))
+
+		_, err := getStack()
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
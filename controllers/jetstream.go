@@ -0,0 +1,411 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// JetStreamPVCName is the PVC backing JetStream of the dedicated NATS server
+	JetStreamPVCName = "nats-jetstream"
+)
+
+// getJetStreamSpec returns the JetStream configuration of a stack, or nil if none is set
+func getJetStreamSpec(stack Stack) *pishopv1alpha1.JetStreamSpec {
+	if stack.Spec().NATS == nil {
+		return nil
+	}
+	return stack.Spec().NATS.JetStream
+}
+
+// hasJetStreamStorage returns true if JetStream of the dedicated NATS server is kept on a PVC
+func hasJetStreamStorage(stack Stack) bool {
+	jetStream := getJetStreamSpec(stack)
+	return !isSharedNATS(stack) && jetStream != nil && jetStream.StorageSize != ""
+}
+
+// hasJetStreamStreams returns true if the stack declares JetStream streams
+func hasJetStreamStreams(stack Stack) bool {
+	jetStream := getJetStreamSpec(stack)
+	return jetStream != nil && len(jetStream.Streams) > 0
+}
+
+// ensureJetStreamPVC creates the JetStream PVC of the dedicated NATS server. An existing PVC is
+// left untouched so streams survive scale-downs and changes of the requested size.
+func (e *StackEngine) ensureJetStreamPVC(ctx context.Context, stack Stack, namespace string) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	jetStream := getJetStreamSpec(stack)
+	quantity, err := resource.ParseQuantity(jetStream.StorageSize)
+	if err != nil {
+		return fmt.Errorf("invalid JetStream storage size %s: %v", jetStream.StorageSize, err)
+	}
+
+	existingPVC := &corev1.PersistentVolumeClaim{}
+	err = e.Get(ctx, client.ObjectKey{Name: JetStreamPVCName, Namespace: namespace}, existingPVC)
+	if err == nil {
+		log.Info("JetStream PVC already exists", "pvc", JetStreamPVCName)
+		return e.releaseObject(ctx, stack, existingPVC)
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get JetStream PVC: %v", err)
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      JetStreamPVCName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app": "nats",
+				"pr":  stack.ID(),
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				corev1.ReadWriteOnce,
+			},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: quantity,
+				},
+			},
+		},
+	}
+	if jetStream.StorageClass != "" {
+		pvc.Spec.StorageClassName = &jetStream.StorageClass
+	}
+
+	if err := e.Create(ctx, pvc); err != nil {
+		return fmt.Errorf("failed to create JetStream PVC: %v", err)
+	}
+
+	log.Info("JetStream PVC created", "pvc", JetStreamPVCName, "size", jetStream.StorageSize)
+	return nil
+}
+
+// isNATSReady returns true once the NATS server of a stack accepts connections.
+// The shared NATS server is managed outside the operator and always considered ready.
+func (e *StackEngine) isNATSReady(ctx context.Context, stack Stack, namespace string) (bool, error) {
+	if isSharedNATS(stack) {
+		return true, nil
+	}
+
+	deployment := &appsv1.Deployment{}
+	if err := e.Get(ctx, client.ObjectKey{Name: "nats", Namespace: namespace}, deployment); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get NATS deployment: %v", err)
+	}
+
+	return deployment.Status.ReadyReplicas > 0, nil
+}
+
+// connectStackNATS connects to the NATS server of a stack with access to its JetStream account
+func (e *StackEngine) connectStackNATS(ctx context.Context, stack Stack) (*nats.Conn, error) {
+	namespaceName := stack.Namespace()
+
+	if isSharedNATS(stack) {
+		accountKey, err := e.getNATSAccountKey(ctx, stack)
+		if err != nil {
+			return nil, err
+		}
+		if accountKey == nil {
+			return nil, fmt.Errorf("NATS account key of the stack not found")
+		}
+
+		natsURL := e.getSharedNATSURL(stack)
+		if natsURL == "" {
+			return nil, fmt.Errorf("shared NATS URL is not configured")
+		}
+		return connectNATSAccount(natsURL, accountKey, "pishop-operator-streams")
+	}
+
+	natsURL := fmt.Sprintf("nats://nats.%s.svc.cluster.local:4222", namespaceName)
+	if stack.Status().NATS != nil && stack.Status().NATS.ConnectionString != "" {
+		natsURL = stack.Status().NATS.ConnectionString
+	}
+
+	nc, err := nats.Connect(natsURL,
+		nats.Name("pishop-operator"),
+		nats.Timeout(natsRequestTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %v", err)
+	}
+	return nc, nil
+}
+
+// prefixNATSSubject places a subject relative to the PR under the PR subject prefix
+func prefixNATSSubject(subjectPrefix, subject string) string {
+	return subjectPrefix + "." + strings.TrimPrefix(subject, ".")
+}
+
+// buildStreamConfig translates a stream definition into the JetStream stream configuration.
+// Unset limits use the server's representation of "unlimited" so they compare equal to the
+// configuration reported by the server.
+func buildStreamConfig(stream pishopv1alpha1.StreamSpec, subjectPrefix string) jetstream.StreamConfig {
+	config := jetstream.StreamConfig{
+		Name:      stream.Name,
+		Storage:   jetstream.FileStorage,
+		Retention: jetstream.LimitsPolicy,
+		MaxBytes:  -1,
+		MaxMsgs:   -1,
+	}
+
+	for _, subject := range stream.Subjects {
+		config.Subjects = append(config.Subjects, prefixNATSSubject(subjectPrefix, subject))
+	}
+
+	if stream.Storage == "memory" {
+		config.Storage = jetstream.MemoryStorage
+	}
+
+	switch stream.Retention {
+	case "interest":
+		config.Retention = jetstream.InterestPolicy
+	case "workqueue":
+		config.Retention = jetstream.WorkQueuePolicy
+	}
+
+	if stream.MaxAge != nil {
+		config.MaxAge = stream.MaxAge.Duration
+	}
+	if stream.MaxBytes > 0 {
+		config.MaxBytes = stream.MaxBytes
+	}
+	if stream.MaxMsgs > 0 {
+		config.MaxMsgs = stream.MaxMsgs
+	}
+
+	return config
+}
+
+// buildConsumerConfig translates a consumer definition into a durable JetStream consumer configuration
+func buildConsumerConfig(consumer pishopv1alpha1.ConsumerSpec, subjectPrefix string) jetstream.ConsumerConfig {
+	config := jetstream.ConsumerConfig{
+		Durable:       consumer.Name,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		MaxDeliver:    -1,
+	}
+
+	if consumer.FilterSubject != "" {
+		config.FilterSubject = prefixNATSSubject(subjectPrefix, consumer.FilterSubject)
+	}
+
+	switch consumer.DeliverPolicy {
+	case "new":
+		config.DeliverPolicy = jetstream.DeliverNewPolicy
+	case "last":
+		config.DeliverPolicy = jetstream.DeliverLastPolicy
+	}
+
+	switch consumer.AckPolicy {
+	case "none":
+		config.AckPolicy = jetstream.AckNonePolicy
+	case "all":
+		config.AckPolicy = jetstream.AckAllPolicy
+	}
+
+	if consumer.AckWait != nil {
+		config.AckWait = consumer.AckWait.Duration
+	}
+	if consumer.MaxDeliver > 0 {
+		config.MaxDeliver = consumer.MaxDeliver
+	}
+
+	return config
+}
+
+// streamConfigDrifted returns true if the server's stream configuration differs from the declared one
+func streamConfigDrifted(current, desired jetstream.StreamConfig) bool {
+	currentSubjects := slices.Clone(current.Subjects)
+	desiredSubjects := slices.Clone(desired.Subjects)
+	slices.Sort(currentSubjects)
+	slices.Sort(desiredSubjects)
+
+	return !slices.Equal(currentSubjects, desiredSubjects) ||
+		current.Storage != desired.Storage ||
+		current.Retention != desired.Retention ||
+		current.MaxAge != desired.MaxAge ||
+		current.MaxBytes != desired.MaxBytes ||
+		current.MaxMsgs != desired.MaxMsgs
+}
+
+// consumerConfigDrifted returns true if the server's consumer configuration differs from the declared one.
+// AckWait is only compared when declared, as the server fills in its own default otherwise.
+func consumerConfigDrifted(current, desired jetstream.ConsumerConfig) bool {
+	return current.FilterSubject != desired.FilterSubject ||
+		current.DeliverPolicy != desired.DeliverPolicy ||
+		current.AckPolicy != desired.AckPolicy ||
+		current.MaxDeliver != desired.MaxDeliver ||
+		(desired.AckWait != 0 && current.AckWait != desired.AckWait)
+}
+
+// keepImmutableStreamFields returns the declared stream configuration with the fields the server
+// cannot change on an existing stream taken from its current configuration, and the names of
+// the declared fields that differ from the current ones
+func keepImmutableStreamFields(current, desired jetstream.StreamConfig) (jetstream.StreamConfig, []string) {
+	var ignored []string
+	if current.Storage != desired.Storage {
+		ignored = append(ignored, "storage")
+		desired.Storage = current.Storage
+	}
+	if current.Retention != desired.Retention {
+		ignored = append(ignored, "retention")
+		desired.Retention = current.Retention
+	}
+	return desired, ignored
+}
+
+// keepImmutableConsumerFields returns the declared consumer configuration with the fields the
+// server cannot change on an existing consumer taken from its current configuration, and the
+// names of the declared fields that differ from the current ones
+func keepImmutableConsumerFields(current, desired jetstream.ConsumerConfig) (jetstream.ConsumerConfig, []string) {
+	var ignored []string
+	if current.DeliverPolicy != desired.DeliverPolicy {
+		ignored = append(ignored, "deliverPolicy")
+		desired.DeliverPolicy = current.DeliverPolicy
+	}
+	if current.AckPolicy != desired.AckPolicy {
+		ignored = append(ignored, "ackPolicy")
+		desired.AckPolicy = current.AckPolicy
+	}
+	return desired, ignored
+}
+
+// getDeclaredStreams returns the streams of a stack whose owning service is deployed
+func getDeclaredStreams(stack Stack) []pishopv1alpha1.StreamSpec {
+	jetStream := getJetStreamSpec(stack)
+	if jetStream == nil {
+		return nil
+	}
+
+	services := stack.Services()
+	var streams []pishopv1alpha1.StreamSpec
+	for _, stream := range jetStream.Streams {
+		if stream.Service != "" && !containsString(services, stream.Service) {
+			continue
+		}
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// reconcileJetStreamStreams creates the declared streams and consumers and corrects drifted ones.
+// Streams and consumers that are not declared are never deleted, so data created by services is kept.
+// Changes to fields the server cannot update are reported and otherwise ignored, as recreating
+// a stream would drop its messages.
+func (e *StackEngine) reconcileJetStreamStreams(ctx context.Context, stack Stack) error {
+	streams := getDeclaredStreams(stack)
+	if len(streams) == 0 {
+		return nil
+	}
+
+	nc, err := e.connectStackNATS(ctx, stack)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, natsRequestTimeout)
+	defer cancel()
+
+	subjectPrefix := stack.Naming().NATSSubjectPrefix(stack.ID())
+	var names []string
+	for _, stream := range streams {
+		if err := e.reconcileJetStreamStream(requestCtx, js, stack, stream, subjectPrefix); err != nil {
+			return err
+		}
+		names = append(names, stream.Name)
+	}
+
+	if stack.Status().NATS == nil {
+		stack.Status().NATS = &pishopv1alpha1.NATSConfig{SubjectPrefix: subjectPrefix}
+	}
+	stack.Status().NATS.Streams = names
+	return nil
+}
+
+// reconcileJetStreamStream creates or updates a single stream and its consumers
+func (e *StackEngine) reconcileJetStreamStream(ctx context.Context, js jetstream.JetStream, stack Stack, stream pishopv1alpha1.StreamSpec, subjectPrefix string) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	desired := buildStreamConfig(stream, subjectPrefix)
+	existing, err := js.Stream(ctx, stream.Name)
+	switch {
+	case errors.Is(err, jetstream.ErrStreamNotFound):
+		if _, err := js.CreateStream(ctx, desired); err != nil {
+			return fmt.Errorf("failed to create JetStream stream %s: %v", stream.Name, err)
+		}
+		log.Info("Created JetStream stream", "stream", stream.Name)
+	case err != nil:
+		return fmt.Errorf("failed to get JetStream stream %s: %v", stream.Name, err)
+	default:
+		current := existing.CachedInfo().Config
+		desired, ignored := keepImmutableStreamFields(current, desired)
+		if len(ignored) > 0 {
+			log.Info("Ignoring changes to immutable fields of JetStream stream", "stream", stream.Name, "fields", ignored)
+			e.Recorder.Event(stack.Object(), corev1.EventTypeWarning, EventTypeStreamChangeIgnored,
+				fmt.Sprintf("JetStream stream %s keeps its %s, they can only change when the stream is recreated", stream.Name, strings.Join(ignored, ", ")))
+		}
+		if streamConfigDrifted(current, desired) {
+			if _, err := js.UpdateStream(ctx, desired); err != nil {
+				return fmt.Errorf("failed to update JetStream stream %s: %v", stream.Name, err)
+			}
+			log.Info("Corrected drifted JetStream stream", "stream", stream.Name)
+			e.Recorder.Event(stack.Object(), corev1.EventTypeNormal, EventTypeStreamUpdated, fmt.Sprintf("Corrected drifted JetStream stream %s", stream.Name))
+		}
+	}
+
+	for _, consumer := range stream.Consumers {
+		desired := buildConsumerConfig(consumer, subjectPrefix)
+		existing, err := js.Consumer(ctx, stream.Name, consumer.Name)
+		switch {
+		case errors.Is(err, jetstream.ErrConsumerNotFound):
+			if _, err := js.CreateConsumer(ctx, stream.Name, desired); err != nil {
+				return fmt.Errorf("failed to create JetStream consumer %s/%s: %v", stream.Name, consumer.Name, err)
+			}
+			log.Info("Created JetStream consumer", "stream", stream.Name, "consumer", consumer.Name)
+		case err != nil:
+			return fmt.Errorf("failed to get JetStream consumer %s/%s: %v", stream.Name, consumer.Name, err)
+		default:
+			current := existing.CachedInfo().Config
+			desired, ignored := keepImmutableConsumerFields(current, desired)
+			if len(ignored) > 0 {
+				log.Info("Ignoring changes to immutable fields of JetStream consumer", "stream", stream.Name, "consumer", consumer.Name, "fields", ignored)
+				e.Recorder.Event(stack.Object(), corev1.EventTypeWarning, EventTypeStreamChangeIgnored,
+					fmt.Sprintf("JetStream consumer %s/%s keeps its %s, they can only change when the consumer is recreated", stream.Name, consumer.Name, strings.Join(ignored, ", ")))
+			}
+			if consumerConfigDrifted(current, desired) {
+				if _, err := js.UpdateConsumer(ctx, stream.Name, desired); err != nil {
+					return fmt.Errorf("failed to update JetStream consumer %s/%s: %v", stream.Name, consumer.Name, err)
+				}
+				log.Info("Corrected drifted JetStream consumer", "stream", stream.Name, "consumer", consumer.Name)
+				e.Recorder.Event(stack.Object(), corev1.EventTypeNormal, EventTypeStreamUpdated, fmt.Sprintf("Corrected drifted JetStream consumer %s/%s", stream.Name, consumer.Name))
+			}
+		}
+	}
+
+	return nil
+}
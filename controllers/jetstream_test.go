@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("JetStream", func() {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		reconciler *PRStackReconciler
+		fakeClient client.Client
+		prStack    *pishopv1alpha1.PRStack
+		namespace  string
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		fakeClient = newTestClient().Build()
+
+		reconciler = &PRStackReconciler{StackEngine: newTestEngine(fakeClient)}
+
+		namespace = reconciler.getNamespaceName("123")
+		prStack = newTestPRStack()
+		prStack.Spec.NATS = &pishopv1alpha1.NATSSpec{
+			JetStream: &pishopv1alpha1.JetStreamSpec{
+				StorageSize: "1Gi",
+				Streams: []pishopv1alpha1.StreamSpec{
+					{
+						Name:     "ORDERS",
+						Subjects: []string{"orders.>"},
+						Consumers: []pishopv1alpha1.ConsumerSpec{
+							{Name: "order-processor", FilterSubject: "orders.created"},
+						},
+					},
+					{
+						Name:     "EMAILS",
+						Service:  "notification-service",
+						Subjects: []string{"emails.>"},
+					},
+				},
+			},
+		}
+
+		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	Context("stream configuration", func() {
+		It("should place subjects under the PR prefix", func() {
+			config := buildStreamConfig(prStack.Spec.NATS.JetStream.Streams[0], "pishop.pr.123")
+			Expect(config.Name).To(Equal("ORDERS"))
+			Expect(config.Subjects).To(Equal([]string{"pishop.pr.123.orders.>"}))
+			Expect(config.Storage).To(Equal(jetstream.FileStorage))
+			Expect(config.Retention).To(Equal(jetstream.LimitsPolicy))
+			Expect(config.MaxBytes).To(Equal(int64(-1)))
+			Expect(config.MaxMsgs).To(Equal(int64(-1)))
+		})
+
+		It("should translate storage, retention and limits", func() {
+			config := buildStreamConfig(pishopv1alpha1.StreamSpec{
+				Name:      "JOBS",
+				Subjects:  []string{"jobs.*"},
+				Storage:   "memory",
+				Retention: "workqueue",
+				MaxAge:    &metav1.Duration{Duration: 24 * time.Hour},
+				MaxMsgs:   1000,
+			}, "pishop.pr.123")
+			Expect(config.Storage).To(Equal(jetstream.MemoryStorage))
+			Expect(config.Retention).To(Equal(jetstream.WorkQueuePolicy))
+			Expect(config.MaxAge).To(Equal(24 * time.Hour))
+			Expect(config.MaxMsgs).To(Equal(int64(1000)))
+		})
+
+		It("should build durable consumers", func() {
+			config := buildConsumerConfig(pishopv1alpha1.ConsumerSpec{
+				Name:          "order-processor",
+				FilterSubject: "orders.created",
+				DeliverPolicy: "new",
+				AckWait:       &metav1.Duration{Duration: time.Minute},
+				MaxDeliver:    5,
+			}, "pishop.pr.123")
+			Expect(config.Durable).To(Equal("order-processor"))
+			Expect(config.FilterSubject).To(Equal("pishop.pr.123.orders.created"))
+			Expect(config.DeliverPolicy).To(Equal(jetstream.DeliverNewPolicy))
+			Expect(config.AckPolicy).To(Equal(jetstream.AckExplicitPolicy))
+			Expect(config.AckWait).To(Equal(time.Minute))
+			Expect(config.MaxDeliver).To(Equal(5))
+		})
+	})
+
+	Context("drift detection", func() {
+		It("should ignore subject order", func() {
+			desired := buildStreamConfig(pishopv1alpha1.StreamSpec{Name: "ORDERS", Subjects: []string{"a", "b"}}, "p")
+			current := desired
+			current.Subjects = []string{"p.b", "p.a"}
+			Expect(streamConfigDrifted(current, desired)).To(BeFalse())
+		})
+
+		It("should detect changed stream limits", func() {
+			desired := buildStreamConfig(prStack.Spec.NATS.JetStream.Streams[0], "pishop.pr.123")
+			current := desired
+			current.MaxAge = time.Hour
+			Expect(streamConfigDrifted(current, desired)).To(BeTrue())
+		})
+
+		It("should only compare AckWait when declared", func() {
+			desired := buildConsumerConfig(pishopv1alpha1.ConsumerSpec{Name: "c"}, "p")
+			current := desired
+			current.AckWait = 30 * time.Second
+			Expect(consumerConfigDrifted(current, desired)).To(BeFalse())
+
+			current.AckPolicy = jetstream.AckNonePolicy
+			Expect(consumerConfigDrifted(current, desired)).To(BeTrue())
+		})
+
+		It("should keep the immutable fields of existing streams", func() {
+			current := buildStreamConfig(prStack.Spec.NATS.JetStream.Streams[0], "pishop.pr.123")
+			desired := current
+			desired.Storage = jetstream.MemoryStorage
+			desired.Retention = jetstream.WorkQueuePolicy
+
+			update, ignored := keepImmutableStreamFields(current, desired)
+			Expect(ignored).To(Equal([]string{"storage", "retention"}))
+			Expect(update.Storage).To(Equal(current.Storage))
+			Expect(update.Retention).To(Equal(current.Retention))
+			Expect(streamConfigDrifted(current, update)).To(BeFalse())
+
+			desired.MaxAge = time.Hour
+			update, _ = keepImmutableStreamFields(current, desired)
+			Expect(streamConfigDrifted(current, update)).To(BeTrue())
+			Expect(update.MaxAge).To(Equal(time.Hour))
+		})
+
+		It("should keep the immutable fields of existing consumers", func() {
+			current := buildConsumerConfig(pishopv1alpha1.ConsumerSpec{Name: "c"}, "p")
+			desired := current
+			desired.DeliverPolicy = jetstream.DeliverNewPolicy
+			desired.AckPolicy = jetstream.AckNonePolicy
+
+			update, ignored := keepImmutableConsumerFields(current, desired)
+			Expect(ignored).To(Equal([]string{"deliverPolicy", "ackPolicy"}))
+			Expect(consumerConfigDrifted(current, update)).To(BeFalse())
+
+			_, ignored = keepImmutableConsumerFields(current, current)
+			Expect(ignored).To(BeEmpty())
+		})
+	})
+
+	Context("getDeclaredStreams", func() {
+		It("should skip streams of services that are not deployed", func() {
+			Expect(getDeclaredStreams(asStack(prStack))).To(HaveLen(2))
+
+			prStack.Spec.Services = []string{"order-service"}
+			streams := getDeclaredStreams(asStack(prStack))
+			Expect(streams).To(HaveLen(1))
+			Expect(streams[0].Name).To(Equal("ORDERS"))
+		})
+	})
+
+	Context("persistent storage", func() {
+		It("should back the NATS deployment with a PVC", func() {
+			prStack.Spec.NATS.JetStream.StorageClass = "fast"
+			Expect(reconciler.createNATSResources(ctx, asStack(prStack), namespace)).To(Succeed())
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: JetStreamPVCName, Namespace: namespace}, pvc)).To(Succeed())
+			storage := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+			Expect(storage.String()).To(Equal("1Gi"))
+			Expect(*pvc.Spec.StorageClassName).To(Equal("fast"))
+
+			deployment := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "nats", Namespace: namespace}, deployment)).To(Succeed())
+			Expect(deployment.Spec.Strategy.Type).To(Equal(appsv1.RecreateDeploymentStrategyType))
+			Expect(deployment.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal(JetStreamPVCName))
+		})
+
+		It("should keep the emptyDir without a storage size", func() {
+			prStack.Spec.NATS.JetStream.StorageSize = ""
+			Expect(reconciler.createNATSResources(ctx, asStack(prStack), namespace)).To(Succeed())
+
+			deployment := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "nats", Namespace: namespace}, deployment)).To(Succeed())
+			Expect(deployment.Spec.Template.Spec.Volumes[0].EmptyDir).ToNot(BeNil())
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: JetStreamPVCName, Namespace: namespace}, pvc)).ToNot(Succeed())
+		})
+
+		It("should not resize an existing PVC", func() {
+			Expect(reconciler.createNATSResources(ctx, asStack(prStack), namespace)).To(Succeed())
+			prStack.Spec.NATS.JetStream.StorageSize = "5Gi"
+			Expect(reconciler.createNATSResources(ctx, asStack(prStack), namespace)).To(Succeed())
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: JetStreamPVCName, Namespace: namespace}, pvc)).To(Succeed())
+			storage := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+			Expect(storage.String()).To(Equal("1Gi"))
+		})
+	})
+
+	Context("deployment", func() {
+		It("should wait for NATS before creating streams", func() {
+			prStack.Status.Phase = PhaseDeploying
+			prStack.Status.MongoDB = &pishopv1alpha1.MongoDBCredentials{ConnectionString: "mongodb://localhost:27017"}
+			prStack.Status.NATS = &pishopv1alpha1.NATSConfig{ConnectionString: "nats://nats." + namespace + ".svc.cluster.local:4222", SubjectPrefix: "pishop.pr.123"}
+			prStack.Status.Redis = &pishopv1alpha1.RedisConfig{ConnectionString: "redis://redis." + namespace + ".svc.cluster.local:6379", KeyPrefix: "pishop:pr:123:"}
+			Expect(fakeClient.Create(ctx, prStack)).To(Succeed())
+
+			result, err := reconciler.handleDeployment(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(RequeueIntervalShort))
+			Expect(prStack.Status.Message).To(Equal("Waiting for NATS to become ready"))
+			Expect(prStack.Status.Phase).To(Equal(PhaseDeploying))
+		})
+
+		It("should report NATS ready once a replica is ready", func() {
+			Expect(reconciler.createNATSResources(ctx, asStack(prStack), namespace)).To(Succeed())
+
+			ready, err := reconciler.isNATSReady(ctx, asStack(prStack), namespace)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ready).To(BeFalse())
+
+			deployment := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "nats", Namespace: namespace}, deployment)).To(Succeed())
+			deployment.Status.ReadyReplicas = 1
+			Expect(fakeClient.Status().Update(ctx, deployment)).To(Succeed())
+
+			ready, err = reconciler.isNATSReady(ctx, asStack(prStack), namespace)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ready).To(BeTrue())
+		})
+	})
+})
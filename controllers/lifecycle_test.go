@@ -37,17 +37,18 @@ var _ = Describe("Lifecycle Management Tests", func() {
 
 		fakeClient = fake.NewClientBuilder().
 			WithScheme(scheme).
+			WithInterceptorFuncs(serverSideApply).
 			WithStatusSubresource(&pishopv1alpha1.PRStack{}).
 			Build()
 
-		reconciler = &PRStackReconciler{
+		reconciler = &PRStackReconciler{StackEngine: &StackEngine{
 			Client:        fakeClient,
 			Scheme:        scheme,
 			MongoURI:      "mongodb://localhost:27017",
 			MongoUsername: "admin",
 			MongoPassword: "password",
 			BaseDomain:    "shop.pilab.hu",
-		}
+		}}
 
 		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 	})
@@ -128,7 +129,7 @@ var _ = Describe("Lifecycle Management Tests", func() {
 					DeployedAt: nil,
 				},
 			}
-			Expect(reconciler.shouldRolloutDeployments(prStack)).To(BeFalse())
+			Expect(reconciler.shouldRolloutDeployments(asStack(prStack))).To(BeFalse())
 		})
 
 		It("should return true when lastDeployedAt is nil", func() {
@@ -141,7 +142,7 @@ var _ = Describe("Lifecycle Management Tests", func() {
 					LastDeployedAt: nil,
 				},
 			}
-			Expect(reconciler.shouldRolloutDeployments(prStack)).To(BeTrue())
+			Expect(reconciler.shouldRolloutDeployments(asStack(prStack))).To(BeTrue())
 		})
 
 		It("should return false when deployedAt equals lastDeployedAt", func() {
@@ -154,7 +155,7 @@ var _ = Describe("Lifecycle Management Tests", func() {
 					LastDeployedAt: &now,
 				},
 			}
-			Expect(reconciler.shouldRolloutDeployments(prStack)).To(BeFalse())
+			Expect(reconciler.shouldRolloutDeployments(asStack(prStack))).To(BeFalse())
 		})
 
 		It("should return true when deployedAt differs from lastDeployedAt", func() {
@@ -168,7 +169,7 @@ var _ = Describe("Lifecycle Management Tests", func() {
 					LastDeployedAt: &oldTime,
 				},
 			}
-			Expect(reconciler.shouldRolloutDeployments(prStack)).To(BeTrue())
+			Expect(reconciler.shouldRolloutDeployments(asStack(prStack))).To(BeTrue())
 		})
 	})
 
@@ -430,7 +431,7 @@ var _ = Describe("Lifecycle Management Tests", func() {
 				},
 			}
 
-			err := reconciler.rolloutDeployments(ctx, prStack)
+			err := reconciler.rolloutDeployments(ctx, asStack(prStack))
 			Expect(err).ToNot(HaveOccurred())
 		})
 
@@ -474,7 +475,7 @@ var _ = Describe("Lifecycle Management Tests", func() {
 			}
 
 			// Use the correct namespace for rollout
-			err := reconciler.rolloutDeployments(ctx, prStack)
+			err := reconciler.rolloutDeployments(ctx, asStack(prStack))
 			
 			// The rollout should succeed even if no deployments match the namespace
 			Expect(err).ToNot(HaveOccurred())
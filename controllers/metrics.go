@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+// Operations reported by the stack metrics
+const (
+	OperationProvision = "provision"
+	OperationDeploy    = "deploy"
+	OperationCleanup   = "cleanup"
+)
+
+var (
+	// stackOperationDuration is the time taken to provision, deploy or clean up a component
+	// of a stack: MongoDB, NATS, Redis or a service
+	stackOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pishop_stack_operation_duration_seconds",
+		Help:    "Duration of provisioning, deploying and cleaning up stack components.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"kind", "operation", "component"})
+
+	// stackOperationFailures counts the failed operations on a component of a stack
+	stackOperationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pishop_stack_operation_failures_total",
+		Help: "Failed provisioning, deployment and cleanup operations on stack components.",
+	}, []string{"kind", "operation", "component"})
+
+	// stackTimeToRunning is the time from the creation of a stack until it first runs
+	stackTimeToRunning = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pishop_stack_time_to_running_seconds",
+		Help:    "Time from the creation of a stack until all its services are running.",
+		Buckets: []float64{30, 60, 120, 180, 300, 450, 600, 900, 1200, 1800, 3600},
+	}, []string{"kind"})
+
+	// backupsTotal counts the finished backup jobs by result. Stacks come and go with pull
+	// requests, so they are not a label; the per-stack backups are reported by StackCollector.
+	backupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pishop_backups_total",
+		Help: "Finished backup jobs by result (success or failure).",
+	}, []string{"kind", "result"})
+)
+
+// RegisterMetrics registers the stack lifecycle metrics and a collector reporting the
+// stacks and their backups read with c
+func RegisterMetrics(registerer prometheus.Registerer, c client.Reader) {
+	registerer.MustRegister(
+		stackOperationDuration,
+		stackOperationFailures,
+		stackTimeToRunning,
+		backupsTotal,
+		NewStackCollector(c),
+	)
+}
+
+// stackKind returns the kind of the resource owning a stack, used as metric label
+func stackKind(stack Stack) string {
+	switch stack.Object().(type) {
+	case *pishopv1alpha1.Tenant:
+		return "Tenant"
+	default:
+		return "PRStack"
+	}
+}
+
+// timeOperation runs an operation on a component of a stack in its own span, recording its
+// duration and failure
+func timeOperation(ctx context.Context, stack Stack, operation, component string, fn func(ctx context.Context) error) error {
+	ctx, span := startSpan(ctx, fmt.Sprintf("%s %s", operation, component),
+		append(stackAttributes(stack), attribute.String("pishop.component", component))...)
+	start := time.Now()
+	err := fn(ctx)
+	endSpan(span, err)
+	stackOperationDuration.WithLabelValues(stackKind(stack), operation, component).Observe(time.Since(start).Seconds())
+	if err != nil {
+		stackOperationFailures.WithLabelValues(stackKind(stack), operation, component).Inc()
+	}
+	return err
+}
+
+// observeTimeToRunning records the time a stack took to come up the first time it runs and
+// marks it with FirstRunningAt, so later transitions to Running are not observed again. Stacks
+// that were already ready before the marker existed are only marked. Returns true if the time
+// was observed.
+func observeTimeToRunning(stack Stack) bool {
+	status := stack.Status()
+	if status.FirstRunningAt != nil {
+		return false
+	}
+
+	now := metav1.Now()
+	status.FirstRunningAt = &now
+	if status.CreatedAt == nil || apimeta.IsStatusConditionTrue(status.Conditions, ConditionTypeReady) {
+		return false
+	}
+
+	stackTimeToRunning.WithLabelValues(stackKind(stack)).Observe(now.Sub(status.CreatedAt.Time).Seconds())
+	return true
+}
+
+var (
+	stacksDesc = prometheus.NewDesc(
+		"pishop_stacks",
+		"Stacks by kind, phase and active state.",
+		[]string{"kind", "phase", "active"}, nil)
+	backupAgeDesc = prometheus.NewDesc(
+		"pishop_backup_age_seconds",
+		"Time since the last successful backup of a stack.",
+		[]string{"kind", "stack"}, nil)
+	backupSizeDesc = prometheus.NewDesc(
+		"pishop_backup_size_bytes",
+		"Size of the last successful backup of a stack.",
+		[]string{"kind", "stack"}, nil)
+)
+
+// StackCollector reports the PRStacks and Tenants by phase and their last backup. The
+// values are read from the stack status on every scrape.
+type StackCollector struct {
+	client client.Reader
+}
+
+// NewStackCollector returns a collector reading the stacks with c
+func NewStackCollector(c client.Reader) *StackCollector {
+	return &StackCollector{client: c}
+}
+
+// Describe implements prometheus.Collector
+func (c *StackCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- stacksDesc
+	ch <- backupAgeDesc
+	ch <- backupSizeDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *StackCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var stacks []Stack
+
+	prStacks := &pishopv1alpha1.PRStackList{}
+	if err := c.client.List(ctx, prStacks); err != nil {
+		ch <- prometheus.NewInvalidMetric(stacksDesc, err)
+		return
+	}
+	for i := range prStacks.Items {
+		stacks = append(stacks, asStack(&prStacks.Items[i]))
+	}
+
+	tenants := &pishopv1alpha1.TenantList{}
+	if err := c.client.List(ctx, tenants); err != nil {
+		ch <- prometheus.NewInvalidMetric(stacksDesc, err)
+		return
+	}
+	for i := range tenants.Items {
+		stacks = append(stacks, newTenantStack(&tenants.Items[i]))
+	}
+
+	type stackGroup struct{ kind, phase, active string }
+	counts := make(map[stackGroup]int)
+	for _, stack := range stacks {
+		active := "false"
+		if stack.Spec().Active {
+			active = "true"
+		}
+		counts[stackGroup{stackKind(stack), stack.Status().Phase, active}]++
+
+		backup := stack.Status().Backup
+		if backup == nil || backup.LastBackupTime == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(backupAgeDesc, prometheus.GaugeValue,
+			time.Since(backup.LastBackupTime.Time).Seconds(), stackKind(stack), stack.ID())
+		if size, err := resource.ParseQuantity(backup.LastBackupSize); err == nil {
+			ch <- prometheus.MustNewConstMetric(backupSizeDesc, prometheus.GaugeValue,
+				float64(size.Value()), stackKind(stack), stack.ID())
+		}
+	}
+
+	for group, count := range counts {
+		ch <- prometheus.MustNewConstMetric(stacksDesc, prometheus.GaugeValue, float64(count), group.kind, group.phase, group.active)
+	}
+}
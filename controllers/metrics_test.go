@@ -0,0 +1,238 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		ctx        context.Context
+		engine     *StackEngine
+		fakeClient client.Client
+	)
+
+	newPRStack := func(prNumber, phase string, active bool) *pishopv1alpha1.PRStack {
+		return &pishopv1alpha1.PRStack{
+			ObjectMeta: metav1.ObjectMeta{Name: "pr-" + prNumber},
+			Spec: pishopv1alpha1.PRStackSpec{
+				PRNumber: prNumber,
+				Active:   active,
+			},
+			Status: pishopv1alpha1.PRStackStatus{Phase: phase},
+		}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		fakeClient = newTestClient().Build()
+		engine = newTestEngine(fakeClient)
+	})
+
+	Context("timeOperation", func() {
+		It("should record durations and failures per component", func() {
+			stack := asStack(newPRStack("123", PhaseProvisioning, true))
+			failures := stackOperationFailures.WithLabelValues("PRStack", OperationProvision, "Metrics Test")
+			before := testutil.ToFloat64(failures)
+
+			Expect(timeOperation(ctx, stack, OperationProvision, "Metrics Test", func(ctx context.Context) error { return nil })).To(Succeed())
+			Expect(timeOperation(ctx, stack, OperationProvision, "Metrics Test", func(ctx context.Context) error { return fmt.Errorf("boom") })).ToNot(Succeed())
+
+			Expect(testutil.ToFloat64(failures) - before).To(Equal(1.0))
+			Expect(testutil.CollectAndCount(stackOperationDuration, "pishop_stack_operation_duration_seconds")).To(BeNumerically(">=", 1))
+		})
+
+		It("should label tenant operations with their kind", func() {
+			tenant := &pishopv1alpha1.Tenant{Spec: pishopv1alpha1.TenantSpec{TenantID: "acme"}}
+			Expect(stackKind(newTenantStack(tenant))).To(Equal("Tenant"))
+			Expect(stackKind(asStack(newPRStack("123", "", true)))).To(Equal("PRStack"))
+		})
+	})
+
+	Context("observeTimeToRunning", func() {
+		It("should only observe the first time a stack runs", func() {
+			prStack := newPRStack("123", PhaseDeploying, true)
+			created := metav1.NewTime(time.Now().Add(-time.Minute))
+			prStack.Status.CreatedAt = &created
+			stack := asStack(prStack)
+
+			Expect(observeTimeToRunning(stack)).To(BeTrue())
+			Expect(prStack.Status.FirstRunningAt).ToNot(BeNil())
+
+			// Scaled down and resumed later
+			Expect(observeTimeToRunning(stack)).To(BeFalse())
+		})
+
+		It("should only mark stacks that were ready before the marker existed", func() {
+			prStack := newPRStack("123", PhaseRunning, true)
+			created := metav1.NewTime(time.Now().Add(-24 * time.Hour))
+			prStack.Status.CreatedAt = &created
+			prStack.Status.Conditions = []metav1.Condition{{Type: ConditionTypeReady, Status: metav1.ConditionTrue}}
+
+			Expect(observeTimeToRunning(asStack(prStack))).To(BeFalse())
+			Expect(prStack.Status.FirstRunningAt).ToNot(BeNil())
+		})
+
+		It("should keep the marker of tenants", func() {
+			tenant := &pishopv1alpha1.Tenant{Spec: pishopv1alpha1.TenantSpec{TenantID: "acme"}}
+			stack := newTenantStack(tenant)
+			observeTimeToRunning(stack)
+			stack.ApplyStatus()
+			Expect(tenant.Status.FirstRunningAt).ToNot(BeNil())
+			Expect(observeTimeToRunning(newTenantStack(tenant))).To(BeFalse())
+		})
+	})
+
+	Context("StackCollector", func() {
+		It("should report stacks by phase and active state and their last backup", func() {
+			running := newPRStack("1", PhaseRunning, true)
+			running.Status.Backup = &pishopv1alpha1.BackupStatus{
+				LastBackupTime: &metav1.Time{Time: time.Now().Add(-time.Hour)},
+				LastBackupSize: "2Mi",
+			}
+			for _, obj := range []client.Object{
+				running,
+				newPRStack("2", PhaseRunning, true),
+				newPRStack("3", PhaseInactive, false),
+			} {
+				Expect(fakeClient.Create(ctx, obj)).To(Succeed())
+			}
+
+			collector := NewStackCollector(fakeClient)
+			expected := `
+# HELP pishop_stacks Stacks by kind, phase and active state.
+# TYPE pishop_stacks gauge
+pishop_stacks{active="false",kind="PRStack",phase="Inactive"} 1
+pishop_stacks{active="true",kind="PRStack",phase="Running"} 2
+# HELP pishop_backup_size_bytes Size of the last successful backup of a stack.
+# TYPE pishop_backup_size_bytes gauge
+pishop_backup_size_bytes{kind="PRStack",stack="1"} 2.097152e+06
+`
+			Expect(testutil.CollectAndCompare(collector, strings.NewReader(expected), "pishop_stacks", "pishop_backup_size_bytes")).To(Succeed())
+
+			registry := prometheus.NewRegistry()
+			Expect(registry.Register(collector)).To(Succeed())
+			families, err := registry.Gather()
+			Expect(err).ToNot(HaveOccurred())
+
+			var age float64
+			for _, family := range families {
+				if family.GetName() == "pishop_backup_age_seconds" {
+					age = family.GetMetric()[0].GetGauge().GetValue()
+				}
+			}
+			Expect(age).To(BeNumerically("~", time.Hour.Seconds(), 60))
+		})
+	})
+
+	Context("recordBackupStatus", func() {
+		var (
+			prStack *pishopv1alpha1.PRStack
+			stack   Stack
+		)
+
+		createBackupJob := func(name string, succeeded bool, completedAt time.Time, message string) {
+			job := &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              name,
+					Namespace:         stack.Namespace(),
+					Labels:            map[string]string{"app": BackupJobApp},
+					CreationTimestamp: metav1.Time{Time: completedAt.Add(-time.Minute)},
+				},
+			}
+			Expect(fakeClient.Create(ctx, job)).To(Succeed())
+
+			if succeeded {
+				job.Status.Succeeded = 1
+				job.Status.CompletionTime = &metav1.Time{Time: completedAt}
+			} else {
+				job.Status.Failed = 1
+				job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+			}
+			Expect(fakeClient.Status().Update(ctx, job)).To(Succeed())
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name + "-pod",
+					Namespace: stack.Namespace(),
+					Labels:    map[string]string{"app": BackupJobApp, "job-name": name},
+				},
+			}
+			Expect(fakeClient.Create(ctx, pod)).To(Succeed())
+			pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+				Name: "mongodb-backup",
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+					ExitCode: 0,
+					Message:  message,
+				}},
+			}}
+			Expect(fakeClient.Status().Update(ctx, pod)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			fakeClient = newTestClient().
+				WithStatusSubresource(&batchv1.Job{}, &corev1.Pod{}).
+				Build()
+			engine.Client = fakeClient
+
+			prStack = newPRStack("321", PhaseRunning, true)
+			stack = asStack(prStack)
+		})
+
+		It("should record the last backup and count finished backups once", func() {
+			createBackupJob("backup-old", true, time.Now().Add(-2*time.Hour), "pr-321-old 1024")
+			createBackupJob("backup-new", true, time.Now().Add(-time.Hour), "pr-321-new 4194304")
+			createBackupJob("backup-failed", false, time.Now(), "")
+
+			successes := backupsTotal.WithLabelValues("PRStack", "success")
+			failures := backupsTotal.WithLabelValues("PRStack", "failure")
+			successesBefore, failuresBefore := testutil.ToFloat64(successes), testutil.ToFloat64(failures)
+
+			Expect(engine.recordBackupStatus(ctx, stack)).To(Succeed())
+			Expect(engine.recordBackupStatus(ctx, stack)).To(Succeed())
+
+			Expect(testutil.ToFloat64(successes) - successesBefore).To(Equal(2.0))
+			Expect(testutil.ToFloat64(failures) - failuresBefore).To(Equal(1.0))
+
+			backup := prStack.Status.Backup
+			Expect(backup).ToNot(BeNil())
+			Expect(backup.LastBackupName).To(Equal("pr-321-new"))
+			Expect(backup.LastBackupSize).To(Equal("4Mi"))
+			Expect(backup.BackupJobs).To(HaveLen(3))
+			Expect(backup.BackupJobs[2].Status).To(Equal(BackupJobFailed))
+		})
+
+		It("should not count backups again when the status was not saved", func() {
+			createBackupJob("backup-new", true, time.Now().Add(-time.Hour), "pr-321-new 4194304")
+			successes := backupsTotal.WithLabelValues("PRStack", "success")
+
+			Expect(engine.recordBackupStatus(ctx, stack)).To(Succeed())
+			counted := testutil.ToFloat64(successes)
+
+			prStack.Status.Backup = nil
+			Expect(engine.recordBackupStatus(ctx, stack)).To(Succeed())
+
+			Expect(testutil.ToFloat64(successes)).To(Equal(counted))
+			Expect(prStack.Status.Backup.LastBackupName).To(Equal("pr-321-new"))
+		})
+
+		It("should leave the status alone without backup jobs", func() {
+			Expect(engine.recordBackupStatus(ctx, stack)).To(Succeed())
+			Expect(prStack.Status.Backup).To(BeNil())
+		})
+	})
+})
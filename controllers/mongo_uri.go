@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	mongoScheme    = "mongodb"
+	mongoSRVScheme = "mongodb+srv"
+)
+
+// mongoURIParts holds the components of a MongoDB connection string
+type mongoURIParts struct {
+	scheme   string
+	userInfo *url.Userinfo
+	hosts    string
+	options  url.Values
+}
+
+// parseMongoURI parses a MongoDB connection string, including replica set host lists
+// (mongodb://h1,h2/?replicaSet=rs) and DNS seed lists (mongodb+srv://cluster.example.com)
+func parseMongoURI(raw string) (*mongoURIParts, error) {
+	scheme, rest, found := strings.Cut(raw, "://")
+	if !found {
+		return nil, fmt.Errorf("invalid MongoDB URI: missing scheme")
+	}
+	if scheme != mongoScheme && scheme != mongoSRVScheme {
+		return nil, fmt.Errorf("invalid MongoDB URI: unsupported scheme %q", scheme)
+	}
+
+	parts := &mongoURIParts{scheme: scheme}
+
+	rest, query, _ := strings.Cut(rest, "?")
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MongoDB URI options: %v", err)
+	}
+	parts.options = options
+
+	// Credentials are everything before the last '@' (reserved characters must be escaped)
+	if at := strings.LastIndex(rest, "@"); at >= 0 {
+		userInfo, err := parseMongoUserInfo(rest[:at])
+		if err != nil {
+			return nil, err
+		}
+		parts.userInfo = userInfo
+		rest = rest[at+1:]
+	}
+
+	// Hosts end at the database path
+	hosts, _, _ := strings.Cut(rest, "/")
+	if hosts == "" {
+		return nil, fmt.Errorf("invalid MongoDB URI: missing host")
+	}
+	if scheme == mongoSRVScheme && (strings.Contains(hosts, ",") || strings.Contains(hosts, ":")) {
+		return nil, fmt.Errorf("invalid MongoDB URI: %s URIs must have a single host without port", mongoSRVScheme)
+	}
+	parts.hosts = hosts
+
+	return parts, nil
+}
+
+// parseMongoUserInfo decodes the percent-encoded user:password section of a MongoDB URI
+func parseMongoUserInfo(raw string) (*url.Userinfo, error) {
+	rawUser, rawPassword, hasPassword := strings.Cut(raw, ":")
+	user, err := url.PathUnescape(rawUser)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MongoDB URI username: %v", err)
+	}
+	if !hasPassword {
+		return url.User(user), nil
+	}
+	password, err := url.PathUnescape(rawPassword)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MongoDB URI password: %v", err)
+	}
+	return url.UserPassword(user, password), nil
+}
+
+// withCredentials returns a copy of the URI authenticating as the given user.
+// PR users are created in the admin database, so authSource is forced to admin and
+// mechanisms specific to the operator's admin user (e.g. MONGODB-X509) are dropped.
+func (p *mongoURIParts) withCredentials(user, password string) *mongoURIParts {
+	options := url.Values{}
+	for key, values := range p.options {
+		options[key] = append([]string(nil), values...)
+	}
+	options.Del("authMechanism")
+	options.Del("authMechanismProperties")
+	options.Set("authSource", "admin")
+
+	return &mongoURIParts{
+		scheme:   p.scheme,
+		userInfo: url.UserPassword(user, password),
+		hosts:    p.hosts,
+		options:  options,
+	}
+}
+
+// build assembles the connection string, optionally targeting a specific database
+func (p *mongoURIParts) build(database string) string {
+	var b strings.Builder
+	b.WriteString(p.scheme)
+	b.WriteString("://")
+	if p.userInfo != nil {
+		b.WriteString(p.userInfo.String())
+		b.WriteString("@")
+	}
+	b.WriteString(p.hosts)
+	if database != "" || len(p.options) > 0 {
+		b.WriteString("/")
+		b.WriteString(database)
+	}
+	if len(p.options) > 0 {
+		b.WriteString("?")
+		b.WriteString(p.options.Encode())
+	}
+	return b.String()
+}
+
+// getServiceMongoURI returns the base MongoDB URI services of a stack connect to.
+// Dedicated stacks use the MongoDB in their namespace and stacks provisioned on a custom
+// MongoDB use that cluster; otherwise the operator-level in-cluster service URI is used,
+// falling back to the provisioning URI.
+func (e *StackEngine) getServiceMongoURI(stack Stack) string {
+	if isDedicatedMongoDB(stack) {
+		return fmt.Sprintf("%s://%s", mongoScheme, getDedicatedMongoDBHost(stack.Namespace()))
+	}
+	if stack.Spec().MongoURI != "" {
+		return stack.Spec().MongoURI
+	}
+	if e.MongoServiceURI != "" {
+		return e.MongoServiceURI
+	}
+	return e.MongoURI
+}
+
+// getAdminMongoURI returns the URI the operator uses to manage the users and databases of a stack
+func (e *StackEngine) getAdminMongoURI(ctx context.Context, stack Stack) (string, error) {
+	if isDedicatedMongoDB(stack) {
+		return e.getDedicatedMongoDBAdminURI(ctx, stack.Namespace())
+	}
+	if stack.Spec().MongoURI != "" {
+		return stack.Spec().MongoURI, nil
+	}
+	return e.MongoURI, nil
+}
+
+// mongoConnectionString returns the service-facing connection string for the PR user
+func (e *StackEngine) mongoConnectionString(stack Stack, user, password string) (string, error) {
+	parts, err := parseMongoURI(e.getServiceMongoURI(stack))
+	if err != nil {
+		return "", err
+	}
+	return parts.withCredentials(user, password).build(""), nil
+}
+
+// mongoDatabaseURI returns the connection string targeting a specific database,
+// keeping any options of the original connection string
+func mongoDatabaseURI(connectionString, database string) string {
+	parts, err := parseMongoURI(connectionString)
+	if err != nil {
+		return fmt.Sprintf("%s/%s", connectionString, database)
+	}
+	return parts.build(database)
+}
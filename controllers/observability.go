@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// Kinds of the Prometheus Operator objects scraping the services of a stack
+const (
+	MetricsScrapingServiceMonitor = "ServiceMonitor"
+	MetricsScrapingPodMonitor     = "PodMonitor"
+
+	// MetricsMonitorName is the name of the ServiceMonitor or PodMonitor of a stack
+	MetricsMonitorName = "pishop-services"
+)
+
+// ObservabilityConfig is the operator-wide tracing, logging and metrics configuration
+// injected into the services of every stack
+type ObservabilityConfig struct {
+	// OTLPEndpoint is the OTLP collector the services export traces to, tracing is disabled
+	// when empty
+	OTLPEndpoint string
+	// SampleRate is the ratio of traces sampled by the services
+	SampleRate string
+	// LogLevel of the services
+	LogLevel string
+	// MetricsScraping is the kind of object created to scrape the services, ServiceMonitor or
+	// PodMonitor; no object is created when empty
+	MetricsScraping string
+}
+
+// configureService sets the tracing and logging configuration of a service of a stack. The
+// resource attributes identify the stack, so traces and metrics of different stacks can be
+// told apart.
+func (c ObservabilityConfig) configureService(stack Stack, sc *ServiceConfig) {
+	if c.LogLevel != "" {
+		sc.LogLevel = c.LogLevel
+	}
+	if c.SampleRate != "" {
+		sc.TracingSampleRate = c.SampleRate
+	}
+	if c.OTLPEndpoint != "" {
+		sc.TracingEnabled = "true"
+		sc.TracingEndpoint = c.OTLPEndpoint
+	}
+	sc.ResourceAttributes = resourceAttributes(stack)
+}
+
+// resourceAttributes returns the OpenTelemetry resource attributes of the services of a stack
+func resourceAttributes(stack Stack) string {
+	attributes := []string{
+		"service.namespace=" + stack.Namespace(),
+		"deployment.environment=" + stack.Naming().Environment(),
+	}
+	if stackKind(stack) == "Tenant" {
+		attributes = append(attributes, "tenant.id="+stack.ID())
+	} else {
+		attributes = append(attributes, "pr.number="+stack.ID())
+	}
+	return strings.Join(attributes, ",")
+}
+
+// monitorGVK returns the kind of a Prometheus Operator monitor
+func monitorGVK(kind string) schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: kind}
+}
+
+// ensureMetricsMonitor creates the ServiceMonitor or PodMonitor scraping the services of a
+// stack and removes the monitor of the other kind. The scraped series are labelled with the
+// PR number. Clusters without the Prometheus Operator are skipped.
+func (e *StackEngine) ensureMetricsMonitor(ctx context.Context, stack Stack, namespace string) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	for _, kind := range []string{MetricsScrapingServiceMonitor, MetricsScrapingPodMonitor} {
+		if kind == e.Observability.MetricsScraping {
+			continue
+		}
+		monitor := &unstructured.Unstructured{}
+		monitor.SetGroupVersionKind(monitorGVK(kind))
+		monitor.SetName(MetricsMonitorName)
+		monitor.SetNamespace(namespace)
+		if err := e.deleteManaged(ctx, monitor); err != nil && !meta.IsNoMatchError(err) {
+			return fmt.Errorf("failed to delete %s: %v", kind, err)
+		}
+	}
+
+	monitor := e.metricsMonitor(stack, namespace)
+	if monitor == nil {
+		return nil
+	}
+	if err := e.Apply(ctx, stack, monitor); err != nil {
+		if meta.IsNoMatchError(err) {
+			log.Info("Prometheus Operator not installed, skipping metrics scraping", "kind", monitor.GetKind())
+			return nil
+		}
+		return fmt.Errorf("failed to create %s: %v", monitor.GetKind(), err)
+	}
+	return nil
+}
+
+// metricsMonitor returns the monitor scraping the services of a stack, nil when scraping is
+// not configured
+func (e *StackEngine) metricsMonitor(stack Stack, namespace string) *unstructured.Unstructured {
+	endpoint := map[string]interface{}{
+		"port":     "http",
+		"path":     "/metrics",
+		"interval": "30s",
+	}
+	spec := map[string]interface{}{
+		"selector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{"component": "microservice"},
+		},
+	}
+
+	switch e.Observability.MetricsScraping {
+	case MetricsScrapingServiceMonitor:
+		spec["endpoints"] = []interface{}{endpoint}
+		spec["targetLabels"] = []interface{}{"pr-number"}
+	case MetricsScrapingPodMonitor:
+		spec["podMetricsEndpoints"] = []interface{}{endpoint}
+		spec["podTargetLabels"] = []interface{}{"pr-number"}
+	default:
+		return nil
+	}
+
+	monitor := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	monitor.SetGroupVersionKind(monitorGVK(e.Observability.MetricsScraping))
+	monitor.SetName(MetricsMonitorName)
+	monitor.SetNamespace(namespace)
+	monitor.SetLabels(map[string]string{
+		"environment": stack.Naming().Environment(),
+		"pr-number":   stack.ID(),
+	})
+	return monitor
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+var _ = Describe("Observability", func() {
+	var (
+		ctx     context.Context
+		engine  *StackEngine
+		prStack *pishopv1alpha1.PRStack
+	)
+
+	newEngine := func(withMonitors bool) {
+		scheme := newTestScheme()
+		if withMonitors {
+			for _, kind := range []string{MetricsScrapingServiceMonitor, MetricsScrapingPodMonitor} {
+				scheme.AddKnownTypeWithName(monitorGVK(kind), &unstructured.Unstructured{})
+				scheme.AddKnownTypeWithName(monitorGVK(kind+"List"), &unstructured.UnstructuredList{})
+			}
+		}
+
+		engine = newTestEngine(newTestClient().WithScheme(scheme).WithObjects(prStack).Build())
+	}
+
+	getMonitor := func(kind string) (*unstructured.Unstructured, error) {
+		monitor := &unstructured.Unstructured{}
+		monitor.SetGroupVersionKind(monitorGVK(kind))
+		err := engine.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: MetricsMonitorName}, monitor)
+		return monitor, err
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		prStack = newTestPRStack()
+		newEngine(true)
+	})
+
+	Context("configureService", func() {
+		It("should leave tracing disabled without an OTLP endpoint", func() {
+			config := GetServiceConfig("cart-service", "123")
+			engine.Observability.configureService(asStack(prStack), config)
+
+			Expect(config.TracingEnabled).To(Equal("false"))
+			Expect(config.TracingEndpoint).To(BeEmpty())
+		})
+
+		It("should point the services of a stack at the OTLP endpoint", func() {
+			engine.Observability = ObservabilityConfig{
+				OTLPEndpoint: "http://otel-collector.observability:4317",
+				SampleRate:   "1",
+				LogLevel:     "debug",
+			}
+			config := GetServiceConfig("cart-service", "123")
+			engine.Observability.configureService(asStack(prStack), config)
+
+			envVars := config.ToEnvVars()
+			Expect(envVars).To(ContainElements(
+				corev1.EnvVar{Name: "TRACING_ENABLED", Value: "true"},
+				corev1.EnvVar{Name: "TRACING_ENDPOINT", Value: "http://otel-collector.observability:4317"},
+				corev1.EnvVar{Name: "TRACING_SAMPLE_RATE", Value: "1"},
+				corev1.EnvVar{Name: "LOG_LEVEL", Value: "debug"},
+				corev1.EnvVar{Name: "OTEL_SERVICE_NAME", Value: "cart-service"},
+				corev1.EnvVar{Name: "OTEL_RESOURCE_ATTRIBUTES", Value: "service.namespace=pr-123-shop-pilab-hu,deployment.environment=pr,pr.number=123"},
+			))
+		})
+
+		It("should identify tenants by their ID", func() {
+			tenant := &pishopv1alpha1.Tenant{Spec: pishopv1alpha1.TenantSpec{TenantID: "acme"}}
+			Expect(resourceAttributes(newTenantStack(tenant))).To(ContainSubstring("tenant.id=acme"))
+		})
+	})
+
+	Context("ensureMetricsMonitor", func() {
+		It("should create a ServiceMonitor labelling series with the PR number", func() {
+			engine.Observability.MetricsScraping = MetricsScrapingServiceMonitor
+			Expect(engine.ensureMetricsMonitor(ctx, asStack(prStack), testNamespace)).To(Succeed())
+
+			monitor, err := getMonitor(MetricsScrapingServiceMonitor)
+			Expect(err).ToNot(HaveOccurred())
+			targetLabels, _, _ := unstructured.NestedStringSlice(monitor.Object, "spec", "targetLabels")
+			Expect(targetLabels).To(Equal([]string{"pr-number"}))
+			Expect(metav1.IsControlledBy(monitor, prStack)).To(BeTrue())
+		})
+
+		It("should replace the ServiceMonitor when switching to PodMonitors", func() {
+			engine.Observability.MetricsScraping = MetricsScrapingServiceMonitor
+			Expect(engine.ensureMetricsMonitor(ctx, asStack(prStack), testNamespace)).To(Succeed())
+
+			engine.Observability.MetricsScraping = MetricsScrapingPodMonitor
+			Expect(engine.ensureMetricsMonitor(ctx, asStack(prStack), testNamespace)).To(Succeed())
+
+			_, err := getMonitor(MetricsScrapingServiceMonitor)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+			monitor, err := getMonitor(MetricsScrapingPodMonitor)
+			Expect(err).ToNot(HaveOccurred())
+			_, found, _ := unstructured.NestedSlice(monitor.Object, "spec", "podMetricsEndpoints")
+			Expect(found).To(BeTrue())
+		})
+
+		It("should skip clusters without the Prometheus Operator", func() {
+			newEngine(false)
+			engine.Observability.MetricsScraping = MetricsScrapingPodMonitor
+			Expect(engine.ensureMetricsMonitor(ctx, asStack(prStack), testNamespace)).To(Succeed())
+		})
+	})
+})
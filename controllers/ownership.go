@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// setStackOwner makes the resource owning a stack the controller of a generated object. Changes
+// to owned objects trigger a reconcile of the stack, and the garbage collector removes them
+// when the stack is deleted.
+func (e *StackEngine) setStackOwner(stack Stack, obj client.Object) error {
+	if err := controllerutil.SetControllerReference(stack.Object(), obj, e.Client.Scheme()); err != nil {
+		return fmt.Errorf("failed to set owner of %s: %v", obj.GetName(), err)
+	}
+	return nil
+}
+
+// adoptObject sets the stack as the controller of an existing object created before owner
+// references were set. Objects controlled by another owner are left alone.
+func (e *StackEngine) adoptObject(ctx context.Context, stack Stack, obj client.Object) error {
+	if metav1.GetControllerOf(obj) != nil || e.diffs != nil {
+		return nil
+	}
+
+	if err := e.setStackOwner(stack, obj); err != nil {
+		return err
+	}
+	if err := e.Update(ctx, obj, client.FieldOwner(FieldManager)); err != nil {
+		return fmt.Errorf("failed to adopt %s: %v", obj.GetName(), err)
+	}
+	return nil
+}
+
+// releaseObject removes the stack from the owners of an object its finalizer deletes, like the
+// namespace and the data PVCs. On a foreground deletion of the stack the garbage collector would
+// delete them ahead of the final backup and cleanup. Objects owned before this are released.
+func (e *StackEngine) releaseObject(ctx context.Context, stack Stack, obj client.Object) error {
+	if e.diffs != nil {
+		return nil
+	}
+
+	var owners []metav1.OwnerReference
+	for _, owner := range obj.GetOwnerReferences() {
+		if owner.UID != stack.Object().GetUID() {
+			owners = append(owners, owner)
+		}
+	}
+	if len(owners) == len(obj.GetOwnerReferences()) {
+		return nil
+	}
+
+	obj.SetOwnerReferences(owners)
+	if err := e.Update(ctx, obj, client.FieldOwner(FieldManager)); err != nil {
+		return fmt.Errorf("failed to release %s: %v", obj.GetName(), err)
+	}
+	return nil
+}
+
+// ownedTypes are the kinds of objects generated for a stack. Controllers watch them so that
+// drift, like a deleted Deployment, is reconciled right away. The namespace and the PVCs are not
+// owned, see releaseObject.
+func ownedTypes() []client.Object {
+	return []client.Object{
+		&appsv1.Deployment{},
+		&appsv1.StatefulSet{},
+		&corev1.Service{},
+		&networkingv1.Ingress{},
+		&corev1.ConfigMap{},
+		&corev1.Secret{},
+		&corev1.ResourceQuota{},
+		&corev1.LimitRange{},
+		&batchv1.Job{},
+		&batchv1.CronJob{},
+		&autoscalingv2.HorizontalPodAutoscaler{},
+		&policyv1.PodDisruptionBudget{},
+	}
+}
+
+// ownStackObjects registers watches for the objects generated for the stacks of a controller
+func ownStackObjects(b *builder.Builder) *builder.Builder {
+	for _, obj := range ownedTypes() {
+		b = b.Owns(obj)
+	}
+	return b
+}
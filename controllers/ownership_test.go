@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Ownership", func() {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		reconciler *PRStackReconciler
+		fakeClient client.Client
+		prStack    *pishopv1alpha1.PRStack
+		namespace  string
+	)
+
+	expectOwnedByStack := func(obj client.Object) {
+		owner := metav1.GetControllerOf(obj)
+		Expect(owner).ToNot(BeNil(), "%s has no controller", obj.GetName())
+		Expect(owner.Kind).To(Equal("PRStack"))
+		Expect(owner.Name).To(Equal(prStack.Name))
+		Expect(owner.UID).To(Equal(prStack.UID))
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		fakeClient = newTestClient().Build()
+
+		reconciler = &PRStackReconciler{StackEngine: newTestEngine(fakeClient)}
+
+		namespace = reconciler.getNamespaceName("123")
+		prStack = newTestPRStack()
+		prStack.UID = types.UID("8d6f2a4e-0c1b-4f7e-9a53-2b1c7d9e6f10")
+		prStack.Status = pishopv1alpha1.PRStackStatus{
+			MongoDB: &pishopv1alpha1.MongoDBCredentials{ConnectionString: "mongodb://localhost:27017"},
+			NATS:    &pishopv1alpha1.NATSConfig{ConnectionString: "nats://nats:4222", SubjectPrefix: "pishop.pr.123"},
+			Redis:   &pishopv1alpha1.RedisConfig{ConnectionString: "redis://redis:6379", KeyPrefix: "pishop:pr:123:"},
+		}
+
+		ctx = ctrl.LoggerInto(ctx, zap.New(zap.UseDevMode(true)))
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("should not own the namespace of the stack", func() {
+		Expect(reconciler.createNamespace(ctx, asStack(prStack), namespace)).To(Succeed())
+
+		ns := &corev1.Namespace{}
+		Expect(fakeClient.Get(ctx, client.ObjectKey{Name: namespace}, ns)).To(Succeed())
+		Expect(ns.OwnerReferences).To(BeEmpty())
+	})
+
+	It("should release a namespace owned by the stack", func() {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+		Expect(reconciler.setStackOwner(asStack(prStack), ns)).To(Succeed())
+		Expect(fakeClient.Create(ctx, ns)).To(Succeed())
+
+		Expect(reconciler.createNamespace(ctx, asStack(prStack), namespace)).To(Succeed())
+
+		Expect(fakeClient.Get(ctx, client.ObjectKey{Name: namespace}, ns)).To(Succeed())
+		Expect(ns.OwnerReferences).To(BeEmpty())
+	})
+
+	It("should not own the data PVCs", func() {
+		prStack.Spec.Redis = &pishopv1alpha1.RedisSpec{
+			Persistence: &pishopv1alpha1.RedisPersistenceSpec{StorageSize: "1Gi"},
+		}
+		Expect(reconciler.ensureRedisDataPVC(ctx, asStack(prStack), namespace)).To(Succeed())
+
+		pvc := &corev1.PersistentVolumeClaim{}
+		Expect(fakeClient.Get(ctx, client.ObjectKey{Name: RedisDataPVCName, Namespace: namespace}, pvc)).To(Succeed())
+		Expect(pvc.OwnerReferences).To(BeEmpty())
+	})
+
+	It("should own the generated service objects", func() {
+		Expect(reconciler.createMongoDBResources(ctx, asStack(prStack), namespace)).To(Succeed())
+		Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "graphql-service")).To(Succeed())
+
+		for _, obj := range []client.Object{
+			&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "graphql-service"}},
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "graphql-service"}},
+			&networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "graphql-service"}},
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "mongodb-config"}},
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "mongodb-secret"}},
+		} {
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: obj.GetName(), Namespace: namespace}, obj)).To(Succeed())
+			expectOwnedByStack(obj)
+		}
+	})
+
+	It("should own the objects of tenants", func() {
+		tenant := &pishopv1alpha1.Tenant{
+			ObjectMeta: metav1.ObjectMeta{Name: "magicshop", UID: types.UID("tenant-uid")},
+			Spec:       pishopv1alpha1.TenantSpec{TenantID: "magicshop", ImageTag: "v1.0.0"},
+		}
+		stack := newTenantStack(tenant)
+		Expect(reconciler.Apply(ctx, stack, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: stack.Namespace()},
+		})).To(Succeed())
+
+		configMap := &corev1.ConfigMap{}
+		Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "config", Namespace: stack.Namespace()}, configMap)).To(Succeed())
+		owner := metav1.GetControllerOf(configMap)
+		Expect(owner).ToNot(BeNil())
+		Expect(owner.Kind).To(Equal("Tenant"))
+		Expect(owner.Name).To(Equal("magicshop"))
+	})
+})
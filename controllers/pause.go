@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// isStackPaused checks if a stack is paused by its spec or the pause-reconcile annotation
+func isStackPaused(stack Stack) bool {
+	return stack.Spec().Paused || isReconcilePaused(stack.Object())
+}
+
+// handlePaused reports the status of a paused stack without changing any of its objects
+func (e *StackEngine) handlePaused(ctx context.Context, stack Stack) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	log.Info("Stack is paused, skipping reconciliation", "stack", stack.ID(), "phase", stack.Status().Phase)
+
+	reason := "SpecPaused"
+	if !stack.Spec().Paused {
+		reason = "AnnotationPaused"
+	}
+
+	if !apimeta.IsStatusConditionTrue(stack.Status().Conditions, ConditionTypePaused) {
+		e.Recorder.Event(stack.Object(), corev1.EventTypeNormal, EventTypePaused, fmt.Sprintf("Reconciliation of %s is paused", stack.Naming().Describe(stack.ID())))
+	}
+	e.setCondition(stack, metav1.Condition{
+		Type:               ConditionTypePaused,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		Message:            "The operator does not change the stack until it is resumed",
+		LastTransitionTime: metav1.Now(),
+	})
+
+	if err := e.updateStackStatus(ctx, stack); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: RequeueIntervalLong}, nil
+}
+
+// resumeStack records that a previously paused stack is reconciled again. The time spent paused
+// does not count as inactivity, so the stack is not expired on the reconcile resuming it.
+func (e *StackEngine) resumeStack(ctx context.Context, stack Stack) error {
+	if !apimeta.IsStatusConditionTrue(stack.Status().Conditions, ConditionTypePaused) {
+		return nil
+	}
+
+	now := metav1.Now()
+	stack.Status().LastActiveAt = &now
+	e.setCondition(stack, metav1.Condition{
+		Type:               ConditionTypePaused,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Resumed",
+		Message:            "The stack is reconciled",
+		LastTransitionTime: metav1.Now(),
+	})
+	return e.updateStackStatus(ctx, stack)
+}
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Paused Stacks", func() {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		reconciler *PRStackReconciler
+		fakeClient client.Client
+		recorder   *record.FakeRecorder
+		prStack    *pishopv1alpha1.PRStack
+		req        ctrl.Request
+	)
+
+	getReplicas := func() int32 {
+		deployment := &appsv1.Deployment{}
+		Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: reconciler.getNamespaceName("123")}, deployment)).To(Succeed())
+		return *deployment.Spec.Replicas
+	}
+
+	getPRStack := func() *pishopv1alpha1.PRStack {
+		updated := &pishopv1alpha1.PRStack{}
+		Expect(fakeClient.Get(ctx, req.NamespacedName, updated)).To(Succeed())
+		return updated
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		fakeClient = newTestClient().Build()
+
+		reconciler = &PRStackReconciler{StackEngine: newTestEngine(fakeClient)}
+		recorder = reconciler.Recorder.(*record.FakeRecorder)
+
+		// An inactive stack would be scaled down on the next reconcile
+		prStack = newTestPRStack()
+		prStack.Finalizers = []string{FinalizerName}
+		prStack.Spec.Active = false
+		prStack.Spec.Paused = true
+		Expect(fakeClient.Create(ctx, prStack)).To(Succeed())
+		now := metav1.Now()
+		prStack.Status = pishopv1alpha1.PRStackStatus{
+			Phase:        PhaseRunning,
+			CreatedAt:    &now,
+			LastActiveAt: &now,
+		}
+		Expect(fakeClient.Status().Update(ctx, prStack)).To(Succeed())
+
+		Expect(fakeClient.Create(ctx, &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "product-service", Namespace: reconciler.getNamespaceName("123")},
+			Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(1)},
+		})).To(Succeed())
+
+		req = ctrl.Request{NamespacedName: types.NamespacedName{Name: prStack.Name}}
+		ctx = ctrl.LoggerInto(ctx, zap.New(zap.UseDevMode(true)))
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("should not scale a paused stack", func() {
+		result, err := reconciler.Reconcile(ctx, req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.RequeueAfter).To(Equal(RequeueIntervalLong))
+
+		Expect(getReplicas()).To(Equal(int32(1)))
+		updated := getPRStack()
+		Expect(updated.Status.Phase).To(Equal(PhaseRunning))
+
+		condition := apimeta.FindStatusCondition(updated.Status.Conditions, ConditionTypePaused)
+		Expect(condition).ToNot(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+		Expect(condition.Reason).To(Equal("SpecPaused"))
+		Expect(recorder.Events).To(Receive(ContainSubstring(EventTypePaused)))
+	})
+
+	It("should pause a stack with the annotation", func() {
+		prStack = getPRStack()
+		prStack.Spec.Paused = false
+		prStack.Annotations = map[string]string{PauseReconcileAnnotation: "true"}
+		Expect(fakeClient.Update(ctx, prStack)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(getReplicas()).To(Equal(int32(1)))
+		condition := apimeta.FindStatusCondition(getPRStack().Status.Conditions, ConditionTypePaused)
+		Expect(condition.Reason).To(Equal("AnnotationPaused"))
+	})
+
+	It("should resume a stack once it is no longer paused", func() {
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).ToNot(HaveOccurred())
+
+		prStack = getPRStack()
+		prStack.Spec.Paused = false
+		Expect(fakeClient.Update(ctx, prStack)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, req)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(getReplicas()).To(Equal(int32(0)))
+		updated := getPRStack()
+		Expect(apimeta.IsStatusConditionFalse(updated.Status.Conditions, ConditionTypePaused)).To(BeTrue())
+		Expect(updated.Status.Phase).To(Equal(PhaseInactive))
+	})
+
+	Context("paused for longer than the expiration time", func() {
+		BeforeEach(func() {
+			prStack = getPRStack()
+			prStack.Spec.Active = true
+			Expect(fakeClient.Update(ctx, prStack)).To(Succeed())
+			pausedAt := metav1.NewTime(time.Now().Add(-2 * StackExpirationTime))
+			prStack.Status.LastActiveAt = &pausedAt
+			Expect(fakeClient.Status().Update(ctx, prStack)).To(Succeed())
+
+			_, err := reconciler.Reconcile(ctx, req)
+			Expect(err).ToNot(HaveOccurred())
+
+			prStack = getPRStack()
+			prStack.Spec.Paused = false
+			Expect(fakeClient.Update(ctx, prStack)).To(Succeed())
+		})
+
+		It("should not count the paused time as inactivity", func() {
+			Expect(reconciler.resumeStack(ctx, asStack(prStack))).To(Succeed())
+
+			updated := getPRStack()
+			Expect(updated.Status.LastActiveAt.Time).To(BeTemporally("~", time.Now(), time.Minute))
+			Expect(stackExpired(asStack(updated))).To(BeFalse())
+		})
+
+		It("should keep the stack running when it is resumed", func() {
+			_, _ = reconciler.Reconcile(ctx, req)
+
+			Expect(getReplicas()).To(Equal(int32(1)))
+			Expect(getPRStack().Spec.Active).To(BeTrue())
+			Expect(recorder.Events).ToNot(Receive(ContainSubstring(EventTypeStackExpired)))
+		})
+	})
+
+	It("should still clean up a paused stack on deletion", func() {
+		Expect(fakeClient.Delete(ctx, prStack)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(getPRStack().Status.Phase).To(Equal(PhaseCleaning))
+	})
+})
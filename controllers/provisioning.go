@@ -11,6 +11,7 @@ import (
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
 	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -19,14 +20,14 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-func (r *PRStackReconciler) provisionMongoDB(ctx context.Context, prStack *pishopv1alpha1.PRStack) error {
+func (e *StackEngine) provisionMongoDB(ctx context.Context, stack Stack) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Provisioning MongoDB for PR", "prNumber", prStack.Spec.PRNumber)
+	log.Info("Provisioning MongoDB for PR", "stack", stack.ID())
 
 	// Connect to MongoDB
-	mongoURI := r.MongoURI
-	if prStack.Spec.MongoURI != "" {
-		mongoURI = prStack.Spec.MongoURI
+	mongoURI, err := e.getAdminMongoURI(ctx, stack)
+	if err != nil {
+		return err
 	}
 
 	client, err := mongo.Connect(options.Client().ApplyURI(mongoURI))
@@ -41,12 +42,18 @@ func (r *PRStackReconciler) provisionMongoDB(ctx context.Context, prStack *pisho
 	}
 
 	// Generate PR user credentials
-	prUser := fmt.Sprintf("pishop_pr_%s", prStack.Spec.PRNumber)
+	prUser := stack.Naming().User(stack.ID())
 	prPassword, err := generateSecurePassword()
 	if err != nil {
 		return fmt.Errorf("failed to generate secure password: %v", err)
 	}
 
+	// Build the connection string services use to reach this MongoDB
+	connectionString, err := e.mongoConnectionString(stack, prUser, prPassword)
+	if err != nil {
+		return fmt.Errorf("failed to build connection string: %v", err)
+	}
+
 	// Create PR user with limited permissions
 	adminDB := client.Database("admin")
 	
@@ -54,7 +61,7 @@ func (r *PRStackReconciler) provisionMongoDB(ctx context.Context, prStack *pisho
 	services := DefaultServices
 	var roles []bson.M
 	for _, service := range services {
-		dbName := getDatabaseName(service, prStack.Spec.PRNumber)
+		dbName := stack.Naming().Database(service, stack.ID())
 		roles = append(roles, bson.M{"role": "readWrite", "db": dbName})
 	}
 
@@ -74,45 +81,65 @@ func (r *PRStackReconciler) provisionMongoDB(ctx context.Context, prStack *pisho
 	var databases []string
 
 	for _, service := range services {
-		dbName := getDatabaseName(service, prStack.Spec.PRNumber)
+		dbName := stack.Naming().Database(service, stack.ID())
 		databases = append(databases, dbName)
 
 		database := client.Database(dbName)
 
 		// Create collections based on service
-		if err := r.createServiceCollections(ctx, database, service); err != nil {
+		collectionsCtx, span := startSpan(ctx, "createServiceCollections",
+			attribute.String("pishop.service", service),
+			attribute.String("db.namespace", dbName))
+		err := e.createServiceCollections(collectionsCtx, database, service)
+		endSpan(span, err)
+		if err != nil {
 			return fmt.Errorf("failed to create collections for %s: %v", service, err)
 		}
 	}
 
-	// Update status
-	prStack.Status.MongoDB = &pishopv1alpha1.MongoDBCredentials{
+	// Update status, keeping the time of the last rotation
+	credentials := &pishopv1alpha1.MongoDBCredentials{
 		User:             prUser,
 		Password:         prPassword,
-		ConnectionString: fmt.Sprintf("mongodb://%s:%s@mongodb.pishop-base.svc.cluster.local:27017", prUser, prPassword),
+		ConnectionString: connectionString,
 		Databases:        databases,
 	}
-
-	// Update the PRStack status
-	if err := r.Status().Update(ctx, prStack); err != nil {
-		return fmt.Errorf("failed to update PRStack status: %v", err)
+	if stack.Status().MongoDB != nil {
+		credentials.LastRotationTime = stack.Status().MongoDB.LastRotationTime
 	}
+	stack.Status().MongoDB = credentials
 
 	return nil
 }
 
-func (r *PRStackReconciler) provisionNATS(ctx context.Context, prStack *pishopv1alpha1.PRStack) error {
+func (e *StackEngine) provisionNATS(ctx context.Context, stack Stack) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Provisioning NATS for PR", "prNumber", prStack.Spec.PRNumber)
+	log.Info("Provisioning NATS for PR", "stack", stack.ID())
+
+	subjectPrefix := stack.Naming().NATSSubjectPrefix(stack.ID())
+	namespaceName := stack.Namespace()
+
+	// Shared mode isolates the PR in its own account on the shared NATS server
+	if isSharedNATS(stack) {
+		account, err := e.provisionSharedNATS(ctx, stack, namespaceName)
+		if err != nil {
+			return err
+		}
+
+		stack.Status().NATS = &pishopv1alpha1.NATSConfig{
+			SubjectPrefix:    subjectPrefix,
+			ConnectionString: e.getSharedNATSURL(stack),
+			Account:          account,
+		}
+		return nil
+	}
 
 	// Set up subject prefixes and connection details
 	// NATS resources will be created in the deployment phase
-	subjectPrefix := fmt.Sprintf("pishop.pr.%s", prStack.Spec.PRNumber)
-	namespaceName := fmt.Sprintf("pr-%s-shop-pilab-hu", prStack.Spec.PRNumber)
 	natsURL := fmt.Sprintf("nats://nats.%s.svc.cluster.local:4222", namespaceName)
 
 	// Update status
-	prStack.Status.NATS = &pishopv1alpha1.NATSConfig{
+	stack.Status().NATS = &pishopv1alpha1.NATSConfig{
 		SubjectPrefix:    subjectPrefix,
 		ConnectionString: natsURL,
 	}
@@ -121,18 +148,34 @@ func (r *PRStackReconciler) provisionNATS(ctx context.Context, prStack *pishopv1
 	return nil
 }
 
-func (r *PRStackReconciler) provisionRedis(ctx context.Context, prStack *pishopv1alpha1.PRStack) error {
+func (e *StackEngine) provisionRedis(ctx context.Context, stack Stack) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Provisioning Redis for PR", "prNumber", prStack.Spec.PRNumber)
+	log.Info("Provisioning Redis for PR", "stack", stack.ID())
+
+	keyPrefix := stack.Naming().RedisKeyPrefix(stack.ID())
+	namespaceName := stack.Namespace()
+
+	// Shared mode restricts the PR to its key prefix with an ACL user on the shared Redis server
+	if isSharedRedis(stack) {
+		connectionString, err := e.provisionSharedRedis(ctx, stack, namespaceName)
+		if err != nil {
+			return err
+		}
+
+		stack.Status().Redis = &pishopv1alpha1.RedisConfig{
+			KeyPrefix:        keyPrefix,
+			ConnectionString: connectionString,
+			User:             stack.Naming().User(stack.ID()),
+		}
+		return nil
+	}
 
 	// Set up key prefixes and connection details
 	// Redis resources will be created in the deployment phase
-	keyPrefix := fmt.Sprintf("pishop:pr:%s:", prStack.Spec.PRNumber)
-	namespaceName := fmt.Sprintf("pr-%s-shop-pilab-hu", prStack.Spec.PRNumber)
 	redisURL := fmt.Sprintf("redis://redis.%s.svc.cluster.local:6379", namespaceName)
 
 	// Update status
-	prStack.Status.Redis = &pishopv1alpha1.RedisConfig{
+	stack.Status().Redis = &pishopv1alpha1.RedisConfig{
 		KeyPrefix:        keyPrefix,
 		ConnectionString: redisURL,
 	}
@@ -141,10 +184,22 @@ func (r *PRStackReconciler) provisionRedis(ctx context.Context, prStack *pishopv
 	return nil
 }
 
-func (r *PRStackReconciler) createNATSResources(ctx context.Context, prStack *pishopv1alpha1.PRStack, namespace string) error {
+// dataVolumeStrategy returns the strategy of deployments with a data PVC. A ReadWriteOnce volume
+// cannot be attached to the old and new pod at the same time, so the old pod is stopped first.
+func dataVolumeStrategy() appsv1.DeploymentStrategy {
+	return appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+}
+
+func (e *StackEngine) createNATSResources(ctx context.Context, stack Stack, namespace string) error {
 	log := ctrl.LoggerFrom(ctx)
 	log.Info("Creating NATS resources", "namespace", namespace)
 
+	// The PR account on the shared NATS server is set up during provisioning
+	if isSharedNATS(stack) {
+		log.Info("Using shared NATS server, skipping NATS deployment", "namespace", namespace)
+		return nil
+	}
+
 	// Create NATS deployment
 	natsDeployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
@@ -152,7 +207,7 @@ func (r *PRStackReconciler) createNATSResources(ctx context.Context, prStack *pi
 			Namespace: namespace,
 			Labels: map[string]string{
 				"app": "nats",
-				"pr":  prStack.Spec.PRNumber,
+				"pr":  stack.ID(),
 			},
 		},
 		Spec: appsv1.DeploymentSpec{
@@ -160,14 +215,14 @@ func (r *PRStackReconciler) createNATSResources(ctx context.Context, prStack *pi
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
 					"app": "nats",
-					"pr":  prStack.Spec.PRNumber,
+					"pr":  stack.ID(),
 				},
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: map[string]string{
 						"app": "nats",
-						"pr":  prStack.Spec.PRNumber,
+						"pr":  stack.ID(),
 					},
 				},
 				Spec: corev1.PodSpec{
@@ -201,8 +256,8 @@ func (r *PRStackReconciler) createNATSResources(ctx context.Context, prStack *pi
 									corev1.ResourceMemory: resource.MustParse("0Mi"),
 								},
 								Limits: corev1.ResourceList{
-									corev1.ResourceCPU:    resource.MustParse("500m"),
-									corev1.ResourceMemory: resource.MustParse("512Mi"),
+									corev1.ResourceCPU:    resource.MustParse(BackendCPULimit),
+									corev1.ResourceMemory: resource.MustParse(BackendMemoryLimit),
 								},
 							},
 						},
@@ -220,7 +275,20 @@ func (r *PRStackReconciler) createNATSResources(ctx context.Context, prStack *pi
 		},
 	}
 
-	if err := r.CreateOrUpdate(ctx, natsDeployment); err != nil {
+	// Keep JetStream data on a PVC so streams survive scaling NATS down
+	if hasJetStreamStorage(stack) {
+		if err := e.ensureJetStreamPVC(ctx, stack, namespace); err != nil {
+			return err
+		}
+		natsDeployment.Spec.Template.Spec.Volumes[0].VolumeSource = corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: JetStreamPVCName,
+			},
+		}
+		natsDeployment.Spec.Strategy = dataVolumeStrategy()
+	}
+
+	if err := e.Apply(ctx, stack, natsDeployment); err != nil {
 		return fmt.Errorf("failed to create NATS deployment: %v", err)
 	}
 
@@ -231,13 +299,13 @@ func (r *PRStackReconciler) createNATSResources(ctx context.Context, prStack *pi
 			Namespace: namespace,
 			Labels: map[string]string{
 				"app": "nats",
-				"pr":  prStack.Spec.PRNumber,
+				"pr":  stack.ID(),
 			},
 		},
 		Spec: corev1.ServiceSpec{
 			Selector: map[string]string{
 				"app": "nats",
-				"pr":  prStack.Spec.PRNumber,
+				"pr":  stack.ID(),
 			},
 			Ports: []corev1.ServicePort{
 				{
@@ -256,7 +324,7 @@ func (r *PRStackReconciler) createNATSResources(ctx context.Context, prStack *pi
 		},
 	}
 
-	if err := r.CreateOrUpdate(ctx, natsService); err != nil {
+	if err := e.Apply(ctx, stack, natsService); err != nil {
 		return fmt.Errorf("failed to create NATS service: %v", err)
 	}
 
@@ -264,10 +332,43 @@ func (r *PRStackReconciler) createNATSResources(ctx context.Context, prStack *pi
 	return nil
 }
 
-func (r *PRStackReconciler) createRedisResources(ctx context.Context, prStack *pishopv1alpha1.PRStack, namespace string) error {
+func (e *StackEngine) createRedisResources(ctx context.Context, stack Stack, namespace string) error {
 	log := ctrl.LoggerFrom(ctx)
 	log.Info("Creating Redis resources", "namespace", namespace)
 
+	// The PR user and redis-secret on the shared Redis server are set up during provisioning
+	if isSharedRedis(stack) {
+		log.Info("Using shared Redis server, skipping Redis deployment", "namespace", namespace)
+		return nil
+	}
+
+	// Create Redis secret first so the server and services share the same password
+	password, err := e.getOrCreateDedicatedRedisPassword(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	redisSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      RedisSecretName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app": "redis",
+				"pr":  stack.ID(),
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"url":       []byte(getDedicatedRedisURL(namespace, password)),
+			"password":  []byte(password),
+			"keyPrefix": []byte(stack.Naming().RedisKeyPrefix(stack.ID())),
+		},
+	}
+
+	if err := e.Apply(ctx, stack, redisSecret); err != nil {
+		return fmt.Errorf("failed to create Redis secret: %v", err)
+	}
+
 	// Create Redis deployment
 	redisDeployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
@@ -275,7 +376,7 @@ func (r *PRStackReconciler) createRedisResources(ctx context.Context, prStack *p
 			Namespace: namespace,
 			Labels: map[string]string{
 				"app": "redis",
-				"pr":  prStack.Spec.PRNumber,
+				"pr":  stack.ID(),
 			},
 		},
 		Spec: appsv1.DeploymentSpec{
@@ -283,14 +384,14 @@ func (r *PRStackReconciler) createRedisResources(ctx context.Context, prStack *p
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
 					"app": "redis",
-					"pr":  prStack.Spec.PRNumber,
+					"pr":  stack.ID(),
 				},
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: map[string]string{
 						"app": "redis",
-						"pr":  prStack.Spec.PRNumber,
+						"pr":  stack.ID(),
 					},
 				},
 				Spec: corev1.PodSpec{
@@ -298,14 +399,17 @@ func (r *PRStackReconciler) createRedisResources(ctx context.Context, prStack *p
 						{
 							Name:  "redis",
 							Image: "redis:7-alpine",
-							Args: []string{
-								"redis-server",
-								"--appendonly",
-								"yes",
-								"--maxmemory",
-								"256mb",
-								"--maxmemory-policy",
-								"allkeys-lru",
+							Args:  redisServerArgs(stack),
+							Env: []corev1.EnvVar{
+								{
+									Name: "REDIS_PASSWORD",
+									ValueFrom: &corev1.EnvVarSource{
+										SecretKeyRef: &corev1.SecretKeySelector{
+											LocalObjectReference: corev1.LocalObjectReference{Name: RedisSecretName},
+											Key:                  "password",
+										},
+									},
+								},
 							},
 							Ports: []corev1.ContainerPort{
 								{
@@ -325,8 +429,8 @@ func (r *PRStackReconciler) createRedisResources(ctx context.Context, prStack *p
 									corev1.ResourceMemory: resource.MustParse("0Mi"),
 								},
 								Limits: corev1.ResourceList{
-									corev1.ResourceCPU:    resource.MustParse("500m"),
-									corev1.ResourceMemory: resource.MustParse("512Mi"),
+									corev1.ResourceCPU:    resource.MustParse(BackendCPULimit),
+									corev1.ResourceMemory: resource.MustParse(BackendMemoryLimit),
 								},
 							},
 						},
@@ -344,7 +448,20 @@ func (r *PRStackReconciler) createRedisResources(ctx context.Context, prStack *p
 		},
 	}
 
-	if err := r.CreateOrUpdate(ctx, redisDeployment); err != nil {
+	// Keep Redis data on a PVC so carts and sessions survive scaling Redis down
+	if hasRedisStorage(stack) {
+		if err := e.ensureRedisDataPVC(ctx, stack, namespace); err != nil {
+			return err
+		}
+		redisDeployment.Spec.Template.Spec.Volumes[0].VolumeSource = corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: RedisDataPVCName,
+			},
+		}
+		redisDeployment.Spec.Strategy = dataVolumeStrategy()
+	}
+
+	if err := e.Apply(ctx, stack, redisDeployment); err != nil {
 		return fmt.Errorf("failed to create Redis deployment: %v", err)
 	}
 
@@ -355,13 +472,13 @@ func (r *PRStackReconciler) createRedisResources(ctx context.Context, prStack *p
 			Namespace: namespace,
 			Labels: map[string]string{
 				"app": "redis",
-				"pr":  prStack.Spec.PRNumber,
+				"pr":  stack.ID(),
 			},
 		},
 		Spec: corev1.ServiceSpec{
 			Selector: map[string]string{
 				"app": "redis",
-				"pr":  prStack.Spec.PRNumber,
+				"pr":  stack.ID(),
 			},
 			Ports: []corev1.ServicePort{
 				{
@@ -374,7 +491,7 @@ func (r *PRStackReconciler) createRedisResources(ctx context.Context, prStack *p
 		},
 	}
 
-	if err := r.CreateOrUpdate(ctx, redisService); err != nil {
+	if err := e.Apply(ctx, stack, redisService); err != nil {
 		return fmt.Errorf("failed to create Redis service: %v", err)
 	}
 
@@ -382,7 +499,7 @@ func (r *PRStackReconciler) createRedisResources(ctx context.Context, prStack *p
 	return nil
 }
 
-func (r *PRStackReconciler) createServiceCollections(ctx context.Context, database *mongo.Database, service string) error {
+func (e *StackEngine) createServiceCollections(ctx context.Context, database *mongo.Database, service string) error {
 	// Convert service name to collection name by removing "-service" suffix and handling special cases
 	var collectionName string
 	switch service {
@@ -417,35 +534,35 @@ func (r *PRStackReconciler) createServiceCollections(ctx context.Context, databa
 	// Call the appropriate collection creation function
 	switch collectionName {
 	case "products":
-		return r.createProductCollections(ctx, database)
+		return e.createProductCollections(ctx, database)
 	case "cart":
-		return r.createCartCollections(ctx, database)
+		return e.createCartCollections(ctx, database)
 	case "orders":
-		return r.createOrderCollections(ctx, database)
+		return e.createOrderCollections(ctx, database)
 	case "payments":
-		return r.createPaymentCollections(ctx, database)
+		return e.createPaymentCollections(ctx, database)
 	case "customers":
-		return r.createCustomerCollections(ctx, database)
+		return e.createCustomerCollections(ctx, database)
 	case "inventory":
-		return r.createInventoryCollections(ctx, database)
+		return e.createInventoryCollections(ctx, database)
 	case "notifications":
-		return r.createNotificationCollections(ctx, database)
+		return e.createNotificationCollections(ctx, database)
 	case "discounts":
-		return r.createDiscountCollections(ctx, database)
+		return e.createDiscountCollections(ctx, database)
 	case "checkout":
-		return r.createCheckoutCollections(ctx, database)
+		return e.createCheckoutCollections(ctx, database)
 	case "analytics":
-		return r.createAnalyticsCollections(ctx, database)
+		return e.createAnalyticsCollections(ctx, database)
 	case "auth":
-		return r.createAuthCollections(ctx, database)
+		return e.createAuthCollections(ctx, database)
 	case "graphql":
-		return r.createGraphQLCollections(ctx, database)
+		return e.createGraphQLCollections(ctx, database)
 	default:
 		return fmt.Errorf("unknown collection: %s", collectionName)
 	}
 }
 
-func (r *PRStackReconciler) createProductCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createProductCollections(ctx context.Context, database *mongo.Database) error {
 	// Create products collection with indexes
 	productsCollection := database.Collection("products")
 
@@ -478,7 +595,7 @@ func (r *PRStackReconciler) createProductCollections(ctx context.Context, databa
 	return nil
 }
 
-func (r *PRStackReconciler) createCartCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createCartCollections(ctx context.Context, database *mongo.Database) error {
 	// Create carts collection
 	cartsCollection := database.Collection("carts")
 	indexes := []mongo.IndexModel{
@@ -496,7 +613,7 @@ func (r *PRStackReconciler) createCartCollections(ctx context.Context, database
 	return nil
 }
 
-func (r *PRStackReconciler) createOrderCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createOrderCollections(ctx context.Context, database *mongo.Database) error {
 	// Create orders collection
 	ordersCollection := database.Collection("orders")
 	indexes := []mongo.IndexModel{
@@ -522,7 +639,7 @@ func (r *PRStackReconciler) createOrderCollections(ctx context.Context, database
 	return nil
 }
 
-func (r *PRStackReconciler) createPaymentCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createPaymentCollections(ctx context.Context, database *mongo.Database) error {
 	// Create payments collection
 	paymentsCollection := database.Collection("payments")
 	indexes := []mongo.IndexModel{
@@ -547,7 +664,7 @@ func (r *PRStackReconciler) createPaymentCollections(ctx context.Context, databa
 	return nil
 }
 
-func (r *PRStackReconciler) createCustomerCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createCustomerCollections(ctx context.Context, database *mongo.Database) error {
 	// Create customers collection
 	customersCollection := database.Collection("customers")
 	indexes := []mongo.IndexModel{
@@ -571,7 +688,7 @@ func (r *PRStackReconciler) createCustomerCollections(ctx context.Context, datab
 	return nil
 }
 
-func (r *PRStackReconciler) createInventoryCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createInventoryCollections(ctx context.Context, database *mongo.Database) error {
 	// Create inventory_items collection
 	inventoryItemsCollection := database.Collection("inventory_items")
 	indexes := []mongo.IndexModel{
@@ -596,7 +713,7 @@ func (r *PRStackReconciler) createInventoryCollections(ctx context.Context, data
 	return nil
 }
 
-func (r *PRStackReconciler) createNotificationCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createNotificationCollections(ctx context.Context, database *mongo.Database) error {
 	// Create notifications collection
 	notificationsCollection := database.Collection("notifications")
 	indexes := []mongo.IndexModel{
@@ -622,7 +739,7 @@ func (r *PRStackReconciler) createNotificationCollections(ctx context.Context, d
 	return nil
 }
 
-func (r *PRStackReconciler) createDiscountCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createDiscountCollections(ctx context.Context, database *mongo.Database) error {
 	// Create discounts collection
 	discountsCollection := database.Collection("discounts")
 	indexes := []mongo.IndexModel{
@@ -649,7 +766,7 @@ func (r *PRStackReconciler) createDiscountCollections(ctx context.Context, datab
 	return nil
 }
 
-func (r *PRStackReconciler) createCheckoutCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createCheckoutCollections(ctx context.Context, database *mongo.Database) error {
 	// Create checkout_sessions collection
 	checkoutSessionsCollection := database.Collection("checkout_sessions")
 	indexes := []mongo.IndexModel{
@@ -683,7 +800,7 @@ func generateSecurePassword() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-func (r *PRStackReconciler) createAnalyticsCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createAnalyticsCollections(ctx context.Context, database *mongo.Database) error {
 	// Create analytics collection with indexes
 	analyticsCollection := database.Collection("analytics")
 
@@ -701,7 +818,7 @@ func (r *PRStackReconciler) createAnalyticsCollections(ctx context.Context, data
 	return nil
 }
 
-func (r *PRStackReconciler) createAuthCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createAuthCollections(ctx context.Context, database *mongo.Database) error {
 	// Create auth collection with indexes
 	authCollection := database.Collection("users")
 
@@ -719,7 +836,7 @@ func (r *PRStackReconciler) createAuthCollections(ctx context.Context, database
 	return nil
 }
 
-func (r *PRStackReconciler) createGraphQLCollections(ctx context.Context, database *mongo.Database) error {
+func (e *StackEngine) createGraphQLCollections(ctx context.Context, database *mongo.Database) error {
 	// Create graphql collection with indexes
 	graphqlCollection := database.Collection("queries")
 
@@ -4,18 +4,13 @@ import (
 	"context"
 	"fmt"
 	"slices"
-	"strings"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
-	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -49,6 +44,20 @@ const (
 	ConditionTypeReady       = "Ready"
 	ConditionTypeDegraded    = "Degraded"
 	ConditionTypeProgressing = "Progressing"
+	ConditionTypeDrifted     = "Drifted"
+	ConditionTypePaused      = "Paused"
+
+	// Component condition types
+	ConditionTypeMongoDBReady  = "MongoDBReady"
+	ConditionTypeNATSReady     = "NATSReady"
+	ConditionTypeRedisReady    = "RedisReady"
+	ConditionTypeServicesReady = "ServicesReady"
+	ConditionTypeIngressReady  = "IngressReady"
+	ConditionTypeBackupHealthy = "BackupHealthy"
+	ConditionTypeExpired       = "Expired"
+
+	// ConditionTypeStale is True on PRStacks whose pull request is closed
+	ConditionTypeStale = "Stale"
 
 	// Event types
 	EventTypeInitializing         = "Initializing"
@@ -67,6 +76,21 @@ const (
 	EventTypeRolloutFailed        = "RolloutFailed"
 	EventTypeScaleDownFailed      = "ScaleDownFailed"
 	EventTypeStackExpired         = "StackExpired"
+	EventTypeCredentialsRotated   = "CredentialsRotated"
+	EventTypeRotationFailed       = "CredentialRotationFailed"
+	EventTypeStreamUpdated        = "StreamUpdated"
+	EventTypeStreamsFailed        = "StreamReconcileFailed"
+	EventTypeStreamChangeIgnored  = "StreamChangeIgnored"
+	EventTypeDeletionBlocked      = "DeletionBlocked"
+	EventTypeBackupScheduleFailed = "BackupScheduleFailed"
+	EventTypeDriftDetected        = "DriftDetected"
+	EventTypeDriftCorrected       = "DriftCorrected"
+	EventTypePaused               = "Paused"
+	EventTypeGitHubReportFailed   = "GitHubReportFailed"
+	EventTypeStackStale           = "StackStale"
+	EventTypeStaleStackDeleted    = "StaleStackDeleted"
+	EventTypeStorageLimitIgnored  = "StorageLimitIgnored"
+	EventTypeWaveTimeout          = "WaveTimeout"
 
 	// Default services - moved to constants.go
 
@@ -75,26 +99,23 @@ const (
 
 	// Restart annotation
 	RestartAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+	// PauseReconcileAnnotation set to "true" on a managed object keeps the operator from changing
+	// it, on a PRStack or Tenant it pauses the whole stack
+	PauseReconcileAnnotation = "shop.pilab.hu/pause-reconcile"
+
+	// KeepAnnotation on a PRStack keeps the stale stack sweeper from deleting it
+	KeepAnnotation = "shop.pilab.hu/keep"
+
+	// BackupCountedAnnotation marks a finished backup Job counted in the backup metrics
+	BackupCountedAnnotation = "shop.pilab.hu/backup-counted"
 )
 
 // PRStackReconciler reconciles a PRStack object
 type PRStackReconciler struct {
-	client.Client
-	Scheme         *runtime.Scheme
-	Recorder       record.EventRecorder
-	MongoURI       string
-	MongoUsername  string
-	MongoPassword  string
-	BackupManager  *BackupRestoreManager
-	GitHubToken    string
-	GitHubUsername string
-	GitHubEmail    string
-	BaseDomain     string
-	// Ingress configuration
-	IngressClassName        string
-	CertManagerIssuer      string
-	TraefikEntrypoints     string
-	TraefikTLSEnabled      string
+	*StackEngine
+	// GitHub publishes deployment statuses and comments on the pull requests, nil disables it
+	GitHub *GitHubReporter
 }
 
 //+kubebuilder:rbac:groups=shop.pilab.hu,resources=prstacks,verbs=get;list;watch;create;update;patch;delete
@@ -102,25 +123,23 @@ type PRStackReconciler struct {
 //+kubebuilder:rbac:groups=shop.pilab.hu,resources=prstacks/finalizers,verbs=update
 //+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
 //+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=resourcequotas;limitranges,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors;podmonitors,verbs=get;list;watch;create;update;patch;delete
 
 func (r *PRStackReconciler) getNamespaceName(prNumber string) string {
-	return fmt.Sprintf(NamespacePattern, prNumber)
-}
-
-// getDomain returns the domain to use for ingress based on CustomDomain or default pattern
-func (r *PRStackReconciler) getDomain(prStack *pishopv1alpha1.PRStack) string {
-	if prStack.Spec.CustomDomain != "" {
-		return prStack.Spec.CustomDomain
-	}
-	return fmt.Sprintf("pr-%s.%s", prStack.Spec.PRNumber, r.BaseDomain)
+	return prStackNaming{}.Namespace(prNumber)
 }
 
 // Reconcile is part of the main kubernetes reconciliation loop
@@ -139,15 +158,26 @@ func (r *PRStackReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, err
 	}
 
+	return r.traceReconcile(ctx, asStack(&prStack), func(ctx context.Context) (ctrl.Result, error) {
+		result, err := r.reconcilePRStack(ctx, &prStack)
+		r.reportToGitHub(ctx, &prStack)
+		return result, err
+	})
+}
+
+// reconcilePRStack moves a PRStack through its phases
+func (r *PRStackReconciler) reconcilePRStack(ctx context.Context, prStack *pishopv1alpha1.PRStack) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+
 	// Handle deletion
 	if !prStack.DeletionTimestamp.IsZero() {
-		return r.handleDeletion(ctx, &prStack)
+		return r.handleDeletion(ctx, prStack)
 	}
 
 	// Add finalizer if not present
 	if !containsString(prStack.Finalizers, FinalizerName) {
 		prStack.Finalizers = append(prStack.Finalizers, FinalizerName)
-		if err := r.Update(ctx, &prStack); err != nil {
+		if err := r.Update(ctx, prStack); err != nil {
 			return ctrl.Result{}, err
 		}
 	}
@@ -158,15 +188,23 @@ func (r *PRStackReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		prStack.Status.CreatedAt = &now
 		prStack.Status.LastActiveAt = &now
 
-		if err := r.Status().Update(ctx, &prStack); err != nil {
+		if err := r.Status().Update(ctx, prStack); err != nil {
 			return ctrl.Result{}, err
 		}
 	}
 
+	// Paused stacks only report their status until they are resumed
+	if isStackPaused(asStack(prStack)) {
+		return r.handlePaused(ctx, asStack(prStack))
+	}
+	if err := r.resumeStack(ctx, asStack(prStack)); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// If stack is becoming active (transitioning from inactive/expired), update LastActiveAt
 	// This prevents immediate re-expiration
 	wasReactivated := false
-	isExpired := r.isStackExpired(&prStack)
+	isExpired := r.isStackExpired(prStack)
 	log.Info("Checking reactivation conditions",
 		"prNumber", prStack.Spec.PRNumber,
 		"active", prStack.Spec.Active,
@@ -176,7 +214,7 @@ func (r *PRStackReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	if prStack.Spec.Active && (prStack.Status.Phase == "Inactive" || isExpired) {
 		log.Info("Stack being reactivated, updating LastActiveAt", "prNumber", prStack.Spec.PRNumber)
 		prStack.Status.LastActiveAt = &now
-		if err := r.Status().Update(ctx, &prStack); err != nil {
+		if err := r.Status().Update(ctx, prStack); err != nil {
 			return ctrl.Result{}, err
 		}
 		wasReactivated = true
@@ -184,48 +222,72 @@ func (r *PRStackReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 
 	// Check if stack is expired and set Active to false
 	// Skip if we just reactivated the stack
-	if !wasReactivated && r.isStackExpired(&prStack) && prStack.Spec.Active {
-		return r.handleStackExpiration(ctx, &prStack)
+	if !wasReactivated && r.isStackExpired(prStack) && prStack.Spec.Active {
+		return r.handleStackExpiration(ctx, prStack)
 	}
 
 	// Handle active/inactive state
 	if !prStack.Spec.Active {
-		return r.handleInactiveStack(ctx, &prStack)
+		return r.handleInactiveStack(ctx, prStack)
 	}
 
+	stack := asStack(prStack)
+
 	// Check if a deployment rollout is requested
-	if r.shouldRolloutDeployments(&prStack) {
+	if r.shouldRolloutDeployments(stack) {
 		log.Info("Deployment rollout requested", "prNumber", prStack.Spec.PRNumber, "deployedAt", prStack.Spec.DeployedAt)
-		if err := r.rolloutDeployments(ctx, &prStack); err != nil {
+		if err := r.rolloutDeployments(ctx, stack); err != nil {
 			log.Error(err, "Failed to rollout deployments")
-			r.Recorder.Event(&prStack, corev1.EventTypeWarning, EventTypeRolloutFailed, fmt.Sprintf("Failed to rollout deployments: %v", err))
+			r.Recorder.Event(prStack, corev1.EventTypeWarning, EventTypeRolloutFailed, fmt.Sprintf("Failed to rollout deployments: %v", err))
 			prStack.Status.Message = fmt.Sprintf("Rollout failed: %v", err)
-			if updateErr := r.Status().Update(ctx, &prStack); updateErr != nil {
+			if updateErr := r.Status().Update(ctx, prStack); updateErr != nil {
 				ctrl.LoggerFrom(ctx).Error(updateErr, "Failed to update PRStack status after rollout failure")
 			}
 			return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
 		}
-		r.Recorder.Event(&prStack, corev1.EventTypeNormal, EventTypeRolloutTriggered, fmt.Sprintf("PR #%s deployments rolled out successfully", prStack.Spec.PRNumber))
+		r.Recorder.Event(prStack, corev1.EventTypeNormal, EventTypeRolloutTriggered, fmt.Sprintf("PR #%s deployments rolled out successfully", prStack.Spec.PRNumber))
 		prStack.Status.LastDeployedAt = prStack.Spec.DeployedAt
-		if err := r.Status().Update(ctx, &prStack); err != nil {
+		if err := r.Status().Update(ctx, prStack); err != nil {
 			return ctrl.Result{}, err
 		}
 	}
 
+	// Rotate MongoDB credentials if requested or scheduled
+	// Only running stacks have credentials distributed to the namespace
+	if (prStack.Status.Phase == PhaseRunning || prStack.Status.Phase == PhaseDegraded) && r.shouldRotateCredentials(stack) {
+		if err := r.rotateMongoDBCredentials(ctx, stack); err != nil {
+			log.Error(err, "Failed to rotate MongoDB credentials")
+			r.Recorder.Event(prStack, corev1.EventTypeWarning, EventTypeRotationFailed, fmt.Sprintf("Failed to rotate MongoDB credentials: %v", err))
+			prStack.Status.Message = fmt.Sprintf("Credential rotation failed: %v", err)
+			if updateErr := r.Status().Update(ctx, prStack); updateErr != nil {
+				ctrl.LoggerFrom(ctx).Error(updateErr, "Failed to update PRStack status after rotation failure")
+			}
+			return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+		}
+		r.Recorder.Event(prStack, corev1.EventTypeNormal, EventTypeCredentialsRotated, fmt.Sprintf("PR #%s MongoDB credentials rotated", prStack.Spec.PRNumber))
+	}
+
 	// Reconcile based on current phase
-	return r.reconcileByPhase(ctx, &prStack)
+	return r.reconcileByPhase(ctx, prStack)
 }
 
 func (r *PRStackReconciler) handleInitialization(ctx context.Context, prStack *pishopv1alpha1.PRStack) (ctrl.Result, error) {
 	log := ctrl.LoggerFrom(ctx)
 	log.Info("Initializing PR stack", "prNumber", prStack.Spec.PRNumber)
 
+	if err := ValidatePRStack(prStack); err != nil {
+		log.Error(err, "Invalid PR stack")
+		prStack.Status.Phase = PhaseFailed
+		prStack.Status.Message = err.Error()
+		return ctrl.Result{}, r.Status().Update(ctx, prStack)
+	}
+
 	r.Recorder.Event(prStack, corev1.EventTypeNormal, EventTypeInitializing, fmt.Sprintf("Starting initialization for PR #%s", prStack.Spec.PRNumber))
 
 	// Update status to Provisioning
 	prStack.Status.Phase = PhaseProvisioning
 	prStack.Status.Message = "Starting PR stack provisioning"
-	r.setProgressingCondition(prStack, "Initializing", "Preparing to provision infrastructure")
+	r.setProgressingCondition(asStack(prStack), "Initializing", "Preparing to provision infrastructure")
 	if err := r.Status().Update(ctx, prStack); err != nil {
 		return ctrl.Result{}, err
 	}
@@ -233,235 +295,44 @@ func (r *PRStackReconciler) handleInitialization(ctx context.Context, prStack *p
 	return ctrl.Result{RequeueAfter: RequeueIntervalShort}, nil
 }
 
-func (r *PRStackReconciler) handleProvisioning(ctx context.Context, prStack *pishopv1alpha1.PRStack) (ctrl.Result, error) {
-	log := ctrl.LoggerFrom(ctx)
-	log.Info("Provisioning PR stack resources", "prNumber", prStack.Spec.PRNumber)
-
-	r.Recorder.Event(prStack, corev1.EventTypeNormal, EventTypeProvisioning, fmt.Sprintf("Provisioning infrastructure for PR #%s", prStack.Spec.PRNumber))
-	r.setProgressingCondition(prStack, "Provisioning", "Provisioning MongoDB, NATS, and Redis")
-
-	// Create namespace first
-	namespaceName := r.getNamespaceName(prStack.Spec.PRNumber)
-	if err := r.createNamespace(ctx, namespaceName); err != nil {
-		return r.recordProvisioningError(ctx, prStack, "Namespace", err)
-	}
-
-	// Provision MongoDB databases and users
-	if err := r.provisionMongoDB(ctx, prStack); err != nil {
-		return r.recordProvisioningError(ctx, prStack, "MongoDB", err)
-	}
-
-	// Create secret for MongoDB credentials
-	if err := r.createMongoDBSecret(ctx, prStack); err != nil {
-		return r.recordProvisioningError(ctx, prStack, "MongoDB secret", err)
-	}
-
-	// Provision NATS server and subjects
-	if err := r.provisionNATS(ctx, prStack); err != nil {
-		return r.recordProvisioningError(ctx, prStack, "NATS", err)
-	}
-
-	// Provision Redis keyspaces
-	if err := r.provisionRedis(ctx, prStack); err != nil {
-		return r.recordProvisioningError(ctx, prStack, "Redis", err)
-	}
-
-	r.Recorder.Event(prStack, corev1.EventTypeNormal, EventTypeProvisioningComplete, "Infrastructure provisioning completed successfully")
-
-	// Move to deployment phase
-	prStack.Status.Phase = PhaseDeploying
-	prStack.Status.Message = "Resources provisioned, starting service deployment"
-	r.setProgressingCondition(prStack, "Deploying", "Deploying services to cluster")
-	if err := r.Status().Update(ctx, prStack); err != nil {
-		return ctrl.Result{}, err
-	}
-
-	return ctrl.Result{RequeueAfter: RequeueIntervalShort}, nil
-}
-
-func (r *PRStackReconciler) createMongoDBSecret(ctx context.Context, prStack *pishopv1alpha1.PRStack) error {
-	namespaceName := r.getNamespaceName(prStack.Spec.PRNumber)
-
-	// Check if MongoDB credentials are available
-	if prStack.Status.MongoDB == nil {
-		return fmt.Errorf("MongoDB credentials not available in status")
-	}
-
-	secret := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      MongoDBSecretName,
-			Namespace: namespaceName,
-		},
-		StringData: map[string]string{
-			"username":         prStack.Status.MongoDB.User,
-			"password":         prStack.Status.MongoDB.Password,
-			"connectionString": prStack.Status.MongoDB.ConnectionString,
-			"databases":        strings.Join(prStack.Status.MongoDB.Databases, ","),
-		},
-	}
-
-	if err := r.CreateOrUpdate(ctx, secret); err != nil {
-		return fmt.Errorf("failed to create MongoDB secret: %w", err)
-	}
-
-	return nil
-}
-
-func (r *PRStackReconciler) handleDeployment(ctx context.Context, prStack *pishopv1alpha1.PRStack) (ctrl.Result, error) {
-	log := ctrl.LoggerFrom(ctx)
-	log.Info("Deploying PR stack services", "prNumber", prStack.Spec.PRNumber)
-
-	r.Recorder.Event(prStack, corev1.EventTypeNormal, EventTypeDeploying, fmt.Sprintf("Deploying services for PR #%s", prStack.Spec.PRNumber))
-
-	// Namespace should already exist from provisioning phase
-	namespaceName := r.getNamespaceName(prStack.Spec.PRNumber)
-
-	// Create registry secret for image pulls
-	if err := r.createRegistrySecret(ctx, namespaceName); err != nil {
-		r.updateStatusWithError(ctx, prStack, "Failed to create registry secret", err)
-		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
-	}
-
-	// Create MongoDB, NATS, and Redis resources
-	if err := r.createMongoDBResources(ctx, prStack, namespaceName); err != nil {
-		r.updateStatusWithError(ctx, prStack, "Failed to create MongoDB resources", err)
-		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
-	}
-
-	// Create NATS resources
-	if err := r.createNATSResources(ctx, prStack, namespaceName); err != nil {
-		r.updateStatusWithError(ctx, prStack, "Failed to create NATS resources", err)
-		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
-	}
-
-	// Create Redis resources
-	if err := r.createRedisResources(ctx, prStack, namespaceName); err != nil {
-		r.updateStatusWithError(ctx, prStack, "Failed to create Redis resources", err)
-		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
-	}
-
-	// Ensure backup storage is available
-	if err := r.ensureBackupStorage(ctx, prStack, namespaceName); err != nil {
-		r.updateStatusWithError(ctx, prStack, "Failed to create backup storage", err)
-		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
-	}
-
-	// Deploy services based on the services list
-	services := prStack.Spec.Services
-	if len(services) == 0 {
-		// Default services if none specified
-		services = strings.Split(DefaultServicesString, ",")
-	}
-
-	// Deploy each service
-	var serviceStatuses []pishopv1alpha1.ServiceStatus
-	failedServices := 0
-	for _, serviceName := range services {
-		if err := r.createServiceDeployment(ctx, prStack, namespaceName, serviceName); err != nil {
-			log.Error(err, "Failed to deploy service", "service", serviceName)
-			serviceStatuses = append(serviceStatuses, pishopv1alpha1.ServiceStatus{
-				Name:    serviceName,
-				Status:  "Failed",
-				Message: err.Error(),
-			})
-			failedServices++
-		} else {
-			serviceStatuses = append(serviceStatuses, pishopv1alpha1.ServiceStatus{
-				Name:    serviceName,
-				Status:  "Running",
-				Message: "Service deployed successfully",
-			})
-		}
-	}
-
-	// Update status with service information
-	prStack.Status.Services = serviceStatuses
-
-	// Determine the appropriate state based on service deployment results
-	if failedServices == len(services) {
-		// All services failed - set to Failed state
-		prStack.Status.Phase = PhaseFailed
-		prStack.Status.Message = fmt.Sprintf("All %d services failed to deploy", failedServices)
-		r.setCondition(prStack, metav1.Condition{
-			Type:               ConditionTypeReady,
-			Status:             metav1.ConditionFalse,
-			Reason:             "AllServicesFailed",
-			Message:            fmt.Sprintf("All %d services failed to deploy", failedServices),
-			LastTransitionTime: metav1.Now(),
-		})
-		r.setCondition(prStack, metav1.Condition{
-			Type:               ConditionTypeDegraded,
-			Status:             metav1.ConditionTrue,
-			Reason:             "AllServicesFailed",
-			Message:            "No services are running",
-			LastTransitionTime: metav1.Now(),
-		})
-		r.Recorder.Event(prStack, corev1.EventTypeWarning, EventTypeDeployed, fmt.Sprintf("PR #%s stack failed: all services failed to deploy", prStack.Spec.PRNumber))
-	} else if failedServices > 0 {
-		// Some services failed - set to Degraded state
-		prStack.Status.Phase = PhaseDegraded
-		prStack.Status.Message = fmt.Sprintf("Stack is degraded: %d/%d services failed", failedServices, len(services))
-		r.setCondition(prStack, metav1.Condition{
-			Type:               ConditionTypeReady,
-			Status:             metav1.ConditionTrue,
-			Reason:             "PartiallyDegraded",
-			Message:            fmt.Sprintf("%d/%d services running", len(services)-failedServices, len(services)),
-			LastTransitionTime: metav1.Now(),
-		})
-		r.setCondition(prStack, metav1.Condition{
-			Type:               ConditionTypeDegraded,
-			Status:             metav1.ConditionTrue,
-			Reason:             "ServiceFailures",
-			Message:            fmt.Sprintf("%d services failed to deploy", failedServices),
-			LastTransitionTime: metav1.Now(),
-		})
-		r.Recorder.Event(prStack, corev1.EventTypeWarning, EventTypeDeployed, fmt.Sprintf("PR #%s stack is degraded: %d/%d services failed", prStack.Spec.PRNumber, failedServices, len(services)))
-	} else {
-		// All services deployed successfully - set to Running state
-		prStack.Status.Phase = PhaseRunning
-		prStack.Status.Message = "PR stack is running"
-		r.setReadyCondition(prStack, "StackRunning", fmt.Sprintf("All %d services deployed successfully", len(serviceStatuses)))
-		r.setProgressingCondition(prStack, "Complete", "Stack deployment completed")
-		r.Recorder.Event(prStack, corev1.EventTypeNormal, EventTypeDeployed, fmt.Sprintf("PR #%s stack is now running with %d services", prStack.Spec.PRNumber, len(serviceStatuses)))
-	}
-
-	if err := r.Status().Update(ctx, prStack); err != nil {
-		return ctrl.Result{}, err
-	}
-
-	return ctrl.Result{RequeueAfter: RequeueIntervalLong}, nil
-}
-
 func (r *PRStackReconciler) handleRunning(ctx context.Context, prStack *pishopv1alpha1.PRStack) (ctrl.Result, error) {
 	log := ctrl.LoggerFrom(ctx)
+	stack := asStack(prStack)
 	log.Info("PR stack is running", "prNumber", prStack.Spec.PRNumber)
 
-	// Check if we need to scale based on Active flag
 	namespaceName := r.getNamespaceName(prStack.Spec.PRNumber)
 
-	// Get current deployment state
-	var deployments appsv1.DeploymentList
-	if err := r.List(ctx, &deployments, client.InNamespace(namespaceName)); err == nil && len(deployments.Items) > 0 {
-		// Check if replicas match desired state (max 1 replica)
-		desiredReplicas := int32(1)
-		if !prStack.Spec.Active {
-			desiredReplicas = 0
+	// Scale the deployments to match the Active flag, restoring each service's replicas
+	if prStack.Spec.Active {
+		if err := r.restoreDeployments(ctx, stack); err != nil {
+			log.Error(err, "Failed to restore deployments")
 		}
+	} else if err := r.scaleDeployments(ctx, namespaceName, 0); err != nil {
+		log.Error(err, "Failed to scale deployments")
+	}
 
-		currentReplicas := int32(-1)
-		if len(deployments.Items) > 0 && deployments.Items[0].Spec.Replicas != nil {
-			currentReplicas = *deployments.Items[0].Spec.Replicas
+	// Recreate missing JetStream streams and correct drifted ones
+	if prStack.Spec.Active && hasJetStreamStreams(stack) {
+		if ready, err := r.isNATSReady(ctx, stack, namespaceName); err == nil && ready {
+			if err := r.reconcileJetStreamStreams(ctx, stack); err != nil {
+				log.Error(err, "Failed to reconcile JetStream streams")
+				r.Recorder.Event(prStack, corev1.EventTypeWarning, EventTypeStreamsFailed, err.Error())
+			}
 		}
+	}
 
-		// Only scale if there's a mismatch
-		if currentReplicas != desiredReplicas {
-			log.Info("Scaling deployments to match active state", "current", currentReplicas, "desired", desiredReplicas)
-			if err := r.scaleDeployments(ctx, namespaceName, desiredReplicas); err != nil {
-				log.Error(err, "Failed to scale deployments")
-			}
+	// Re-apply managed objects changed by hand; inactive stacks are scaled down on purpose
+	if prStack.Spec.Active {
+		if err := r.reconcileDrift(ctx, stack); err != nil {
+			log.Error(err, "Failed to reconcile drift")
 		}
 	}
 
+	// Record finished backups
+	if err := r.recordBackupStatus(ctx, stack); err != nil {
+		log.Error(err, "Failed to record backup status")
+	}
+
 	// Check service health
 	allHealthy := true
 	for _, service := range prStack.Status.Services {
@@ -473,9 +344,10 @@ func (r *PRStackReconciler) handleRunning(ctx context.Context, prStack *pishopv1
 
 	if !allHealthy {
 		prStack.Status.Message = "Some services are not healthy"
-		if updateErr := r.Status().Update(ctx, prStack); updateErr != nil {
-			ctrl.LoggerFrom(ctx).Error(updateErr, "Failed to update PRStack status for unhealthy services")
-		}
+	}
+	r.updateStatusSummary(ctx, stack)
+	if updateErr := r.Status().Update(ctx, prStack); updateErr != nil {
+		ctrl.LoggerFrom(ctx).Error(updateErr, "Failed to update PRStack status")
 	}
 
 	return ctrl.Result{RequeueAfter: RequeueIntervalLong}, nil
@@ -483,6 +355,7 @@ func (r *PRStackReconciler) handleRunning(ctx context.Context, prStack *pishopv1
 
 func (r *PRStackReconciler) handleCleaning(ctx context.Context, prStack *pishopv1alpha1.PRStack) (ctrl.Result, error) {
 	log := ctrl.LoggerFrom(ctx)
+	stack := asStack(prStack)
 	log.Info("Cleaning up PR stack", "prNumber", prStack.Spec.PRNumber)
 
 	r.Recorder.Event(prStack, corev1.EventTypeNormal, EventTypeCleaning, fmt.Sprintf("Cleaning up all resources for PR #%s", prStack.Spec.PRNumber))
@@ -490,7 +363,7 @@ func (r *PRStackReconciler) handleCleaning(ctx context.Context, prStack *pishopv
 	// Create final backup before cleanup if enabled
 	if prStack.Spec.BackupConfig != nil && prStack.Spec.BackupConfig.Enabled && prStack.Status.MongoDB != nil {
 		log.Info("Creating final backup before cleanup", "prNumber", prStack.Spec.PRNumber)
-		if err := r.BackupManager.CreateBackup(ctx, prStack); err != nil {
+		if err := r.BackupManager.CreateBackup(ctx, stack); err != nil {
 			log.Error(err, "Failed to create final backup")
 			// Continue with cleanup even if backup fails
 		}
@@ -498,26 +371,26 @@ func (r *PRStackReconciler) handleCleaning(ctx context.Context, prStack *pishopv
 
 	// FIRST: Clean up Kubernetes resources (deployments, services, etc.)
 	// This ensures deployments are removed before database cleanup
-	if err := r.cleanupAllResources(ctx, prStack); err != nil {
-		r.updateStatusWithError(ctx, prStack, "Kubernetes cleanup failed", err)
+	if err := r.cleanupAllResources(ctx, stack); err != nil {
+		r.updateStatusWithError(ctx, stack, "Kubernetes cleanup failed", err)
 		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
 	}
 
 	// SECOND: Clean up MongoDB databases and users
-	if err := r.cleanupMongoDB(ctx, prStack); err != nil {
-		r.updateStatusWithError(ctx, prStack, "MongoDB cleanup failed", err)
+	if err := r.cleanupMongoDB(ctx, stack); err != nil {
+		r.updateStatusWithError(ctx, stack, "MongoDB cleanup failed", err)
 		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
 	}
 
 	// THIRD: Clean up NATS subjects
-	if err := r.cleanupNATS(ctx, prStack); err != nil {
-		r.updateStatusWithError(ctx, prStack, "NATS cleanup failed", err)
+	if err := r.cleanupNATS(ctx, stack); err != nil {
+		r.updateStatusWithError(ctx, stack, "NATS cleanup failed", err)
 		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
 	}
 
 	// FOURTH: Clean up Redis keyspaces
-	if err := r.cleanupRedis(ctx, prStack); err != nil {
-		r.updateStatusWithError(ctx, prStack, "Redis cleanup failed", err)
+	if err := r.cleanupRedis(ctx, stack); err != nil {
+		r.updateStatusWithError(ctx, stack, "Redis cleanup failed", err)
 		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
 	}
 
@@ -565,30 +438,20 @@ func (r *PRStackReconciler) handleDeletion(ctx context.Context, prStack *pishopv
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *PRStackReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&pishopv1alpha1.PRStack{}).
-		Owns(&appsv1.Deployment{}).
-		Owns(&corev1.Service{}).
-		Owns(&corev1.ConfigMap{}).
-		Owns(&corev1.Secret{}).
+	return ownStackObjects(ctrl.NewControllerManagedBy(mgr).
+		For(&pishopv1alpha1.PRStack{})).
 		Complete(r)
 }
 
 // New handler functions for enhanced lifecycle management
 
 func (r *PRStackReconciler) isStackExpired(prStack *pishopv1alpha1.PRStack) bool {
-	if prStack.Status.LastActiveAt == nil {
-		// Fallback to CreatedAt if LastActiveAt is not set
-		if prStack.Status.CreatedAt == nil {
-			return false
-		}
-		return time.Since(prStack.Status.CreatedAt.Time) > StackExpirationTime
-	}
-	return time.Since(prStack.Status.LastActiveAt.Time) > StackExpirationTime
+	return stackExpired(asStack(prStack))
 }
 
 func (r *PRStackReconciler) handleInactiveStack(ctx context.Context, prStack *pishopv1alpha1.PRStack) (ctrl.Result, error) {
 	log := ctrl.LoggerFrom(ctx)
+	stack := asStack(prStack)
 
 	// Check if this is due to expiration
 	isExpired := r.isStackExpired(prStack)
@@ -607,16 +470,27 @@ func (r *PRStackReconciler) handleInactiveStack(ctx context.Context, prStack *pi
 	if err := r.scaleDeployments(ctx, namespaceName, 0); err != nil {
 		log.Error(err, "Failed to scale down deployments")
 		r.Recorder.Event(prStack, corev1.EventTypeWarning, EventTypeScaleDownFailed, fmt.Sprintf("Failed to scale down: %v", err))
-		r.updateStatusWithError(ctx, prStack, "Failed to scale down", err)
+		r.updateStatusWithError(ctx, stack, "Failed to scale down", err)
 		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
 	}
 
+	// Dedicated MongoDB is scaled back up when the stack is provisioned again
+	if isDedicatedMongoDB(stack) {
+		if err := r.scaleDedicatedMongoDB(ctx, namespaceName, 0); err != nil {
+			log.Error(err, "Failed to scale down dedicated MongoDB")
+			r.Recorder.Event(prStack, corev1.EventTypeWarning, EventTypeScaleDownFailed, fmt.Sprintf("Failed to scale down dedicated MongoDB: %v", err))
+			r.updateStatusWithError(ctx, stack, "Failed to scale down", err)
+			return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+		}
+	}
+
 	prStack.Status.Phase = PhaseInactive
 	if isExpired {
 		prStack.Status.Message = fmt.Sprintf("Stack expired (age: %v) - all deployments scaled to 0", time.Since(prStack.Status.CreatedAt.Time).Round(time.Minute))
 	} else {
 		prStack.Status.Message = "Stack is inactive - all deployments scaled to 0"
 	}
+	r.updateStatusSummary(ctx, stack)
 
 	if err := r.Status().Update(ctx, prStack); err != nil {
 		return ctrl.Result{}, err
@@ -627,40 +501,6 @@ func (r *PRStackReconciler) handleInactiveStack(ctx context.Context, prStack *pi
 	return ctrl.Result{RequeueAfter: RequeueIntervalLong}, nil
 }
 
-func (r *PRStackReconciler) scaleDeployments(ctx context.Context, namespace string, replicas int32) error {
-	log := ctrl.LoggerFrom(ctx)
-
-	// List all deployments in the namespace
-	var deployments appsv1.DeploymentList
-	if err := r.List(ctx, &deployments, client.InNamespace(namespace)); err != nil {
-		return fmt.Errorf("failed to list deployments: %v", err)
-	}
-
-	// Scale each deployment
-	scaledCount := 0
-	for _, deployment := range deployments.Items {
-		if deployment.Spec.Replicas != nil && *deployment.Spec.Replicas == replicas {
-			continue // Already at desired replica count
-		}
-
-		log.Info("Scaling deployment", "name", deployment.Name, "namespace", namespace, "replicas", replicas)
-
-		// Update the deployment
-		deployment.Spec.Replicas = &replicas
-		if err := r.Update(ctx, &deployment); err != nil {
-			log.Error(err, "Failed to scale deployment", "name", deployment.Name)
-			return fmt.Errorf("failed to scale deployment %s: %v", deployment.Name, err)
-		}
-		scaledCount++
-	}
-
-	if scaledCount > 0 {
-		log.Info("Scaled deployments", "count", scaledCount, "namespace", namespace, "replicas", replicas)
-	}
-
-	return nil
-}
-
 // func (r *PRStackReconciler) forceRestartDeployments(ctx context.Context, namespace string) error {
 // 	log := ctrl.LoggerFrom(ctx)
 
@@ -694,63 +534,6 @@ func (r *PRStackReconciler) scaleDeployments(ctx context.Context, namespace stri
 // 	return nil
 // }
 
-// shouldRolloutDeployments checks if deployments should be rolled out based on deployedAt timestamp
-func (r *PRStackReconciler) shouldRolloutDeployments(prStack *pishopv1alpha1.PRStack) bool {
-	// If deployedAt is not set in spec, no rollout needed
-	if prStack.Spec.DeployedAt == nil {
-		return false
-	}
-
-	// If lastDeployedAt is not set in status, rollout is needed
-	if prStack.Status.LastDeployedAt == nil {
-		return true
-	}
-
-	// Rollout if deployedAt is different from lastDeployedAt
-	return !prStack.Spec.DeployedAt.Equal(prStack.Status.LastDeployedAt)
-}
-
-// rolloutDeployments triggers a rollout of all deployments in the namespace
-func (r *PRStackReconciler) rolloutDeployments(ctx context.Context, prStack *pishopv1alpha1.PRStack) error {
-	log := ctrl.LoggerFrom(ctx)
-	namespaceName := r.getNamespaceName(prStack.Spec.PRNumber)
-
-	log.Info("Rolling out all deployments", "namespace", namespaceName)
-
-	// List all deployments in the namespace
-	deployments := &appsv1.DeploymentList{}
-	if err := r.List(ctx, deployments, client.InNamespace(namespaceName)); err != nil {
-		return fmt.Errorf("failed to list deployments: %w", err)
-	}
-
-	if len(deployments.Items) == 0 {
-		log.Info("No deployments found to rollout", "namespace", namespaceName)
-		return nil
-	}
-
-	// Trigger rollout for each deployment by updating the restartedAt annotation
-	for i := range deployments.Items {
-		deployment := &deployments.Items[i]
-		log.Info("Rolling out deployment", "name", deployment.Name, "namespace", deployment.Namespace)
-
-		// Add/update the restartedAt annotation to trigger a rollout
-		if deployment.Spec.Template.Annotations == nil {
-			deployment.Spec.Template.Annotations = make(map[string]string)
-		}
-		deployment.Spec.Template.Annotations[RestartAnnotation] = prStack.Spec.DeployedAt.Format(time.RFC3339)
-
-		if err := r.Update(ctx, deployment); err != nil {
-			log.Error(err, "Failed to rollout deployment", "name", deployment.Name)
-			return fmt.Errorf("failed to rollout deployment %s: %w", deployment.Name, err)
-		}
-
-		log.Info("Successfully triggered rollout", "deployment", deployment.Name)
-	}
-
-	log.Info("All deployments rolled out successfully", "count", len(deployments.Items))
-	return nil
-}
-
 // Helper functions
 func containsString(slice []string, s string) bool {
 	return slices.Contains(slice, s)
@@ -785,6 +568,7 @@ func (r *PRStackReconciler) handleStackExpiration(ctx context.Context, prStack *
 // reconcileByPhase handles reconciliation based on current phase
 func (r *PRStackReconciler) reconcileByPhase(ctx context.Context, prStack *pishopv1alpha1.PRStack) (ctrl.Result, error) {
 	log := ctrl.LoggerFrom(ctx)
+	stack := asStack(prStack)
 
 	switch prStack.Status.Phase {
 	case PhaseInitialization:
@@ -800,9 +584,9 @@ func (r *PRStackReconciler) reconcileByPhase(ctx context.Context, prStack *pisho
 		}
 		return r.handleInitialization(ctx, prStack)
 	case PhaseProvisioning:
-		return r.handleProvisioning(ctx, prStack)
+		return r.handleProvisioning(ctx, stack)
 	case PhaseDeploying:
-		return r.handleDeployment(ctx, prStack)
+		return r.handleDeployment(ctx, stack)
 	case PhaseRunning:
 		return r.handleRunning(ctx, prStack)
 	case PhaseDegraded:
@@ -820,85 +604,3 @@ func (r *PRStackReconciler) reconcileByPhase(ctx context.Context, prStack *pisho
 		return ctrl.Result{}, nil
 	}
 }
-
-// updateStatusWithError updates PRStack status with error information
-func (r *PRStackReconciler) updateStatusWithError(ctx context.Context, prStack *pishopv1alpha1.PRStack, message string, err error) {
-	prStack.Status.Message = fmt.Sprintf("%s: %v", message, err)
-	prStack.Status.Phase = PhaseFailed
-	r.setCondition(prStack, metav1.Condition{
-		Type:               ConditionTypeReady,
-		Status:             metav1.ConditionFalse,
-		Reason:             "Error",
-		Message:            fmt.Sprintf("%s: %v", message, err),
-		LastTransitionTime: metav1.Now(),
-	})
-	r.setCondition(prStack, metav1.Condition{
-		Type:               ConditionTypeDegraded,
-		Status:             metav1.ConditionTrue,
-		Reason:             "ReconciliationFailed",
-		Message:            fmt.Sprintf("%s: %v", message, err),
-		LastTransitionTime: metav1.Now(),
-	})
-	if updateErr := r.Status().Update(ctx, prStack); updateErr != nil {
-		// Log the error but don't return it to avoid masking the original error
-		ctrl.LoggerFrom(ctx).Error(updateErr, "Failed to update PRStack status with error information")
-	}
-}
-
-// recordProvisioningError records a provisioning error event and updates status
-func (r *PRStackReconciler) recordProvisioningError(ctx context.Context, prStack *pishopv1alpha1.PRStack, component string, err error) (ctrl.Result, error) {
-	log := ctrl.LoggerFrom(ctx)
-	log.Error(err, fmt.Sprintf("Failed to provision %s", component))
-	r.Recorder.Event(prStack, corev1.EventTypeWarning, EventTypeProvisioningFailed,
-		fmt.Sprintf("%s provisioning failed: %v", component, err))
-	r.updateStatusWithError(ctx, prStack, fmt.Sprintf("%s provisioning failed", component), err)
-	return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
-}
-
-// setCondition sets or updates a condition in the PRStack status
-func (r *PRStackReconciler) setCondition(prStack *pishopv1alpha1.PRStack, condition metav1.Condition) {
-	// Find existing condition
-	for i, existingCondition := range prStack.Status.Conditions {
-		if existingCondition.Type == condition.Type {
-			// Only update if status or reason changed
-			if existingCondition.Status != condition.Status || existingCondition.Reason != condition.Reason {
-				condition.LastTransitionTime = metav1.Now()
-			} else {
-				condition.LastTransitionTime = existingCondition.LastTransitionTime
-			}
-			prStack.Status.Conditions[i] = condition
-			return
-		}
-	}
-	// Condition doesn't exist, add it
-	prStack.Status.Conditions = append(prStack.Status.Conditions, condition)
-}
-
-// setReadyCondition sets the Ready condition to True and clears degraded state
-func (r *PRStackReconciler) setReadyCondition(prStack *pishopv1alpha1.PRStack, reason, message string) {
-	r.setCondition(prStack, metav1.Condition{
-		Type:               ConditionTypeReady,
-		Status:             metav1.ConditionTrue,
-		Reason:             reason,
-		Message:            message,
-		LastTransitionTime: metav1.Now(),
-	})
-	r.setCondition(prStack, metav1.Condition{
-		Type:               ConditionTypeDegraded,
-		Status:             metav1.ConditionFalse,
-		Reason:             "Healthy",
-		Message:            "Stack is operating normally",
-		LastTransitionTime: metav1.Now(),
-	})
-}
-
-// setProgressingCondition sets the Progressing condition
-func (r *PRStackReconciler) setProgressingCondition(prStack *pishopv1alpha1.PRStack, reason, message string) {
-	r.setCondition(prStack, metav1.Condition{
-		Type:               ConditionTypeProgressing,
-		Status:             metav1.ConditionTrue,
-		Reason:             reason,
-		Message:            message,
-		LastTransitionTime: metav1.Now(),
-	})
-}
@@ -44,11 +44,12 @@ var _ = Describe("PRStack Controller", func() {
 		
 		fakeClient = fake.NewClientBuilder().
 			WithScheme(scheme).
+			WithInterceptorFuncs(serverSideApply).
 			WithStatusSubresource(&pishopv1alpha1.PRStack{}).
 			Build()
 		
 		recorder := record.NewFakeRecorder(100)
-		reconciler = &PRStackReconciler{
+		reconciler = &PRStackReconciler{StackEngine: &StackEngine{
 			Client:         fakeClient,
 			Scheme:         scheme,
 			Recorder:       recorder,
@@ -56,7 +57,7 @@ var _ = Describe("PRStack Controller", func() {
 			MongoUsername:  "admin",
 			MongoPassword:  "password",
 			BaseDomain:     "shop.pilab.hu",
-		}
+		}}
 		
 		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 	})
@@ -141,6 +142,31 @@ var _ = Describe("PRStack Controller", func() {
 			Expect(updatedPRStack.Status.LastActiveAt).ToNot(BeNil())
 		})
 
+		It("should fail initialization of an invalid stack", func() {
+			prStack := &pishopv1alpha1.PRStack{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test-pr",
+				},
+				Spec: pishopv1alpha1.PRStackSpec{
+					PRNumber: "abc",
+					Active:   true,
+				},
+			}
+
+			Expect(fakeClient.Create(ctx, prStack)).To(Succeed())
+
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "test-pr"}}
+			for i := 0; i < 3; i++ {
+				_, err := reconciler.Reconcile(ctx, req)
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			var updatedPRStack pishopv1alpha1.PRStack
+			Expect(fakeClient.Get(ctx, req.NamespacedName, &updatedPRStack)).To(Succeed())
+			Expect(updatedPRStack.Status.Phase).To(Equal(PhaseFailed))
+			Expect(updatedPRStack.Status.Message).To(ContainSubstring("PR number must be numeric"))
+		})
+
 		It("should handle inactive stack", func() {
 			prStack := &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
@@ -227,7 +253,7 @@ var _ = Describe("PRStack Controller", func() {
 				},
 			}
 			
-			domain := reconciler.getDomain(prStack)
+			domain := reconciler.getDomain(asStack(prStack))
 			Expect(domain).To(Equal("custom.example.com"))
 		})
 
@@ -238,7 +264,7 @@ var _ = Describe("PRStack Controller", func() {
 				},
 			}
 			
-			domain := reconciler.getDomain(prStack)
+			domain := reconciler.getDomain(asStack(prStack))
 			Expect(domain).To(Equal("pr-123.shop.pilab.hu"))
 		})
 
@@ -275,7 +301,7 @@ var _ = Describe("PRStack Controller", func() {
 				},
 			}
 			
-			Expect(reconciler.shouldRolloutDeployments(prStack)).To(BeTrue())
+			Expect(reconciler.shouldRolloutDeployments(asStack(prStack))).To(BeTrue())
 		})
 
 		It("should not detect rollout needed when deployedAt unchanged", func() {
@@ -289,7 +315,7 @@ var _ = Describe("PRStack Controller", func() {
 				},
 			}
 			
-			Expect(reconciler.shouldRolloutDeployments(prStack)).To(BeFalse())
+			Expect(reconciler.shouldRolloutDeployments(asStack(prStack))).To(BeFalse())
 		})
 	})
 
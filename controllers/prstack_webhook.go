@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+//+kubebuilder:webhook:path=/mutate-shop-pilab-hu-v1alpha1-prstack,mutating=true,failurePolicy=fail,sideEffects=None,groups=shop.pilab.hu,resources=prstacks,verbs=create;update,versions=v1alpha1,name=mprstack.shop.pilab.hu,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-shop-pilab-hu-v1alpha1-prstack,mutating=false,failurePolicy=fail,sideEffects=None,groups=shop.pilab.hu,resources=prstacks,verbs=create;update,versions=v1alpha1,name=vprstack.shop.pilab.hu,admissionReviewVersions=v1
+
+// PRStackWebhook defaults and validates PRStacks when they are written, so invalid specs are
+// rejected by the API server and the stored object shows what the operator deploys
+type PRStackWebhook struct{}
+
+var (
+	_ webhook.CustomDefaulter = &PRStackWebhook{}
+	_ webhook.CustomValidator = &PRStackWebhook{}
+)
+
+// SetupWebhookWithManager registers the defaulting and validating webhooks with the manager
+func (w *PRStackWebhook) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&pishopv1alpha1.PRStack{}).
+		WithDefaulter(w).
+		WithValidator(w).
+		Complete()
+}
+
+// Default fills in the image tag, services and backup storage the operator uses when they
+// are not set
+func (w *PRStackWebhook) Default(ctx context.Context, obj runtime.Object) error {
+	prStack, ok := obj.(*pishopv1alpha1.PRStack)
+	if !ok {
+		return fmt.Errorf("expected a PRStack but got %T", obj)
+	}
+
+	DefaultPRStack(prStack)
+	return nil
+}
+
+// ValidateCreate rejects invalid PRStacks
+func (w *PRStackWebhook) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	prStack, ok := obj.(*pishopv1alpha1.PRStack)
+	if !ok {
+		return nil, fmt.Errorf("expected a PRStack but got %T", obj)
+	}
+
+	return nil, ValidatePRStack(prStack)
+}
+
+// ValidateUpdate rejects invalid PRStacks, changes to the storage limit of a dedicated MongoDB
+// and changes to the PR number, which would orphan
+// the namespace and databases of the stack, or make the cleanup of a deleted stack drop those of
+// another PR. Apart from the PR number, updates leaving the spec unchanged, like status and
+// finalizer updates, and updates of deleted stacks are not validated, so stacks stored before a
+// validation was added can still be cleaned up.
+func (w *PRStackWebhook) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldPRStack, ok := oldObj.(*pishopv1alpha1.PRStack)
+	if !ok {
+		return nil, fmt.Errorf("expected a PRStack but got %T", oldObj)
+	}
+	prStack, ok := newObj.(*pishopv1alpha1.PRStack)
+	if !ok {
+		return nil, fmt.Errorf("expected a PRStack but got %T", newObj)
+	}
+
+	if prStack.Spec.PRNumber != oldPRStack.Spec.PRNumber {
+		return nil, &ValidationError{Field: "prNumber", Message: "PR number is immutable"}
+	}
+
+	if prStack.DeletionTimestamp != nil || equality.Semantic.DeepEqual(prStack.Spec, oldPRStack.Spec) {
+		return nil, nil
+	}
+
+	if err := validateDedicatedMongoDBStorageUpdate(oldPRStack, prStack); err != nil {
+		return nil, err
+	}
+
+	return nil, ValidatePRStack(prStack)
+}
+
+// validateDedicatedMongoDBStorageUpdate rejects changes to the storage limit of a dedicated
+// MongoDB, whose data volume is a StatefulSet claim template that cannot change once created
+func validateDedicatedMongoDBStorageUpdate(oldPRStack, prStack *pishopv1alpha1.PRStack) error {
+	if !isDedicatedMongoDB(asStack(oldPRStack)) || !isDedicatedMongoDB(asStack(prStack)) {
+		return nil
+	}
+
+	// Invalid storage limits are reported by ValidatePRStack
+	oldStorage, oldErr := dedicatedMongoDBStorage(asStack(oldPRStack))
+	storage, err := dedicatedMongoDBStorage(asStack(prStack))
+	if oldErr != nil || err != nil || sameStorage(oldStorage, storage) {
+		return nil
+	}
+
+	return &ValidationError{
+		Field:   "resourceLimits.storageLimit",
+		Message: "the storage limit of a dedicated MongoDB is immutable, its data volume is created with the stack",
+	}
+}
+
+// ValidateDelete allows every deletion, the finalizer cleans up the stack
+func (w *PRStackWebhook) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// DefaultPRStack sets the defaults the operator would otherwise apply when provisioning
+func DefaultPRStack(prStack *pishopv1alpha1.PRStack) {
+	if prStack.Spec.ImageTag == "" && prStack.Spec.PRNumber != "" {
+		prStack.Spec.ImageTag = "pr-" + prStack.Spec.PRNumber
+	}
+
+	if len(prStack.Spec.Services) == 0 {
+		prStack.Spec.Services = defaultServices()
+	}
+
+	if backupConfig := prStack.Spec.BackupConfig; backupConfig != nil {
+		if backupConfig.StorageClass == "" {
+			backupConfig.StorageClass = DefaultBackupStorageClass
+		}
+		if backupConfig.StorageSize == "" {
+			backupConfig.StorageSize = DefaultBackupStorageSize
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+// The admission webhooks are tested against a real API server, which needs the envtest binaries
+// (see setup-envtest) pointed to by KUBEBUILDER_ASSETS
+var _ = Describe("PRStack Webhook with envtest", Ordered, func() {
+	var (
+		ctx       context.Context
+		cancel    context.CancelFunc
+		testEnv   *envtest.Environment
+		k8sClient client.Client
+	)
+
+	BeforeAll(func() {
+		if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+			Skip("KUBEBUILDER_ASSETS is not set")
+		}
+
+		ctx, cancel = context.WithCancel(context.Background())
+
+		testEnv = &envtest.Environment{
+			CRDDirectoryPaths:     []string{filepath.Join("..", "config", "crd", "bases")},
+			ErrorIfCRDPathMissing: true,
+			WebhookInstallOptions: envtest.WebhookInstallOptions{
+				Paths: []string{filepath.Join("..", "config", "webhook", "manifests.yaml")},
+			},
+		}
+		cfg, err := testEnv.Start()
+		Expect(err).ToNot(HaveOccurred())
+
+		scheme := newTestScheme()
+
+		k8sClient, err = client.New(cfg, client.Options{Scheme: scheme})
+		Expect(err).ToNot(HaveOccurred())
+
+		webhookOptions := &testEnv.WebhookInstallOptions
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme:  scheme,
+			Metrics: metricsserver.Options{BindAddress: "0"},
+			WebhookServer: webhook.NewServer(webhook.Options{
+				Host:    webhookOptions.LocalServingHost,
+				Port:    webhookOptions.LocalServingPort,
+				CertDir: webhookOptions.LocalServingCertDir,
+			}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect((&PRStackWebhook{}).SetupWebhookWithManager(mgr)).To(Succeed())
+
+		go func() {
+			defer GinkgoRecover()
+			Expect(mgr.Start(ctx)).To(Succeed())
+		}()
+		Eventually(func() error {
+			return mgr.GetWebhookServer().StartedChecker()(nil)
+		}).Should(Succeed())
+	})
+
+	AfterAll(func() {
+		if testEnv == nil {
+			return
+		}
+		cancel()
+		Expect(testEnv.Stop()).To(Succeed())
+	})
+
+	newPRStack := func(name, prNumber string) *pishopv1alpha1.PRStack {
+		return &pishopv1alpha1.PRStack{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: pishopv1alpha1.PRStackSpec{
+				PRNumber: prNumber,
+				Active:   true,
+			},
+		}
+	}
+
+	It("should store the defaults", func() {
+		prStack := newPRStack("pr-123", "123")
+		Expect(k8sClient.Create(ctx, prStack)).To(Succeed())
+
+		stored := &pishopv1alpha1.PRStack{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(prStack), stored)).To(Succeed())
+		Expect(stored.Spec.ImageTag).To(Equal("pr-123"))
+		Expect(stored.Spec.Services).To(Equal(defaultServices()))
+	})
+
+	It("should reject an invalid spec", func() {
+		err := k8sClient.Create(ctx, newPRStack("pr-invalid", "abc"))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("PR number must be numeric"))
+	})
+
+	It("should reject changing the PR number", func() {
+		prStack := newPRStack("pr-456", "456")
+		Expect(k8sClient.Create(ctx, prStack)).To(Succeed())
+
+		prStack.Spec.PRNumber = "789"
+		err := k8sClient.Update(ctx, prStack)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("PR number is immutable"))
+	})
+
+	It("should delete an invalid stack", func() {
+		prStack := newPRStack("pr-321", "321")
+		prStack.Finalizers = []string{FinalizerName}
+		Expect(k8sClient.Create(ctx, prStack)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, prStack)).To(Succeed())
+
+		// A deleted stack is no longer validated, as a stack stored before a validation was added
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(prStack), prStack)).To(Succeed())
+		prStack.Spec.ImageTag = "invalid tag"
+		Expect(k8sClient.Update(ctx, prStack)).To(Succeed())
+
+		// The cleanup would drop the databases of another PR
+		changed := prStack.DeepCopy()
+		changed.Spec.PRNumber = "654"
+		err := k8sClient.Update(ctx, changed)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("PR number is immutable"))
+
+		// Removing the finalizer leaves the invalid spec unchanged
+		prStack.Finalizers = nil
+		Expect(k8sClient.Update(ctx, prStack)).To(Succeed())
+		Eventually(func() bool {
+			return errors.IsNotFound(k8sClient.Get(ctx, client.ObjectKeyFromObject(prStack), &pishopv1alpha1.PRStack{}))
+		}).Should(BeTrue())
+	})
+})
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+var _ = Describe("PRStack Webhook", func() {
+	var (
+		ctx     context.Context
+		webhook *PRStackWebhook
+		prStack *pishopv1alpha1.PRStack
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		webhook = &PRStackWebhook{}
+		prStack = newTestPRStack()
+	})
+
+	Context("Default", func() {
+		It("should default the image tag and services", func() {
+			Expect(webhook.Default(ctx, prStack)).To(Succeed())
+
+			Expect(prStack.Spec.ImageTag).To(Equal("pr-123"))
+			Expect(prStack.Spec.Services).To(Equal(defaultServices()))
+			Expect(prStack.Spec.BackupConfig).To(BeNil())
+		})
+
+		It("should default the backup storage", func() {
+			prStack.Spec.BackupConfig = &pishopv1alpha1.BackupConfig{Enabled: true, Schedule: "0 2 * * *"}
+
+			Expect(webhook.Default(ctx, prStack)).To(Succeed())
+
+			Expect(prStack.Spec.BackupConfig.StorageClass).To(Equal(DefaultBackupStorageClass))
+			Expect(prStack.Spec.BackupConfig.StorageSize).To(Equal(DefaultBackupStorageSize))
+		})
+
+		It("should keep the values that are set", func() {
+			prStack.Spec.ImageTag = "v1.2.3"
+			prStack.Spec.Services = []string{"product-service"}
+			prStack.Spec.BackupConfig = &pishopv1alpha1.BackupConfig{StorageClass: "fast", StorageSize: "1Gi"}
+
+			Expect(webhook.Default(ctx, prStack)).To(Succeed())
+
+			Expect(prStack.Spec.ImageTag).To(Equal("v1.2.3"))
+			Expect(prStack.Spec.Services).To(Equal([]string{"product-service"}))
+			Expect(prStack.Spec.BackupConfig.StorageClass).To(Equal("fast"))
+			Expect(prStack.Spec.BackupConfig.StorageSize).To(Equal("1Gi"))
+		})
+	})
+
+	Context("Validate", func() {
+		It("should accept a valid stack", func() {
+			_, err := webhook.ValidateCreate(ctx, prStack)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should reject an invalid stack", func() {
+			prStack.Spec.PRNumber = "abc"
+
+			_, err := webhook.ValidateCreate(ctx, prStack)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("PR number must be numeric"))
+		})
+
+		It("should reject changing the PR number", func() {
+			updated := prStack.DeepCopy()
+			updated.Spec.PRNumber = "456"
+
+			_, err := webhook.ValidateUpdate(ctx, prStack, updated)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("PR number is immutable"))
+		})
+
+		It("should accept other updates", func() {
+			updated := prStack.DeepCopy()
+			updated.Spec.Active = false
+
+			_, err := webhook.ValidateUpdate(ctx, prStack, updated)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should not validate updates leaving an invalid spec unchanged", func() {
+			prStack.Spec.PRNumber = "abc"
+			updated := prStack.DeepCopy()
+			updated.Finalizers = []string{FinalizerName}
+
+			_, err := webhook.ValidateUpdate(ctx, prStack, updated)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should not validate deleted stacks", func() {
+			updated := prStack.DeepCopy()
+			updated.Spec.ImageTag = "invalid tag"
+			updated.DeletionTimestamp = &metav1.Time{}
+
+			_, err := webhook.ValidateUpdate(ctx, prStack, updated)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should reject changing the PR number of deleted stacks", func() {
+			updated := prStack.DeepCopy()
+			updated.Spec.PRNumber = "456"
+			updated.DeletionTimestamp = &metav1.Time{}
+
+			_, err := webhook.ValidateUpdate(ctx, prStack, updated)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("PR number is immutable"))
+		})
+
+		It("should reject changing the storage limit of a dedicated MongoDB", func() {
+			prStack.Spec.MongoDB = &pishopv1alpha1.MongoDBConfig{Mode: MongoDBModeDedicated}
+			prStack.Spec.ResourceLimits = &pishopv1alpha1.ResourceLimits{StorageLimit: "5Gi"}
+			updated := prStack.DeepCopy()
+			updated.Spec.ResourceLimits.StorageLimit = "10Gi"
+
+			_, err := webhook.ValidateUpdate(ctx, prStack, updated)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("resourceLimits.storageLimit"))
+
+			updated.Spec.ResourceLimits = nil
+			_, err = webhook.ValidateUpdate(ctx, prStack, updated)
+			Expect(err).To(HaveOccurred())
+
+			updated.Spec.ResourceLimits = &pishopv1alpha1.ResourceLimits{StorageLimit: "5120Mi"}
+			_, err = webhook.ValidateUpdate(ctx, prStack, updated)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should accept changing the storage limit when switching to a dedicated MongoDB", func() {
+			updated := prStack.DeepCopy()
+			updated.Spec.MongoDB = &pishopv1alpha1.MongoDBConfig{Mode: MongoDBModeDedicated}
+			updated.Spec.ResourceLimits = &pishopv1alpha1.ResourceLimits{StorageLimit: "5Gi"}
+
+			_, err := webhook.ValidateUpdate(ctx, prStack, updated)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// DefaultRegistryHost is the registry the service images are pulled from
+	DefaultRegistryHost = "ghcr.io"
+	// DefaultRegistryRepository is the repository prefix of the service images
+	DefaultRegistryRepository = "pilab-dev"
+
+	// RegistrySecretName is the pull secret created in stack namespaces from the registry
+	// credentials. The name is kept from when only GHCR was supported.
+	RegistrySecretName = "ghcr-secret"
+)
+
+// RegistryConfig defines the container registry the service images are pulled from
+type RegistryConfig struct {
+	// Host of the registry, DefaultRegistryHost when empty
+	Host string
+	// Repository prefix of the images on the registry, e.g. "pilab-dev" for
+	// ghcr.io/pilab-dev/cart-service. DefaultRegistryRepository when empty.
+	Repository string
+	// CredentialsSecret names the Secret holding the pull credentials, either a
+	// kubernetes.io/dockerconfigjson Secret or one with username and password keys. When empty
+	// the GitHub credentials of the operator are used.
+	CredentialsSecret string
+	// CredentialsNamespace of the credentials Secret, the operator namespace
+	CredentialsNamespace string
+}
+
+// image returns the reference of the image of a service with the given tag
+func (r RegistryConfig) image(service, tag string) string {
+	host := r.Host
+	if host == "" {
+		host = DefaultRegistryHost
+	}
+	repository := r.Repository
+	if repository == "" {
+		repository = DefaultRegistryRepository
+	}
+	return fmt.Sprintf("%s/%s/%s:%s", host, repository, service, tag)
+}
+
+// host returns the registry host the credentials are for
+func (r RegistryConfig) host() string {
+	if r.Host == "" {
+		return DefaultRegistryHost
+	}
+	return r.Host
+}
+
+// getImageTag returns the image of a service, tagged with the ImageTag of the stack or
+// pr-{prNumber} by default
+func (e *StackEngine) getImageTag(stack Stack, serviceName string) string {
+	if stack.Spec().ImageTag != "" {
+		return e.Registry.image(serviceName, stack.Spec().ImageTag)
+	}
+	return e.Registry.image(serviceName, "pr-"+stack.ID())
+}
+
+// hasRegistryCredentials reports whether the operator creates the registry pull secret
+func (e *StackEngine) hasRegistryCredentials() bool {
+	return e.Registry.CredentialsSecret != "" || (e.GitHubUsername != "" && e.GitHubToken != "")
+}
+
+// imagePullSecrets returns the pull secrets of the services of a stack: those of its spec, or
+// the registry pull secret of the operator when it has credentials
+func (e *StackEngine) imagePullSecrets(stack Stack) []corev1.LocalObjectReference {
+	if len(stack.Spec().ImagePullSecrets) > 0 {
+		return stack.Spec().ImagePullSecrets
+	}
+	if e.hasRegistryCredentials() {
+		return []corev1.LocalObjectReference{{Name: RegistrySecretName}}
+	}
+	return nil
+}
+
+// registryDockerConfig returns the .dockerconfigjson of the registry credentials, read from
+// the credentials Secret or built from the GitHub credentials. It is nil without credentials.
+func (e *StackEngine) registryDockerConfig(ctx context.Context) ([]byte, error) {
+	if e.Registry.CredentialsSecret == "" {
+		if e.GitHubUsername == "" || e.GitHubToken == "" {
+			return nil, nil
+		}
+		return dockerConfigJSON(e.Registry.host(), e.GitHubUsername, e.GitHubToken, e.GitHubEmail)
+	}
+
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Name: e.Registry.CredentialsSecret, Namespace: e.Registry.CredentialsNamespace}
+	if err := e.Get(ctx, key, secret); err != nil {
+		return nil, fmt.Errorf("failed to get registry credentials secret %s: %v", key, err)
+	}
+	if config, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+		return config, nil
+	}
+	username, password := string(secret.Data["username"]), string(secret.Data["password"])
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("registry credentials secret %s has neither %s nor username and password", key, corev1.DockerConfigJsonKey)
+	}
+	return dockerConfigJSON(e.Registry.host(), username, password, string(secret.Data["email"]))
+}
+
+// dockerConfigJSON builds a .dockerconfigjson authenticating to a single registry
+func dockerConfigJSON(host, username, password, email string) ([]byte, error) {
+	type dockerConfigEntry struct {
+		Username string `json:"username"`
+		Email    string `json:"email,omitempty"`
+		Password string `json:"password"`
+		Auth     string `json:"auth"`
+	}
+
+	type dockerConfig struct {
+		Auths map[string]dockerConfigEntry `json:"auths"`
+	}
+
+	config, err := json.Marshal(dockerConfig{
+		Auths: map[string]dockerConfigEntry{
+			host: {
+				Username: username,
+				Password: password,
+				Email:    email,
+				Auth:     base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password))),
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal docker config: %v", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+var _ = Describe("Registry", func() {
+	var (
+		ctx        context.Context
+		engine     *StackEngine
+		fakeClient client.Client
+		prStack    *pishopv1alpha1.PRStack
+	)
+
+	registrySecret := func() *corev1.Secret {
+		secret := &corev1.Secret{}
+		Expect(fakeClient.Get(ctx, client.ObjectKey{Name: RegistrySecretName, Namespace: testNamespace}, secret)).To(Succeed())
+		return secret
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		prStack = newTestPRStack()
+		fakeClient = newTestClient().Build()
+
+		engine = newTestEngine(fakeClient)
+		engine.Registry = RegistryConfig{
+			Host:                 "harbor.pilab.hu",
+			Repository:           "mirror/pishop",
+			CredentialsNamespace: "pishop-operator-system",
+		}
+	})
+
+	It("should pull the images from the configured registry", func() {
+		Expect(engine.getImageTag(asStack(prStack), "cart-service")).To(Equal("harbor.pilab.hu/mirror/pishop/cart-service:pr-123"))
+		Expect((&StackEngine{}).getImageTag(asStack(prStack), "cart-service")).To(Equal("ghcr.io/pilab-dev/cart-service:pr-123"))
+	})
+
+	It("should only reference the registry secret when there are credentials", func() {
+		Expect(engine.imagePullSecrets(asStack(prStack))).To(BeEmpty())
+
+		engine.GitHubUsername = "pilab"
+		engine.GitHubToken = "token"
+		Expect(engine.imagePullSecrets(asStack(prStack))).To(Equal([]corev1.LocalObjectReference{{Name: RegistrySecretName}}))
+
+		prStack.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "harbor-pull"}}
+		Expect(engine.imagePullSecrets(asStack(prStack))).To(Equal([]corev1.LocalObjectReference{{Name: "harbor-pull"}}))
+	})
+
+	It("should copy the docker config of the credentials secret", func() {
+		dockerConfig := []byte(`{"auths":{"harbor.pilab.hu":{"auth":"cm9ib3Q6c2VjcmV0"}}}`)
+		Expect(fakeClient.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "harbor-credentials", Namespace: "pishop-operator-system"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: dockerConfig},
+		})).To(Succeed())
+		engine.Registry.CredentialsSecret = "harbor-credentials"
+
+		Expect(engine.createRegistrySecret(ctx, asStack(prStack), testNamespace)).To(Succeed())
+
+		Expect(registrySecret().Data[corev1.DockerConfigJsonKey]).To(Equal(dockerConfig))
+	})
+
+	It("should build the docker config for the registry host from a username and password", func() {
+		Expect(fakeClient.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "harbor-credentials", Namespace: "pishop-operator-system"},
+			Data:       map[string][]byte{"username": []byte("robot"), "password": []byte("secret")},
+		})).To(Succeed())
+		engine.Registry.CredentialsSecret = "harbor-credentials"
+
+		Expect(engine.createRegistrySecret(ctx, asStack(prStack), testNamespace)).To(Succeed())
+
+		var config struct {
+			Auths map[string]struct {
+				Username string `json:"username"`
+				Auth     string `json:"auth"`
+			} `json:"auths"`
+		}
+		Expect(json.Unmarshal(registrySecret().Data[corev1.DockerConfigJsonKey], &config)).To(Succeed())
+		Expect(config.Auths).To(HaveKey("harbor.pilab.hu"))
+		Expect(config.Auths["harbor.pilab.hu"].Username).To(Equal("robot"))
+		Expect(config.Auths["harbor.pilab.hu"].Auth).To(Equal("cm9ib3Q6c2VjcmV0"))
+	})
+
+	It("should fail when the credentials secret is missing", func() {
+		engine.Registry.CredentialsSecret = "harbor-credentials"
+
+		Expect(engine.createRegistrySecret(ctx, asStack(prStack), testNamespace)).To(MatchError(ContainSubstring("harbor-credentials")))
+	})
+})
@@ -0,0 +1,277 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ResourceQuotaName is the ResourceQuota capping the resources of a PR stack namespace
+	ResourceQuotaName = "pishop-quota"
+	// LimitRangeName is the LimitRange defaulting and bounding the containers and volumes of a
+	// stack namespace
+	LimitRangeName = "pishop-limits"
+
+	// Default resources of the service containers
+	DefaultCPULimit      = "500m"
+	DefaultMemoryLimit   = "512Mi"
+	DefaultCPURequest    = "10m"
+	DefaultMemoryRequest = "64Mi"
+
+	// Limits of the backend containers, counted in the ResourceQuota of a stack
+	BackendCPULimit      = "500m"
+	BackendMemoryLimit   = "512Mi"
+	MongoDBCPULimit      = "1000m"
+	MongoDBMemoryLimit   = "1Gi"
+	BackupJobCPULimit    = "500m"
+	BackupJobMemoryLimit = "1Gi"
+)
+
+// StackQuota caps the total resources of each PR stack namespace, so a single PR cannot starve
+// the cluster. Empty fields leave the resource uncapped.
+type StackQuota struct {
+	// CPU is the sum of the CPU limits of the pods (limits.cpu)
+	CPU string
+	// Memory is the sum of the memory limits of the pods (limits.memory)
+	Memory string
+	// Storage is the sum of the sizes of the persistent volume claims (requests.storage)
+	Storage string
+}
+
+// hard returns the ResourceQuota limits of the caps
+func (q StackQuota) hard() (corev1.ResourceList, error) {
+	hard := corev1.ResourceList{}
+	for name, value := range map[corev1.ResourceName]string{
+		corev1.ResourceLimitsCPU:       q.CPU,
+		corev1.ResourceLimitsMemory:    q.Memory,
+		corev1.ResourceRequestsStorage: q.Storage,
+	} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s quota %q: %v", name, value, err)
+		}
+		hard[name] = quantity
+	}
+	return hard, nil
+}
+
+// Validate checks the caps are valid quantities
+func (q StackQuota) Validate() error {
+	_, err := q.hard()
+	return err
+}
+
+// stackQuota returns the ResourceQuota limits of a capped stack. The CPU and memory limits of
+// its services are multiplied by the pods they may run and added to the limits of the backend
+// pods, the storage limit is multiplied by the volumes of the stack. The operator quota caps
+// each of them and alone limits the resources the stack sets no limit for.
+func (e *StackEngine) stackQuota(stack Stack) (corev1.ResourceList, error) {
+	hard, err := e.Quota.hard()
+	if err != nil {
+		return nil, err
+	}
+	limits := stack.ResourcePolicy().Limits
+	if limits == nil {
+		return hard, nil
+	}
+
+	stackLimits := corev1.ResourceList{}
+	backendCPU, backendMemory := backendLimits(stack)
+	for _, r := range []struct {
+		name    corev1.ResourceName
+		limit   string
+		backend resource.Quantity
+	}{
+		{corev1.ResourceLimitsCPU, limits.CPULimit, backendCPU},
+		{corev1.ResourceLimitsMemory, limits.MemoryLimit, backendMemory},
+	} {
+		if r.limit == "" {
+			continue
+		}
+		limit, err := resource.ParseQuantity(r.limit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s limit %q: %v", r.name, r.limit, err)
+		}
+		limit.Mul(servicePods(stack))
+		limit.Add(r.backend)
+		stackLimits[r.name] = limit
+	}
+	if limits.StorageLimit != "" {
+		storage, err := resource.ParseQuantity(limits.StorageLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage limit %q: %v", limits.StorageLimit, err)
+		}
+		storage.Mul(stackVolumes(stack))
+		stackLimits[corev1.ResourceRequestsStorage] = storage
+	}
+
+	for name, limit := range stackLimits {
+		if operatorLimit, ok := hard[name]; ok && operatorLimit.Cmp(limit) < 0 {
+			continue
+		}
+		hard[name] = limit
+	}
+	return hard, nil
+}
+
+// servicePods returns the pods the services of a stack may run: the replicas of each service,
+// or its maximum replicas when autoscaled, and one more for rolling updates
+func servicePods(stack Stack) int64 {
+	policy := stack.ResourcePolicy()
+	var pods int64
+	for _, service := range stack.Services() {
+		replicas := policy.serviceReplicas(service)
+		if autoscaling := policy.serviceAutoscaling(service); autoscaling != nil {
+			_, replicas = policy.autoscalingBounds(service, autoscaling)
+		}
+		pods += int64(replicas) + 1
+	}
+	return pods
+}
+
+// backendLimits returns the CPU and memory limits of the pods a stack runs next to its
+// services: the dedicated NATS, Redis and MongoDB servers and one backup or restore job
+func backendLimits(stack Stack) (resource.Quantity, resource.Quantity) {
+	cpu, memory := resource.MustParse(BackupJobCPULimit), resource.MustParse(BackupJobMemoryLimit)
+	if !isSharedNATS(stack) {
+		cpu.Add(resource.MustParse(BackendCPULimit))
+		memory.Add(resource.MustParse(BackendMemoryLimit))
+	}
+	if !isSharedRedis(stack) {
+		cpu.Add(resource.MustParse(BackendCPULimit))
+		memory.Add(resource.MustParse(BackendMemoryLimit))
+	}
+	if isDedicatedMongoDB(stack) {
+		cpu.Add(resource.MustParse(MongoDBCPULimit))
+		memory.Add(resource.MustParse(MongoDBMemoryLimit))
+	}
+	return cpu, memory
+}
+
+// stackVolumes returns the number of PVCs of a stack, each bounded by the storage limit
+func stackVolumes(stack Stack) int64 {
+	var volumes int64
+	if hasJetStreamStorage(stack) {
+		volumes++
+	}
+	if !isSharedRedis(stack) && hasRedisStorage(stack) {
+		volumes++
+	}
+	if isDedicatedMongoDB(stack) {
+		volumes++
+	}
+	if backupConfig := stack.Spec().BackupConfig; backupConfig != nil && backupConfig.Enabled {
+		volumes++
+	}
+	return volumes
+}
+
+// getResourceRequirements returns the resources of the service containers of a stack, from
+// its resource policy or the defaults. Requests are kept low and never above the limits.
+func (e *StackEngine) getResourceRequirements(stack Stack) (corev1.ResourceRequirements, error) {
+	cpuLimit, memoryLimit := DefaultCPULimit, DefaultMemoryLimit
+	if resourceLimits := stack.ResourcePolicy().Limits; resourceLimits != nil {
+		if resourceLimits.CPULimit != "" {
+			cpuLimit = resourceLimits.CPULimit
+		}
+		if resourceLimits.MemoryLimit != "" {
+			memoryLimit = resourceLimits.MemoryLimit
+		}
+	}
+
+	limits := corev1.ResourceList{}
+	requests := corev1.ResourceList{}
+	for _, r := range []struct {
+		name           corev1.ResourceName
+		limit, request string
+	}{
+		{corev1.ResourceCPU, cpuLimit, DefaultCPURequest},
+		{corev1.ResourceMemory, memoryLimit, DefaultMemoryRequest},
+	} {
+		limit, err := resource.ParseQuantity(r.limit)
+		if err != nil {
+			return corev1.ResourceRequirements{}, fmt.Errorf("invalid %s limit %q: %v", r.name, r.limit, err)
+		}
+		request := resource.MustParse(r.request)
+		if request.Cmp(limit) > 0 {
+			request = limit
+		}
+		limits[r.name] = limit
+		requests[r.name] = request
+	}
+
+	return corev1.ResourceRequirements{
+		Limits:   limits,
+		Requests: requests,
+	}, nil
+}
+
+// ensureResourceGuards applies the LimitRange of a stack namespace and, for capped stacks, its
+// ResourceQuota, see stackQuota. The LimitRange defaults containers to the service resources
+// and bounds each volume by the storage limit of the stack.
+func (e *StackEngine) ensureResourceGuards(ctx context.Context, stack Stack, namespace string) error {
+	requirements, err := e.getResourceRequirements(stack)
+	if err != nil {
+		return err
+	}
+
+	limitRange := &corev1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      LimitRangeName,
+			Namespace: namespace,
+		},
+		Spec: corev1.LimitRangeSpec{
+			Limits: []corev1.LimitRangeItem{{
+				Type:           corev1.LimitTypeContainer,
+				Default:        requirements.Limits,
+				DefaultRequest: requirements.Requests,
+			}},
+		},
+	}
+	if limits := stack.ResourcePolicy().Limits; limits != nil && limits.StorageLimit != "" {
+		storage, err := resource.ParseQuantity(limits.StorageLimit)
+		if err != nil {
+			return fmt.Errorf("invalid storage limit %q: %v", limits.StorageLimit, err)
+		}
+		limitRange.Spec.Limits = append(limitRange.Spec.Limits, corev1.LimitRangeItem{
+			Type: corev1.LimitTypePersistentVolumeClaim,
+			Max:  corev1.ResourceList{corev1.ResourceStorage: storage},
+		})
+	}
+	if err := e.Apply(ctx, stack, limitRange); err != nil {
+		return fmt.Errorf("failed to apply LimitRange: %v", err)
+	}
+
+	var hard corev1.ResourceList
+	if stack.ResourcePolicy().Capped {
+		if hard, err = e.stackQuota(stack); err != nil {
+			return err
+		}
+	}
+	if len(hard) == 0 {
+		quota := &corev1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: ResourceQuotaName, Namespace: namespace}}
+		if err := e.deleteManaged(ctx, quota); err != nil {
+			return fmt.Errorf("failed to delete ResourceQuota: %v", err)
+		}
+		return nil
+	}
+
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ResourceQuotaName,
+			Namespace: namespace,
+		},
+		Spec: corev1.ResourceQuotaSpec{Hard: hard},
+	}
+	if err := e.Apply(ctx, stack, quota); err != nil {
+		return fmt.Errorf("failed to apply ResourceQuota: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+var _ = Describe("Resource quota", func() {
+	var (
+		ctx        context.Context
+		engine     *StackEngine
+		fakeClient client.Client
+		prStack    *pishopv1alpha1.PRStack
+	)
+
+	const namespace = testNamespace
+
+	getQuota := func() (*corev1.ResourceQuota, error) {
+		quota := &corev1.ResourceQuota{}
+		return quota, fakeClient.Get(ctx, client.ObjectKey{Name: ResourceQuotaName, Namespace: namespace}, quota)
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		prStack = newTestPRStack()
+		prStack.Spec.ResourceLimits = &pishopv1alpha1.ResourceLimits{
+			CPULimit:     "250m",
+			MemoryLimit:  "48Mi",
+			StorageLimit: "5Gi",
+		}
+
+		fakeClient = newTestClient().Build()
+
+		engine = newTestEngine(fakeClient)
+		engine.Quota = StackQuota{CPU: "4", Memory: "8Gi", Storage: "20Gi"}
+	})
+
+	It("should default containers to the service resources and bound volumes", func() {
+		Expect(engine.ensureResourceGuards(ctx, asStack(prStack), namespace)).To(Succeed())
+
+		limitRange := &corev1.LimitRange{}
+		Expect(fakeClient.Get(ctx, client.ObjectKey{Name: LimitRangeName, Namespace: namespace}, limitRange)).To(Succeed())
+		Expect(limitRange.Spec.Limits).To(HaveLen(2))
+
+		container := limitRange.Spec.Limits[0]
+		Expect(container.Type).To(Equal(corev1.LimitTypeContainer))
+		Expect(container.Default.Cpu().String()).To(Equal("250m"))
+		Expect(container.Default.Memory().String()).To(Equal("48Mi"))
+		Expect(container.DefaultRequest.Cpu().String()).To(Equal(DefaultCPURequest))
+		// Requests never exceed the limits
+		Expect(container.DefaultRequest.Memory().String()).To(Equal("48Mi"))
+
+		volume := limitRange.Spec.Limits[1]
+		Expect(volume.Type).To(Equal(corev1.LimitTypePersistentVolumeClaim))
+		Expect(volume.Max.Storage().String()).To(Equal("5Gi"))
+	})
+
+	It("should cap PR stack namespaces with the operator quota", func() {
+		prStack.Spec.ResourceLimits = nil
+		Expect(engine.ensureResourceGuards(ctx, asStack(prStack), namespace)).To(Succeed())
+
+		quota, err := getQuota()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(quota.Spec.Hard).To(Equal(corev1.ResourceList{
+			corev1.ResourceLimitsCPU:       resource.MustParse("4"),
+			corev1.ResourceLimitsMemory:    resource.MustParse("8Gi"),
+			corev1.ResourceRequestsStorage: resource.MustParse("20Gi"),
+		}))
+
+		engine.Quota = StackQuota{}
+		Expect(engine.ensureResourceGuards(ctx, asStack(prStack), namespace)).To(Succeed())
+
+		_, err = getQuota()
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	Context("with resource limits", func() {
+		BeforeEach(func() {
+			prStack.Spec.Services = []string{"cart-service", "graphql-service"}
+			prStack.Spec.ServiceScaling = []pishopv1alpha1.ServiceScaling{
+				{Name: "graphql-service", Autoscaling: &pishopv1alpha1.AutoscalingSpec{MaxReplicas: 3, TargetCPU: "200m"}},
+			}
+			prStack.Spec.BackupConfig = &pishopv1alpha1.BackupConfig{Enabled: true}
+		})
+
+		It("should derive the quota from the limits of the stack", func() {
+			engine.Quota = StackQuota{}
+			Expect(engine.ensureResourceGuards(ctx, asStack(prStack), namespace)).To(Succeed())
+
+			// 6 service pods (1+1 cart, 3+1 graphql) of 250m and 48Mi, the NATS and Redis
+			// servers, one backup job and the backup volume
+			quota, err := getQuota()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(quota.Spec.Hard).To(Equal(corev1.ResourceList{
+				corev1.ResourceLimitsCPU:       resource.MustParse("3"),
+				corev1.ResourceLimitsMemory:    resource.MustParse("2336Mi"),
+				corev1.ResourceRequestsStorage: resource.MustParse("5Gi"),
+			}))
+		})
+
+		It("should count the volumes of the stack", func() {
+			engine.Quota = StackQuota{}
+			prStack.Spec.MongoDB = &pishopv1alpha1.MongoDBConfig{Mode: MongoDBModeDedicated}
+			Expect(engine.ensureResourceGuards(ctx, asStack(prStack), namespace)).To(Succeed())
+
+			quota, err := getQuota()
+			Expect(err).NotTo(HaveOccurred())
+			storage := quota.Spec.Hard[corev1.ResourceRequestsStorage]
+			Expect(storage.String()).To(Equal("10Gi"))
+		})
+
+		It("should cap the limits of the stack with the operator quota", func() {
+			engine.Quota = StackQuota{CPU: "2", Memory: "8Gi"}
+			Expect(engine.ensureResourceGuards(ctx, asStack(prStack), namespace)).To(Succeed())
+
+			quota, err := getQuota()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(quota.Spec.Hard).To(Equal(corev1.ResourceList{
+				corev1.ResourceLimitsCPU:       resource.MustParse("2"),
+				corev1.ResourceLimitsMemory:    resource.MustParse("2336Mi"),
+				corev1.ResourceRequestsStorage: resource.MustParse("5Gi"),
+			}))
+		})
+	})
+
+	It("should keep a paused quota", func() {
+		prStack.Spec.ResourceLimits = nil
+		Expect(engine.ensureResourceGuards(ctx, asStack(prStack), namespace)).To(Succeed())
+		quota, err := getQuota()
+		Expect(err).NotTo(HaveOccurred())
+		quota.Annotations = map[string]string{PauseReconcileAnnotation: "true"}
+		Expect(fakeClient.Update(ctx, quota)).To(Succeed())
+
+		engine.Quota = StackQuota{}
+		Expect(engine.ensureResourceGuards(ctx, asStack(prStack), namespace)).To(Succeed())
+
+		_, err = getQuota()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should not cap tenants", func() {
+		tenant := &pishopv1alpha1.Tenant{
+			ObjectMeta: metav1.ObjectMeta{Name: "acme", UID: "acme-uid"},
+			Spec:       pishopv1alpha1.TenantSpec{TenantID: "acme", ImageTag: "v1.0.0"},
+		}
+		stack := newTenantStack(tenant)
+
+		Expect(engine.ensureResourceGuards(ctx, stack, stack.Namespace())).To(Succeed())
+
+		quota := &corev1.ResourceQuota{}
+		err := fakeClient.Get(ctx, client.ObjectKey{Name: ResourceQuotaName, Namespace: stack.Namespace()}, quota)
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should return invalid limits as errors instead of panicking", func() {
+		prStack.Spec.ResourceLimits.CPULimit = "lots"
+
+		_, err := engine.getResourceRequirements(asStack(prStack))
+		Expect(err).To(MatchError(ContainSubstring(`invalid cpu limit "lots"`)))
+		Expect(engine.ensureResourceGuards(ctx, asStack(prStack), namespace)).To(MatchError(ContainSubstring("lots")))
+		Expect(engine.createServiceDeployment(ctx, asStack(prStack), namespace, "cart-service")).To(MatchError(ContainSubstring("lots")))
+
+		prStack.Spec.ResourceLimits.CPULimit = ""
+		prStack.Spec.ResourceLimits.StorageLimit = "a lot"
+		Expect(engine.ensureResourceGuards(ctx, asStack(prStack), namespace)).To(MatchError(ContainSubstring("invalid storage limit")))
+	})
+
+	It("should reject invalid operator quotas", func() {
+		Expect(StackQuota{CPU: "4", Memory: "many"}.Validate()).To(MatchError(ContainSubstring("limits.memory")))
+		Expect(StackQuota{}.Validate()).To(Succeed())
+	})
+})
@@ -43,6 +43,8 @@ type ServiceConfig struct {
 	NATSPassword string
 	NATSToken    string
 	NATSTimeout  string
+	// NATSCredsFile is the mounted user credentials file on the shared NATS server
+	NATSCredsFile string
 
 	// Observability configuration
 	MetricsEnabled     string
@@ -52,6 +54,8 @@ type ServiceConfig struct {
 	TracingServiceName string
 	TracingEndpoint    string
 	TracingSampleRate  string
+	// ResourceAttributes are the OpenTelemetry resource attributes identifying the stack
+	ResourceAttributes string
 	HealthEnabled      string
 	HealthPort         string
 	HealthPath         string
@@ -343,22 +347,22 @@ func GetServiceConfig(serviceName, prNumber string) *ServiceConfig {
 		IdleTimeout:  "60s",
 
 		// Database configuration
-		MongoDBURI:         "mongodb://mongodb-service:27017",
+		MongoDBURI:         "", // Will be set from secret
 		MongoDBDatabase:    getDatabaseName(serviceName, prNumber),
-		MongoDBUsername:    "admin",
+		MongoDBUsername:    "", // Will be set from secret
 		MongoDBPassword:    "", // Will be set from secret
 		MongoDBTimeout:     "10s",
 		MongoDBMaxPoolSize: "100",
 		MongoDBMinPoolSize: "10",
 
 		// Cache configuration (Redis)
-		RedisURL:      "redis://redis-service:6379",
-		RedisPassword: "", // Will be set from secret if needed
+		RedisURL:      "", // Will be set from secret
+		RedisPassword: "", // Will be set from secret
 		RedisDatabase: "0",
 		RedisTimeout:  "10s",
 
 		// NATS configuration
-		NATSURL:      "nats://nats-service:4222",
+		NATSURL:      "", // Will be set from config map
 		NATSUsername: "",
 		NATSPassword: "",
 		NATSToken:    "",
@@ -368,9 +372,9 @@ func GetServiceConfig(serviceName, prNumber string) *ServiceConfig {
 		MetricsEnabled:     "true",
 		MetricsPort:        "8080",
 		MetricsPath:        "/metrics",
-		TracingEnabled:     "true",
+		TracingEnabled:     "false", // Enabled with the operator OTLP endpoint
 		TracingServiceName: serviceName,
-		TracingEndpoint:    "http://jaeger-service:14268/api/traces",
+		TracingEndpoint:    "",
 		TracingSampleRate:  "0.1",
 		HealthEnabled:      "true",
 		HealthPort:         "8080",
@@ -640,19 +644,16 @@ func (sc *ServiceConfig) ToEnvVars() []corev1.EnvVar {
 		{Name: "SERVER_IDLE_TIMEOUT", Value: sc.IdleTimeout},
 
 		// Database configuration - Fixed naming to match service expectations
-		{Name: "MONGODB_URI", Value: sc.MongoDBURI},
 		{Name: "MONGODB_DATABASE", Value: sc.MongoDBDatabase},
 		{Name: "MONGODB_TIMEOUT", Value: sc.MongoDBTimeout},
 		{Name: "MONGODB_MAX_POOL_SIZE", Value: sc.MongoDBMaxPoolSize},
 		{Name: "MONGODB_MIN_POOL_SIZE", Value: sc.MongoDBMinPoolSize},
 
 		// Cache configuration (Redis) - Fixed naming to match service expectations
-		{Name: "REDIS_URL", Value: sc.RedisURL},
 		{Name: "REDIS_DATABASE", Value: sc.RedisDatabase},
 		{Name: "REDIS_TIMEOUT", Value: sc.RedisTimeout},
 
 		// NATS configuration
-		{Name: "NATS_URL", Value: sc.NATSURL},
 		{Name: "NATS_TIMEOUT", Value: sc.NATSTimeout},
 
 		// Observability configuration - Fixed naming to match service expectations
@@ -663,6 +664,8 @@ func (sc *ServiceConfig) ToEnvVars() []corev1.EnvVar {
 		{Name: "TRACING_SERVICE_NAME", Value: sc.TracingServiceName},
 		{Name: "TRACING_ENDPOINT", Value: sc.TracingEndpoint},
 		{Name: "TRACING_SAMPLE_RATE", Value: sc.TracingSampleRate},
+		{Name: "OTEL_SERVICE_NAME", Value: sc.TracingServiceName},
+		{Name: "OTEL_RESOURCE_ATTRIBUTES", Value: sc.ResourceAttributes},
 		{Name: "HEALTH_ENABLED", Value: sc.HealthEnabled},
 		{Name: "HEALTH_PORT", Value: sc.HealthPort},
 		{Name: "HEALTH_PATH", Value: sc.HealthPath},
@@ -687,6 +690,75 @@ func (sc *ServiceConfig) ToEnvVars() []corev1.EnvVar {
 		{Name: "GRACEFUL_SHUTDOWN", Value: sc.TimeoutGracefulShutdown},
 	}
 
+	// Add MongoDB connection string from secret unless explicitly configured
+	if sc.MongoDBURI != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "MONGODB_URI", Value: sc.MongoDBURI})
+	} else {
+		envVars = append(envVars, corev1.EnvVar{
+			Name: "MONGODB_URI",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "mongodb-secret"},
+					Key:                  "uri",
+				},
+			},
+		})
+	}
+
+	// Add Redis connection string from secret unless explicitly configured
+	if sc.RedisURL != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "REDIS_URL", Value: sc.RedisURL})
+	} else {
+		envVars = append(envVars, corev1.EnvVar{
+			Name: "REDIS_URL",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "redis-secret"},
+					Key:                  "url",
+				},
+			},
+		})
+	}
+
+	envVars = append(envVars, corev1.EnvVar{
+		Name: "REDIS_KEY_PREFIX",
+		ValueFrom: &corev1.EnvVarSource{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "redis-config"},
+				Key:                  "keyPrefix",
+			},
+		},
+	})
+
+	// Add NATS connection details from config map unless explicitly configured
+	if sc.NATSURL != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "NATS_URL", Value: sc.NATSURL})
+	} else {
+		envVars = append(envVars, corev1.EnvVar{
+			Name: "NATS_URL",
+			ValueFrom: &corev1.EnvVarSource{
+				ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "nats-config"},
+					Key:                  "url",
+				},
+			},
+		})
+	}
+
+	envVars = append(envVars, corev1.EnvVar{
+		Name: "NATS_SUBJECT_PREFIX",
+		ValueFrom: &corev1.EnvVarSource{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "nats-config"},
+				Key:                  "subjectPrefix",
+			},
+		},
+	})
+
+	if sc.NATSCredsFile != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "NATS_CREDS_FILE", Value: sc.NATSCredsFile})
+	}
+
 	// Add MongoDB credentials from secret - Fixed naming to match service expectations
 	envVars = append(envVars, corev1.EnvVar{
 		Name: "MONGODB_USERNAME",
@@ -708,8 +780,10 @@ func (sc *ServiceConfig) ToEnvVars() []corev1.EnvVar {
 		},
 	})
 
-	// Add Redis password from secret if needed - Fixed naming to match service expectations
+	// Add Redis password from secret unless explicitly configured
 	if sc.RedisPassword != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "REDIS_PASSWORD", Value: sc.RedisPassword})
+	} else {
 		envVars = append(envVars, corev1.EnvVar{
 			Name: "REDIS_PASSWORD",
 			ValueFrom: &corev1.EnvVarSource{
@@ -1130,7 +1204,7 @@ func getDatabaseName(serviceName, prNumber string) string {
 }
 
 // getDatabaseConfigMapData generates the database configuration map for all services
-func getDatabaseConfigMapData(prNumber string) map[string]string {
+func getDatabaseConfigMapData(naming StackNaming, id string) map[string]string {
 	data := map[string]string{
 		"uri":     "", // Will be set by caller
 		"timeout": "10",
@@ -1138,7 +1212,7 @@ func getDatabaseConfigMapData(prNumber string) map[string]string {
 	
 	// Add database names for each service
 	for _, service := range DefaultServices {
-		dbName := getDatabaseName(service, prNumber)
+		dbName := naming.Database(service, id)
 		// Convert service name to config key (e.g., "product-service" -> "product-database")
 		configKey := strings.TrimSuffix(service, "-service") + "-database"
 		data[configKey] = dbName
@@ -65,14 +65,47 @@ var _ = Describe("Service Config", func() {
 			Expect(envVars).To(ContainElement(corev1.EnvVar{Name: "LOG_LEVEL", Value: "info"}))
 			
 			// Check MongoDB configuration
-			Expect(envVars).To(ContainElement(corev1.EnvVar{Name: "MONGODB_URI", Value: "mongodb://mongodb-service:27017"}))
+			Expect(envVars).To(ContainElement(corev1.EnvVar{
+				Name: "MONGODB_URI",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "mongodb-secret"},
+						Key:                  "uri",
+					},
+				},
+			}))
 			Expect(envVars).To(ContainElement(corev1.EnvVar{Name: "MONGODB_DATABASE", Value: "pishop_product_pr_123"}))
 			
 			// Check Redis configuration
-			Expect(envVars).To(ContainElement(corev1.EnvVar{Name: "REDIS_URL", Value: "redis://redis-service:6379"}))
+			Expect(envVars).To(ContainElement(corev1.EnvVar{
+				Name: "REDIS_URL",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "redis-secret"},
+						Key:                  "url",
+					},
+				},
+			}))
+			Expect(envVars).To(ContainElement(corev1.EnvVar{
+				Name: "REDIS_PASSWORD",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "redis-secret"},
+						Key:                  "password",
+					},
+				},
+			}))
 			
 			// Check NATS configuration
-			Expect(envVars).To(ContainElement(corev1.EnvVar{Name: "NATS_URL", Value: "nats://nats-service:4222"}))
+			Expect(envVars).To(ContainElement(corev1.EnvVar{
+				Name: "NATS_URL",
+				ValueFrom: &corev1.EnvVarSource{
+					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "nats-config"},
+						Key:                  "url",
+					},
+				},
+			}))
 		})
 
 		It("should include MongoDB credentials from secret", func() {
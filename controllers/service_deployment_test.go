@@ -14,8 +14,10 @@ import (
 
 	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
 )
 
 var _ = Describe("Service Deployment Tests", func() {
@@ -34,14 +36,17 @@ var _ = Describe("Service Deployment Tests", func() {
 		Expect(pishopv1alpha1.AddToScheme(scheme)).To(Succeed())
 		Expect(corev1.AddToScheme(scheme)).To(Succeed())
 		Expect(appsv1.AddToScheme(scheme)).To(Succeed())
+		Expect(autoscalingv2.AddToScheme(scheme)).To(Succeed())
+		Expect(policyv1.AddToScheme(scheme)).To(Succeed())
 		Expect(networkingv1.AddToScheme(scheme)).To(Succeed())
 		
 		fakeClient = fake.NewClientBuilder().
 			WithScheme(scheme).
+			WithInterceptorFuncs(serverSideApply).
 			WithStatusSubresource(&pishopv1alpha1.PRStack{}).
 			Build()
 		
-		reconciler = &PRStackReconciler{
+		reconciler = &PRStackReconciler{StackEngine: &StackEngine{
 			Client:         fakeClient,
 			Scheme:         scheme,
 			MongoURI:       "mongodb://localhost:27017",
@@ -51,7 +56,7 @@ var _ = Describe("Service Deployment Tests", func() {
 			GitHubUsername: "testuser",
 			GitHubToken:    "testtoken",
 			GitHubEmail:    "test@example.com",
-		}
+		}}
 		
 		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 	})
@@ -77,8 +82,7 @@ var _ = Describe("Service Deployment Tests", func() {
 
 			prStack = &pishopv1alpha1.PRStack{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "pr-123",
-					Namespace: "default",
+					Name: "pr-123",
 				},
 				Spec: pishopv1alpha1.PRStackSpec{
 					PRNumber: "123",
@@ -104,7 +108,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		})
 
 		It("should create deployment with active replicas", func() {
-			err := reconciler.createServiceDeployment(ctx, prStack, namespace, "product-service")
+			err := reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")
 			Expect(err).ToNot(HaveOccurred())
 
 			var deployment appsv1.Deployment
@@ -119,7 +123,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		It("should create deployment with zero replicas when inactive", func() {
 			prStack.Spec.Active = false
 
-			err := reconciler.createServiceDeployment(ctx, prStack, namespace, "product-service")
+			err := reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")
 			Expect(err).ToNot(HaveOccurred())
 
 			var deployment appsv1.Deployment
@@ -132,7 +136,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		})
 
 		It("should create service with correct labels", func() {
-			err := reconciler.createServiceDeployment(ctx, prStack, namespace, "product-service")
+			err := reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")
 			Expect(err).ToNot(HaveOccurred())
 
 			var service corev1.Service
@@ -146,7 +150,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		})
 
 		It("should create ingress only for graphql-service", func() {
-			err := reconciler.createServiceDeployment(ctx, prStack, namespace, "graphql-service")
+			err := reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "graphql-service")
 			Expect(err).ToNot(HaveOccurred())
 
 			var ingress networkingv1.Ingress
@@ -158,7 +162,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		})
 
 		It("should not create ingress for non-graphql services", func() {
-			err := reconciler.createServiceDeployment(ctx, prStack, namespace, "product-service")
+			err := reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")
 			Expect(err).ToNot(HaveOccurred())
 
 			var ingress networkingv1.Ingress
@@ -175,7 +179,7 @@ var _ = Describe("Service Deployment Tests", func() {
 				MemoryLimit: "2Gi",
 			}
 
-			err := reconciler.createServiceDeployment(ctx, prStack, namespace, "product-service")
+			err := reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")
 			Expect(err).ToNot(HaveOccurred())
 
 			var deployment appsv1.Deployment
@@ -190,7 +194,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		})
 
 		It("should handle service with empty name", func() {
-			err := reconciler.createServiceDeployment(ctx, prStack, namespace, "")
+			err := reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "")
 			// Should not panic, may fail gracefully
 			// Just verify it doesn't crash
 			_ = err
@@ -198,12 +202,12 @@ var _ = Describe("Service Deployment Tests", func() {
 
 		It("should update existing deployment", func() {
 			// Create first time
-			err := reconciler.createServiceDeployment(ctx, prStack, namespace, "product-service")
+			err := reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")
 			Expect(err).ToNot(HaveOccurred())
 
 			// Update
 			prStack.Spec.ImageTag = "v2.0.0"
-			err = reconciler.createServiceDeployment(ctx, prStack, namespace, "product-service")
+			err = reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")
 			Expect(err).ToNot(HaveOccurred())
 
 			var deployment appsv1.Deployment
@@ -230,7 +234,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		})
 
 		It("should create ingress with default domain", func() {
-			ingress := reconciler.createIngress(prStack, namespace, "graphql-service", "graphql")
+			ingress := reconciler.createIngress(asStack(prStack), namespace, "graphql-service", "graphql")
 
 			Expect(ingress.Spec.Rules).To(HaveLen(1))
 			Expect(ingress.Spec.Rules[0].Host).To(Equal("pr-456.shop.pilab.hu"))
@@ -238,33 +242,33 @@ var _ = Describe("Service Deployment Tests", func() {
 
 		It("should create ingress with custom domain", func() {
 			prStack.Spec.CustomDomain = "custom.example.com"
-			ingress := reconciler.createIngress(prStack, namespace, "graphql-service", "graphql")
+			ingress := reconciler.createIngress(asStack(prStack), namespace, "graphql-service", "graphql")
 
 			Expect(ingress.Spec.Rules[0].Host).To(Equal("custom.example.com"))
 		})
 
 		It("should include TLS configuration when secret specified", func() {
 			prStack.Spec.IngressTlsSecretName = "tls-secret"
-			ingress := reconciler.createIngress(prStack, namespace, "graphql-service", "graphql")
+			ingress := reconciler.createIngress(asStack(prStack), namespace, "graphql-service", "graphql")
 
 			Expect(ingress.Spec.TLS).To(HaveLen(1))
 			Expect(ingress.Spec.TLS[0].SecretName).To(Equal("tls-secret"))
 		})
 
 		It("should not include TLS when secret not specified", func() {
-			ingress := reconciler.createIngress(prStack, namespace, "graphql-service", "graphql")
+			ingress := reconciler.createIngress(asStack(prStack), namespace, "graphql-service", "graphql")
 
 			Expect(ingress.Spec.TLS).To(BeNil())
 		})
 
 		It("should handle empty path prefix", func() {
-			ingress := reconciler.createIngress(prStack, namespace, "graphql-service", "")
+			ingress := reconciler.createIngress(asStack(prStack), namespace, "graphql-service", "")
 
 			Expect(ingress.Spec.Rules[0].HTTP.Paths[0].Path).To(Equal("/"))
 		})
 
 		It("should set correct backend service", func() {
-			ingress := reconciler.createIngress(prStack, namespace, "graphql-service", "graphql")
+			ingress := reconciler.createIngress(asStack(prStack), namespace, "graphql-service", "graphql")
 
 			backend := ingress.Spec.Rules[0].HTTP.Paths[0].Backend
 			Expect(backend.Service.Name).To(Equal("graphql-service"))
@@ -274,9 +278,11 @@ var _ = Describe("Service Deployment Tests", func() {
 
 	Context("Edge Cases - createRegistrySecret", func() {
 		var namespace string
+		var stack Stack
 
 		BeforeEach(func() {
 			namespace = "pr-789-shop-pilab-hu"
+			stack = asStack(&pishopv1alpha1.PRStack{ObjectMeta: metav1.ObjectMeta{Name: "pr-789"}})
 			
 			// Create namespace
 			ns := &corev1.Namespace{
@@ -288,7 +294,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		})
 
 		It("should create registry secret with GitHub credentials", func() {
-			err := reconciler.createRegistrySecret(ctx, namespace)
+			err := reconciler.createRegistrySecret(ctx, stack, namespace)
 			Expect(err).ToNot(HaveOccurred())
 
 			var secret corev1.Secret
@@ -305,7 +311,7 @@ var _ = Describe("Service Deployment Tests", func() {
 			reconciler.GitHubUsername = ""
 			reconciler.GitHubToken = ""
 
-			err := reconciler.createRegistrySecret(ctx, namespace)
+			err := reconciler.createRegistrySecret(ctx, stack, namespace)
 			Expect(err).ToNot(HaveOccurred())
 
 			var secret corev1.Secret
@@ -319,14 +325,14 @@ var _ = Describe("Service Deployment Tests", func() {
 		It("should handle empty GitHub username", func() {
 			reconciler.GitHubUsername = ""
 
-			err := reconciler.createRegistrySecret(ctx, namespace)
+			err := reconciler.createRegistrySecret(ctx, stack, namespace)
 			Expect(err).ToNot(HaveOccurred())
 		})
 
 		It("should handle empty GitHub token", func() {
 			reconciler.GitHubToken = ""
 
-			err := reconciler.createRegistrySecret(ctx, namespace)
+			err := reconciler.createRegistrySecret(ctx, stack, namespace)
 			Expect(err).ToNot(HaveOccurred())
 		})
 
@@ -334,7 +340,7 @@ var _ = Describe("Service Deployment Tests", func() {
 			reconciler.GitHubUsername = "user@domain"
 			reconciler.GitHubToken = "token!@#$%"
 
-			err := reconciler.createRegistrySecret(ctx, namespace)
+			err := reconciler.createRegistrySecret(ctx, stack, namespace)
 			Expect(err).ToNot(HaveOccurred())
 		})
 	})
@@ -376,7 +382,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		})
 
 		It("should create MongoDB ConfigMap", func() {
-			err := reconciler.createMongoDBResources(ctx, prStack, namespace)
+			err := reconciler.createMongoDBResources(ctx, asStack(prStack), namespace)
 			Expect(err).ToNot(HaveOccurred())
 
 			var configMap corev1.ConfigMap
@@ -389,7 +395,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		})
 
 		It("should create MongoDB Secret", func() {
-			err := reconciler.createMongoDBResources(ctx, prStack, namespace)
+			err := reconciler.createMongoDBResources(ctx, asStack(prStack), namespace)
 			Expect(err).ToNot(HaveOccurred())
 
 			var secret corev1.Secret
@@ -403,7 +409,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		})
 
 		It("should create NATS ConfigMap", func() {
-			err := reconciler.createMongoDBResources(ctx, prStack, namespace)
+			err := reconciler.createMongoDBResources(ctx, asStack(prStack), namespace)
 			Expect(err).ToNot(HaveOccurred())
 
 			var configMap corev1.ConfigMap
@@ -416,7 +422,7 @@ var _ = Describe("Service Deployment Tests", func() {
 		})
 
 		It("should create Redis ConfigMap", func() {
-			err := reconciler.createMongoDBResources(ctx, prStack, namespace)
+			err := reconciler.createMongoDBResources(ctx, asStack(prStack), namespace)
 			Expect(err).ToNot(HaveOccurred())
 
 			var configMap corev1.ConfigMap
@@ -432,18 +438,18 @@ var _ = Describe("Service Deployment Tests", func() {
 			prStack.Status.MongoDB.User = ""
 			prStack.Status.MongoDB.Password = ""
 
-			err := reconciler.createMongoDBResources(ctx, prStack, namespace)
+			err := reconciler.createMongoDBResources(ctx, asStack(prStack), namespace)
 			Expect(err).ToNot(HaveOccurred())
 		})
 
 		It("should update existing resources", func() {
 			// Create first time
-			err := reconciler.createMongoDBResources(ctx, prStack, namespace)
+			err := reconciler.createMongoDBResources(ctx, asStack(prStack), namespace)
 			Expect(err).ToNot(HaveOccurred())
 
 			// Update
 			prStack.Status.MongoDB.ConnectionString = "mongodb://updated:27017"
-			err = reconciler.createMongoDBResources(ctx, prStack, namespace)
+			err = reconciler.createMongoDBResources(ctx, asStack(prStack), namespace)
 			Expect(err).ToNot(HaveOccurred())
 
 			var configMap corev1.ConfigMap
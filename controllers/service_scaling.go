@@ -0,0 +1,380 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+const (
+	// ReplicasAnnotation remembers the replicas of a deployment while its stack is scaled to zero
+	ReplicasAnnotation = "shop.pilab.hu/replicas"
+
+	// ReplicasHandoverFieldManager keeps the replicas of a deployment once the operator stops
+	// applying them, until the HorizontalPodAutoscaler takes them over
+	ReplicasHandoverFieldManager = "pishop-operator-handover"
+)
+
+// serviceScaling returns the scaling overrides of a service, nil when it follows the stack defaults
+func (p ResourcePolicy) serviceScaling(service string) *pishopv1alpha1.ServiceScaling {
+	for i := range p.ServiceScaling {
+		if p.ServiceScaling[i].Name == service {
+			return &p.ServiceScaling[i]
+		}
+	}
+	return nil
+}
+
+// serviceReplicas returns the replicas of a service while the stack is active
+func (p ResourcePolicy) serviceReplicas(service string) int32 {
+	replicas := p.Replicas
+	if scaling := p.serviceScaling(service); scaling != nil && scaling.Replicas != nil {
+		replicas = *scaling.Replicas
+	}
+	if replicas < 1 {
+		replicas = 1
+	}
+	return replicas
+}
+
+// serviceAutoscaling returns the autoscaling of a service, nil when the service is not autoscaled
+func (p ResourcePolicy) serviceAutoscaling(service string) *pishopv1alpha1.AutoscalingSpec {
+	if scaling := p.serviceScaling(service); scaling != nil {
+		return scaling.Autoscaling
+	}
+	return nil
+}
+
+// autoscalingBounds returns the replica range of an autoscaled service, the minimum defaults
+// to the replicas of the service
+func (p ResourcePolicy) autoscalingBounds(service string, autoscaling *pishopv1alpha1.AutoscalingSpec) (int32, int32) {
+	minReplicas := p.serviceReplicas(service)
+	if autoscaling.MinReplicas != nil {
+		minReplicas = *autoscaling.MinReplicas
+	}
+	maxReplicas := autoscaling.MaxReplicas
+	if maxReplicas < minReplicas {
+		maxReplicas = minReplicas
+	}
+	return minReplicas, maxReplicas
+}
+
+// rememberedReplicas returns the replicas of a running deployment, or the replicas it had
+// before its stack was scaled to zero
+func rememberedReplicas(deployment *appsv1.Deployment) int32 {
+	if deployment.Spec.Replicas != nil && *deployment.Spec.Replicas > 0 {
+		return *deployment.Spec.Replicas
+	}
+	if value, ok := deployment.Annotations[ReplicasAnnotation]; ok {
+		if replicas, err := strconv.ParseInt(value, 10, 32); err == nil && replicas > 0 {
+			return int32(replicas)
+		}
+	}
+	return 0
+}
+
+// activeReplicas returns the replicas of a deployment of an active stack. Autoscaled services
+// keep the replicas chosen by their HorizontalPodAutoscaler, other services run their configured
+// replicas. Deployments that are not stack services (NATS, Redis) get their remembered replicas
+// back. The deployment is nil when it does not exist yet.
+func activeReplicas(stack Stack, name string, deployment *appsv1.Deployment) int32 {
+	remembered := int32(0)
+	if deployment != nil {
+		remembered = rememberedReplicas(deployment)
+	}
+
+	if !containsString(stack.Services(), name) {
+		if remembered > 0 {
+			return remembered
+		}
+		return 1
+	}
+
+	policy := stack.ResourcePolicy()
+	autoscaling := policy.serviceAutoscaling(name)
+	if autoscaling == nil {
+		return policy.serviceReplicas(name)
+	}
+
+	minReplicas, maxReplicas := policy.autoscalingBounds(name, autoscaling)
+	switch {
+	case remembered < minReplicas:
+		return minReplicas
+	case remembered > maxReplicas:
+		return maxReplicas
+	}
+	return remembered
+}
+
+// getServiceReplicas returns the replicas a service deployment is created or updated with, and
+// the replicas to remember while the stack is scaled to zero. The replicas are nil for running
+// autoscaled services, they are left to the HorizontalPodAutoscaler.
+func (e *StackEngine) getServiceReplicas(ctx context.Context, stack Stack, namespace, service string) (*int32, int32, error) {
+	var existing *appsv1.Deployment
+	var deployment appsv1.Deployment
+	if err := e.Get(ctx, client.ObjectKey{Name: service, Namespace: namespace}, &deployment); err == nil {
+		existing = &deployment
+	} else if !errors.IsNotFound(err) {
+		return nil, 0, fmt.Errorf("failed to get deployment %s: %v", service, err)
+	}
+
+	if !stack.Spec().Active {
+		remembered := int32(0)
+		if existing != nil {
+			remembered = rememberedReplicas(existing)
+		}
+		replicas := int32(0)
+		return &replicas, remembered, nil
+	}
+
+	// The autoscaler does not scale deployments up from zero, those get their replicas back first
+	if existing != nil && existing.Spec.Replicas != nil && *existing.Spec.Replicas > 0 &&
+		stack.ResourcePolicy().serviceAutoscaling(service) != nil {
+		return nil, 0, nil
+	}
+
+	replicas := activeReplicas(stack, service, existing)
+	return &replicas, 0, nil
+}
+
+// handOverReplicas hands the replicas of a deployment to its HorizontalPodAutoscaler before the
+// operator stops applying them. Server-side apply resets a field the applier drops when no other
+// manager owns it, so unless the autoscaler already scaled the deployment the live replicas are
+// first applied by ReplicasHandoverFieldManager, which the autoscaler takes them over from.
+func (e *StackEngine) handOverReplicas(ctx context.Context, namespace, name string) error {
+	if e.diffs != nil {
+		return nil
+	}
+
+	deployment := &appsv1.Deployment{}
+	if err := e.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, deployment); err != nil {
+		return fmt.Errorf("failed to get deployment %s: %v", name, err)
+	}
+	if deployment.Spec.Replicas == nil || replicasManagedByOthers(deployment) {
+		return nil
+	}
+
+	handover := &unstructured.Unstructured{}
+	handover.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("Deployment"))
+	handover.SetName(name)
+	handover.SetNamespace(namespace)
+	if err := unstructured.SetNestedField(handover.Object, int64(*deployment.Spec.Replicas), "spec", "replicas"); err != nil {
+		return err
+	}
+	if err := e.Patch(ctx, handover, client.Apply, client.FieldOwner(ReplicasHandoverFieldManager)); err != nil {
+		return fmt.Errorf("failed to hand over the replicas of %s: %v", name, err)
+	}
+	return nil
+}
+
+// replicasManagedByOthers returns true if a manager other than the operator's apply owns the
+// replicas of a deployment
+func replicasManagedByOthers(deployment *appsv1.Deployment) bool {
+	for _, entry := range deployment.ManagedFields {
+		if entry.Manager == FieldManager && entry.Operation == metav1.ManagedFieldsOperationApply {
+			continue
+		}
+		if entry.FieldsV1 == nil {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		if spec, ok := fields["f:spec"].(map[string]interface{}); ok {
+			if _, ok := spec["f:replicas"]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restoreDeployments scales the deployments of an active stack that were scaled to zero back
+// to their desired replicas
+func (e *StackEngine) restoreDeployments(ctx context.Context, stack Stack) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	var deployments appsv1.DeploymentList
+	if err := e.List(ctx, &deployments, client.InNamespace(stack.Namespace())); err != nil {
+		return fmt.Errorf("failed to list deployments: %v", err)
+	}
+
+	restoredCount := 0
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas > 0 {
+			continue
+		}
+
+		replicas := activeReplicas(stack, deployment.Name, deployment)
+		log.Info("Restoring deployment", "name", deployment.Name, "namespace", stack.Namespace(), "replicas", replicas)
+
+		deployment.Spec.Replicas = &replicas
+		delete(deployment.Annotations, ReplicasAnnotation)
+		if err := e.Update(ctx, deployment, client.FieldOwner(FieldManager)); err != nil {
+			return fmt.Errorf("failed to restore deployment %s: %v", deployment.Name, err)
+		}
+		restoredCount++
+	}
+
+	if restoredCount > 0 {
+		log.Info("Restored deployments", "count", restoredCount, "namespace", stack.Namespace())
+	}
+
+	return nil
+}
+
+// ensureServiceAutoscaler creates the HorizontalPodAutoscaler of an autoscaled service and removes
+// it once autoscaling is turned off
+func (e *StackEngine) ensureServiceAutoscaler(ctx context.Context, stack Stack, namespace, service string) error {
+	policy := stack.ResourcePolicy()
+	autoscaling := policy.serviceAutoscaling(service)
+	if autoscaling == nil {
+		hpa := &autoscalingv2.HorizontalPodAutoscaler{ObjectMeta: metav1.ObjectMeta{Name: service, Namespace: namespace}}
+		if err := e.deleteManaged(ctx, hpa); err != nil {
+			return fmt.Errorf("failed to delete autoscaler for %s: %v", service, err)
+		}
+		return nil
+	}
+
+	metrics, err := autoscalerMetrics(autoscaling)
+	if err != nil {
+		return fmt.Errorf("invalid autoscaling for %s: %v", service, err)
+	}
+
+	minReplicas, maxReplicas := policy.autoscalingBounds(service, autoscaling)
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app":         service,
+				"environment": stack.Naming().Environment(),
+				"pr-number":   stack.ID(),
+			},
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       service,
+			},
+			MinReplicas: &minReplicas,
+			MaxReplicas: maxReplicas,
+			Metrics:     metrics,
+		},
+	}
+
+	if err := e.Apply(ctx, stack, hpa); err != nil {
+		return fmt.Errorf("failed to create autoscaler for %s: %v", service, err)
+	}
+
+	return nil
+}
+
+// autoscalerMetrics returns the metrics an autoscaled service is scaled on. Services run without
+// CPU requests, so CPU is targeted as an absolute average rather than a utilization percentage.
+func autoscalerMetrics(autoscaling *pishopv1alpha1.AutoscalingSpec) ([]autoscalingv2.MetricSpec, error) {
+	var metrics []autoscalingv2.MetricSpec
+
+	if autoscaling.TargetCPU != "" {
+		target, err := resource.ParseQuantity(autoscaling.TargetCPU)
+		if err != nil {
+			return nil, fmt.Errorf("invalid targetCPU %q: %v", autoscaling.TargetCPU, err)
+		}
+		metrics = append(metrics, autoscalingv2.MetricSpec{
+			Type: autoscalingv2.ResourceMetricSourceType,
+			Resource: &autoscalingv2.ResourceMetricSource{
+				Name: corev1.ResourceCPU,
+				Target: autoscalingv2.MetricTarget{
+					Type:         autoscalingv2.AverageValueMetricType,
+					AverageValue: &target,
+				},
+			},
+		})
+	}
+
+	if autoscaling.CustomMetric != nil {
+		target, err := resource.ParseQuantity(autoscaling.CustomMetric.TargetAverageValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid customMetric targetAverageValue %q: %v", autoscaling.CustomMetric.TargetAverageValue, err)
+		}
+		metrics = append(metrics, autoscalingv2.MetricSpec{
+			Type: autoscalingv2.PodsMetricSourceType,
+			Pods: &autoscalingv2.PodsMetricSource{
+				Metric: autoscalingv2.MetricIdentifier{Name: autoscaling.CustomMetric.Name},
+				Target: autoscalingv2.MetricTarget{
+					Type:         autoscalingv2.AverageValueMetricType,
+					AverageValue: &target,
+				},
+			},
+		})
+	}
+
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("targetCPU or customMetric is required")
+	}
+
+	return metrics, nil
+}
+
+// ensureServiceDisruptionBudget keeps all but one pod of a service running several replicas
+// available during voluntary disruptions such as node drains
+func (e *StackEngine) ensureServiceDisruptionBudget(ctx context.Context, stack Stack, namespace, service string) error {
+	policy := stack.ResourcePolicy()
+	minReplicas := policy.serviceReplicas(service)
+	if autoscaling := policy.serviceAutoscaling(service); autoscaling != nil {
+		minReplicas, _ = policy.autoscalingBounds(service, autoscaling)
+	}
+
+	if minReplicas < 2 {
+		pdb := &policyv1.PodDisruptionBudget{ObjectMeta: metav1.ObjectMeta{Name: service, Namespace: namespace}}
+		if err := e.deleteManaged(ctx, pdb); err != nil {
+			return fmt.Errorf("failed to delete disruption budget for %s: %v", service, err)
+		}
+		return nil
+	}
+
+	maxUnavailable := intstr.FromInt(1)
+	pdb := &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app":         service,
+				"environment": stack.Naming().Environment(),
+				"pr-number":   stack.ID(),
+			},
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MaxUnavailable: &maxUnavailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": service,
+				},
+			},
+		},
+	}
+
+	if err := e.Apply(ctx, stack, pdb); err != nil {
+		return fmt.Errorf("failed to create disruption budget for %s: %v", service, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Service Scaling", func() {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		reconciler *PRStackReconciler
+		fakeClient client.Client
+		prStack    *pishopv1alpha1.PRStack
+		namespace  string
+	)
+
+	getDeployment := func(name string) *appsv1.Deployment {
+		var deployment appsv1.Deployment
+		Expect(fakeClient.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, &deployment)).To(Succeed())
+		return &deployment
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		fakeClient = newTestClient().Build()
+
+		reconciler = &PRStackReconciler{StackEngine: newTestEngine(fakeClient)}
+
+		namespace = reconciler.getNamespaceName("123")
+		prStack = newTestPRStack()
+		prStack.Spec.Services = []string{"product-service", "order-service"}
+		prStack.Spec.ServiceScaling = []pishopv1alpha1.ServiceScaling{
+			{Name: "product-service", Replicas: int32Ptr(3)},
+			{Name: "order-service", Autoscaling: &pishopv1alpha1.AutoscalingSpec{
+				MinReplicas: int32Ptr(2),
+				MaxReplicas: 5,
+				TargetCPU:   "250m",
+			}},
+		}
+
+		ctx = ctrl.LoggerInto(ctx, zap.New(zap.UseDevMode(true)))
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	Context("createServiceDeployment", func() {
+		It("should run the configured replicas with a disruption budget", func() {
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")).To(Succeed())
+
+			Expect(*getDeployment("product-service").Spec.Replicas).To(Equal(int32(3)))
+
+			var pdb policyv1.PodDisruptionBudget
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, &pdb)).To(Succeed())
+			Expect(pdb.Spec.MaxUnavailable.IntValue()).To(Equal(1))
+			Expect(pdb.Spec.Selector.MatchLabels).To(HaveKeyWithValue("app", "product-service"))
+
+			var hpa autoscalingv2.HorizontalPodAutoscaler
+			err := fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, &hpa)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should create an autoscaler for autoscaled services", func() {
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "order-service")).To(Succeed())
+
+			Expect(*getDeployment("order-service").Spec.Replicas).To(Equal(int32(2)))
+
+			var hpa autoscalingv2.HorizontalPodAutoscaler
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "order-service", Namespace: namespace}, &hpa)).To(Succeed())
+			Expect(hpa.Spec.ScaleTargetRef.Name).To(Equal("order-service"))
+			Expect(*hpa.Spec.MinReplicas).To(Equal(int32(2)))
+			Expect(hpa.Spec.MaxReplicas).To(Equal(int32(5)))
+			Expect(hpa.Spec.Metrics).To(HaveLen(1))
+			Expect(hpa.Spec.Metrics[0].Resource.Name).To(Equal(corev1.ResourceCPU))
+			Expect(hpa.Spec.Metrics[0].Resource.Target.AverageValue.Cmp(resource.MustParse("250m"))).To(Equal(0))
+		})
+
+		It("should scale on a custom metric", func() {
+			prStack.Spec.ServiceScaling[1].Autoscaling.TargetCPU = ""
+			prStack.Spec.ServiceScaling[1].Autoscaling.CustomMetric = &pishopv1alpha1.CustomMetricSpec{
+				Name:               "http_requests_per_second",
+				TargetAverageValue: "100",
+			}
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "order-service")).To(Succeed())
+
+			var hpa autoscalingv2.HorizontalPodAutoscaler
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "order-service", Namespace: namespace}, &hpa)).To(Succeed())
+			Expect(hpa.Spec.Metrics).To(HaveLen(1))
+			Expect(hpa.Spec.Metrics[0].Type).To(Equal(autoscalingv2.PodsMetricSourceType))
+			Expect(hpa.Spec.Metrics[0].Pods.Metric.Name).To(Equal("http_requests_per_second"))
+		})
+
+		It("should keep the replicas chosen by the autoscaler", func() {
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "order-service")).To(Succeed())
+
+			deployment := getDeployment("order-service")
+			deployment.Spec.Replicas = int32Ptr(4)
+			Expect(fakeClient.Update(ctx, deployment)).To(Succeed())
+
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "order-service")).To(Succeed())
+			Expect(*getDeployment("order-service").Spec.Replicas).To(Equal(int32(4)))
+		})
+
+		It("should leave the replicas of running autoscaled services to the autoscaler", func() {
+			replicas, _, err := reconciler.getServiceReplicas(ctx, asStack(prStack), namespace, "order-service")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*replicas).To(Equal(int32(2)))
+
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "order-service")).To(Succeed())
+			replicas, _, err = reconciler.getServiceReplicas(ctx, asStack(prStack), namespace, "order-service")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(replicas).To(BeNil())
+
+			replicas, _, err = reconciler.getServiceReplicas(ctx, asStack(prStack), namespace, "product-service")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*replicas).To(Equal(int32(3)))
+		})
+
+		It("should detect replicas owned by other managers", func() {
+			deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{ManagedFields: []metav1.ManagedFieldsEntry{{
+				Manager:   FieldManager,
+				Operation: metav1.ManagedFieldsOperationApply,
+				FieldsV1:  &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:replicas":{}}}`)},
+			}}}}
+			Expect(replicasManagedByOthers(deployment)).To(BeFalse())
+
+			deployment.ManagedFields = append(deployment.ManagedFields, metav1.ManagedFieldsEntry{
+				Manager:     "kube-controller-manager",
+				Operation:   metav1.ManagedFieldsOperationUpdate,
+				Subresource: "scale",
+				FieldsV1:    &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:replicas":{}}}`)},
+			})
+			Expect(replicasManagedByOthers(deployment)).To(BeTrue())
+		})
+
+		It("should remove the autoscaler and disruption budget when scaling is reset", func() {
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "order-service")).To(Succeed())
+
+			prStack.Spec.ServiceScaling = nil
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "order-service")).To(Succeed())
+
+			Expect(*getDeployment("order-service").Spec.Replicas).To(Equal(int32(1)))
+
+			var hpa autoscalingv2.HorizontalPodAutoscaler
+			err := fakeClient.Get(ctx, client.ObjectKey{Name: "order-service", Namespace: namespace}, &hpa)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+			var pdb policyv1.PodDisruptionBudget
+			err = fakeClient.Get(ctx, client.ObjectKey{Name: "order-service", Namespace: namespace}, &pdb)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should reject invalid autoscaling targets", func() {
+			prStack.Spec.ServiceScaling[1].Autoscaling.TargetCPU = "half"
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "order-service")).ToNot(Succeed())
+		})
+	})
+
+	Context("active state", func() {
+		BeforeEach(func() {
+			for _, service := range prStack.Spec.Services {
+				Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, service)).To(Succeed())
+			}
+			Expect(fakeClient.Create(ctx, &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "nats", Namespace: namespace},
+				Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(1)},
+			})).To(Succeed())
+
+			// The autoscaler scaled the order service up
+			deployment := getDeployment("order-service")
+			deployment.Spec.Replicas = int32Ptr(4)
+			Expect(fakeClient.Update(ctx, deployment)).To(Succeed())
+		})
+
+		It("should remember the replicas when scaling to zero", func() {
+			Expect(reconciler.scaleDeployments(ctx, namespace, 0)).To(Succeed())
+
+			deployment := getDeployment("order-service")
+			Expect(*deployment.Spec.Replicas).To(Equal(int32(0)))
+			Expect(deployment.Annotations).To(HaveKeyWithValue(ReplicasAnnotation, "4"))
+		})
+
+		It("should restore each deployment's replicas", func() {
+			Expect(reconciler.scaleDeployments(ctx, namespace, 0)).To(Succeed())
+			Expect(reconciler.restoreDeployments(ctx, asStack(prStack))).To(Succeed())
+
+			Expect(*getDeployment("product-service").Spec.Replicas).To(Equal(int32(3)))
+			Expect(*getDeployment("nats").Spec.Replicas).To(Equal(int32(1)))
+
+			deployment := getDeployment("order-service")
+			Expect(*deployment.Spec.Replicas).To(Equal(int32(4)))
+			Expect(deployment.Annotations).ToNot(HaveKey(ReplicasAnnotation))
+		})
+
+		It("should clamp remembered replicas to the autoscaling bounds", func() {
+			Expect(reconciler.scaleDeployments(ctx, namespace, 0)).To(Succeed())
+
+			prStack.Spec.ServiceScaling[1].Autoscaling.MaxReplicas = 3
+			Expect(reconciler.restoreDeployments(ctx, asStack(prStack))).To(Succeed())
+
+			Expect(*getDeployment("order-service").Spec.Replicas).To(Equal(int32(3)))
+		})
+
+		It("should deploy remembered replicas when the stack is reactivated", func() {
+			prStack.Spec.Active = false
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "order-service")).To(Succeed())
+			Expect(*getDeployment("order-service").Spec.Replicas).To(Equal(int32(0)))
+
+			prStack.Spec.Active = true
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "order-service")).To(Succeed())
+			Expect(*getDeployment("order-service").Spec.Replicas).To(Equal(int32(4)))
+		})
+	})
+})
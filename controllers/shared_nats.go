@@ -0,0 +1,456 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// NATS modes
+	NATSModeShared    = "shared"
+	NATSModeDedicated = "dedicated"
+
+	// NATS secret holding the PR user credentials in shared mode
+	NATSSecretName     = "nats-secret"
+	NATSCredsKey       = "user.creds"
+	NATSCredsMountPath = "/etc/nats"
+
+	// NATSAccountSeedKey holds the seed of the PR account in the account secret of the
+	// operator namespace, out of reach of the PR workloads
+	NATSAccountSeedKey = "account.seed"
+
+	// natsClaimsUpdateSubject is the system account subject used to push account JWTs to the resolver
+	natsClaimsUpdateSubject = "$SYS.REQ.CLAIMS.UPDATE"
+	natsRequestTimeout      = 10 * time.Second
+)
+
+// isSharedNATS returns true if the stack uses a per-PR account on the shared NATS server
+func isSharedNATS(stack Stack) bool {
+	return stack.Spec().NATS != nil && stack.Spec().NATS.Mode == NATSModeShared
+}
+
+// getNATSSubjectPrefix returns the subject prefix reserved for a PR
+func getNATSSubjectPrefix(prNumber string) string {
+	return fmt.Sprintf("pishop.pr.%s", prNumber)
+}
+
+// getNATSAccountName returns the name of the PR account on the shared NATS server
+func getNATSAccountName(prNumber string) string {
+	return fmt.Sprintf("pishop-pr-%s", prNumber)
+}
+
+// getSharedNATSURL returns the shared NATS server of a stack, preferring the stack's NatsURL
+func (e *StackEngine) getSharedNATSURL(stack Stack) string {
+	if stack.Spec().NatsURL != "" {
+		return stack.Spec().NatsURL
+	}
+	return e.NATSURL
+}
+
+// provisionSharedNATS creates or updates the PR account on the shared NATS server and stores
+// the credentials of a user restricted to the PR subject prefix in the PR namespace.
+// It returns the public key of the PR account.
+func (e *StackEngine) provisionSharedNATS(ctx context.Context, stack Stack, namespace string) (string, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	natsURL := e.getSharedNATSURL(stack)
+	if natsURL == "" {
+		return "", fmt.Errorf("shared NATS URL is not configured")
+	}
+
+	operatorKey, err := e.getNATSOperatorKey()
+	if err != nil {
+		return "", err
+	}
+
+	accountKey, err := e.getOrCreateNATSAccountKey(ctx, stack)
+	if err != nil {
+		return "", err
+	}
+	accountPub, err := accountKey.PublicKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to get NATS account public key: %v", err)
+	}
+
+	// Store the account key before the account exists on the server, so it can always be revoked
+	if err := e.storeNATSAccountKey(ctx, stack, accountKey); err != nil {
+		return "", err
+	}
+
+	accountJWT, err := buildNATSAccountJWT(operatorKey, accountPub, stack.Naming().NATSAccountName(stack.ID()), false)
+	if err != nil {
+		return "", err
+	}
+	if err := e.pushNATSAccountJWT(ctx, natsURL, accountJWT); err != nil {
+		return "", err
+	}
+
+	subjectPrefix := stack.Naming().NATSSubjectPrefix(stack.ID())
+	userJWT, userSeed, err := buildNATSUserJWT(accountKey, stack.Naming().User(stack.ID()), natsUserPermissions(subjectPrefix))
+	if err != nil {
+		return "", err
+	}
+	creds, err := jwt.FormatUserConfig(userJWT, userSeed)
+	if err != nil {
+		return "", fmt.Errorf("failed to format NATS credentials: %v", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      NATSSecretName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app": "nats",
+				"pr":  stack.ID(),
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"url":           []byte(natsURL),
+			"subjectPrefix": []byte(subjectPrefix),
+			NATSCredsKey:    creds,
+		},
+	}
+
+	if err := e.Apply(ctx, stack, secret); err != nil {
+		return "", fmt.Errorf("failed to create NATS secret: %v", err)
+	}
+
+	log.Info("Shared NATS account provisioned", "account", accountPub, "subjectPrefix", subjectPrefix)
+	return accountPub, nil
+}
+
+// cleanupSharedNATS deletes all JetStream streams of the PR account, revokes its users
+// and blocks new connections to it. The account secret is left to be garbage collected with the
+// stack, so a retried cleanup can revoke the account again.
+func (e *StackEngine) cleanupSharedNATS(ctx context.Context, stack Stack) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	accountKey, err := e.getNATSAccountKey(ctx, stack)
+	if err != nil {
+		return err
+	}
+	if accountKey == nil {
+		// An account recorded in the status without its key cannot be revoked
+		if stack.Status().NATS != nil && stack.Status().NATS.Account != "" {
+			return fmt.Errorf("key of NATS account %s not found, it cannot be revoked", stack.Status().NATS.Account)
+		}
+		log.Info("NATS account key not found, no shared NATS account to clean up")
+		return nil
+	}
+	accountPub, err := accountKey.PublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to get NATS account public key: %v", err)
+	}
+
+	natsURL := e.getSharedNATSURL(stack)
+	if natsURL == "" {
+		return fmt.Errorf("shared NATS URL is not configured")
+	}
+
+	deleted, err := deleteNATSAccountStreams(ctx, natsURL, accountKey)
+	if err != nil {
+		return err
+	}
+	log.Info("Deleted JetStream streams of PR account", "account", accountPub, "streams", deleted)
+
+	operatorKey, err := e.getNATSOperatorKey()
+	if err != nil {
+		return err
+	}
+	accountJWT, err := buildNATSAccountJWT(operatorKey, accountPub, stack.Naming().NATSAccountName(stack.ID()), true)
+	if err != nil {
+		return err
+	}
+	if err := e.pushNATSAccountJWT(ctx, natsURL, accountJWT); err != nil {
+		return err
+	}
+
+	log.Info("Revoked shared NATS account", "account", accountPub)
+	return nil
+}
+
+// getNATSOperatorKey returns the key used to sign PR account JWTs
+func (e *StackEngine) getNATSOperatorKey() (nkeys.KeyPair, error) {
+	if e.NATSOperatorSeed == "" {
+		return nil, fmt.Errorf("NATS operator seed is not configured")
+	}
+	operatorKey, err := nkeys.FromSeed([]byte(e.NATSOperatorSeed))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NATS operator seed: %v", err)
+	}
+	return operatorKey, nil
+}
+
+// natsAccountSecretName returns the name of the secret holding the PR account key of a stack
+// namespace in the operator namespace
+func natsAccountSecretName(namespace string) string {
+	return fmt.Sprintf("nats-account-%s", namespace)
+}
+
+// natsAccountSecretKey returns the key of the account secret of a stack
+func (e *StackEngine) natsAccountSecretKey(stack Stack) (client.ObjectKey, error) {
+	if e.NATSAccountNamespace == "" {
+		return client.ObjectKey{}, fmt.Errorf("NATS account namespace is not configured")
+	}
+	return client.ObjectKey{Name: natsAccountSecretName(stack.Namespace()), Namespace: e.NATSAccountNamespace}, nil
+}
+
+// getNATSAccountKey returns the PR account key of a stack, or nil when it has none. Keys of
+// stacks provisioned before the account secret was introduced are read from the NATS secret
+// of the PR namespace.
+func (e *StackEngine) getNATSAccountKey(ctx context.Context, stack Stack) (nkeys.KeyPair, error) {
+	key, err := e.natsAccountSecretKey(stack)
+	if err != nil {
+		return nil, err
+	}
+
+	var seed []byte
+	secret := &corev1.Secret{}
+	if err := e.Get(ctx, key, secret); err == nil {
+		seed = secret.Data[NATSAccountSeedKey]
+	} else if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get NATS account secret: %v", err)
+	}
+
+	if len(seed) == 0 {
+		legacy := &corev1.Secret{}
+		err := e.Get(ctx, client.ObjectKey{Name: NATSSecretName, Namespace: stack.Namespace()}, legacy)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to get NATS secret: %v", err)
+		}
+		seed = legacy.Data[NATSAccountSeedKey]
+	}
+	if len(seed) == 0 {
+		return nil, nil
+	}
+
+	accountKey, err := nkeys.FromSeed(seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NATS account seed: %v", err)
+	}
+	return accountKey, nil
+}
+
+// getOrCreateNATSAccountKey reuses the stored PR account key so the account keeps its identity
+// when the stack is provisioned again
+func (e *StackEngine) getOrCreateNATSAccountKey(ctx context.Context, stack Stack) (nkeys.KeyPair, error) {
+	accountKey, err := e.getNATSAccountKey(ctx, stack)
+	if err != nil || accountKey != nil {
+		return accountKey, err
+	}
+
+	accountKey, err = nkeys.CreateAccount()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NATS account key: %v", err)
+	}
+	return accountKey, nil
+}
+
+// storeNATSAccountKey stores the PR account key of a stack in the operator namespace, owned by
+// the stack so it is removed once the stack is deleted
+func (e *StackEngine) storeNATSAccountKey(ctx context.Context, stack Stack, accountKey nkeys.KeyPair) error {
+	key, err := e.natsAccountSecretKey(stack)
+	if err != nil {
+		return err
+	}
+	accountSeed, err := accountKey.Seed()
+	if err != nil {
+		return fmt.Errorf("failed to get NATS account seed: %v", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.Name,
+			Namespace: key.Namespace,
+			Labels: map[string]string{
+				"app": "nats",
+				"pr":  stack.ID(),
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			NATSAccountSeedKey: accountSeed,
+		},
+	}
+
+	if err := e.Apply(ctx, stack, secret); err != nil {
+		return fmt.Errorf("failed to store NATS account key: %v", err)
+	}
+	return nil
+}
+
+// buildNATSAccountJWT builds the PR account JWT signed by the operator key.
+// Revoked accounts reject all existing users and new connections.
+func buildNATSAccountJWT(operatorKey nkeys.KeyPair, accountPub, accountName string, revoked bool) (string, error) {
+	claims := jwt.NewAccountClaims(accountPub)
+	claims.Name = accountName
+
+	if revoked {
+		claims.Revoke(jwt.All)
+		claims.Limits.Conn = 0
+		claims.Limits.LeafNodeConn = 0
+	} else {
+		claims.Limits.JetStreamLimits = jwt.JetStreamLimits{
+			MemoryStorage: jwt.NoLimit,
+			DiskStorage:   jwt.NoLimit,
+			Streams:       jwt.NoLimit,
+			Consumer:      jwt.NoLimit,
+			MaxAckPending: jwt.NoLimit,
+		}
+	}
+
+	token, err := claims.Encode(operatorKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode NATS account JWT: %v", err)
+	}
+	return token, nil
+}
+
+// natsUserPermissions restricts a PR user to the PR subject prefix, JetStream and request/reply inboxes.
+// Inboxes are safe to allow because every PR has its own account.
+func natsUserPermissions(subjectPrefix string) jwt.Permissions {
+	permissions := jwt.Permissions{
+		Resp: &jwt.ResponsePermission{MaxMsgs: 1},
+	}
+	permissions.Pub.Allow.Add(subjectPrefix+".>", "$JS.API.>", "$JS.ACK.>", "_INBOX.>")
+	permissions.Sub.Allow.Add(subjectPrefix+".>", "_INBOX.>")
+	return permissions
+}
+
+// buildNATSUserJWT creates a new user in the PR account and returns its JWT and seed
+func buildNATSUserJWT(accountKey nkeys.KeyPair, name string, permissions jwt.Permissions) (string, []byte, error) {
+	userKey, err := nkeys.CreateUser()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create NATS user key: %v", err)
+	}
+	userPub, err := userKey.PublicKey()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get NATS user public key: %v", err)
+	}
+	userSeed, err := userKey.Seed()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get NATS user seed: %v", err)
+	}
+
+	claims := jwt.NewUserClaims(userPub)
+	claims.Name = name
+	claims.Permissions = permissions
+
+	token, err := claims.Encode(accountKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode NATS user JWT: %v", err)
+	}
+	return token, userSeed, nil
+}
+
+// pushNATSAccountJWT publishes an account JWT to the resolver of the shared NATS server
+func (e *StackEngine) pushNATSAccountJWT(ctx context.Context, natsURL, accountJWT string) error {
+	if e.NATSSystemCreds == "" {
+		return fmt.Errorf("NATS system account credentials are not configured")
+	}
+
+	nc, err := nats.Connect(natsURL,
+		nats.Name("pishop-operator"),
+		nats.UserCredentials(e.NATSSystemCreds),
+		nats.Timeout(natsRequestTimeout))
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+
+	requestCtx, cancel := context.WithTimeout(ctx, natsRequestTimeout)
+	defer cancel()
+
+	msg, err := nc.RequestWithContext(requestCtx, natsClaimsUpdateSubject, []byte(accountJWT))
+	if err != nil {
+		return fmt.Errorf("failed to push NATS account JWT: %v", err)
+	}
+
+	return parseNATSClaimsUpdateResponse(msg.Data)
+}
+
+// parseNATSClaimsUpdateResponse checks the resolver response to a claims update
+func parseNATSClaimsUpdateResponse(data []byte) error {
+	var response struct {
+		Error *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error,omitempty"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return fmt.Errorf("invalid NATS claims update response: %v", err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("NATS rejected account JWT (%d): %s", response.Error.Code, response.Error.Description)
+	}
+	return nil
+}
+
+// connectNATSAccount connects to the shared NATS server as a short-lived user of a PR account
+func connectNATSAccount(natsURL string, accountKey nkeys.KeyPair, name string) (*nats.Conn, error) {
+	userJWT, userSeed, err := buildNATSUserJWT(accountKey, name, jwt.Permissions{})
+	if err != nil {
+		return nil, err
+	}
+
+	nc, err := nats.Connect(natsURL,
+		nats.Name("pishop-operator"),
+		nats.UserJWTAndSeed(userJWT, string(userSeed)),
+		nats.Timeout(natsRequestTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %v", err)
+	}
+	return nc, nil
+}
+
+// deleteNATSAccountStreams connects as a temporary user of the PR account and deletes all of its streams
+func deleteNATSAccountStreams(ctx context.Context, natsURL string, accountKey nkeys.KeyPair) (int, error) {
+	nc, err := connectNATSAccount(natsURL, accountKey, "pishop-operator-cleanup")
+	if err != nil {
+		return 0, err
+	}
+	defer nc.Close()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, natsRequestTimeout)
+	defer cancel()
+
+	var streams []string
+	lister := js.StreamNames(requestCtx)
+	for name := range lister.Name() {
+		streams = append(streams, name)
+	}
+	if err := lister.Err(); err != nil {
+		if errors.Is(err, jetstream.ErrJetStreamNotEnabled) || errors.Is(err, jetstream.ErrJetStreamNotEnabledForAccount) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to list JetStream streams: %v", err)
+	}
+
+	for _, stream := range streams {
+		if err := js.DeleteStream(requestCtx, stream); err != nil && !errors.Is(err, jetstream.ErrStreamNotFound) {
+			return 0, fmt.Errorf("failed to delete JetStream stream %s: %v", stream, err)
+		}
+	}
+
+	return len(streams), nil
+}
@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Shared NATS", func() {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		reconciler *PRStackReconciler
+		fakeClient client.Client
+		prStack    *pishopv1alpha1.PRStack
+		namespace  string
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		fakeClient = newTestClient().Build()
+
+		reconciler = &PRStackReconciler{StackEngine: newTestEngine(fakeClient)}
+		reconciler.NATSURL = "nats://nats.pishop-base.svc.cluster.local:4222"
+		reconciler.NATSAccountNamespace = "pishop-operator-system"
+
+		namespace = reconciler.getNamespaceName("123")
+		prStack = newTestPRStack()
+		prStack.Spec.NATS = &pishopv1alpha1.NATSSpec{Mode: NATSModeShared}
+		prStack.Status = pishopv1alpha1.PRStackStatus{
+			NATS: &pishopv1alpha1.NATSConfig{
+				ConnectionString: "nats://nats.pishop-base.svc.cluster.local:4222",
+				SubjectPrefix:    "pishop.pr.123",
+			},
+			Redis: &pishopv1alpha1.RedisConfig{
+				ConnectionString: "redis://redis:6379",
+				KeyPrefix:        "pishop:pr:123:",
+			},
+		}
+
+		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	Context("mode and URL selection", func() {
+		It("should default to dedicated mode", func() {
+			Expect(isSharedNATS(asStack(&pishopv1alpha1.PRStack{}))).To(BeFalse())
+			Expect(isSharedNATS(asStack(prStack))).To(BeTrue())
+		})
+
+		It("should prefer the stack NatsURL", func() {
+			Expect(reconciler.getSharedNATSURL(asStack(prStack))).To(Equal("nats://nats.pishop-base.svc.cluster.local:4222"))
+			prStack.Spec.NatsURL = "nats://custom:4222"
+			Expect(reconciler.getSharedNATSURL(asStack(prStack))).To(Equal("nats://custom:4222"))
+		})
+	})
+
+	Context("account and user JWTs", func() {
+		var operatorKey, accountKey nkeys.KeyPair
+		var accountPub string
+
+		BeforeEach(func() {
+			var err error
+			operatorKey, err = nkeys.CreateOperator()
+			Expect(err).ToNot(HaveOccurred())
+			accountKey, err = nkeys.CreateAccount()
+			Expect(err).ToNot(HaveOccurred())
+			accountPub, err = accountKey.PublicKey()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should build an account with JetStream enabled", func() {
+			token, err := buildNATSAccountJWT(operatorKey, accountPub, getNATSAccountName("123"), false)
+			Expect(err).ToNot(HaveOccurred())
+
+			claims, err := jwt.DecodeAccountClaims(token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims.Subject).To(Equal(accountPub))
+			Expect(claims.Name).To(Equal("pishop-pr-123"))
+			Expect(claims.Limits.IsJSEnabled()).To(BeTrue())
+			Expect(claims.Revocations).To(BeEmpty())
+		})
+
+		It("should revoke all users and connections of a revoked account", func() {
+			token, err := buildNATSAccountJWT(operatorKey, accountPub, getNATSAccountName("123"), true)
+			Expect(err).ToNot(HaveOccurred())
+
+			claims, err := jwt.DecodeAccountClaims(token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims.Revocations).To(HaveKey(jwt.All))
+			Expect(claims.Limits.Conn).To(BeZero())
+			Expect(claims.Limits.IsJSEnabled()).To(BeFalse())
+		})
+
+		It("should restrict users to the PR subject prefix", func() {
+			token, seed, err := buildNATSUserJWT(accountKey, "pishop_pr_123", natsUserPermissions("pishop.pr.123"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(seed).ToNot(BeEmpty())
+
+			claims, err := jwt.DecodeUserClaims(token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims.Issuer).To(Equal(accountPub))
+			Expect(claims.Permissions.Pub.Allow).To(ContainElement("pishop.pr.123.>"))
+			Expect(claims.Permissions.Sub.Allow).To(ContainElement("pishop.pr.123.>"))
+			Expect(claims.Permissions.Pub.Allow).ToNot(ContainElement(">"))
+		})
+	})
+
+	Context("claims update response", func() {
+		It("should accept successful updates", func() {
+			Expect(parseNATSClaimsUpdateResponse([]byte(`{"data":{"account":"A","code":200,"message":"jwt updated"}}`))).To(Succeed())
+		})
+
+		It("should report rejected updates", func() {
+			err := parseNATSClaimsUpdateResponse([]byte(`{"error":{"account":"A","code":500,"description":"jwt not signed by trusted operator"}}`))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("jwt not signed by trusted operator"))
+		})
+	})
+
+	Context("provisioning", func() {
+		It("should fail without an operator seed", func() {
+			_, err := reconciler.provisionSharedNATS(ctx, asStack(prStack), namespace)
+			Expect(err).To(MatchError(ContainSubstring("operator seed")))
+		})
+
+		It("should fail without a NATS URL", func() {
+			reconciler.NATSURL = ""
+			_, err := reconciler.provisionSharedNATS(ctx, asStack(prStack), namespace)
+			Expect(err).To(MatchError(ContainSubstring("NATS URL")))
+		})
+
+		It("should reuse the stored account key", func() {
+			accountKey, err := nkeys.CreateAccount()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reconciler.storeNATSAccountKey(ctx, asStack(prStack), accountKey)).To(Succeed())
+
+			var secret corev1.Secret
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "nats-account-" + namespace, Namespace: "pishop-operator-system"}, &secret)).To(Succeed())
+			Expect(secret.Data).To(HaveKey(NATSAccountSeedKey))
+
+			stored, err := reconciler.getOrCreateNATSAccountKey(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+			storedPub, _ := stored.PublicKey()
+			expectedPub, _ := accountKey.PublicKey()
+			Expect(storedPub).To(Equal(expectedPub))
+		})
+
+		It("should reuse an account key stored in the PR namespace", func() {
+			accountKey, err := nkeys.CreateAccount()
+			Expect(err).ToNot(HaveOccurred())
+			seed, err := accountKey.Seed()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: NATSSecretName, Namespace: namespace},
+				Data:       map[string][]byte{NATSAccountSeedKey: seed},
+			})).To(Succeed())
+
+			stored, err := reconciler.getNATSAccountKey(ctx, asStack(prStack))
+			Expect(err).ToNot(HaveOccurred())
+			storedPub, _ := stored.PublicKey()
+			expectedPub, _ := accountKey.PublicKey()
+			Expect(storedPub).To(Equal(expectedPub))
+		})
+
+		It("should not deploy NATS in the PR namespace", func() {
+			Expect(reconciler.createNATSResources(ctx, asStack(prStack), namespace)).To(Succeed())
+
+			var deployment appsv1.Deployment
+			err := fakeClient.Get(ctx, client.ObjectKey{Name: "nats", Namespace: namespace}, &deployment)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("cleanup", func() {
+		It("should skip stacks without an account", func() {
+			Expect(reconciler.cleanupSharedNATS(ctx, asStack(prStack))).To(Succeed())
+		})
+
+		It("should fail when the key of a recorded account is missing", func() {
+			prStack.Status.NATS.Account = "ACCOUNT"
+
+			err := reconciler.cleanupSharedNATS(ctx, asStack(prStack))
+			Expect(err).To(MatchError(ContainSubstring("cannot be revoked")))
+			Expect(reconciler.cleanupAllResources(ctx, asStack(prStack))).To(MatchError(ContainSubstring("cannot be revoked")))
+		})
+	})
+
+	Context("service deployments", func() {
+		It("should mount the NATS user credentials", func() {
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")).To(Succeed())
+
+			var deployment appsv1.Deployment
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, &deployment)).To(Succeed())
+
+			podSpec := deployment.Spec.Template.Spec
+			Expect(podSpec.Volumes).To(ContainElement(HaveField("Secret.SecretName", NATSSecretName)))
+			Expect(podSpec.Containers[0].VolumeMounts).To(ContainElement(HaveField("MountPath", NATSCredsMountPath)))
+			Expect(podSpec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "NATS_CREDS_FILE", Value: "/etc/nats/user.creds"}))
+		})
+
+		It("should not mount credentials in dedicated mode", func() {
+			prStack.Spec.NATS = nil
+			Expect(reconciler.createServiceDeployment(ctx, asStack(prStack), namespace, "product-service")).To(Succeed())
+
+			var deployment appsv1.Deployment
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, &deployment)).To(Succeed())
+			Expect(deployment.Spec.Template.Spec.Volumes).To(BeEmpty())
+		})
+	})
+})
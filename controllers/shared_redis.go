@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/redis/go-redis/v9"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Redis modes
+	RedisModeShared    = "shared"
+	RedisModeDedicated = "dedicated"
+
+	// Redis secret holding the connection string services use
+	RedisSecretName = "redis-secret"
+
+	// redisScanBatchSize is the number of keys fetched per SCAN when purging a PR key prefix
+	redisScanBatchSize = 500
+)
+
+// isSharedRedis returns true if the stack uses an ACL user on the shared Redis server
+func isSharedRedis(stack Stack) bool {
+	return stack.Spec().Redis != nil && stack.Spec().Redis.Mode == RedisModeShared
+}
+
+// getRedisKeyPrefix returns the key prefix reserved for a PR
+func getRedisKeyPrefix(prNumber string) string {
+	return fmt.Sprintf("pishop:pr:%s:", prNumber)
+}
+
+// getRedisUser returns the ACL user of a PR on the shared Redis server
+func getRedisUser(prNumber string) string {
+	return fmt.Sprintf("pishop_pr_%s", prNumber)
+}
+
+// getSharedRedisURL returns the shared Redis server of a stack, preferring the stack's RedisURL
+func (e *StackEngine) getSharedRedisURL(stack Stack) string {
+	if stack.Spec().RedisURL != "" {
+		return stack.Spec().RedisURL
+	}
+	return e.RedisURL
+}
+
+// redisACLRules returns the ACL SETUSER rules restricting a user to the PR keys and channels.
+// Dangerous commands (FLUSHALL, KEYS, CONFIG, ...) are denied as they are not limited by key patterns.
+func redisACLRules(password, keyPrefix string) []interface{} {
+	return []interface{}{
+		"reset",
+		"on",
+		">" + password,
+		"~" + keyPrefix + "*",
+		"&" + keyPrefix + "*",
+		"+@all",
+		"-@dangerous",
+	}
+}
+
+// redisUserURL returns the Redis URL authenticating as the given user
+func redisUserURL(adminURL string, userInfo *url.Userinfo) (string, error) {
+	u, err := url.Parse(adminURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid Redis URL: %v", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return "", fmt.Errorf("invalid Redis URL: unsupported scheme %q", u.Scheme)
+	}
+	u.User = userInfo
+	return u.String(), nil
+}
+
+// connectSharedRedis connects to the shared Redis server of a stack with the operator's credentials
+func (e *StackEngine) connectSharedRedis(ctx context.Context, stack Stack) (*redis.Client, error) {
+	redisURL := e.getSharedRedisURL(stack)
+	if redisURL == "" {
+		return nil, fmt.Errorf("shared Redis URL is not configured")
+	}
+
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %v", err)
+	}
+
+	redisClient := redis.NewClient(opts)
+	if err := redisClient.Ping(ctx).Err(); err != nil {
+		redisClient.Close()
+		return nil, fmt.Errorf("failed to ping Redis: %v", err)
+	}
+
+	return redisClient, nil
+}
+
+// provisionSharedRedis creates or updates the PR ACL user on the shared Redis server and stores
+// its connection string in the PR namespace. It returns the connection string without password.
+func (e *StackEngine) provisionSharedRedis(ctx context.Context, stack Stack, namespace string) (string, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	redisClient, err := e.connectSharedRedis(ctx, stack)
+	if err != nil {
+		return "", err
+	}
+	defer redisClient.Close()
+
+	// Keep the existing password so running services stay connected when provisioning again
+	password := ""
+	existing := &corev1.Secret{}
+	if err := e.Get(ctx, client.ObjectKey{Name: RedisSecretName, Namespace: namespace}, existing); err == nil {
+		password = string(existing.Data["password"])
+	} else if !apierrors.IsNotFound(err) {
+		return "", fmt.Errorf("failed to get Redis secret: %v", err)
+	}
+	if password == "" {
+		password, err = generateSecurePassword()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate secure password: %v", err)
+		}
+	}
+
+	user := stack.Naming().User(stack.ID())
+	keyPrefix := stack.Naming().RedisKeyPrefix(stack.ID())
+
+	// Build the connection strings before touching Redis so an invalid URL changes nothing
+	redisURL := e.getSharedRedisURL(stack)
+	serviceURL, err := redisUserURL(redisURL, url.UserPassword(user, password))
+	if err != nil {
+		return "", err
+	}
+	connectionString, err := redisUserURL(redisURL, url.User(user))
+	if err != nil {
+		return "", err
+	}
+
+	args := append([]interface{}{"ACL", "SETUSER", user}, redisACLRules(password, keyPrefix)...)
+	if err := redisClient.Do(ctx, args...).Err(); err != nil {
+		return "", fmt.Errorf("failed to set Redis ACL user: %v", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      RedisSecretName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app": "redis",
+				"pr":  stack.ID(),
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"url":       []byte(serviceURL),
+			"username":  []byte(user),
+			"password":  []byte(password),
+			"keyPrefix": []byte(keyPrefix),
+		},
+	}
+
+	if err := e.Apply(ctx, stack, secret); err != nil {
+		return "", fmt.Errorf("failed to create Redis secret: %v", err)
+	}
+
+	log.Info("Shared Redis user provisioned", "user", user, "keyPrefix", keyPrefix)
+	return connectionString, nil
+}
+
+// cleanupSharedRedis deletes the PR ACL user, which also disconnects its clients,
+// and purges all keys under the PR key prefix
+func (e *StackEngine) cleanupSharedRedis(ctx context.Context, stack Stack) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	redisClient, err := e.connectSharedRedis(ctx, stack)
+	if err != nil {
+		return err
+	}
+	defer redisClient.Close()
+
+	user := stack.Naming().User(stack.ID())
+	removed, err := redisClient.Do(ctx, "ACL", "DELUSER", user).Int64()
+	if err != nil {
+		return fmt.Errorf("failed to delete Redis ACL user: %v", err)
+	}
+	if removed == 0 {
+		log.Info("Redis ACL user not found during cleanup (expected)", "user", user)
+	} else {
+		log.Info("Successfully deleted Redis ACL user", "user", user)
+	}
+
+	keyPrefix := stack.Naming().RedisKeyPrefix(stack.ID())
+	deleted, err := purgeRedisKeys(ctx, redisClient, keyPrefix)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Purged Redis keys", "prefix", keyPrefix, "keys", deleted)
+	return nil
+}
+
+// purgeRedisKeys deletes all keys under a prefix without blocking the server
+func purgeRedisKeys(ctx context.Context, redisClient *redis.Client, keyPrefix string) (int64, error) {
+	var cursor uint64
+	var deleted int64
+	for {
+		keys, next, err := redisClient.Scan(ctx, cursor, keyPrefix+"*", redisScanBatchSize).Result()
+		if err != nil {
+			return deleted, fmt.Errorf("failed to scan Redis keys: %v", err)
+		}
+		if len(keys) > 0 {
+			n, err := redisClient.Unlink(ctx, keys...).Result()
+			if err != nil {
+				return deleted, fmt.Errorf("failed to delete Redis keys: %v", err)
+			}
+			deleted += n
+		}
+		cursor = next
+		if cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+// Stack is a shop deployment handled by the StackEngine. Each stack kind (PRStack, Tenant)
+// adapts its resource to this interface; the engine provisions, deploys, backs up and cleans
+// up any stack without knowing its kind.
+type Stack interface {
+	// Object is the resource owning the stack, events are recorded on it
+	Object() client.Object
+	// ID identifies the stack among the stacks of its kind (PR number, tenant ID)
+	ID() string
+	// Namespace holding the Kubernetes resources of the stack
+	Namespace() string
+	// Naming scheme of the stack resources
+	Naming() StackNaming
+	// Services deployed in the stack
+	Services() []string
+	// ResourcePolicy of the stack services
+	ResourcePolicy() ResourcePolicy
+	// Spec holds the image, ingress, backend and backup configuration of the stack
+	Spec() *pishopv1alpha1.PRStackSpec
+	// Status holds the provisioned backends and the lifecycle state of the stack
+	Status() *pishopv1alpha1.PRStackStatus
+	// ApplyStatus writes Status to the resource owning the stack and returns the resource
+	// for a status update
+	ApplyStatus() client.Object
+}
+
+// ResourcePolicy defines how the services of a stack are sized
+type ResourcePolicy struct {
+	// Replicas of each service while the stack is active
+	Replicas int32
+	// Limits of the service containers, the defaults are used when nil
+	Limits *pishopv1alpha1.ResourceLimits
+	// ServiceScaling overrides the replicas and autoscaling of individual services
+	ServiceScaling []pishopv1alpha1.ServiceScaling
+	// Capped namespaces get a ResourceQuota from Limits and the operator-wide StackQuota
+	Capped bool
+}
+
+// defaultServices returns the services deployed when a stack does not list any
+func defaultServices() []string {
+	return strings.Split(DefaultServicesString, ",")
+}
+
+// prStackAdapter adapts a PRStack to the stack engine
+type prStackAdapter struct {
+	prStack *pishopv1alpha1.PRStack
+}
+
+// asStack returns the engine view of a PRStack, status changes are made on the PRStack itself
+func asStack(prStack *pishopv1alpha1.PRStack) Stack {
+	return &prStackAdapter{prStack: prStack}
+}
+
+func (s *prStackAdapter) Object() client.Object {
+	return s.prStack
+}
+
+func (s *prStackAdapter) ID() string {
+	return s.prStack.Spec.PRNumber
+}
+
+func (s *prStackAdapter) Namespace() string {
+	return s.Naming().Namespace(s.ID())
+}
+
+func (s *prStackAdapter) Naming() StackNaming {
+	return prStackNaming{}
+}
+
+func (s *prStackAdapter) Services() []string {
+	if len(s.prStack.Spec.Services) == 0 {
+		return defaultServices()
+	}
+	return s.prStack.Spec.Services
+}
+
+// ResourcePolicy runs a single replica of each service unless overridden by spec.serviceScaling,
+// PR stacks are scaled to zero when inactive and capped by the operator-wide quota
+func (s *prStackAdapter) ResourcePolicy() ResourcePolicy {
+	return ResourcePolicy{
+		Replicas:       1,
+		Limits:         s.prStack.Spec.ResourceLimits,
+		ServiceScaling: s.prStack.Spec.ServiceScaling,
+		Capped:         true,
+	}
+}
+
+func (s *prStackAdapter) Spec() *pishopv1alpha1.PRStackSpec {
+	return &s.prStack.Spec
+}
+
+func (s *prStackAdapter) Status() *pishopv1alpha1.PRStackStatus {
+	return &s.prStack.Status
+}
+
+func (s *prStackAdapter) ApplyStatus() client.Object {
+	return s.prStack
+}
@@ -0,0 +1,634 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// StackEngine provisions, deploys, backs up and cleans up stacks. It holds the operator
+// configuration shared by the reconcilers of all stack kinds.
+type StackEngine struct {
+	client.Client
+	Scheme        *runtime.Scheme
+	Recorder      record.EventRecorder
+	MongoURI      string
+	MongoUsername string
+	MongoPassword string
+	// MongoServiceURI is the in-cluster MongoDB address handed to services
+	MongoServiceURI string
+	// Shared NATS server used by stacks in shared NATS mode
+	NATSURL          string
+	NATSOperatorSeed string
+	NATSSystemCreds  string
+	// NATSAccountNamespace holds the PR account keys, the operator namespace
+	NATSAccountNamespace string
+	// Shared Redis server used by stacks in shared Redis mode
+	RedisURL       string
+	BackupManager  *BackupRestoreManager
+	GitHubToken    string
+	GitHubUsername string
+	GitHubEmail    string
+	BaseDomain     string
+	// Registry the service images are pulled from
+	Registry RegistryConfig
+	// Quota caps the resources of each PR stack namespace
+	Quota StackQuota
+	// Ingress configuration
+	IngressClassName   string
+	CertManagerIssuer  string
+	TraefikEntrypoints string
+	TraefikTLSEnabled  string
+	// Observability configuration injected into the services
+	Observability ObservabilityConfig
+	// WaveTimeout is how long a deployment wave may wait for its dependencies before the
+	// stack is degraded, DefaultWaveTimeout when zero
+	WaveTimeout time.Duration
+
+	// diffs collects the changes of a dry run instead of applying them, see DiffStack
+	diffs *diffRecorder
+}
+
+// updateStackStatus writes the status of a stack to the resource owning it
+func (e *StackEngine) updateStackStatus(ctx context.Context, stack Stack) error {
+	return e.Status().Update(ctx, stack.ApplyStatus())
+}
+
+// getDomain returns the domain to use for ingress based on CustomDomain or default pattern
+func (e *StackEngine) getDomain(stack Stack) string {
+	if stack.Spec().CustomDomain != "" {
+		return stack.Spec().CustomDomain
+	}
+	return stack.Naming().Host(stack.ID(), e.BaseDomain)
+}
+
+func (e *StackEngine) handleProvisioning(ctx context.Context, stack Stack) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	log.Info("Provisioning stack resources", "stack", stack.ID())
+
+	e.Recorder.Event(stack.Object(), corev1.EventTypeNormal, EventTypeProvisioning, fmt.Sprintf("Provisioning infrastructure for %s", stack.Naming().Describe(stack.ID())))
+	e.setProgressingCondition(stack, "Provisioning", "Provisioning MongoDB, NATS, and Redis")
+
+	// Create namespace first
+	namespaceName := stack.Namespace()
+	if err := timeOperation(ctx, stack, OperationProvision, "Namespace", func(ctx context.Context) error {
+		return e.createNamespace(ctx, stack, namespaceName)
+	}); err != nil {
+		return e.recordProvisioningError(ctx, stack, "Namespace", err)
+	}
+
+	// Bound the resources of the namespace before any pod is created
+	if err := e.ensureResourceGuards(ctx, stack, namespaceName); err != nil {
+		return e.recordProvisioningError(ctx, stack, "Resource quota", err)
+	}
+
+	// Dedicated MongoDB must be up before databases and users can be provisioned
+	if isDedicatedMongoDB(stack) {
+		if err := timeOperation(ctx, stack, OperationProvision, "Dedicated MongoDB", func(ctx context.Context) error {
+			return e.createDedicatedMongoDBResources(ctx, stack, namespaceName)
+		}); err != nil {
+			return e.recordProvisioningError(ctx, stack, "Dedicated MongoDB", err)
+		}
+
+		ready, err := e.isDedicatedMongoDBReady(ctx, namespaceName)
+		if err != nil {
+			return e.recordProvisioningError(ctx, stack, "Dedicated MongoDB", err)
+		}
+		if !ready {
+			log.Info("Waiting for dedicated MongoDB to become ready", "namespace", namespaceName)
+			stack.Status().Message = "Waiting for dedicated MongoDB to become ready"
+			if err := e.updateStackStatus(ctx, stack); err != nil {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{RequeueAfter: RequeueIntervalShort}, nil
+		}
+	}
+
+	// Provision MongoDB databases and users
+	if err := timeOperation(ctx, stack, OperationProvision, "MongoDB", func(ctx context.Context) error {
+		return e.provisionMongoDB(ctx, stack)
+	}); err != nil {
+		return e.recordProvisioningError(ctx, stack, "MongoDB", err)
+	}
+
+	// Create secret for MongoDB credentials
+	if err := e.createMongoDBSecret(ctx, stack); err != nil {
+		return e.recordProvisioningError(ctx, stack, "MongoDB secret", err)
+	}
+
+	// Provision NATS server and subjects
+	if err := timeOperation(ctx, stack, OperationProvision, "NATS", func(ctx context.Context) error {
+		return e.provisionNATS(ctx, stack)
+	}); err != nil {
+		return e.recordProvisioningError(ctx, stack, "NATS", err)
+	}
+
+	// Provision Redis keyspaces
+	if err := timeOperation(ctx, stack, OperationProvision, "Redis", func(ctx context.Context) error {
+		return e.provisionRedis(ctx, stack)
+	}); err != nil {
+		return e.recordProvisioningError(ctx, stack, "Redis", err)
+	}
+
+	e.Recorder.Event(stack.Object(), corev1.EventTypeNormal, EventTypeProvisioningComplete, "Infrastructure provisioning completed successfully")
+
+	// Move to deployment phase
+	stack.Status().Phase = PhaseDeploying
+	stack.Status().Message = "Resources provisioned, starting service deployment"
+	e.setProgressingCondition(stack, "Deploying", "Deploying services to cluster")
+	e.updateStatusSummary(ctx, stack)
+
+	if err := e.updateStackStatus(ctx, stack); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: RequeueIntervalShort}, nil
+}
+
+// createMongoDBSecret applies mongodb-secret with the credentials of the PR user, the connection
+// string and one connection string per service database. It is the only writer of the secret,
+// provisioning, deployment and rotation all apply the full set of keys.
+func (e *StackEngine) createMongoDBSecret(ctx context.Context, stack Stack) error {
+	namespaceName := stack.Namespace()
+
+	// Check if MongoDB credentials are available
+	credentials := stack.Status().MongoDB
+	if credentials == nil {
+		return fmt.Errorf("MongoDB credentials not available in status")
+	}
+
+	data := map[string]string{
+		"uri":              credentials.ConnectionString,
+		"username":         credentials.User,
+		"password":         credentials.Password,
+		"connectionString": credentials.ConnectionString,
+		"databases":        strings.Join(credentials.Databases, ","),
+	}
+	for key, database := range map[string]string{
+		"product-db-uri":      "products",
+		"cart-db-uri":         "cart",
+		"order-db-uri":        "orders",
+		"payment-db-uri":      "payments",
+		"customer-db-uri":     "customers",
+		"inventory-db-uri":    "inventory",
+		"notification-db-uri": "notifications",
+		"discount-db-uri":     "discounts",
+		"checkout-db-uri":     "checkout",
+		"analytics-db-uri":    "analytics",
+		"auth-db-uri":         "auth",
+		"graphql-db-uri":      "graphql",
+	} {
+		data[key] = mongoDatabaseURI(credentials.ConnectionString, stack.Naming().Database(database, stack.ID()))
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      MongoDBSecretName,
+			Namespace: namespaceName,
+		},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: data,
+	}
+
+	if err := e.Apply(ctx, stack, secret); err != nil {
+		return fmt.Errorf("failed to create MongoDB secret: %w", err)
+	}
+
+	return nil
+}
+
+func (e *StackEngine) handleDeployment(ctx context.Context, stack Stack) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	log.Info("Deploying stack services", "stack", stack.ID())
+
+	e.Recorder.Event(stack.Object(), corev1.EventTypeNormal, EventTypeDeploying, fmt.Sprintf("Deploying services for %s", stack.Naming().Describe(stack.ID())))
+
+	// Namespace should already exist from provisioning phase
+	namespaceName := stack.Namespace()
+
+	// Create registry secret for image pulls
+	if err := e.createRegistrySecret(ctx, stack, namespaceName); err != nil {
+		e.updateStatusWithError(ctx, stack, "Failed to create registry secret", err)
+		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+	}
+
+	// Create MongoDB, NATS, and Redis resources
+	if err := timeOperation(ctx, stack, OperationDeploy, "MongoDB", func(ctx context.Context) error {
+		return e.createMongoDBResources(ctx, stack, namespaceName)
+	}); err != nil {
+		e.updateStatusWithError(ctx, stack, "Failed to create MongoDB resources", err)
+		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+	}
+
+	// Create NATS resources
+	if err := timeOperation(ctx, stack, OperationDeploy, "NATS", func(ctx context.Context) error {
+		return e.createNATSResources(ctx, stack, namespaceName)
+	}); err != nil {
+		e.updateStatusWithError(ctx, stack, "Failed to create NATS resources", err)
+		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+	}
+
+	// Create Redis resources
+	if err := timeOperation(ctx, stack, OperationDeploy, "Redis", func(ctx context.Context) error {
+		return e.createRedisResources(ctx, stack, namespaceName)
+	}); err != nil {
+		e.updateStatusWithError(ctx, stack, "Failed to create Redis resources", err)
+		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+	}
+
+	// Create declared JetStream streams before services start publishing to them
+	if hasJetStreamStreams(stack) {
+		ready, err := e.isNATSReady(ctx, stack, namespaceName)
+		if err != nil {
+			e.updateStatusWithError(ctx, stack, "Failed to check NATS readiness", err)
+			return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+		}
+		if !ready {
+			log.Info("Waiting for NATS to become ready", "namespace", namespaceName)
+			stack.Status().Message = "Waiting for NATS to become ready"
+			if err := e.updateStackStatus(ctx, stack); err != nil {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{RequeueAfter: RequeueIntervalShort}, nil
+		}
+
+		if err := e.reconcileJetStreamStreams(ctx, stack); err != nil {
+			e.Recorder.Event(stack.Object(), corev1.EventTypeWarning, EventTypeStreamsFailed, err.Error())
+			e.updateStatusWithError(ctx, stack, "Failed to reconcile JetStream streams", err)
+			return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+		}
+	}
+
+	// Ensure backup storage is available
+	if err := e.ensureBackupStorage(ctx, stack, namespaceName); err != nil {
+		e.updateStatusWithError(ctx, stack, "Failed to create backup storage", err)
+		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+	}
+
+	// Deploy the services wave by wave, each wave starts once the previous one is ready.
+	// Inactive stacks start no pods, their services are deployed without waiting.
+	services := stack.Services()
+	waves := deploymentWaves(services)
+
+	var serviceStatuses []pishopv1alpha1.ServiceStatus
+	failedServices := 0
+	failed := make(map[string]bool)
+	for i := 1; i < len(waves); i++ {
+		if stack.Spec().Active {
+			blockedBy, err := e.firstUnreadyDependency(ctx, stack, waves[i-1], failed)
+			if err != nil {
+				e.updateStatusWithError(ctx, stack, "Failed to check dependency readiness", err)
+				return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+			}
+			if blockedBy != "" {
+				stack.Status().Services = serviceStatuses
+				return e.waitForDependency(ctx, stack, waves, i, blockedBy)
+			}
+		}
+
+		for _, serviceName := range waves[i] {
+			if err := timeOperation(ctx, stack, OperationDeploy, serviceName, func(ctx context.Context) error {
+				return e.createServiceDeployment(ctx, stack, namespaceName, serviceName)
+			}); err != nil {
+				log.Error(err, "Failed to deploy service", "service", serviceName)
+				serviceStatuses = append(serviceStatuses, pishopv1alpha1.ServiceStatus{
+					Name:    serviceName,
+					Status:  "Failed",
+					Message: err.Error(),
+				})
+				failed[serviceName] = true
+				failedServices++
+			} else {
+				serviceStatuses = append(serviceStatuses, pishopv1alpha1.ServiceStatus{
+					Name:    serviceName,
+					Status:  "Running",
+					Message: "Service deployed successfully",
+				})
+			}
+		}
+	}
+
+	// Scrape the metrics of the deployed services
+	if err := e.ensureMetricsMonitor(ctx, stack, namespaceName); err != nil {
+		e.updateStatusWithError(ctx, stack, "Failed to create metrics monitor", err)
+		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+	}
+
+	// Update status with service information
+	stack.Status().Services = serviceStatuses
+	stack.Status().Deployment = nil
+
+	// Determine the appropriate state based on service deployment results
+	if failedServices == len(services) {
+		// All services failed - set to Failed state
+		stack.Status().Phase = PhaseFailed
+		stack.Status().Message = fmt.Sprintf("All %d services failed to deploy", failedServices)
+		e.setCondition(stack, metav1.Condition{
+			Type:               ConditionTypeReady,
+			Status:             metav1.ConditionFalse,
+			Reason:             "AllServicesFailed",
+			Message:            fmt.Sprintf("All %d services failed to deploy", failedServices),
+			LastTransitionTime: metav1.Now(),
+		})
+		e.setCondition(stack, metav1.Condition{
+			Type:               ConditionTypeDegraded,
+			Status:             metav1.ConditionTrue,
+			Reason:             "AllServicesFailed",
+			Message:            "No services are running",
+			LastTransitionTime: metav1.Now(),
+		})
+		e.Recorder.Event(stack.Object(), corev1.EventTypeWarning, EventTypeDeployed, fmt.Sprintf("%s stack failed: all services failed to deploy", stack.Naming().Describe(stack.ID())))
+	} else if failedServices > 0 {
+		// Some services failed - set to Degraded state
+		stack.Status().Phase = PhaseDegraded
+		stack.Status().Message = fmt.Sprintf("Stack is degraded: %d/%d services failed", failedServices, len(services))
+		e.setCondition(stack, metav1.Condition{
+			Type:               ConditionTypeReady,
+			Status:             metav1.ConditionTrue,
+			Reason:             "PartiallyDegraded",
+			Message:            fmt.Sprintf("%d/%d services running", len(services)-failedServices, len(services)),
+			LastTransitionTime: metav1.Now(),
+		})
+		e.setCondition(stack, metav1.Condition{
+			Type:               ConditionTypeDegraded,
+			Status:             metav1.ConditionTrue,
+			Reason:             "ServiceFailures",
+			Message:            fmt.Sprintf("%d services failed to deploy", failedServices),
+			LastTransitionTime: metav1.Now(),
+		})
+		e.Recorder.Event(stack.Object(), corev1.EventTypeWarning, EventTypeDeployed, fmt.Sprintf("%s stack is degraded: %d/%d services failed", stack.Naming().Describe(stack.ID()), failedServices, len(services)))
+	} else {
+		// All services deployed successfully - set to Running state
+		observeTimeToRunning(stack)
+		stack.Status().Phase = PhaseRunning
+		stack.Status().Message = "Stack is running"
+		e.setReadyCondition(stack, "StackRunning", fmt.Sprintf("All %d services deployed successfully", len(serviceStatuses)))
+		e.setProgressingCondition(stack, "Complete", "Stack deployment completed")
+		e.Recorder.Event(stack.Object(), corev1.EventTypeNormal, EventTypeDeployed, fmt.Sprintf("%s stack is now running with %d services", stack.Naming().Describe(stack.ID()), len(serviceStatuses)))
+	}
+
+	e.updateStatusSummary(ctx, stack)
+
+	if err := e.updateStackStatus(ctx, stack); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: RequeueIntervalLong}, nil
+}
+
+// waitForDependency reports the wave in progress and the dependency the next wave is waiting for.
+// A wave waiting longer than the wave timeout degrades the stack, deployment goes on once the
+// dependency becomes ready.
+func (e *StackEngine) waitForDependency(ctx context.Context, stack Stack, waves [][]string, wave int, blockedBy string) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	log.Info("Waiting for dependency", "stack", stack.ID(), "wave", wave, "dependency", blockedBy)
+
+	startedAt := metav1.Now()
+	if previous := stack.Status().Deployment; previous != nil && previous.Wave == int32(wave) && previous.StartedAt != nil {
+		startedAt = *previous.StartedAt
+	}
+
+	message := fmt.Sprintf("Deploying wave %d/%d (%s), waiting for %s", wave, len(waves), describeWave(waves[wave-1]), blockedBy)
+	stack.Status().Deployment = &pishopv1alpha1.DeploymentProgress{
+		Wave:       int32(wave),
+		TotalWaves: int32(len(waves)),
+		Services:   waves[wave-1],
+		BlockedBy:  blockedBy,
+		StartedAt:  &startedAt,
+	}
+	stack.Status().Message = message
+	e.setProgressingCondition(stack, "WaitingForDependency", message)
+
+	if timeout := e.waveTimeout(); time.Since(startedAt.Time) > timeout {
+		message := fmt.Sprintf("Wave %d/%d has been waiting for %s for more than %s", wave, len(waves), blockedBy, timeout)
+		if condition := apimeta.FindStatusCondition(stack.Status().Conditions, ConditionTypeDegraded); condition == nil || condition.Reason != "WaveTimeout" {
+			log.Info("Deployment wave timed out", "stack", stack.ID(), "wave", wave, "dependency", blockedBy)
+			e.Recorder.Event(stack.Object(), corev1.EventTypeWarning, EventTypeWaveTimeout, message)
+		}
+		stack.Status().Message = message
+		e.setCondition(stack, metav1.Condition{
+			Type:               ConditionTypeDegraded,
+			Status:             metav1.ConditionTrue,
+			Reason:             "WaveTimeout",
+			Message:            message,
+			LastTransitionTime: metav1.Now(),
+		})
+	}
+
+	e.updateStatusSummary(ctx, stack)
+
+	if err := e.updateStackStatus(ctx, stack); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: RequeueIntervalShort}, nil
+}
+
+func (e *StackEngine) scaleDeployments(ctx context.Context, namespace string, replicas int32) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	// List all deployments in the namespace
+	var deployments appsv1.DeploymentList
+	if err := e.List(ctx, &deployments, client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("failed to list deployments: %v", err)
+	}
+
+	// Scale each deployment
+	scaledCount := 0
+	for _, deployment := range deployments.Items {
+		if deployment.Spec.Replicas != nil && *deployment.Spec.Replicas == replicas {
+			continue // Already at desired replica count
+		}
+
+		log.Info("Scaling deployment", "name", deployment.Name, "namespace", namespace, "replicas", replicas)
+
+		// Remember the replicas to restore once the stack is active again
+		if replicas == 0 {
+			if current := rememberedReplicas(&deployment); current > 0 {
+				if deployment.Annotations == nil {
+					deployment.Annotations = map[string]string{}
+				}
+				deployment.Annotations[ReplicasAnnotation] = strconv.Itoa(int(current))
+			}
+		}
+
+		// Update the deployment
+		deployment.Spec.Replicas = &replicas
+		if err := e.Update(ctx, &deployment, client.FieldOwner(FieldManager)); err != nil {
+			log.Error(err, "Failed to scale deployment", "name", deployment.Name)
+			return fmt.Errorf("failed to scale deployment %s: %v", deployment.Name, err)
+		}
+		scaledCount++
+	}
+
+	if scaledCount > 0 {
+		log.Info("Scaled deployments", "count", scaledCount, "namespace", namespace, "replicas", replicas)
+	}
+
+	return nil
+}
+
+// shouldRolloutDeployments checks if deployments should be rolled out based on deployedAt timestamp
+func (e *StackEngine) shouldRolloutDeployments(stack Stack) bool {
+	// If deployedAt is not set in spec, no rollout needed
+	if stack.Spec().DeployedAt == nil {
+		return false
+	}
+
+	// If lastDeployedAt is not set in status, rollout is needed
+	if stack.Status().LastDeployedAt == nil {
+		return true
+	}
+
+	// Rollout if deployedAt is different from lastDeployedAt
+	return !stack.Spec().DeployedAt.Equal(stack.Status().LastDeployedAt)
+}
+
+// rolloutDeployments triggers a rollout of all deployments in the namespace
+func (e *StackEngine) rolloutDeployments(ctx context.Context, stack Stack) error {
+	restartedAt := time.Now()
+	if stack.Spec().DeployedAt != nil {
+		restartedAt = stack.Spec().DeployedAt.Time
+	}
+	return e.restartDeployments(ctx, stack.Namespace(), restartedAt)
+}
+
+// restartDeployments triggers a rolling restart of all deployments in the namespace
+func (e *StackEngine) restartDeployments(ctx context.Context, namespaceName string, restartedAt time.Time) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	log.Info("Rolling out all deployments", "namespace", namespaceName)
+
+	// List all deployments in the namespace
+	deployments := &appsv1.DeploymentList{}
+	if err := e.List(ctx, deployments, client.InNamespace(namespaceName)); err != nil {
+		return fmt.Errorf("failed to list deployments: %w", err)
+	}
+
+	if len(deployments.Items) == 0 {
+		log.Info("No deployments found to rollout", "namespace", namespaceName)
+		return nil
+	}
+
+	// Trigger rollout for each deployment by updating the restartedAt annotation
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		log.Info("Rolling out deployment", "name", deployment.Name, "namespace", deployment.Namespace)
+
+		// Add/update the restartedAt annotation to trigger a rollout
+		if deployment.Spec.Template.Annotations == nil {
+			deployment.Spec.Template.Annotations = make(map[string]string)
+		}
+		deployment.Spec.Template.Annotations[RestartAnnotation] = restartedAt.Format(time.RFC3339)
+
+		if err := e.Update(ctx, deployment, client.FieldOwner(FieldManager)); err != nil {
+			log.Error(err, "Failed to rollout deployment", "name", deployment.Name)
+			return fmt.Errorf("failed to rollout deployment %s: %w", deployment.Name, err)
+		}
+
+		log.Info("Successfully triggered rollout", "deployment", deployment.Name)
+	}
+
+	log.Info("All deployments rolled out successfully", "count", len(deployments.Items))
+	return nil
+}
+
+// updateStatusWithError updates the stack status with error information
+func (e *StackEngine) updateStatusWithError(ctx context.Context, stack Stack, message string, err error) {
+	stack.Status().Message = fmt.Sprintf("%s: %v", message, err)
+	stack.Status().Phase = PhaseFailed
+	e.setCondition(stack, metav1.Condition{
+		Type:               ConditionTypeReady,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Error",
+		Message:            fmt.Sprintf("%s: %v", message, err),
+		LastTransitionTime: metav1.Now(),
+	})
+	e.setCondition(stack, metav1.Condition{
+		Type:               ConditionTypeDegraded,
+		Status:             metav1.ConditionTrue,
+		Reason:             "ReconciliationFailed",
+		Message:            fmt.Sprintf("%s: %v", message, err),
+		LastTransitionTime: metav1.Now(),
+	})
+	if updateErr := e.updateStackStatus(ctx, stack); updateErr != nil {
+		// Log the error but don't return it to avoid masking the original error
+		ctrl.LoggerFrom(ctx).Error(updateErr, "Failed to update stack status with error information")
+	}
+}
+
+// recordProvisioningError records a provisioning error event and updates status
+func (e *StackEngine) recordProvisioningError(ctx context.Context, stack Stack, component string, err error) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	log.Error(err, fmt.Sprintf("Failed to provision %s", component))
+	e.Recorder.Event(stack.Object(), corev1.EventTypeWarning, EventTypeProvisioningFailed,
+		fmt.Sprintf("%s provisioning failed: %v", component, err))
+	e.updateStatusWithError(ctx, stack, fmt.Sprintf("%s provisioning failed", component), err)
+	return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+}
+
+// setCondition sets or updates a condition in the stack status
+func (e *StackEngine) setCondition(stack Stack, condition metav1.Condition) {
+	condition.ObservedGeneration = stack.Object().GetGeneration()
+	if condition.LastTransitionTime.IsZero() {
+		condition.LastTransitionTime = metav1.Now()
+	}
+
+	// Find existing condition
+	for i, existingCondition := range stack.Status().Conditions {
+		if existingCondition.Type == condition.Type {
+			// Only update if status or reason changed
+			if existingCondition.Status != condition.Status || existingCondition.Reason != condition.Reason {
+				condition.LastTransitionTime = metav1.Now()
+			} else {
+				condition.LastTransitionTime = existingCondition.LastTransitionTime
+			}
+			stack.Status().Conditions[i] = condition
+			return
+		}
+	}
+	// Condition doesn't exist, add it
+	stack.Status().Conditions = append(stack.Status().Conditions, condition)
+}
+
+// setReadyCondition sets the Ready condition to True and clears degraded state
+func (e *StackEngine) setReadyCondition(stack Stack, reason, message string) {
+	e.setCondition(stack, metav1.Condition{
+		Type:               ConditionTypeReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+	})
+	e.setCondition(stack, metav1.Condition{
+		Type:               ConditionTypeDegraded,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Healthy",
+		Message:            "Stack is operating normally",
+		LastTransitionTime: metav1.Now(),
+	})
+}
+
+// setProgressingCondition sets the Progressing condition
+func (e *StackEngine) setProgressingCondition(stack Stack, reason, message string) {
+	e.setCondition(stack, metav1.Condition{
+		Type:               ConditionTypeProgressing,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+	})
+}
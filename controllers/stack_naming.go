@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StackNaming derives the names of the resources of a stack from its identifier
+// (the PR number of a PRStack or the tenant ID of a Tenant)
+type StackNaming interface {
+	// Namespace holding the Kubernetes resources of the stack
+	Namespace(id string) string
+	// Database of a service; the "-service" suffix is removed from the service name
+	Database(service, id string) string
+	// User of the stack on the shared MongoDB, NATS and Redis servers
+	User(id string) string
+	// NATSSubjectPrefix reserved for the stack
+	NATSSubjectPrefix(id string) string
+	// NATSAccountName of the stack on the shared NATS server
+	NATSAccountName(id string) string
+	// RedisKeyPrefix reserved for the stack
+	RedisKeyPrefix(id string) string
+	// Host of the stack ingress when no custom domain is set
+	Host(id, baseDomain string) string
+	// Environment reported to services and set on the environment labels
+	Environment() string
+	// Describe returns the stack as referred to in events (e.g. "PR #123")
+	Describe(id string) string
+	// BackupPrefix of the backup names of the stack
+	BackupPrefix(id string) string
+}
+
+// prStackNaming names the resources of short-lived PR environments
+type prStackNaming struct{}
+
+func (prStackNaming) Namespace(id string) string {
+	return fmt.Sprintf(NamespacePattern, id)
+}
+
+func (prStackNaming) Database(service, id string) string {
+	return getDatabaseName(service, id)
+}
+
+func (prStackNaming) User(id string) string {
+	return fmt.Sprintf("pishop_pr_%s", id)
+}
+
+func (prStackNaming) NATSSubjectPrefix(id string) string {
+	return getNATSSubjectPrefix(id)
+}
+
+func (prStackNaming) NATSAccountName(id string) string {
+	return getNATSAccountName(id)
+}
+
+func (prStackNaming) RedisKeyPrefix(id string) string {
+	return getRedisKeyPrefix(id)
+}
+
+func (prStackNaming) Host(id, baseDomain string) string {
+	return fmt.Sprintf("pr-%s.%s", id, baseDomain)
+}
+
+func (prStackNaming) Environment() string {
+	return "pr"
+}
+
+func (prStackNaming) Describe(id string) string {
+	return fmt.Sprintf("PR #%s", id)
+}
+
+func (prStackNaming) BackupPrefix(id string) string {
+	return fmt.Sprintf("pr-%s", id)
+}
+
+// tenantNaming names the resources of long-lived customer shops
+type tenantNaming struct{}
+
+func (tenantNaming) Namespace(id string) string {
+	return fmt.Sprintf(TenantNamespacePattern, id)
+}
+
+func (tenantNaming) Database(service, id string) string {
+	return fmt.Sprintf("tenant_%s_%s", strings.ReplaceAll(id, "-", "_"), strings.TrimSuffix(service, "-service"))
+}
+
+func (tenantNaming) User(id string) string {
+	return fmt.Sprintf("pishop_tenant_%s", id)
+}
+
+func (tenantNaming) NATSSubjectPrefix(id string) string {
+	return fmt.Sprintf("pishop.tenant.%s", id)
+}
+
+func (tenantNaming) NATSAccountName(id string) string {
+	return fmt.Sprintf("pishop-tenant-%s", id)
+}
+
+func (tenantNaming) RedisKeyPrefix(id string) string {
+	return fmt.Sprintf("pishop:tenant:%s:", id)
+}
+
+func (tenantNaming) Host(id, baseDomain string) string {
+	return fmt.Sprintf("%s.%s", id, baseDomain)
+}
+
+func (tenantNaming) Environment() string {
+	return "production"
+}
+
+func (tenantNaming) Describe(id string) string {
+	return fmt.Sprintf("tenant %s", id)
+}
+
+func (tenantNaming) BackupPrefix(id string) string {
+	return fmt.Sprintf("tenant-%s", id)
+}
@@ -3,17 +3,13 @@ package controllers
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
+	"strconv"
 
 	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/client"
 
-	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
@@ -22,9 +18,9 @@ import (
 )
 
 // createMongoDBResources creates the MongoDB ConfigMap and Secret for the PR namespace
-func (r *PRStackReconciler) createMongoDBResources(ctx context.Context, prStack *pishopv1alpha1.PRStack, namespace string) error {
+func (e *StackEngine) createMongoDBResources(ctx context.Context, stack Stack, namespace string) error {
 	log := ctrl.LoggerFrom(ctx)
-	log.Info("Creating MongoDB resources for PR", "prNumber", prStack.Spec.PRNumber, "namespace", namespace)
+	log.Info("Creating MongoDB resources for PR", "stack", stack.ID(), "namespace", namespace)
 
 	// Create MongoDB ConfigMap (based on k8s/base/mongodb-external.yaml)
 	mongodbConfigMap := &corev1.ConfigMap{
@@ -33,44 +29,18 @@ func (r *PRStackReconciler) createMongoDBResources(ctx context.Context, prStack
 			Namespace: namespace,
 		},
 		Data: func() map[string]string {
-			data := getDatabaseConfigMapData(prStack.Spec.PRNumber)
-			data["uri"] = prStack.Status.MongoDB.ConnectionString
+			data := getDatabaseConfigMapData(stack.Naming(), stack.ID())
+			data["uri"] = stack.Status().MongoDB.ConnectionString
 			return data
 		}(),
 	}
 
-	if err := r.CreateOrUpdate(ctx, mongodbConfigMap); err != nil {
+	if err := e.Apply(ctx, stack, mongodbConfigMap); err != nil {
 		return fmt.Errorf("failed to create MongoDB ConfigMap: %v", err)
 	}
 
-	// Create MongoDB Secret (based on k8s/base/mongodb-external.yaml)
-	mongodbSecret := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "mongodb-secret",
-			Namespace: namespace,
-		},
-		Type: corev1.SecretTypeOpaque,
-		StringData: map[string]string{
-			"uri":                 prStack.Status.MongoDB.ConnectionString,
-			"username":            prStack.Status.MongoDB.User,
-			"password":            prStack.Status.MongoDB.Password,
-			"product-db-uri":      fmt.Sprintf("%s/pishop_products_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-			"cart-db-uri":         fmt.Sprintf("%s/pishop_cart_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-			"order-db-uri":        fmt.Sprintf("%s/pishop_orders_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-			"payment-db-uri":      fmt.Sprintf("%s/pishop_payments_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-			"customer-db-uri":     fmt.Sprintf("%s/pishop_customers_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-			"inventory-db-uri":    fmt.Sprintf("%s/pishop_inventory_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-			"notification-db-uri": fmt.Sprintf("%s/pishop_notifications_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-			"discount-db-uri":     fmt.Sprintf("%s/pishop_discounts_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-			"checkout-db-uri":     fmt.Sprintf("%s/pishop_checkout_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-			"analytics-db-uri":    fmt.Sprintf("%s/pishop_analytics_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-			"auth-db-uri":         fmt.Sprintf("%s/pishop_auth_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-			"graphql-db-uri":      fmt.Sprintf("%s/pishop_graphql_pr_%s", prStack.Status.MongoDB.ConnectionString, prStack.Spec.PRNumber),
-		},
-	}
-
-	if err := r.CreateOrUpdate(ctx, mongodbSecret); err != nil {
-		return fmt.Errorf("failed to create MongoDB Secret: %v", err)
+	if err := e.createMongoDBSecret(ctx, stack); err != nil {
+		return err
 	}
 
 	// Create NATS ConfigMap
@@ -80,11 +50,12 @@ func (r *PRStackReconciler) createMongoDBResources(ctx context.Context, prStack
 			Namespace: namespace,
 		},
 		Data: map[string]string{
-			"url": prStack.Status.NATS.ConnectionString,
+			"url":           stack.Status().NATS.ConnectionString,
+			"subjectPrefix": stack.Status().NATS.SubjectPrefix,
 		},
 	}
 
-	if err := r.CreateOrUpdate(ctx, natsConfigMap); err != nil {
+	if err := e.Apply(ctx, stack, natsConfigMap); err != nil {
 		return fmt.Errorf("failed to create NATS ConfigMap: %v", err)
 	}
 
@@ -95,11 +66,12 @@ func (r *PRStackReconciler) createMongoDBResources(ctx context.Context, prStack
 			Namespace: namespace,
 		},
 		Data: map[string]string{
-			"url": prStack.Status.Redis.ConnectionString,
+			"url":       stack.Status().Redis.ConnectionString,
+			"keyPrefix": stack.Status().Redis.KeyPrefix,
 		},
 	}
 
-	if err := r.CreateOrUpdate(ctx, redisConfigMap); err != nil {
+	if err := e.Apply(ctx, stack, redisConfigMap); err != nil {
 		return fmt.Errorf("failed to create Redis ConfigMap: %v", err)
 	}
 
@@ -107,49 +79,25 @@ func (r *PRStackReconciler) createMongoDBResources(ctx context.Context, prStack
 	return nil
 }
 
-// createRegistrySecret creates a docker-registry secret for pulling images from GitHub Container Registry
-func (r *PRStackReconciler) createRegistrySecret(ctx context.Context, namespace string) error {
+// createRegistrySecret creates a docker-registry secret for pulling the service images from
+// the configured registry
+func (e *StackEngine) createRegistrySecret(ctx context.Context, stack Stack, namespace string) error {
 	log := ctrl.LoggerFrom(ctx)
 	log.Info("Creating registry secret for namespace", "namespace", namespace)
 
-	if r.GitHubUsername == "" || r.GitHubToken == "" {
-		log.Info("GitHub credentials not configured, skipping registry secret creation")
-		return nil
-	}
-
-	// Create docker config JSON
-	type dockerConfigEntry struct {
-		Username string `json:"username"`
-		Email    string `json:"email,omitempty"`
-		Password string `json:"password"`
-		Auth     string `json:"auth"`
-	}
-
-	type dockerConfig struct {
-		Auths map[string]dockerConfigEntry `json:"auths"`
-	}
-
-	auth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", r.GitHubUsername, r.GitHubToken)))
-	dockerCfg := dockerConfig{
-		Auths: map[string]dockerConfigEntry{
-			"ghcr.io": {
-				Username: r.GitHubUsername,
-				Password: r.GitHubToken,
-				Email:    r.GitHubEmail,
-				Auth:     auth,
-			},
-		},
-	}
-
-	dockerCfgJSON, err := json.Marshal(dockerCfg)
+	dockerCfgJSON, err := e.registryDockerConfig(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal docker config: %v", err)
+		return err
+	}
+	if dockerCfgJSON == nil {
+		log.Info("Registry credentials not configured, skipping registry secret creation")
+		return nil
 	}
 
 	// Create the secret
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "ghcr-secret",
+			Name:      RegistrySecretName,
 			Namespace: namespace,
 		},
 		Type: corev1.SecretTypeDockerConfigJson,
@@ -158,7 +106,7 @@ func (r *PRStackReconciler) createRegistrySecret(ctx context.Context, namespace
 		},
 	}
 
-	if err := r.CreateOrUpdate(ctx, secret); err != nil {
+	if err := e.Apply(ctx, stack, secret); err != nil {
 		return fmt.Errorf("failed to create registry secret: %v", err)
 	}
 
@@ -167,17 +115,28 @@ func (r *PRStackReconciler) createRegistrySecret(ctx context.Context, namespace
 }
 
 // createServiceDeployment creates a deployment for a specific service based on the K8s templates
-func (r *PRStackReconciler) createServiceDeployment(ctx context.Context, prStack *pishopv1alpha1.PRStack, namespace string, serviceName string) error {
+func (e *StackEngine) createServiceDeployment(ctx context.Context, stack Stack, namespace string, serviceName string) error {
 	log := ctrl.LoggerFrom(ctx)
 	log.Info("Creating deployment for service", "service", serviceName, "namespace", namespace)
 
 	// Get resource requirements
-	resourceRequirements := r.getResourceRequirements(prStack)
+	resourceRequirements, err := e.getResourceRequirements(stack)
+	if err != nil {
+		return err
+	}
 
-	// Determine replica count based on Active flag (max 1 replica)
-	replicas := int32(1)
-	if !prStack.Spec.Active {
-		replicas = 0
+	// Determine replica count based on Active flag and the service scaling
+	replicas, remembered, err := e.getServiceReplicas(ctx, stack, namespace, serviceName)
+	if err != nil {
+		return err
+	}
+
+	serviceConfig := GetServiceConfig(serviceName, stack.ID())
+	serviceConfig.Environment = stack.Naming().Environment()
+	serviceConfig.MongoDBDatabase = stack.Naming().Database(serviceName, stack.ID())
+	e.Observability.configureService(stack, serviceConfig)
+	if isSharedNATS(stack) {
+		serviceConfig.NATSCredsFile = NATSCredsMountPath + "/" + NATSCredsKey
 	}
 
 	// Create deployment based on the service
@@ -188,13 +147,13 @@ func (r *PRStackReconciler) createServiceDeployment(ctx context.Context, prStack
 			Labels: map[string]string{
 				"app":         serviceName,
 				"component":   "microservice",
-				"environment": "pr",
-				"tier":        "pr",
-				"pr-number":   prStack.Spec.PRNumber,
+				"environment": stack.Naming().Environment(),
+				"tier":        stack.Naming().Environment(),
+				"pr-number":   stack.ID(),
 			},
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: &replicas,
+			Replicas: replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
 					"app": serviceName,
@@ -205,21 +164,19 @@ func (r *PRStackReconciler) createServiceDeployment(ctx context.Context, prStack
 					Labels: map[string]string{
 						"app":         serviceName,
 						"component":   "microservice",
-						"environment": "pr",
-						"tier":        "pr",
-						"pr-number":   prStack.Spec.PRNumber,
+						"environment": stack.Naming().Environment(),
+						"tier":        stack.Naming().Environment(),
+						"pr-number":   stack.ID(),
 					},
 				},
 				Spec: corev1.PodSpec{
-					ImagePullSecrets: []corev1.LocalObjectReference{
-						{Name: "ghcr-secret"},
-					},
+					ImagePullSecrets: e.imagePullSecrets(stack),
 					Containers: []corev1.Container{
 						{
 							Name:      serviceName,
-							Image:     getImageTag(prStack, serviceName),
+							Image:     e.getImageTag(stack, serviceName),
 							Ports:     GetServicePorts(),
-							Env:       GetServiceConfig(serviceName, prStack.Spec.PRNumber).ToEnvVars(),
+							Env:       serviceConfig.ToEnvVars(),
 							Resources: resourceRequirements,
 							LivenessProbe: &corev1.Probe{
 								ProbeHandler: corev1.ProbeHandler{
@@ -248,10 +205,51 @@ func (r *PRStackReconciler) createServiceDeployment(ctx context.Context, prStack
 		},
 	}
 
-	if err := r.CreateOrUpdate(ctx, deployment); err != nil {
+	// Keep the replicas to restore once the stack is active again
+	if remembered > 0 {
+		deployment.Annotations = map[string]string{ReplicasAnnotation: strconv.Itoa(int(remembered))}
+	}
+
+	// Mount the shared NATS user credentials
+	if isSharedNATS(stack) {
+		podSpec := &deployment.Spec.Template.Spec
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "nats-creds",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: NATSSecretName,
+					Items: []corev1.KeyToPath{
+						{Key: NATSCredsKey, Path: NATSCredsKey},
+					},
+				},
+			},
+		})
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "nats-creds",
+			MountPath: NATSCredsMountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	// Leave the replicas of a running autoscaled service to its autoscaler
+	if replicas == nil {
+		if err := e.handOverReplicas(ctx, namespace, serviceName); err != nil {
+			return err
+		}
+	}
+
+	if err := e.Apply(ctx, stack, deployment); err != nil {
 		return fmt.Errorf("failed to create deployment for %s: %v", serviceName, err)
 	}
 
+	if err := e.ensureServiceAutoscaler(ctx, stack, namespace, serviceName); err != nil {
+		return err
+	}
+
+	if err := e.ensureServiceDisruptionBudget(ctx, stack, namespace, serviceName); err != nil {
+		return err
+	}
+
 	// Create service
 	service := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -259,9 +257,10 @@ func (r *PRStackReconciler) createServiceDeployment(ctx context.Context, prStack
 			Namespace: namespace,
 			Labels: map[string]string{
 				"app":         serviceName,
-				"environment": "pr",
-				"tier":        "pr",
-				"pr-number":   prStack.Spec.PRNumber,
+				"component":   "microservice",
+				"environment": stack.Naming().Environment(),
+				"tier":        stack.Naming().Environment(),
+				"pr-number":   stack.ID(),
 			},
 			Annotations: map[string]string{
 				"prometheus.io/scrape": "true",
@@ -277,14 +276,14 @@ func (r *PRStackReconciler) createServiceDeployment(ctx context.Context, prStack
 		},
 	}
 
-	if err := r.CreateOrUpdate(ctx, service); err != nil {
+	if err := e.Apply(ctx, stack, service); err != nil {
 		return fmt.Errorf("failed to create service for %s: %v", serviceName, err)
 	}
 
 	// Create ingress only for GraphQL service
 	if serviceName == "graphql-service" {
-		ingress := r.createIngress(prStack, namespace, serviceName, "graphql")
-		if err := r.CreateOrUpdate(ctx, ingress); err != nil {
+		ingress := e.createIngress(stack, namespace, serviceName, "graphql")
+		if err := e.Apply(ctx, stack, ingress); err != nil {
 			return fmt.Errorf("failed to create ingress for %s: %v", serviceName, err)
 		}
 	}
@@ -293,102 +292,55 @@ func (r *PRStackReconciler) createServiceDeployment(ctx context.Context, prStack
 	return nil
 }
 
-// getResourceRequirements returns resource requirements for a service based on PRStack configuration
-func (r *PRStackReconciler) getResourceRequirements(prStack *pishopv1alpha1.PRStack) corev1.ResourceRequirements {
-	limits := corev1.ResourceList{}
-	requests := corev1.ResourceList{}
-
-	if prStack.Spec.ResourceLimits != nil {
-		if prStack.Spec.ResourceLimits.CPULimit != "" {
-			limits["cpu"] = resource.MustParse(prStack.Spec.ResourceLimits.CPULimit)
-		}
-		if prStack.Spec.ResourceLimits.MemoryLimit != "" {
-			limits["memory"] = resource.MustParse(prStack.Spec.ResourceLimits.MemoryLimit)
-		}
-	} else {
-		// Default limits
-		limits["cpu"] = resource.MustParse("500m")
-		limits["memory"] = resource.MustParse("512Mi")
-	}
-
-	// Set zero requests to prevent cluster over-allocation
-	requests["cpu"] = resource.MustParse("0m")
-	requests["memory"] = resource.MustParse("0Mi")
-
-	return corev1.ResourceRequirements{
-		Limits:   limits,
-		Requests: requests,
-	}
-}
-
-// CreateOrUpdate creates or updates a Kubernetes resource
-func (r *PRStackReconciler) CreateOrUpdate(ctx context.Context, obj client.Object) error {
-	if err := r.Create(ctx, obj); err != nil {
-		if errors.IsAlreadyExists(err) {
-			return r.Update(ctx, obj)
-		}
-		return err
-	}
-	return nil
-}
-
-// createNamespace creates a namespace if it doesn't exist
-func (r *PRStackReconciler) createNamespace(ctx context.Context, namespaceName string) error {
+// createNamespace creates the namespace of a stack if it doesn't exist. The namespace is not
+// owned by the stack, the finalizer deletes it after the final backup and cleanup.
+func (e *StackEngine) createNamespace(ctx context.Context, stack Stack, namespaceName string) error {
 	namespace := &corev1.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: namespaceName,
 		},
 	}
 
-	if err := r.Get(ctx, types.NamespacedName{Name: namespaceName}, namespace); err != nil {
+	if err := e.Get(ctx, types.NamespacedName{Name: namespaceName}, namespace); err != nil {
 		if errors.IsNotFound(err) {
-			if err := r.Create(ctx, namespace); err != nil {
+			if err := e.Create(ctx, namespace); err != nil {
 				return err
 			}
 		} else {
 			return err
 		}
+		return nil
 	}
 
-	return nil
-}
-
-// getImageTag returns the Docker image tag to use for a specific service
-// If ImageTag is specified in the PRStack spec, use it
-// Otherwise, default to pr-{prNumber}
-func getImageTag(prStack *pishopv1alpha1.PRStack, serviceName string) string {
-	if prStack.Spec.ImageTag != "" {
-		return fmt.Sprintf("ghcr.io/pilab-dev/%s:%s", serviceName, prStack.Spec.ImageTag)
-	}
-	return fmt.Sprintf("ghcr.io/pilab-dev/%s:pr-%s", serviceName, prStack.Spec.PRNumber)
+	return e.releaseObject(ctx, stack, namespace)
 }
 
 // createIngress creates an ingress resource for the GraphQL service
-func (r *PRStackReconciler) createIngress(prStack *pishopv1alpha1.PRStack, namespace, serviceName, pathPrefix string) *networkingv1.Ingress {
-	hostname := r.getDomain(prStack)
+func (e *StackEngine) createIngress(stack Stack, namespace, serviceName, pathPrefix string) *networkingv1.Ingress {
+	hostname := e.getDomain(stack)
 
 	// Set default values if not configured
-	ingressClassName := r.IngressClassName
+	ingressClassName := e.IngressClassName
 	if ingressClassName == "" {
 		ingressClassName = "traefik"
 	}
-	certManagerIssuer := r.CertManagerIssuer
-	traefikEntrypoints := r.TraefikEntrypoints
+	certManagerIssuer := e.CertManagerIssuer
+	traefikEntrypoints := e.TraefikEntrypoints
 	if traefikEntrypoints == "" {
 		traefikEntrypoints = "websecure"
 	}
-	traefikTLSEnabled := r.TraefikTLSEnabled
+	traefikTLSEnabled := e.TraefikTLSEnabled
 	if traefikTLSEnabled == "" {
 		traefikTLSEnabled = "true"
 	}
 
 	// Determine if we should enable TLS
-	enableTLS := prStack.Spec.IngressTlsSecretName != "" || certManagerIssuer != ""
+	enableTLS := stack.Spec().IngressTlsSecretName != "" || certManagerIssuer != ""
 	
 	// Determine the TLS secret name
 	var tlsSecretName string
-	if prStack.Spec.IngressTlsSecretName != "" {
-		tlsSecretName = prStack.Spec.IngressTlsSecretName
+	if stack.Spec().IngressTlsSecretName != "" {
+		tlsSecretName = stack.Spec().IngressTlsSecretName
 	} else if certManagerIssuer != "" {
 		tlsSecretName = fmt.Sprintf("%s-tls", serviceName)
 	}
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+var _ = Describe("Stack", func() {
+	var prStack *pishopv1alpha1.PRStack
+
+	BeforeEach(func() {
+		prStack = newTestPRStack()
+		prStack.Spec.ResourceLimits = &pishopv1alpha1.ResourceLimits{CPULimit: "250m"}
+	})
+
+	Context("PRStack adapter", func() {
+		It("should keep the PR naming", func() {
+			stack := asStack(prStack)
+			Expect(stack.Object()).To(BeIdenticalTo(prStack))
+			Expect(stack.ID()).To(Equal("123"))
+			Expect(stack.Namespace()).To(Equal("pr-123-shop-pilab-hu"))
+			Expect(stack.Naming().Database("product-service", "123")).To(Equal(getDatabaseName("product-service", "123")))
+			Expect(stack.Naming().User("123")).To(Equal("pishop_pr_123"))
+			Expect(stack.Naming().BackupPrefix("123")).To(Equal("pr-123"))
+		})
+
+		It("should deploy the default services when none are listed", func() {
+			Expect(asStack(prStack).Services()).To(Equal(defaultServices()))
+
+			prStack.Spec.Services = []string{"product-service"}
+			Expect(asStack(prStack).Services()).To(Equal([]string{"product-service"}))
+		})
+
+		It("should run a single replica with the PR resource limits", func() {
+			policy := asStack(prStack).ResourcePolicy()
+			Expect(policy.Replicas).To(Equal(int32(1)))
+			Expect(policy.Limits.CPULimit).To(Equal("250m"))
+		})
+
+		It("should change the status of the PRStack", func() {
+			stack := asStack(prStack)
+			stack.Status().Phase = PhaseRunning
+			Expect(prStack.Status.Phase).To(Equal(PhaseRunning))
+			Expect(stack.ApplyStatus()).To(BeIdenticalTo(prStack))
+		})
+	})
+})
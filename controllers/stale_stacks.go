@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+const (
+	// DefaultStaleSweepInterval is how often the open pull requests are listed
+	DefaultStaleSweepInterval = time.Hour
+	// DefaultStaleGracePeriod is how long a stale PRStack is kept before it is deleted
+	DefaultStaleGracePeriod = 24 * time.Hour
+)
+
+// StaleStackSweeper periodically compares the PRStacks with the open pull requests on GitHub.
+// Stacks of closed or merged pull requests get a Stale condition and are deleted after a grace
+// period, unless they have the KeepAnnotation. Stacks of repositories whose pull requests
+// cannot be listed are left alone.
+type StaleStackSweeper struct {
+	*StackEngine
+	// GitHub lists the open pull requests
+	GitHub *GitHubClient
+	// Repository (owner/name) of the pull requests of PRStacks that do not set one
+	Repository string
+	// Interval between sweeps, DefaultStaleSweepInterval when zero
+	Interval time.Duration
+	// GracePeriod a stale stack is kept for, DefaultStaleGracePeriod when zero
+	GracePeriod time.Duration
+	// DryRun only records events, stacks are neither marked stale nor deleted
+	DryRun bool
+}
+
+// Start sweeps the PRStacks every interval until the context is cancelled
+func (s *StaleStackSweeper) Start(ctx context.Context) error {
+	log := ctrl.Log.WithName("stale-stack-sweeper")
+	ctx = ctrl.LoggerInto(ctx, log)
+
+	interval := s.Interval
+	if interval == 0 {
+		interval = DefaultStaleSweepInterval
+	}
+	log.Info("Sweeping stale PRStacks", "interval", interval, "dryRun", s.DryRun)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Sweep(ctx); err != nil {
+			log.Error(err, "Failed to sweep stale PRStacks")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep marks the PRStacks of closed pull requests stale and deletes those stale for longer
+// than the grace period
+func (s *StaleStackSweeper) Sweep(ctx context.Context) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	prStacks := &pishopv1alpha1.PRStackList{}
+	if err := s.List(ctx, prStacks); err != nil {
+		return fmt.Errorf("failed to list PRStacks: %v", err)
+	}
+
+	// Open pull requests by repository, and the repositories they could not be listed for
+	openPRs := map[string][]string{}
+	failed := map[string]bool{}
+	for i := range prStacks.Items {
+		prStack := &prStacks.Items[i]
+		if !prStack.DeletionTimestamp.IsZero() {
+			continue
+		}
+		repository := s.Repository
+		if prStack.Spec.GitHub != nil && prStack.Spec.GitHub.Repository != "" {
+			repository = prStack.Spec.GitHub.Repository
+		}
+		if repository == "" {
+			continue
+		}
+
+		if failed[repository] {
+			continue
+		}
+		open, listed := openPRs[repository]
+		if !listed {
+			var err error
+			if open, err = s.GitHub.OpenPullRequests(ctx, repository); err != nil {
+				log.Error(err, "Failed to list open pull requests, skipping its stacks", "repository", repository)
+				failed[repository] = true
+				continue
+			}
+			openPRs[repository] = open
+		}
+
+		if err := s.sweepStack(ctx, prStack, slices.Contains(open, prStack.Spec.PRNumber)); err != nil {
+			log.Error(err, "Failed to sweep PRStack", "prNumber", prStack.Spec.PRNumber)
+		}
+	}
+	return nil
+}
+
+// sweepStack records whether the pull request of a PRStack is still open, and deletes the
+// stack once it has been stale for the grace period
+func (s *StaleStackSweeper) sweepStack(ctx context.Context, prStack *pishopv1alpha1.PRStack, open bool) error {
+	stale := meta.FindStatusCondition(prStack.Status.Conditions, ConditionTypeStale)
+	if open {
+		if stale == nil || stale.Status != metav1.ConditionTrue || s.DryRun {
+			return nil
+		}
+		return s.setStaleCondition(ctx, prStack, metav1.ConditionFalse, "PullRequestOpen",
+			fmt.Sprintf("PR #%s is open", prStack.Spec.PRNumber))
+	}
+
+	_, keep := prStack.Annotations[KeepAnnotation]
+	if s.DryRun {
+		message := fmt.Sprintf("PR #%s is closed, the stack would be deleted", prStack.Spec.PRNumber)
+		if keep {
+			message = fmt.Sprintf("PR #%s is closed, the stack is kept by the %s annotation", prStack.Spec.PRNumber, KeepAnnotation)
+		}
+		s.Recorder.Event(prStack, corev1.EventTypeNormal, EventTypeStackStale, message+" (dry run)")
+		return nil
+	}
+
+	if stale == nil || stale.Status != metav1.ConditionTrue {
+		s.Recorder.Event(prStack, corev1.EventTypeNormal, EventTypeStackStale,
+			fmt.Sprintf("PR #%s is closed, the stack is deleted in %s", prStack.Spec.PRNumber, s.gracePeriod()))
+		return s.setStaleCondition(ctx, prStack, metav1.ConditionTrue, "PullRequestClosed",
+			fmt.Sprintf("PR #%s is closed or merged", prStack.Spec.PRNumber))
+	}
+
+	if keep || time.Since(stale.LastTransitionTime.Time) < s.gracePeriod() {
+		return nil
+	}
+	ctrl.LoggerFrom(ctx).Info("Deleting stale PRStack", "prNumber", prStack.Spec.PRNumber, "staleSince", stale.LastTransitionTime)
+	s.Recorder.Event(prStack, corev1.EventTypeNormal, EventTypeStaleStackDeleted,
+		fmt.Sprintf("PR #%s has been closed since %s", prStack.Spec.PRNumber, stale.LastTransitionTime.Format(time.RFC3339)))
+	return client.IgnoreNotFound(s.Delete(ctx, prStack))
+}
+
+// setStaleCondition updates the Stale condition of a PRStack
+func (s *StaleStackSweeper) setStaleCondition(ctx context.Context, prStack *pishopv1alpha1.PRStack, status metav1.ConditionStatus, reason, message string) error {
+	base := prStack.DeepCopy()
+	s.setCondition(asStack(prStack), metav1.Condition{
+		Type:    ConditionTypeStale,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+	return client.IgnoreNotFound(s.Status().Patch(ctx, prStack, client.MergeFrom(base)))
+}
+
+func (s *StaleStackSweeper) gracePeriod() time.Duration {
+	if s.GracePeriod == 0 {
+		return DefaultStaleGracePeriod
+	}
+	return s.GracePeriod
+}
@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+var _ = Describe("Stale stack sweeper", func() {
+	var (
+		ctx        context.Context
+		sweeper    *StaleStackSweeper
+		fakeClient client.Client
+		server     *httptest.Server
+		recorder   *record.FakeRecorder
+	)
+
+	createStack := func(prNumber string, annotations map[string]string, conditions ...metav1.Condition) {
+		prStack := &pishopv1alpha1.PRStack{
+			ObjectMeta: metav1.ObjectMeta{Name: "pr-" + prNumber, Annotations: annotations},
+			Spec:       pishopv1alpha1.PRStackSpec{PRNumber: prNumber, Active: true},
+		}
+		Expect(fakeClient.Create(ctx, prStack)).To(Succeed())
+		prStack.Status.Conditions = conditions
+		Expect(fakeClient.Status().Update(ctx, prStack)).To(Succeed())
+	}
+
+	getStack := func(prNumber string) (*pishopv1alpha1.PRStack, error) {
+		prStack := &pishopv1alpha1.PRStack{}
+		return prStack, fakeClient.Get(ctx, client.ObjectKey{Name: "pr-" + prNumber}, prStack)
+	}
+
+	staleSince := func(age time.Duration) metav1.Condition {
+		return metav1.Condition{
+			Type:               ConditionTypeStale,
+			Status:             metav1.ConditionTrue,
+			Reason:             "PullRequestClosed",
+			LastTransitionTime: metav1.NewTime(time.Now().Add(-age)),
+		}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		fakeClient = newTestClient().Build()
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("state") != "open" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			switch r.URL.Path {
+			case "/repos/pilab-dev/pishop/pulls":
+				_ = json.NewEncoder(w).Encode([]map[string]int{{"number": 1}})
+			case "/repos/pilab-dev/archived/pulls":
+				_ = json.NewEncoder(w).Encode([]map[string]int{})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+		sweeper = &StaleStackSweeper{
+			StackEngine: newTestEngine(fakeClient),
+			GitHub:      &GitHubClient{BaseURL: server.URL},
+			Repository:  "pilab-dev/pishop",
+			GracePeriod: time.Hour,
+		}
+		recorder = sweeper.Recorder.(*record.FakeRecorder)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should mark stacks of closed pull requests stale", func() {
+		createStack("1", nil)
+		createStack("2", nil)
+
+		Expect(sweeper.Sweep(ctx)).To(Succeed())
+
+		open, err := getStack("1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(meta.FindStatusCondition(open.Status.Conditions, ConditionTypeStale)).To(BeNil())
+
+		closed, err := getStack("2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(meta.IsStatusConditionTrue(closed.Status.Conditions, ConditionTypeStale)).To(BeTrue())
+		Expect(recorder.Events).To(Receive(ContainSubstring(EventTypeStackStale)))
+	})
+
+	It("should delete stale stacks after the grace period unless kept", func() {
+		createStack("2", nil, staleSince(2*time.Hour))
+		createStack("3", map[string]string{KeepAnnotation: "true"}, staleSince(2*time.Hour))
+		createStack("4", nil, staleSince(time.Minute))
+
+		Expect(sweeper.Sweep(ctx)).To(Succeed())
+
+		_, err := getStack("2")
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+		_, err = getStack("3")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = getStack("4")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should clear the Stale condition when the pull request is reopened", func() {
+		createStack("1", nil, staleSince(2*time.Hour))
+
+		Expect(sweeper.Sweep(ctx)).To(Succeed())
+
+		prStack, err := getStack("1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(meta.IsStatusConditionFalse(prStack.Status.Conditions, ConditionTypeStale)).To(BeTrue())
+	})
+
+	It("should only record events in dry-run mode", func() {
+		sweeper.DryRun = true
+		createStack("2", nil, staleSince(2*time.Hour))
+		createStack("3", nil)
+
+		Expect(sweeper.Sweep(ctx)).To(Succeed())
+
+		_, err := getStack("2")
+		Expect(err).NotTo(HaveOccurred())
+		prStack, err := getStack("3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prStack.Status.Conditions).To(BeEmpty())
+		Expect(recorder.Events).To(HaveLen(2))
+		Expect(recorder.Events).To(Receive(ContainSubstring("dry run")))
+	})
+
+	It("should leave stacks alone when their pull requests cannot be listed", func() {
+		Expect(fakeClient.Create(ctx, &pishopv1alpha1.PRStack{
+			ObjectMeta: metav1.ObjectMeta{Name: "pr-2"},
+			Spec: pishopv1alpha1.PRStackSpec{
+				PRNumber: "2",
+				GitHub:   &pishopv1alpha1.GitHubSpec{Repository: "pilab-dev/unknown"},
+			},
+		})).To(Succeed())
+
+		Expect(sweeper.Sweep(ctx)).To(Succeed())
+
+		prStack, err := getStack("2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prStack.Status.Conditions).To(BeEmpty())
+	})
+
+	It("should mark every stack stale when no pull request is open", func() {
+		Expect(fakeClient.Create(ctx, &pishopv1alpha1.PRStack{
+			ObjectMeta: metav1.ObjectMeta{Name: "pr-2"},
+			Spec: pishopv1alpha1.PRStackSpec{
+				PRNumber: "2",
+				GitHub:   &pishopv1alpha1.GitHubSpec{Repository: "pilab-dev/archived"},
+			},
+		})).To(Succeed())
+
+		Expect(sweeper.Sweep(ctx)).To(Succeed())
+
+		prStack, err := getStack("2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(meta.IsStatusConditionTrue(prStack.Status.Conditions, ConditionTypeStale)).To(BeTrue())
+	})
+})
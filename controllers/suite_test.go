@@ -1,13 +1,85 @@
 package controllers
 
 import (
+	"context"
 	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
 )
 
+// testNamespace is the namespace of the stack of newTestPRStack
+const testNamespace = "pr-123-shop-pilab-hu"
+
 func TestControllers(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Controllers Suite")
-}
\ No newline at end of file
+}
+
+// serverSideApply makes the fake client create missing objects on apply like the API server,
+// the fake client only applies patches to existing objects
+var serverSideApply = interceptor.Funcs{
+	Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+		if patch.Type() != types.ApplyPatchType {
+			return c.Patch(ctx, obj, patch, opts...)
+		}
+
+		existing := obj.DeepCopyObject().(client.Object)
+		if err := c.Get(ctx, client.ObjectKeyFromObject(obj), existing); !apierrors.IsNotFound(err) {
+			return c.Patch(ctx, obj, patch, opts...)
+		}
+
+		patchOptions := &client.PatchOptions{}
+		patchOptions.ApplyOptions(opts)
+		return c.Create(ctx, obj, &client.CreateOptions{DryRun: patchOptions.DryRun})
+	},
+}
+
+// newTestScheme returns a scheme with the API and the Kubernetes kinds managed by the operator
+func newTestScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	Expect(pishopv1alpha1.AddToScheme(scheme)).To(Succeed())
+	return scheme
+}
+
+// newTestClient returns the builder of a fake client applying objects like the API server, with
+// the status subresource of PRStacks and Tenants. Tests add the objects they start from.
+func newTestClient() *fake.ClientBuilder {
+	return fake.NewClientBuilder().
+		WithScheme(newTestScheme()).
+		WithInterceptorFuncs(serverSideApply).
+		WithStatusSubresource(&pishopv1alpha1.PRStack{}, &pishopv1alpha1.Tenant{})
+}
+
+// newTestEngine returns a StackEngine for stacks on shop.pilab.hu backed by c, recording its
+// events in a FakeRecorder
+func newTestEngine(c client.Client) *StackEngine {
+	return &StackEngine{
+		Client:     c,
+		Scheme:     c.Scheme(),
+		Recorder:   record.NewFakeRecorder(100),
+		MongoURI:   "mongodb://localhost:27017",
+		BaseDomain: "shop.pilab.hu",
+	}
+}
+
+// newTestPRStack returns the active PRStack of PR 123 in testNamespace, tests set the fields
+// they need on top
+func newTestPRStack() *pishopv1alpha1.PRStack {
+	return &pishopv1alpha1.PRStack{
+		ObjectMeta: metav1.ObjectMeta{Name: "pr-123", UID: "pr-123-uid"},
+		Spec:       pishopv1alpha1.PRStackSpec{PRNumber: "123", Active: true},
+	}
+}
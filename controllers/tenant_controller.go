@@ -0,0 +1,460 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Finalizer name for Tenant resources
+	TenantFinalizerName = "shop.pilab.hu/tenant-finalizer"
+
+	// Tenant namespace name pattern
+	TenantNamespacePattern = "tenant-%s"
+
+	// Defaults of tenant stacks
+	DefaultTenantReplicas            = 2
+	DefaultTenantBackupRetentionDays = 30
+
+	// ConditionTypeDeletionProtected reports whether deleting the Tenant removes its data
+	ConditionTypeDeletionProtected = "DeletionProtected"
+)
+
+// TenantReconciler reconciles a Tenant object
+type TenantReconciler struct {
+	*StackEngine
+}
+
+//+kubebuilder:rbac:groups=shop.pilab.hu,resources=tenants,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=shop.pilab.hu,resources=tenants/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=shop.pilab.hu,resources=tenants/finalizers,verbs=update
+//+kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile drives a Tenant through provisioning and deployment. Tenants never expire
+// and are only removed once their deletion protection is turned off.
+func (r *TenantReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	// Fetch the Tenant instance
+	var tenant pishopv1alpha1.Tenant
+	if err := r.Get(ctx, req.NamespacedName, &tenant); err != nil {
+		if errors.IsNotFound(err) {
+			log.Info("Tenant resource not found. Ignoring since object must be deleted")
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "Failed to get Tenant")
+
+		return ctrl.Result{}, err
+	}
+
+	stack := newTenantStack(&tenant)
+	return r.traceReconcile(ctx, stack, func(ctx context.Context) (ctrl.Result, error) {
+		return r.reconcileTenant(ctx, stack)
+	})
+}
+
+// reconcileTenant moves a Tenant through its phases
+func (r *TenantReconciler) reconcileTenant(ctx context.Context, stack *tenantStack) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	tenant := stack.tenant
+
+	// Handle deletion
+	if !tenant.DeletionTimestamp.IsZero() {
+		return r.handleDeletion(ctx, tenant)
+	}
+
+	// Add finalizer if not present
+	if !containsString(tenant.Finalizers, TenantFinalizerName) {
+		tenant.Finalizers = append(tenant.Finalizers, TenantFinalizerName)
+		if err := r.Update(ctx, tenant); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	r.setDeletionProtectedCondition(stack)
+
+	// Paused tenants only report their status until they are resumed
+	if isStackPaused(stack) {
+		return r.handlePaused(ctx, stack)
+	}
+	if err := r.resumeStack(ctx, stack); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var result ctrl.Result
+	var err error
+	switch tenant.Status.Phase {
+	case PhaseInitialization:
+		result, err = r.handleInitialization(ctx, stack)
+	case PhaseProvisioning:
+		result, err = r.handleProvisioning(ctx, stack)
+	case PhaseDeploying:
+		result, err = r.handleDeployment(ctx, stack)
+		if err == nil && (stack.Status().Phase == PhaseRunning || stack.Status().Phase == PhaseDegraded) {
+			result, err = r.handleDeployed(ctx, stack)
+		}
+	case PhaseRunning, PhaseDegraded:
+		result, err = r.handleRunning(ctx, stack)
+	case PhaseFailed:
+		result, err = r.handleFailed(ctx, stack)
+	default:
+		log.Info("Unknown phase", "phase", tenant.Status.Phase)
+		return ctrl.Result{}, nil
+	}
+
+	if updateErr := r.updateStackStatus(ctx, stack); updateErr != nil {
+		if err == nil {
+			err = updateErr
+		}
+		log.Error(updateErr, "Failed to update Tenant status")
+	}
+
+	return result, err
+}
+
+// handleInitialization validates the tenant before anything is provisioned
+func (r *TenantReconciler) handleInitialization(ctx context.Context, stack *tenantStack) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	tenant := stack.tenant
+	log.Info("Initializing tenant", "tenantID", tenant.Spec.TenantID)
+
+	if err := ValidateTenant(tenant); err != nil {
+		log.Error(err, "Invalid tenant")
+		stack.Status().Phase = PhaseFailed
+		stack.Status().Message = err.Error()
+		return ctrl.Result{}, nil
+	}
+
+	r.Recorder.Event(tenant, corev1.EventTypeNormal, EventTypeInitializing, fmt.Sprintf("Starting initialization for tenant %s", tenant.Spec.TenantID))
+
+	now := metav1.Now()
+	stack.Status().CreatedAt = &now
+	stack.Status().Phase = PhaseProvisioning
+	stack.Status().Message = "Starting tenant provisioning"
+	r.setProgressingCondition(stack, "Initializing", "Preparing to provision infrastructure")
+
+	return ctrl.Result{RequeueAfter: RequeueIntervalShort}, nil
+}
+
+// handleDeployed records the deployed spec and schedules backups right away
+func (r *TenantReconciler) handleDeployed(ctx context.Context, stack *tenantStack) (ctrl.Result, error) {
+	stack.tenant.Status.ObservedGeneration = stack.tenant.Generation
+	stack.Status().LastDeployedAt = stack.tenant.Spec.DeployedAt
+
+	if err := r.ensureTenantBackupSchedule(ctx, stack); err != nil {
+		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+	}
+
+	return ctrl.Result{RequeueAfter: RequeueIntervalLong}, nil
+}
+
+// ensureTenantBackupSchedule creates the mandatory backup CronJob of a tenant
+func (r *TenantReconciler) ensureTenantBackupSchedule(ctx context.Context, stack *tenantStack) error {
+	if err := r.ensureBackupSchedule(ctx, stack); err != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "Failed to ensure backup schedule")
+		r.Recorder.Event(stack.tenant, corev1.EventTypeWarning, EventTypeBackupScheduleFailed, err.Error())
+		stack.Status().Message = fmt.Sprintf("Backup schedule failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// handleRunning keeps a deployed tenant in sync with its spec. Unlike PR stacks tenants
+// are never scaled down; spec changes are rolled out by deploying the stack again.
+func (r *TenantReconciler) handleRunning(ctx context.Context, stack *tenantStack) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	tenant := stack.tenant
+
+	// Check if a deployment rollout is requested
+	if r.shouldRolloutDeployments(stack) {
+		log.Info("Deployment rollout requested", "tenantID", tenant.Spec.TenantID, "deployedAt", tenant.Spec.DeployedAt)
+		if err := r.rolloutDeployments(ctx, stack); err != nil {
+			log.Error(err, "Failed to rollout deployments")
+			r.Recorder.Event(tenant, corev1.EventTypeWarning, EventTypeRolloutFailed, fmt.Sprintf("Failed to rollout deployments: %v", err))
+			stack.Status().Message = fmt.Sprintf("Rollout failed: %v", err)
+			return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+		}
+		r.Recorder.Event(tenant, corev1.EventTypeNormal, EventTypeRolloutTriggered, fmt.Sprintf("Tenant %s deployments rolled out successfully", tenant.Spec.TenantID))
+		stack.Status().LastDeployedAt = tenant.Spec.DeployedAt
+	}
+
+	if tenant.Generation != tenant.Status.ObservedGeneration {
+		log.Info("Tenant spec changed, redeploying", "tenantID", tenant.Spec.TenantID, "generation", tenant.Generation)
+		stack.Status().Phase = PhaseDeploying
+		stack.Status().Message = "Tenant spec changed, deploying services"
+		return ctrl.Result{RequeueAfter: RequeueIntervalShort}, nil
+	}
+
+	// Backups are mandatory, recreate the schedule if it was removed
+	if err := r.ensureTenantBackupSchedule(ctx, stack); err != nil {
+		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+	}
+	if err := r.recordBackupStatus(ctx, stack); err != nil {
+		log.Error(err, "Failed to record backup status")
+	}
+
+	// Recreate missing JetStream streams and correct drifted ones
+	if hasJetStreamStreams(stack) {
+		if ready, err := r.isNATSReady(ctx, stack, stack.Namespace()); err == nil && ready {
+			if err := r.reconcileJetStreamStreams(ctx, stack); err != nil {
+				log.Error(err, "Failed to reconcile JetStream streams")
+				r.Recorder.Event(tenant, corev1.EventTypeWarning, EventTypeStreamsFailed, err.Error())
+			}
+		}
+	}
+
+	// Re-apply managed objects changed by hand
+	if err := r.reconcileDrift(ctx, stack); err != nil {
+		log.Error(err, "Failed to reconcile drift")
+	}
+
+	r.updateStatusSummary(ctx, stack)
+
+	return ctrl.Result{RequeueAfter: RequeueIntervalLong}, nil
+}
+
+// handleFailed retries a failed tenant. Customer shops are not left failed until someone
+// notices: the tenant is deployed again, or provisioned again if provisioning never completed.
+func (r *TenantReconciler) handleFailed(ctx context.Context, stack *tenantStack) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	tenant := stack.tenant
+
+	if err := ValidateTenant(tenant); err != nil {
+		log.Info("Tenant is invalid, waiting for a spec change", "tenantID", tenant.Spec.TenantID)
+		stack.Status().Message = err.Error()
+		return ctrl.Result{}, nil
+	}
+
+	status := stack.Status()
+	if status.CreatedAt == nil {
+		status.Phase = PhaseInitialization
+	} else if status.MongoDB == nil || status.NATS == nil || status.Redis == nil {
+		status.Phase = PhaseProvisioning
+	} else {
+		status.Phase = PhaseDeploying
+	}
+
+	log.Info("Retrying failed tenant", "tenantID", tenant.Spec.TenantID, "phase", status.Phase)
+	return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, nil
+}
+
+// handleDeletion removes all resources of a tenant unless it is deletion protected
+func (r *TenantReconciler) handleDeletion(ctx context.Context, tenant *pishopv1alpha1.Tenant) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	log.Info("Handling tenant deletion", "tenantID", tenant.Spec.TenantID, "phase", tenant.Status.Phase)
+
+	if !containsString(tenant.Finalizers, TenantFinalizerName) {
+		return ctrl.Result{}, nil
+	}
+
+	stack := newTenantStack(tenant)
+
+	// Protected tenants keep their finalizer until the protection is turned off
+	if isDeletionProtected(tenant) {
+		message := fmt.Sprintf("Tenant %s is deletion protected, set spec.deletionProtection to false to delete it", tenant.Spec.TenantID)
+		if tenant.Status.Message != message {
+			r.Recorder.Event(tenant, corev1.EventTypeWarning, EventTypeDeletionBlocked, message)
+		}
+		r.setDeletionProtectedCondition(stack)
+		stack.Status().Message = message
+		if err := r.updateStackStatus(ctx, stack); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	r.Recorder.Event(tenant, corev1.EventTypeNormal, EventTypeCleaning, fmt.Sprintf("Cleaning up all resources for tenant %s", tenant.Spec.TenantID))
+
+	// Databases, NATS and Redis first, then the namespace with the services
+	if err := r.cleanupAllResources(ctx, stack); err != nil {
+		stack.Status().Phase = PhaseCleaning
+		stack.Status().Message = fmt.Sprintf("Cleanup failed: %v", err)
+		if updateErr := r.updateStackStatus(ctx, stack); updateErr != nil {
+			log.Error(updateErr, "Failed to update Tenant status after cleanup failure")
+		}
+		return ctrl.Result{RequeueAfter: RequeueIntervalMedium}, err
+	}
+
+	r.Recorder.Event(tenant, corev1.EventTypeNormal, EventTypeCleanupComplete, fmt.Sprintf("All resources for tenant %s cleaned up successfully", tenant.Spec.TenantID))
+
+	// Remove finalizer to allow deletion
+	tenant.Finalizers = removeString(tenant.Finalizers, TenantFinalizerName)
+	if err := r.Update(ctx, tenant); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	log.Info("Successfully completed cleanup and removed finalizer", "tenantID", tenant.Spec.TenantID)
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *TenantReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ownStackObjects(ctrl.NewControllerManagedBy(mgr).
+		For(&pishopv1alpha1.Tenant{})).
+		Complete(r)
+}
+
+// getTenantReplicas returns the replica count of the tenant services
+func getTenantReplicas(tenant *pishopv1alpha1.Tenant) int32 {
+	if tenant.Spec.Replicas < DefaultTenantReplicas {
+		return DefaultTenantReplicas
+	}
+	return tenant.Spec.Replicas
+}
+
+// isDeletionProtected returns true unless deletion protection was explicitly turned off
+func isDeletionProtected(tenant *pishopv1alpha1.Tenant) bool {
+	return tenant.Spec.DeletionProtection == nil || *tenant.Spec.DeletionProtection
+}
+
+// setDeletionProtectedCondition reports the deletion protection of a tenant
+func (r *TenantReconciler) setDeletionProtectedCondition(stack *tenantStack) {
+	condition := metav1.Condition{
+		Type:               ConditionTypeDeletionProtected,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Enabled",
+		Message:            "Deleting the Tenant is blocked",
+		LastTransitionTime: metav1.Now(),
+	}
+	if !isDeletionProtected(stack.tenant) {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Disabled"
+		condition.Message = "Deleting the Tenant removes all of its data"
+	}
+	r.setCondition(stack, condition)
+}
+
+// tenantStack adapts a Tenant to the stack engine. The engine works on a PRStack shaped
+// copy of the tenant; the copy is always active and always has scheduled backups, and
+// ApplyStatus writes its status back to the Tenant.
+type tenantStack struct {
+	tenant *pishopv1alpha1.Tenant
+	spec   pishopv1alpha1.PRStackSpec
+	status pishopv1alpha1.PRStackStatus
+}
+
+// newTenantStack returns the engine view of a tenant
+func newTenantStack(tenant *pishopv1alpha1.Tenant) *tenantStack {
+	retentionDays := tenant.Spec.Backup.RetentionDays
+	if retentionDays == 0 {
+		retentionDays = DefaultTenantBackupRetentionDays
+	}
+
+	return &tenantStack{
+		tenant: tenant,
+		spec: pishopv1alpha1.PRStackSpec{
+			PRNumber:             tenant.Spec.TenantID,
+			ImageTag:             tenant.Spec.ImageTag,
+			ImagePullSecrets:     tenant.Spec.ImagePullSecrets,
+			CustomDomain:         tenant.Spec.CustomDomain,
+			IngressTlsSecretName: tenant.Spec.IngressTlsSecretName,
+			Active:               true,
+			DeployedAt:           tenant.Spec.DeployedAt,
+			Paused:               tenant.Spec.Paused,
+			MongoDB:              tenant.Spec.MongoDB,
+			MongoURI:             tenant.Spec.MongoURI,
+			MongoUsername:        tenant.Spec.MongoUsername,
+			MongoPassword:        tenant.Spec.MongoPassword,
+			NATS:                 tenant.Spec.NATS,
+			NatsURL:              tenant.Spec.NatsURL,
+			Redis:                tenant.Spec.Redis,
+			RedisURL:             tenant.Spec.RedisURL,
+			Services:             tenant.Spec.Services,
+			Environment:          tenant.Spec.Environment,
+			ResourceLimits:       tenant.Spec.ResourceLimits,
+			ServiceScaling:       tenant.Spec.ServiceScaling,
+			BackupConfig: &pishopv1alpha1.BackupConfig{
+				Enabled:       true,
+				Schedule:      tenant.Spec.Backup.Schedule,
+				RetentionDays: retentionDays,
+				StorageClass:  tenant.Spec.Backup.StorageClass,
+				StorageSize:   tenant.Spec.Backup.StorageSize,
+			},
+		},
+		status: pishopv1alpha1.PRStackStatus{
+			Phase:          tenant.Status.Phase,
+			Message:        tenant.Status.Message,
+			CreatedAt:      tenant.Status.CreatedAt,
+			LastDeployedAt: tenant.Status.LastDeployedAt,
+			FirstRunningAt: tenant.Status.FirstRunningAt,
+			MongoDB:        tenant.Status.MongoDB,
+			NATS:           tenant.Status.NATS,
+			Redis:          tenant.Status.Redis,
+			Services:       tenant.Status.Services,
+			Deployment:     tenant.Status.Deployment,
+			Conditions:     tenant.Status.Conditions,
+			ReadyServices:  tenant.Status.ReadyServices,
+			URL:            tenant.Status.URL,
+			Endpoints:      tenant.Status.Endpoints,
+			Backup:         tenant.Status.Backup,
+		},
+	}
+}
+
+func (s *tenantStack) Object() client.Object {
+	return s.tenant
+}
+
+func (s *tenantStack) ID() string {
+	return s.tenant.Spec.TenantID
+}
+
+func (s *tenantStack) Namespace() string {
+	return s.Naming().Namespace(s.ID())
+}
+
+func (s *tenantStack) Naming() StackNaming {
+	return tenantNaming{}
+}
+
+func (s *tenantStack) Services() []string {
+	if len(s.tenant.Spec.Services) == 0 {
+		return defaultServices()
+	}
+	return s.tenant.Spec.Services
+}
+
+// ResourcePolicy runs at least DefaultTenantReplicas replicas of each service
+func (s *tenantStack) ResourcePolicy() ResourcePolicy {
+	return ResourcePolicy{
+		Replicas:       getTenantReplicas(s.tenant),
+		Limits:         s.tenant.Spec.ResourceLimits,
+		ServiceScaling: s.tenant.Spec.ServiceScaling,
+	}
+}
+
+func (s *tenantStack) Spec() *pishopv1alpha1.PRStackSpec {
+	return &s.spec
+}
+
+func (s *tenantStack) Status() *pishopv1alpha1.PRStackStatus {
+	return &s.status
+}
+
+func (s *tenantStack) ApplyStatus() client.Object {
+	s.tenant.Status.Phase = s.status.Phase
+	s.tenant.Status.Message = s.status.Message
+	s.tenant.Status.Namespace = s.Namespace()
+	s.tenant.Status.CreatedAt = s.status.CreatedAt
+	s.tenant.Status.LastDeployedAt = s.status.LastDeployedAt
+	s.tenant.Status.FirstRunningAt = s.status.FirstRunningAt
+	s.tenant.Status.MongoDB = s.status.MongoDB
+	s.tenant.Status.NATS = s.status.NATS
+	s.tenant.Status.Redis = s.status.Redis
+	s.tenant.Status.Services = s.status.Services
+	s.tenant.Status.Deployment = s.status.Deployment
+	s.tenant.Status.Conditions = s.status.Conditions
+	s.tenant.Status.ReadyServices = s.status.ReadyServices
+	s.tenant.Status.URL = s.status.URL
+	s.tenant.Status.Endpoints = s.status.Endpoints
+	s.tenant.Status.Backup = s.status.Backup
+	return s.tenant
+}
@@ -0,0 +1,320 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Tenant", func() {
+	var (
+		ctx        context.Context
+		cancel     context.CancelFunc
+		reconciler *TenantReconciler
+		recorder   *record.FakeRecorder
+		fakeClient client.Client
+		tenant     *pishopv1alpha1.Tenant
+		namespace  string
+	)
+
+	reconcile := func() (ctrl.Result, error) {
+		return reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: tenant.Name}})
+	}
+
+	getTenant := func() *pishopv1alpha1.Tenant {
+		current := &pishopv1alpha1.Tenant{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: tenant.Name}, current)).To(Succeed())
+		return current
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		fakeClient = newTestClient().
+			WithStatusSubresource(&appsv1.Deployment{}, &appsv1.StatefulSet{}).
+			Build()
+
+		reconciler = &TenantReconciler{StackEngine: newTestEngine(fakeClient)}
+		reconciler.BackupManager = &BackupRestoreManager{Client: fakeClient}
+		recorder = reconciler.Recorder.(*record.FakeRecorder)
+
+		namespace = "tenant-magicshop"
+		tenant = &pishopv1alpha1.Tenant{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "magicshop",
+			},
+			Spec: pishopv1alpha1.TenantSpec{
+				TenantID: "magicshop",
+				ImageTag: "v1.5.2",
+				Replicas: 3,
+				Services: []string{"product-service"},
+				MongoDB:  &pishopv1alpha1.MongoDBConfig{Mode: MongoDBModeDedicated},
+				Backup: pishopv1alpha1.TenantBackupConfig{
+					Schedule: "0 2 * * *",
+				},
+			},
+		}
+
+		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	Context("naming", func() {
+		It("should derive names from the tenant ID", func() {
+			naming := tenantNaming{}
+			Expect(naming.Namespace("magic-shop")).To(Equal("tenant-magic-shop"))
+			Expect(naming.Database("product-service", "magic-shop")).To(Equal("tenant_magic_shop_product"))
+			Expect(naming.User("magic-shop")).To(Equal("pishop_tenant_magic-shop"))
+			Expect(naming.NATSSubjectPrefix("magic-shop")).To(Equal("pishop.tenant.magic-shop"))
+			Expect(naming.RedisKeyPrefix("magic-shop")).To(Equal("pishop:tenant:magic-shop:"))
+			Expect(naming.Host("magic-shop", "shop.pilab.hu")).To(Equal("magic-shop.shop.pilab.hu"))
+			Expect(naming.BackupPrefix("magic-shop")).To(Equal("tenant-magic-shop"))
+		})
+	})
+
+	Context("tenantStack", func() {
+		It("should always be active with scheduled backups", func() {
+			stack := newTenantStack(tenant)
+			Expect(stack.ID()).To(Equal("magicshop"))
+			Expect(stack.Namespace()).To(Equal(namespace))
+			Expect(stack.Spec().Active).To(BeTrue())
+			Expect(stack.Spec().BackupConfig.Enabled).To(BeTrue())
+			Expect(stack.Spec().BackupConfig.Schedule).To(Equal("0 2 * * *"))
+			Expect(stack.Spec().BackupConfig.RetentionDays).To(Equal(DefaultTenantBackupRetentionDays))
+		})
+
+		It("should size services by the tenant replicas", func() {
+			Expect(newTenantStack(tenant).ResourcePolicy().Replicas).To(Equal(int32(3)))
+
+			tenant.Spec.Replicas = 0
+			Expect(newTenantStack(tenant).ResourcePolicy().Replicas).To(Equal(int32(DefaultTenantReplicas)))
+		})
+
+		It("should write the stack status back to the tenant", func() {
+			stack := newTenantStack(tenant)
+			stack.Status().Phase = PhaseRunning
+			stack.Status().Redis = &pishopv1alpha1.RedisConfig{KeyPrefix: "pishop:tenant:magicshop:"}
+
+			Expect(stack.ApplyStatus()).To(BeIdenticalTo(tenant))
+			Expect(tenant.Status.Phase).To(Equal(PhaseRunning))
+			Expect(tenant.Status.Namespace).To(Equal(namespace))
+			Expect(tenant.Status.Redis.KeyPrefix).To(Equal("pishop:tenant:magicshop:"))
+		})
+	})
+
+	Context("initialization", func() {
+		It("should add the finalizer and start provisioning", func() {
+			Expect(fakeClient.Create(ctx, tenant)).To(Succeed())
+
+			_, err := reconcile()
+			Expect(err).ToNot(HaveOccurred())
+
+			current := getTenant()
+			Expect(current.Finalizers).To(ContainElement(TenantFinalizerName))
+			Expect(current.Status.Phase).To(Equal(PhaseProvisioning))
+			Expect(current.Status.Namespace).To(Equal(namespace))
+			Expect(current.Status.CreatedAt).ToNot(BeNil())
+			Expect(apimeta.IsStatusConditionTrue(current.Status.Conditions, ConditionTypeDeletionProtected)).To(BeTrue())
+		})
+
+		It("should fail tenants without a backup schedule", func() {
+			tenant.Spec.Backup.Schedule = ""
+			Expect(fakeClient.Create(ctx, tenant)).To(Succeed())
+
+			_, err := reconcile()
+			Expect(err).ToNot(HaveOccurred())
+
+			current := getTenant()
+			Expect(current.Status.Phase).To(Equal(PhaseFailed))
+			Expect(current.Status.Message).To(ContainSubstring("backup.schedule"))
+		})
+	})
+
+	Context("deployment", func() {
+		BeforeEach(func() {
+			tenant.Status = pishopv1alpha1.TenantStatus{
+				Phase:     PhaseDeploying,
+				CreatedAt: &metav1.Time{},
+				MongoDB: &pishopv1alpha1.MongoDBCredentials{
+					User:             "pishop_tenant_magicshop",
+					ConnectionString: "mongodb://mongodb." + namespace + ".svc.cluster.local:27017",
+					Databases:        []string{"tenant_magicshop_product"},
+				},
+				NATS:  &pishopv1alpha1.NATSConfig{ConnectionString: "nats://nats." + namespace + ".svc.cluster.local:4222", SubjectPrefix: "pishop.tenant.magicshop"},
+				Redis: &pishopv1alpha1.RedisConfig{ConnectionString: "redis://redis." + namespace + ".svc.cluster.local:6379", KeyPrefix: "pishop:tenant:magicshop:"},
+			}
+			tenant.Finalizers = []string{TenantFinalizerName}
+			Expect(fakeClient.Create(ctx, tenant)).To(Succeed())
+
+			// MongoDB, NATS and Redis are up, services are deployed in the next wave
+			mongoDB := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: DedicatedMongoDBName, Namespace: namespace}}
+			Expect(fakeClient.Create(ctx, mongoDB)).To(Succeed())
+			mongoDB.Status.ReadyReplicas = 1
+			Expect(fakeClient.Status().Update(ctx, mongoDB)).To(Succeed())
+			for _, name := range []string{"nats", "redis"} {
+				deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+				Expect(fakeClient.Create(ctx, deployment)).To(Succeed())
+				deployment.Status.ReadyReplicas = 1
+				Expect(fakeClient.Status().Update(ctx, deployment)).To(Succeed())
+			}
+		})
+
+		It("should wait for the infrastructure before deploying services", func() {
+			deployment := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "redis", Namespace: namespace}, deployment)).To(Succeed())
+			deployment.Status.ReadyReplicas = 0
+			Expect(fakeClient.Status().Update(ctx, deployment)).To(Succeed())
+
+			_, err := reconcile()
+			Expect(err).ToNot(HaveOccurred())
+
+			current := getTenant()
+			Expect(current.Status.Phase).To(Equal(PhaseDeploying))
+			Expect(current.Status.Deployment).ToNot(BeNil())
+			Expect(current.Status.Deployment.Wave).To(Equal(int32(1)))
+			Expect(current.Status.Deployment.BlockedBy).To(Equal(DependencyRedis))
+
+			err = fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, deployment)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should deploy production services with multiple replicas", func() {
+			_, err := reconcile()
+			Expect(err).ToNot(HaveOccurred())
+
+			current := getTenant()
+			Expect(current.Status.Phase).To(Equal(PhaseRunning))
+			Expect(current.Status.ObservedGeneration).To(Equal(current.Generation))
+			Expect(current.Status.Deployment).To(BeNil())
+
+			deployment := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, deployment)).To(Succeed())
+			Expect(*deployment.Spec.Replicas).To(Equal(int32(3)))
+			Expect(deployment.Labels["environment"]).To(Equal("production"))
+			Expect(deployment.Spec.Template.Spec.Containers[0].Image).To(Equal("ghcr.io/pilab-dev/product-service:v1.5.2"))
+			Expect(deployment.Spec.Template.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "MONGODB_DATABASE", Value: "tenant_magicshop_product"}))
+		})
+
+		It("should schedule backups once deployed", func() {
+			_, err := reconcile()
+			Expect(err).ToNot(HaveOccurred())
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "mongodb-backup-pvc", Namespace: namespace}, pvc)).To(Succeed())
+
+			cronJob := &batchv1.CronJob{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: BackupCronJobName, Namespace: namespace}, cronJob)).To(Succeed())
+			Expect(cronJob.Spec.Schedule).To(Equal("0 2 * * *"))
+			Expect(cronJob.Spec.ConcurrencyPolicy).To(Equal(batchv1.ForbidConcurrent))
+
+			container := cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0]
+			Expect(container.Env).To(ContainElement(corev1.EnvVar{Name: "BACKUP_NAME", Value: namespace}))
+			Expect(container.Args[0]).To(ContainSubstring(`BACKUP_NAME="${BACKUP_NAME}-$(date -u +%Y%m%d-%H%M%S)"`))
+			Expect(container.Args[0]).To(ContainSubstring(`-name "tenant-magicshop-*.tar.gz" -mtime +30`))
+			Expect(container.Args[0]).To(ContainSubstring("tenant_magicshop_product"))
+		})
+
+		It("should redeploy when the spec changes", func() {
+			_, err := reconcile()
+			Expect(err).ToNot(HaveOccurred())
+
+			current := getTenant()
+			current.Spec.Replicas = 4
+			// The fake client does not maintain the generation
+			current.Generation++
+			Expect(fakeClient.Update(ctx, current)).To(Succeed())
+
+			_, err = reconcile()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getTenant().Status.Phase).To(Equal(PhaseDeploying))
+
+			_, err = reconcile()
+			Expect(err).ToNot(HaveOccurred())
+
+			deployment := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, client.ObjectKey{Name: "product-service", Namespace: namespace}, deployment)).To(Succeed())
+			Expect(*deployment.Spec.Replicas).To(Equal(int32(4)))
+		})
+	})
+
+	Context("deletion", func() {
+		BeforeEach(func() {
+			tenant.Finalizers = []string{TenantFinalizerName}
+			tenant.Status.Phase = PhaseRunning
+		})
+
+		It("should block deletion of protected tenants", func() {
+			Expect(fakeClient.Create(ctx, tenant)).To(Succeed())
+			Expect(fakeClient.Delete(ctx, tenant)).To(Succeed())
+
+			_, err := reconcile()
+			Expect(err).ToNot(HaveOccurred())
+
+			current := getTenant()
+			Expect(current.Finalizers).To(ContainElement(TenantFinalizerName))
+			Expect(current.Status.Message).To(ContainSubstring("deletion protected"))
+			Expect(recorder.Events).To(Receive(ContainSubstring(EventTypeDeletionBlocked)))
+		})
+
+		It("should remove unprotected tenants", func() {
+			tenant.Spec.DeletionProtection = new(bool)
+			Expect(fakeClient.Create(ctx, tenant)).To(Succeed())
+			Expect(fakeClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})).To(Succeed())
+			Expect(fakeClient.Delete(ctx, tenant)).To(Succeed())
+
+			_, err := reconcile()
+			Expect(err).ToNot(HaveOccurred())
+
+			err = fakeClient.Get(ctx, types.NamespacedName{Name: tenant.Name}, &pishopv1alpha1.Tenant{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+			err = fakeClient.Get(ctx, types.NamespacedName{Name: namespace}, &corev1.Namespace{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+	})
+
+	Context("ValidateTenant", func() {
+		It("should accept a valid tenant", func() {
+			Expect(ValidateTenant(tenant)).To(Succeed())
+		})
+
+		It("should reject invalid tenant IDs", func() {
+			tenant.Spec.TenantID = "Magic_Shop"
+			Expect(ValidateTenant(tenant)).ToNot(Succeed())
+		})
+
+		It("should require an image tag", func() {
+			tenant.Spec.ImageTag = ""
+			Expect(ValidateTenant(tenant)).ToNot(Succeed())
+		})
+
+		It("should reject a single replica", func() {
+			tenant.Spec.Replicas = 1
+			Expect(ValidateTenant(tenant)).ToNot(Succeed())
+		})
+
+		It("should reject a backup volume larger than the storage limit", func() {
+			tenant.Spec.ResourceLimits = &pishopv1alpha1.ResourceLimits{StorageLimit: "5Gi"}
+			Expect(ValidateTenant(tenant)).To(MatchError(ContainSubstring("backup.storageSize")))
+
+			tenant.Spec.Backup.StorageSize = "5Gi"
+			Expect(ValidateTenant(tenant)).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// TracerName is the instrumentation name of the operator spans
+	TracerName = "go.pilab.hu/shop/pishop-provisioner"
+
+	// TraceIDAnnotation holds the ID of the trace of the current phase of a stack
+	TraceIDAnnotation = "shop.pilab.hu/trace-id"
+
+	// TraceParentAnnotation holds the W3C traceparent of the current phase of a stack, the
+	// reconciles of the phase are recorded as its children
+	TraceParentAnnotation = "shop.pilab.hu/traceparent"
+)
+
+// SetupTracing exports the operator spans with OTLP over gRPC to endpoint (host:port). The
+// returned function flushes the pending spans and stops the exporter.
+func SetupTracing(ctx context.Context, endpoint string, insecure bool, version string) (func(context.Context) error, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("pishop-operator"),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// tracer returns the operator tracer of the current global tracer provider, spans are dropped
+// when tracing is not set up
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(TracerName)
+}
+
+// startSpan starts a span for a step of a stack reconcile
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error of a step, if any, and ends its span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// stackAttributes identify a stack on its spans
+func stackAttributes(stack Stack) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("pishop.stack.kind", stackKind(stack)),
+		attribute.String("pishop.stack.id", stack.ID()),
+	}
+}
+
+// traceReconcile runs a reconcile of a stack as a span of the trace of its current phase.
+// Each phase gets its own trace, started when the stack enters the phase; its trace ID and
+// traceparent are stored as annotations so the later reconciles of the phase join it.
+func (e *StackEngine) traceReconcile(ctx context.Context, stack Stack, reconcile func(ctx context.Context) (ctrl.Result, error)) (ctrl.Result, error) {
+	phase := stack.Status().Phase
+	if _, ok := stack.Object().GetAnnotations()[TraceParentAnnotation]; !ok {
+		e.startPhaseTrace(ctx, stack)
+	}
+
+	carrier := propagation.MapCarrier{"traceparent": stack.Object().GetAnnotations()[TraceParentAnnotation]}
+	ctx = propagation.TraceContext{}.Extract(ctx, carrier)
+
+	ctx, span := startSpan(ctx, fmt.Sprintf("reconcile %s", stackKind(stack)),
+		append(stackAttributes(stack), attribute.String("pishop.stack.phase", phase))...)
+	result, err := reconcile(ctx)
+	endSpan(span, err)
+
+	if stack.Status().Phase != phase && stack.Object().GetDeletionTimestamp().IsZero() {
+		e.startPhaseTrace(ctx, stack)
+	}
+	return result, err
+}
+
+// startPhaseTrace starts the trace of the current phase of a stack and annotates the stack
+// with it. Nothing is stored when tracing is not set up.
+func (e *StackEngine) startPhaseTrace(ctx context.Context, stack Stack) {
+	phase := stack.Status().Phase
+	if phase == PhaseInitialization {
+		phase = "Initialization"
+	}
+
+	_, span := tracer().Start(ctx, fmt.Sprintf("%s %s", stackKind(stack), phase),
+		trace.WithNewRoot(),
+		trace.WithAttributes(append(stackAttributes(stack), attribute.String("pishop.stack.phase", phase))...))
+	span.End()
+	if !span.SpanContext().IsValid() {
+		return
+	}
+
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(trace.ContextWithSpanContext(ctx, span.SpanContext()), carrier)
+
+	obj := stack.Object()
+	base := obj.DeepCopyObject().(client.Object)
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[TraceIDAnnotation] = span.SpanContext().TraceID().String()
+	annotations[TraceParentAnnotation] = carrier.Get("traceparent")
+	obj.SetAnnotations(annotations)
+
+	if err := e.Patch(ctx, obj, client.MergeFrom(base)); client.IgnoreNotFound(err) != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "Failed to store trace ID", "stack", stack.ID())
+	}
+}
@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
+)
+
+// otlpCollector is a local OTLP trace collector recording the names of the exported spans
+type otlpCollector struct {
+	coltracepb.UnimplementedTraceServiceServer
+
+	mu    sync.Mutex
+	spans []string
+}
+
+func (c *otlpCollector) Export(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, resourceSpans := range req.GetResourceSpans() {
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			for _, span := range scopeSpans.GetSpans() {
+				c.spans = append(c.spans, span.GetName())
+			}
+		}
+	}
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+func (c *otlpCollector) spanNames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.spans...)
+}
+
+var _ = Describe("Tracing", func() {
+	var (
+		ctx        context.Context
+		engine     *StackEngine
+		fakeClient client.Client
+		recorder   *tracetest.SpanRecorder
+		prStack    *pishopv1alpha1.PRStack
+	)
+
+	spanNamed := func(name string) sdktrace.ReadOnlySpan {
+		for _, span := range recorder.Ended() {
+			if span.Name() == name {
+				return span
+			}
+		}
+		return nil
+	}
+
+	getPRStack := func() *pishopv1alpha1.PRStack {
+		updated := &pishopv1alpha1.PRStack{}
+		Expect(fakeClient.Get(ctx, client.ObjectKeyFromObject(prStack), updated)).To(Succeed())
+		return updated
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		prStack = newTestPRStack()
+		fakeClient = newTestClient().WithObjects(prStack).Build()
+		engine = newTestEngine(fakeClient)
+
+		recorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	})
+
+	AfterEach(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	Context("traceReconcile", func() {
+		It("should start a trace per phase and store its ID on the stack", func() {
+			enterProvisioning := func(ctx context.Context) (ctrl.Result, error) {
+				prStack.Status.Phase = PhaseProvisioning
+				return ctrl.Result{}, nil
+			}
+			_, err := engine.traceReconcile(ctx, asStack(prStack), enterProvisioning)
+			Expect(err).ToNot(HaveOccurred())
+
+			initialization := spanNamed("PRStack Initialization")
+			Expect(initialization).ToNot(BeNil())
+			reconcile := spanNamed("reconcile PRStack")
+			Expect(reconcile).ToNot(BeNil())
+			Expect(reconcile.SpanContext().TraceID()).To(Equal(initialization.SpanContext().TraceID()))
+			Expect(reconcile.Parent().SpanID()).To(Equal(initialization.SpanContext().SpanID()))
+
+			provisioning := spanNamed("PRStack Provisioning")
+			Expect(provisioning).ToNot(BeNil())
+			Expect(provisioning.SpanContext().TraceID()).ToNot(Equal(initialization.SpanContext().TraceID()))
+
+			prStack = getPRStack()
+			Expect(prStack.Annotations).To(HaveKeyWithValue(TraceIDAnnotation, provisioning.SpanContext().TraceID().String()))
+		})
+
+		It("should join the trace of the current phase", func() {
+			_, err := engine.traceReconcile(ctx, asStack(prStack), func(ctx context.Context) (ctrl.Result, error) {
+				return ctrl.Result{}, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			traceID := getPRStack().Annotations[TraceIDAnnotation]
+			Expect(traceID).ToNot(BeEmpty())
+
+			prStack = getPRStack()
+			_, err = engine.traceReconcile(ctx, asStack(prStack), func(ctx context.Context) (ctrl.Result, error) {
+				_, span := startSpan(ctx, "step")
+				span.End()
+				return ctrl.Result{}, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(spanNamed("step").SpanContext().TraceID().String()).To(Equal(traceID))
+			Expect(getPRStack().Annotations[TraceIDAnnotation]).To(Equal(traceID))
+		})
+
+		It("should not annotate stacks when tracing is disabled", func() {
+			otel.SetTracerProvider(noop.NewTracerProvider())
+
+			_, err := engine.traceReconcile(ctx, asStack(prStack), func(ctx context.Context) (ctrl.Result, error) {
+				prStack.Status.Phase = PhaseProvisioning
+				return ctrl.Result{}, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getPRStack().Annotations).ToNot(HaveKey(TraceIDAnnotation))
+		})
+	})
+
+	Context("spans", func() {
+		It("should record operations and their errors", func() {
+			err := timeOperation(ctx, asStack(prStack), OperationCleanup, "Redis", func(ctx context.Context) error {
+				return context.DeadlineExceeded
+			})
+			Expect(err).To(HaveOccurred())
+
+			span := spanNamed("cleanup Redis")
+			Expect(span).ToNot(BeNil())
+			Expect(span.Status().Code).To(Equal(codes.Error))
+		})
+
+		It("should record applied objects", func() {
+			configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: testNamespace}}
+			Expect(engine.Apply(ctx, asStack(prStack), configMap)).To(Succeed())
+
+			Expect(spanNamed("Apply ConfigMap")).ToNot(BeNil())
+		})
+	})
+
+	Context("SetupTracing", func() {
+		It("should export spans to an OTLP collector", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+
+			collector := &otlpCollector{}
+			server := grpc.NewServer()
+			coltracepb.RegisterTraceServiceServer(server, collector)
+			go func() {
+				defer GinkgoRecover()
+				Expect(server.Serve(listener)).To(Succeed())
+			}()
+			defer server.Stop()
+
+			shutdown, err := SetupTracing(ctx, listener.Addr().String(), true, "test")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, span := startSpan(ctx, "exported")
+			span.End()
+			Expect(shutdown(ctx)).To(Succeed())
+
+			Expect(collector.spanNames()).To(ContainElement("exported"))
+		})
+	})
+})
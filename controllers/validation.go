@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/resource"
 	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
@@ -49,6 +50,9 @@ func ValidatePRStack(prStack *pishopv1alpha1.PRStack) error {
 		}
 	}
 
+	// Validate per-service replicas and autoscaling
+	errors = append(errors, validateServiceScaling(prStack.Spec.ServiceScaling, 1)...)
+
 	// Validate backup config if provided
 	if prStack.Spec.BackupConfig != nil {
 		if err := validateBackupConfig(prStack.Spec.BackupConfig); err != nil {
@@ -56,6 +60,27 @@ func ValidatePRStack(prStack *pishopv1alpha1.PRStack) error {
 		}
 	}
 
+	// Validate credential rotation if provided
+	if prStack.Spec.CredentialRotation != nil {
+		if err := validateCredentialRotation(prStack.Spec.CredentialRotation); err != nil {
+			errors = append(errors, err)
+		}
+	}
+
+	// Validate MongoDB, NATS and Redis configuration
+	errors = append(errors, validateStackBackends(prStack.Spec.MongoDB, prStack.Spec.MongoURI, prStack.Spec.NATS, prStack.Spec.Redis)...)
+
+	// Volumes must fit the storage limit enforced by the LimitRange of the namespace
+	volumes := backendVolumeSizes(prStack.Spec.NATS, prStack.Spec.Redis)
+	if backupConfig := prStack.Spec.BackupConfig; backupConfig != nil && backupConfig.Enabled {
+		size := backupConfig.StorageSize
+		if size == "" {
+			size = DefaultBackupStorageSize
+		}
+		volumes = append(volumes, volumeSize{"backupConfig.storageSize", size})
+	}
+	errors = append(errors, validateVolumeSizes(prStack.Spec.ResourceLimits, volumes)...)
+
 	if len(errors) > 0 {
 		return fmt.Errorf("validation failed: %v", errors)
 	}
@@ -63,6 +88,119 @@ func ValidatePRStack(prStack *pishopv1alpha1.PRStack) error {
 	return nil
 }
 
+// ValidateTenant validates a Tenant resource
+func ValidateTenant(tenant *pishopv1alpha1.Tenant) error {
+	var errors []error
+
+	// Validate tenant ID
+	if err := validateTenantID(tenant.Spec.TenantID); err != nil {
+		errors = append(errors, err)
+	}
+
+	// Tenants run a released image, there is no PR image to fall back to
+	if err := validateImageTag(tenant.Spec.ImageTag); err != nil {
+		errors = append(errors, err)
+	}
+
+	// Validate custom domain if provided
+	if tenant.Spec.CustomDomain != "" {
+		if err := validateCustomDomain(tenant.Spec.CustomDomain); err != nil {
+			errors = append(errors, err)
+		}
+	}
+
+	if tenant.Spec.Replicas != 0 && tenant.Spec.Replicas < DefaultTenantReplicas {
+		errors = append(errors, &ValidationError{Field: "replicas", Message: fmt.Sprintf("tenants run at least %d replicas", DefaultTenantReplicas)})
+	}
+
+	// Validate resource limits if provided
+	if tenant.Spec.ResourceLimits != nil {
+		if err := validateResourceLimits(tenant.Spec.ResourceLimits); err != nil {
+			errors = append(errors, err)
+		}
+	}
+
+	// Validate per-service replicas and autoscaling, production services keep the tenant minimum
+	errors = append(errors, validateServiceScaling(tenant.Spec.ServiceScaling, DefaultTenantReplicas)...)
+
+	// Scheduled backups are mandatory
+	if tenant.Spec.Backup.Schedule == "" {
+		errors = append(errors, &ValidationError{Field: "backup.schedule", Message: "backup schedule is required"})
+	} else if err := validateBackupConfig(&pishopv1alpha1.BackupConfig{
+		Enabled:       true,
+		Schedule:      tenant.Spec.Backup.Schedule,
+		RetentionDays: tenant.Spec.Backup.RetentionDays,
+		StorageSize:   tenant.Spec.Backup.StorageSize,
+	}); err != nil {
+		errors = append(errors, err)
+	}
+
+	// Validate MongoDB, NATS and Redis configuration
+	errors = append(errors, validateStackBackends(tenant.Spec.MongoDB, tenant.Spec.MongoURI, tenant.Spec.NATS, tenant.Spec.Redis)...)
+
+	// Volumes must fit the storage limit enforced by the LimitRange of the namespace
+	backupSize := tenant.Spec.Backup.StorageSize
+	if backupSize == "" {
+		backupSize = DefaultBackupStorageSize
+	}
+	volumes := append(backendVolumeSizes(tenant.Spec.NATS, tenant.Spec.Redis), volumeSize{"backup.storageSize", backupSize})
+	errors = append(errors, validateVolumeSizes(tenant.Spec.ResourceLimits, volumes)...)
+
+	if len(errors) > 0 {
+		return fmt.Errorf("validation failed: %v", errors)
+	}
+
+	return nil
+}
+
+// validateStackBackends validates the MongoDB, NATS and Redis configuration of a stack
+func validateStackBackends(mongoDB *pishopv1alpha1.MongoDBConfig, mongoURI string, nats *pishopv1alpha1.NATSSpec, redis *pishopv1alpha1.RedisSpec) []error {
+	var errors []error
+
+	if mongoDB != nil {
+		if err := validateMongoDBConfig(mongoDB, mongoURI); err != nil {
+			errors = append(errors, err)
+		}
+	}
+
+	if nats != nil {
+		if err := validateSharedMode("nats.mode", nats.Mode); err != nil {
+			errors = append(errors, err)
+		}
+		if nats.JetStream != nil {
+			if err := validateJetStream(nats.JetStream); err != nil {
+				errors = append(errors, err)
+			}
+		}
+	}
+
+	if redis != nil {
+		if err := validateRedisConfig(redis); err != nil {
+			errors = append(errors, err)
+		}
+	}
+
+	return errors
+}
+
+// validateTenantID validates the tenant ID format
+func validateTenantID(tenantID string) error {
+	if tenantID == "" {
+		return &ValidationError{Field: "tenantID", Message: "tenant ID is required"}
+	}
+
+	tenantIDRegex := regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	if !tenantIDRegex.MatchString(tenantID) {
+		return &ValidationError{Field: "tenantID", Message: "tenant ID may only contain lowercase letters, digits and '-'"}
+	}
+
+	if len(tenantID) > 40 {
+		return &ValidationError{Field: "tenantID", Message: "tenant ID too long (max 40 characters)"}
+	}
+
+	return nil
+}
+
 // validatePRNumber validates the PR number format
 func validatePRNumber(prNumber string) error {
 	if prNumber == "" {
@@ -135,6 +273,51 @@ func validateCustomDomain(domain string) error {
 	return nil
 }
 
+// volumeSize is the size of a volume of a stack and the field setting it
+type volumeSize struct {
+	field, size string
+}
+
+// backendVolumeSizes returns the sizes of the JetStream and Redis volumes of a stack
+func backendVolumeSizes(nats *pishopv1alpha1.NATSSpec, redis *pishopv1alpha1.RedisSpec) []volumeSize {
+	var volumes []volumeSize
+	if nats != nil && nats.JetStream != nil {
+		volumes = append(volumes, volumeSize{"nats.jetstream.storageSize", nats.JetStream.StorageSize})
+	}
+	if redis != nil && redis.Persistence != nil {
+		volumes = append(volumes, volumeSize{"redis.persistence.storageSize", redis.Persistence.StorageSize})
+	}
+	return volumes
+}
+
+// validateVolumeSizes rejects volumes larger than the storage limit of a stack, which the
+// LimitRange of the namespace would refuse. Invalid sizes are reported by the validation of
+// their fields.
+func validateVolumeSizes(limits *pishopv1alpha1.ResourceLimits, volumes []volumeSize) []error {
+	if limits == nil || limits.StorageLimit == "" {
+		return nil
+	}
+	storageLimit, err := resource.ParseQuantity(limits.StorageLimit)
+	if err != nil {
+		return nil
+	}
+
+	var errors []error
+	for _, volume := range volumes {
+		if volume.size == "" {
+			continue
+		}
+		size, err := resource.ParseQuantity(volume.size)
+		if err != nil {
+			continue
+		}
+		if size.Cmp(storageLimit) > 0 {
+			errors = append(errors, &ValidationError{Field: volume.field, Message: fmt.Sprintf("storage size %s exceeds the storage limit %s", volume.size, limits.StorageLimit)})
+		}
+	}
+	return errors
+}
+
 // validateResourceLimits validates resource limits
 func validateResourceLimits(limits *pishopv1alpha1.ResourceLimits) error {
 	if limits.CPULimit != "" {
@@ -158,6 +341,63 @@ func validateResourceLimits(limits *pishopv1alpha1.ResourceLimits) error {
 	return nil
 }
 
+// validateServiceScaling validates the per-service replicas and autoscaling of a stack
+func validateServiceScaling(scaling []pishopv1alpha1.ServiceScaling, minReplicas int32) []error {
+	var errors []error
+
+	seen := make(map[string]bool)
+	for i, service := range scaling {
+		field := fmt.Sprintf("serviceScaling[%d]", i)
+
+		if service.Name == "" {
+			errors = append(errors, &ValidationError{Field: field + ".name", Message: "service name is required"})
+		} else if seen[service.Name] {
+			errors = append(errors, &ValidationError{Field: field + ".name", Message: fmt.Sprintf("duplicate service %q", service.Name)})
+		}
+		seen[service.Name] = true
+
+		if service.Replicas != nil && *service.Replicas < minReplicas {
+			errors = append(errors, &ValidationError{Field: field + ".replicas", Message: fmt.Sprintf("replicas must be at least %d", minReplicas)})
+		}
+
+		if service.Autoscaling == nil {
+			continue
+		}
+		autoscaling := service.Autoscaling
+
+		if autoscaling.MaxReplicas < 1 {
+			errors = append(errors, &ValidationError{Field: field + ".autoscaling.maxReplicas", Message: "maxReplicas must be at least 1"})
+		}
+		if autoscaling.MinReplicas != nil {
+			if *autoscaling.MinReplicas < minReplicas {
+				errors = append(errors, &ValidationError{Field: field + ".autoscaling.minReplicas", Message: fmt.Sprintf("minReplicas must be at least %d", minReplicas)})
+			}
+			if *autoscaling.MinReplicas > autoscaling.MaxReplicas {
+				errors = append(errors, &ValidationError{Field: field + ".autoscaling.minReplicas", Message: "minReplicas cannot exceed maxReplicas"})
+			}
+		}
+
+		if autoscaling.TargetCPU == "" && autoscaling.CustomMetric == nil {
+			errors = append(errors, &ValidationError{Field: field + ".autoscaling", Message: "targetCPU or customMetric is required"})
+		}
+		if autoscaling.TargetCPU != "" {
+			if err := validateResourceQuantity(autoscaling.TargetCPU, field+".autoscaling.targetCPU"); err != nil {
+				errors = append(errors, err)
+			}
+		}
+		if autoscaling.CustomMetric != nil {
+			if autoscaling.CustomMetric.Name == "" {
+				errors = append(errors, &ValidationError{Field: field + ".autoscaling.customMetric.name", Message: "metric name is required"})
+			}
+			if err := validateResourceQuantity(autoscaling.CustomMetric.TargetAverageValue, field+".autoscaling.customMetric.targetAverageValue"); err != nil {
+				errors = append(errors, err)
+			}
+		}
+	}
+
+	return errors
+}
+
 // validateResourceQuantity validates Kubernetes resource quantity format
 func validateResourceQuantity(quantity, fieldName string) error {
 	if quantity == "" {
@@ -199,3 +439,115 @@ func validateBackupConfig(config *pishopv1alpha1.BackupConfig) error {
 
 	return nil
 }
+
+// validateCredentialRotation validates credential rotation configuration
+func validateCredentialRotation(config *pishopv1alpha1.CredentialRotation) error {
+	if config.Interval != nil && config.Interval.Duration < time.Hour {
+		return &ValidationError{Field: "credentialRotation.interval", Message: "rotation interval too short (min 1h)"}
+	}
+
+	return nil
+}
+
+// validateMongoDBConfig validates MongoDB mode configuration
+func validateMongoDBConfig(config *pishopv1alpha1.MongoDBConfig, mongoURI string) error {
+	switch config.Mode {
+	case "", MongoDBModeShared:
+	case MongoDBModeDedicated:
+		if mongoURI != "" {
+			return &ValidationError{Field: "mongodb.mode", Message: "dedicated mode cannot be combined with mongoURI"}
+		}
+	default:
+		return &ValidationError{Field: "mongodb.mode", Message: fmt.Sprintf("unsupported mode %q (must be shared or dedicated)", config.Mode)}
+	}
+
+	return nil
+}
+
+// validateSharedMode validates the shared/dedicated mode of an infrastructure component
+func validateSharedMode(field, mode string) error {
+	switch mode {
+	case "", NATSModeShared, NATSModeDedicated:
+		return nil
+	default:
+		return &ValidationError{Field: field, Message: fmt.Sprintf("unsupported mode %q (must be shared or dedicated)", mode)}
+	}
+}
+
+// validateJetStream validates JetStream storage and stream definitions
+func validateJetStream(config *pishopv1alpha1.JetStreamSpec) error {
+	if config.StorageSize != "" {
+		if err := validateResourceQuantity(config.StorageSize, "nats.jetstream.storageSize"); err != nil {
+			return err
+		}
+	}
+
+	nameRegex := regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	streams := make(map[string]bool)
+	for i, stream := range config.Streams {
+		field := fmt.Sprintf("nats.jetstream.streams[%d]", i)
+		if !nameRegex.MatchString(stream.Name) {
+			return &ValidationError{Field: field + ".name", Message: "stream name may only contain letters, digits, '-' and '_'"}
+		}
+		if streams[stream.Name] {
+			return &ValidationError{Field: field + ".name", Message: fmt.Sprintf("duplicate stream %q", stream.Name)}
+		}
+		streams[stream.Name] = true
+
+		if len(stream.Subjects) == 0 {
+			return &ValidationError{Field: field + ".subjects", Message: "at least one subject is required"}
+		}
+		for _, subject := range stream.Subjects {
+			if strings.TrimPrefix(subject, ".") == "" || strings.ContainsAny(subject, " \t") {
+				return &ValidationError{Field: field + ".subjects", Message: fmt.Sprintf("invalid subject %q", subject)}
+			}
+		}
+
+		consumers := make(map[string]bool)
+		for j, consumer := range stream.Consumers {
+			if !nameRegex.MatchString(consumer.Name) {
+				return &ValidationError{Field: fmt.Sprintf("%s.consumers[%d].name", field, j), Message: "consumer name may only contain letters, digits, '-' and '_'"}
+			}
+			if consumers[consumer.Name] {
+				return &ValidationError{Field: fmt.Sprintf("%s.consumers[%d].name", field, j), Message: fmt.Sprintf("duplicate consumer %q", consumer.Name)}
+			}
+			consumers[consumer.Name] = true
+		}
+	}
+
+	return nil
+}
+
+// validateRedisConfig validates the Redis mode, persistence and memory settings
+func validateRedisConfig(config *pishopv1alpha1.RedisSpec) error {
+	if err := validateSharedMode("redis.mode", config.Mode); err != nil {
+		return err
+	}
+
+	// Persistence and memory settings only apply to the Redis server deployed for the PR
+	if config.Mode == RedisModeShared && (config.Persistence != nil || config.MaxMemory != "" || config.MaxMemoryPolicy != "") {
+		return &ValidationError{Field: "redis.mode", Message: "persistence and memory settings require dedicated mode"}
+	}
+
+	if config.MaxMemory != "" {
+		maxMemoryRegex := regexp.MustCompile(`^(?i)[0-9]+(b|k|kb|m|mb|g|gb)?$`)
+		if !maxMemoryRegex.MatchString(config.MaxMemory) {
+			return &ValidationError{Field: "redis.maxMemory", Message: fmt.Sprintf("invalid memory size %q (e.g. 256mb)", config.MaxMemory)}
+		}
+	}
+
+	if config.Persistence != nil {
+		switch config.Persistence.Mode {
+		case "", RedisPersistenceNone, RedisPersistenceRDB, RedisPersistenceAOF, RedisPersistenceBoth:
+		default:
+			return &ValidationError{Field: "redis.persistence.mode", Message: fmt.Sprintf("unsupported mode %q (must be none, rdb, aof or both)", config.Persistence.Mode)}
+		}
+		if config.Persistence.StorageSize != "" {
+			if err := validateResourceQuantity(config.Persistence.StorageSize, "redis.persistence.storageSize"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
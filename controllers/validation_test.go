@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -292,4 +293,179 @@ var _ = Describe("Validation", func() {
 			Expect(validateCustomDomain("invalid-.com")).To(HaveOccurred())
 		})
 	})
+
+	Context("validateCredentialRotation", func() {
+		It("should validate rotation without interval", func() {
+			Expect(validateCredentialRotation(&pishopv1alpha1.CredentialRotation{})).ToNot(HaveOccurred())
+		})
+
+		It("should validate reasonable intervals", func() {
+			Expect(validateCredentialRotation(&pishopv1alpha1.CredentialRotation{
+				Interval: &metav1.Duration{Duration: 168 * time.Hour},
+			})).ToNot(HaveOccurred())
+		})
+
+		It("should reject too short intervals", func() {
+			Expect(validateCredentialRotation(&pishopv1alpha1.CredentialRotation{
+				Interval: &metav1.Duration{Duration: time.Minute},
+			})).To(HaveOccurred())
+		})
+	})
+
+	Context("validateMongoDBConfig", func() {
+		It("should validate supported modes", func() {
+			Expect(validateMongoDBConfig(&pishopv1alpha1.MongoDBConfig{}, "")).ToNot(HaveOccurred())
+			Expect(validateMongoDBConfig(&pishopv1alpha1.MongoDBConfig{Mode: MongoDBModeShared}, "mongodb://custom:27017")).ToNot(HaveOccurred())
+			Expect(validateMongoDBConfig(&pishopv1alpha1.MongoDBConfig{Mode: MongoDBModeDedicated}, "")).ToNot(HaveOccurred())
+		})
+
+		It("should reject unknown modes", func() {
+			Expect(validateMongoDBConfig(&pishopv1alpha1.MongoDBConfig{Mode: "sharded"}, "")).To(HaveOccurred())
+		})
+
+		It("should reject dedicated mode with a custom mongoURI", func() {
+			Expect(validateMongoDBConfig(&pishopv1alpha1.MongoDBConfig{Mode: MongoDBModeDedicated}, "mongodb://custom:27017")).To(HaveOccurred())
+		})
+	})
+
+	Context("validateSharedMode", func() {
+		It("should validate supported modes", func() {
+			Expect(validateSharedMode("nats.mode", "")).ToNot(HaveOccurred())
+			Expect(validateSharedMode("nats.mode", NATSModeShared)).ToNot(HaveOccurred())
+			Expect(validateSharedMode("redis.mode", RedisModeDedicated)).ToNot(HaveOccurred())
+		})
+
+		It("should reject unknown modes", func() {
+			Expect(validateSharedMode("redis.mode", "cluster")).To(HaveOccurred())
+		})
+	})
+
+	Context("validateRedisConfig", func() {
+		It("should validate persistence and memory settings", func() {
+			Expect(validateRedisConfig(&pishopv1alpha1.RedisSpec{
+				MaxMemory:       "512mb",
+				MaxMemoryPolicy: "noeviction",
+				Persistence:     &pishopv1alpha1.RedisPersistenceSpec{Mode: RedisPersistenceBoth, StorageSize: "1Gi"},
+			})).ToNot(HaveOccurred())
+		})
+
+		It("should reject invalid memory sizes and storage sizes", func() {
+			Expect(validateRedisConfig(&pishopv1alpha1.RedisSpec{MaxMemory: "lots"})).To(HaveOccurred())
+			Expect(validateRedisConfig(&pishopv1alpha1.RedisSpec{
+				Persistence: &pishopv1alpha1.RedisPersistenceSpec{StorageSize: "big"},
+			})).To(HaveOccurred())
+		})
+
+		It("should reject persistence settings in shared mode", func() {
+			Expect(validateRedisConfig(&pishopv1alpha1.RedisSpec{
+				Mode:        RedisModeShared,
+				Persistence: &pishopv1alpha1.RedisPersistenceSpec{Mode: RedisPersistenceAOF},
+			})).To(HaveOccurred())
+		})
+	})
+
+	Context("validateJetStream", func() {
+		It("should validate streams with consumers", func() {
+			Expect(validateJetStream(&pishopv1alpha1.JetStreamSpec{
+				StorageSize: "1Gi",
+				Streams: []pishopv1alpha1.StreamSpec{{
+					Name:      "ORDERS",
+					Subjects:  []string{"orders.>"},
+					Consumers: []pishopv1alpha1.ConsumerSpec{{Name: "order-processor"}},
+				}},
+			})).ToNot(HaveOccurred())
+		})
+
+		It("should reject invalid storage sizes", func() {
+			Expect(validateJetStream(&pishopv1alpha1.JetStreamSpec{StorageSize: "lots"})).To(HaveOccurred())
+		})
+
+		It("should reject invalid and duplicate names", func() {
+			Expect(validateJetStream(&pishopv1alpha1.JetStreamSpec{
+				Streams: []pishopv1alpha1.StreamSpec{{Name: "orders.v1", Subjects: []string{"orders.>"}}},
+			})).To(HaveOccurred())
+			Expect(validateJetStream(&pishopv1alpha1.JetStreamSpec{
+				Streams: []pishopv1alpha1.StreamSpec{
+					{Name: "ORDERS", Subjects: []string{"orders.>"}},
+					{Name: "ORDERS", Subjects: []string{"returns.>"}},
+				},
+			})).To(HaveOccurred())
+		})
+
+		It("should reject streams without subjects", func() {
+			Expect(validateJetStream(&pishopv1alpha1.JetStreamSpec{
+				Streams: []pishopv1alpha1.StreamSpec{{Name: "ORDERS"}},
+			})).To(HaveOccurred())
+		})
+	})
+
+	Context("validateServiceScaling", func() {
+		It("should validate replicas and autoscaling", func() {
+			Expect(validateServiceScaling([]pishopv1alpha1.ServiceScaling{
+				{Name: "product-service", Replicas: int32Ptr(3)},
+				{Name: "order-service", Autoscaling: &pishopv1alpha1.AutoscalingSpec{MaxReplicas: 5, TargetCPU: "250m"}},
+				{Name: "cart-service", Autoscaling: &pishopv1alpha1.AutoscalingSpec{
+					MaxReplicas:  4,
+					CustomMetric: &pishopv1alpha1.CustomMetricSpec{Name: "http_requests_per_second", TargetAverageValue: "100"},
+				}},
+			}, 1)).To(BeEmpty())
+		})
+
+		It("should reject duplicate services and replicas below the minimum", func() {
+			Expect(validateServiceScaling([]pishopv1alpha1.ServiceScaling{
+				{Name: "product-service"},
+				{Name: "product-service"},
+			}, 1)).To(HaveLen(1))
+			Expect(validateServiceScaling([]pishopv1alpha1.ServiceScaling{
+				{Name: "product-service", Replicas: int32Ptr(1)},
+			}, DefaultTenantReplicas)).To(HaveLen(1))
+		})
+
+		It("should reject autoscaling without a target or with inverted bounds", func() {
+			Expect(validateServiceScaling([]pishopv1alpha1.ServiceScaling{
+				{Name: "product-service", Autoscaling: &pishopv1alpha1.AutoscalingSpec{MaxReplicas: 3}},
+			}, 1)).To(HaveLen(1))
+			Expect(validateServiceScaling([]pishopv1alpha1.ServiceScaling{
+				{Name: "product-service", Autoscaling: &pishopv1alpha1.AutoscalingSpec{MinReplicas: int32Ptr(4), MaxReplicas: 2, TargetCPU: "250m"}},
+			}, 1)).To(HaveLen(1))
+		})
+
+		It("should reject invalid targets", func() {
+			Expect(validateServiceScaling([]pishopv1alpha1.ServiceScaling{
+				{Name: "product-service", Autoscaling: &pishopv1alpha1.AutoscalingSpec{MaxReplicas: 3, TargetCPU: "half"}},
+			}, 1)).To(HaveLen(1))
+		})
+	})
+
+	Context("validateVolumeSizes", func() {
+		limits := &pishopv1alpha1.ResourceLimits{StorageLimit: "5Gi"}
+
+		It("should accept volumes within the storage limit", func() {
+			Expect(validateVolumeSizes(limits, []volumeSize{{"backupConfig.storageSize", "5Gi"}, {"redis.persistence.storageSize", ""}})).To(BeEmpty())
+			Expect(validateVolumeSizes(nil, []volumeSize{{"backupConfig.storageSize", "100Gi"}})).To(BeEmpty())
+		})
+
+		It("should reject volumes larger than the storage limit", func() {
+			errs := validateVolumeSizes(limits, backendVolumeSizes(
+				&pishopv1alpha1.NATSSpec{JetStream: &pishopv1alpha1.JetStreamSpec{StorageSize: "10Gi"}},
+				&pishopv1alpha1.RedisSpec{Persistence: &pishopv1alpha1.RedisPersistenceSpec{StorageSize: "1Gi"}},
+			))
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Error()).To(ContainSubstring("nats.jetstream.storageSize"))
+		})
+
+		It("should reject the default backup volume of a stack with a smaller storage limit", func() {
+			prStack := &pishopv1alpha1.PRStack{
+				Spec: pishopv1alpha1.PRStackSpec{
+					PRNumber:       "123",
+					ResourceLimits: limits,
+					BackupConfig:   &pishopv1alpha1.BackupConfig{Enabled: true},
+				},
+			}
+			Expect(ValidatePRStack(prStack)).To(MatchError(ContainSubstring("backupConfig.storageSize")))
+
+			prStack.Spec.BackupConfig.Enabled = false
+			Expect(ValidatePRStack(prStack)).To(Succeed())
+		})
+	})
 })
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
 	pishopv1alpha1 "go.pilab.hu/shop/pishop-provisioner/api/v1alpha1"
@@ -40,6 +48,24 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getDurationEnvOrDefault(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
@@ -47,11 +73,19 @@ func main() {
 	var mongoURI string
 	var mongoUsername string
 	var mongoPassword string
+	var mongoServiceURI string
+	var natsURL string
+	var natsOperatorSeed string
+	var natsSystemCreds string
+	var natsAccountNamespace string
+	var redisURL string
 
 	var githubUsername string
 	var githubToken string
 	var githubEmail string
 	var baseDomain string
+	var registry controllers.RegistryConfig
+	var quota controllers.StackQuota
 
 	// Ingress configuration
 	var ingressClassName string
@@ -59,6 +93,24 @@ func main() {
 	var traefikEntrypoints string
 	var traefikTLSEnabled string
 
+	var diffMode bool
+	var enableWebhooks bool
+	var otlpEndpoint string
+	var otlpInsecure bool
+	var observability controllers.ObservabilityConfig
+	var githubAPIURL string
+	var githubRepository string
+	var githubDeployments bool
+	var githubPRComments bool
+	var githubWebhookAddr string
+	var githubWebhookSecret string
+	var githubWebhookLabels string
+	var staleSweep bool
+	var staleSweepInterval time.Duration
+	var staleGracePeriod time.Duration
+	var staleSweepDryRun bool
+	var waveTimeout time.Duration
+
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -67,15 +119,49 @@ func main() {
 	flag.StringVar(&mongoURI, "mongo-uri", os.Getenv("MONGO_URI"), "MongoDB connection URI (required)")
 	flag.StringVar(&mongoUsername, "mongo-username", getEnvOrDefault("MONGO_USERNAME", "admin"), "MongoDB admin username")
 	flag.StringVar(&mongoPassword, "mongo-password", getEnvOrDefault("MONGO_PASSWORD", "password"), "MongoDB admin password")
+	flag.StringVar(&mongoServiceURI, "mongo-service-uri", os.Getenv("MONGO_SERVICE_URI"), "In-cluster MongoDB URI handed to PR services (defaults to --mongo-uri)")
+	flag.StringVar(&natsURL, "nats-url", os.Getenv("NATS_URL"), "Shared NATS server URL for stacks in shared NATS mode")
+	flag.StringVar(&natsOperatorSeed, "nats-operator-seed", os.Getenv("NATS_OPERATOR_SEED"), "NATS operator (signing) key seed used to sign PR accounts")
+	flag.StringVar(&natsSystemCreds, "nats-system-creds", os.Getenv("NATS_SYSTEM_CREDS"), "NATS system account credentials file used to push PR accounts")
+	flag.StringVar(&natsAccountNamespace, "nats-account-namespace", os.Getenv("POD_NAMESPACE"), "Namespace the keys of the shared NATS PR accounts are stored in")
+	flag.StringVar(&redisURL, "redis-url", os.Getenv("REDIS_URL"), "Shared Redis server URL for stacks in shared Redis mode")
 	flag.StringVar(&githubUsername, "github-username", os.Getenv("GITHUB_USERNAME"), "GitHub username for container registry")
 	flag.StringVar(&githubToken, "github-token", os.Getenv("GITHUB_TOKEN"), "GitHub token for container registry")
 	flag.StringVar(&githubEmail, "github-email", os.Getenv("GITHUB_EMAIL"), "GitHub email for container registry")
+	flag.StringVar(&registry.Host, "registry-host", getEnvOrDefault("REGISTRY_HOST", controllers.DefaultRegistryHost), "Container registry the service images are pulled from")
+	flag.StringVar(&registry.Repository, "registry-repository", getEnvOrDefault("REGISTRY_REPOSITORY", controllers.DefaultRegistryRepository), "Repository prefix of the service images on the registry")
+	flag.StringVar(&registry.CredentialsSecret, "registry-credentials-secret", os.Getenv("REGISTRY_CREDENTIALS_SECRET"), "Secret with the registry pull credentials (.dockerconfigjson, or username and password), the GitHub credentials are used when empty")
+	flag.StringVar(&registry.CredentialsNamespace, "registry-credentials-namespace", os.Getenv("POD_NAMESPACE"), "Namespace of the registry credentials secret")
+	flag.StringVar(&quota.CPU, "stack-quota-cpu", os.Getenv("STACK_QUOTA_CPU"), "Total CPU limits of the pods of a PR stack namespace, uncapped when empty")
+	flag.StringVar(&quota.Memory, "stack-quota-memory", os.Getenv("STACK_QUOTA_MEMORY"), "Total memory limits of the pods of a PR stack namespace, uncapped when empty")
+	flag.StringVar(&quota.Storage, "stack-quota-storage", os.Getenv("STACK_QUOTA_STORAGE"), "Total size of the volumes of a PR stack namespace, uncapped when empty")
+	flag.StringVar(&githubAPIURL, "github-api-url", getEnvOrDefault("GITHUB_API_URL", controllers.DefaultGitHubAPIURL), "GitHub REST API URL, for GitHub Enterprise")
+	flag.StringVar(&githubRepository, "github-repository", os.Getenv("GITHUB_REPOSITORY"), "Repository (owner/name) of the pull requests of PRStacks that do not set spec.github.repository")
+	flag.BoolVar(&githubDeployments, "github-deployments", os.Getenv("GITHUB_DEPLOYMENTS") == "true", "Publish GitHub deployment statuses for PRStacks")
+	flag.BoolVar(&githubPRComments, "github-pr-comments", os.Getenv("GITHUB_PR_COMMENTS") == "true", "Post and update a comment with the PRStack status on pull requests, requires --github-deployments")
+	flag.StringVar(&githubWebhookAddr, "github-webhook-bind-address", os.Getenv("GITHUB_WEBHOOK_BIND_ADDRESS"), "The address GitHub webhooks are received on (e.g. :8082), PRStacks are not managed from pull request events when empty")
+	flag.StringVar(&githubWebhookSecret, "github-webhook-secret", os.Getenv("GITHUB_WEBHOOK_SECRET"), "Secret the GitHub webhook payloads are signed with")
+	flag.StringVar(&githubWebhookLabels, "github-webhook-labels", os.Getenv("GITHUB_WEBHOOK_LABELS"), "Comma-separated pull request labels opting in to a PRStack, every pull request gets one when empty")
+	flag.BoolVar(&staleSweep, "stale-sweep", os.Getenv("STALE_SWEEP") == "true", "Mark PRStacks of closed pull requests stale and delete them after the grace period")
+	flag.DurationVar(&staleSweepInterval, "stale-sweep-interval", getDurationEnvOrDefault("STALE_SWEEP_INTERVAL", controllers.DefaultStaleSweepInterval), "How often the open pull requests are listed")
+	flag.DurationVar(&staleGracePeriod, "stale-grace-period", getDurationEnvOrDefault("STALE_GRACE_PERIOD", controllers.DefaultStaleGracePeriod), "How long a stale PRStack is kept before it is deleted")
+	flag.BoolVar(&staleSweepDryRun, "stale-sweep-dry-run", os.Getenv("STALE_SWEEP_DRY_RUN") == "true", "Only record events for stale PRStacks, without marking or deleting them")
+	flag.DurationVar(&waveTimeout, "wave-timeout", getDurationEnvOrDefault("WAVE_TIMEOUT", controllers.DefaultWaveTimeout), "How long a deployment wave may wait for its dependencies before the stack is degraded")
 	flag.StringVar(&baseDomain, "base-domain", getEnvOrDefault("BASE_DOMAIN", "shop.pilab.hu"), "Base domain for default PR domains (e.g., shop.pilab.hu)")
 	flag.StringVar(&ingressClassName, "ingress-class-name", getEnvOrDefault("INGRESS_CLASS_NAME", "traefik"), "Ingress class name for ingress resources")
 	flag.StringVar(&certManagerIssuer, "cert-manager-issuer", getEnvOrDefault("CERT_MANAGER_ISSUER", "letsencrypt-staging"), "Cert-manager cluster issuer for TLS certificates")
 	flag.StringVar(&traefikEntrypoints, "traefik-entrypoints", getEnvOrDefault("TRAEFIK_ENTRYPOINTS", "websecure"), "Traefik entrypoints for ingress")
 	flag.StringVar(&traefikTLSEnabled, "traefik-tls-enabled", getEnvOrDefault("TRAEFIK_TLS_ENABLED", "true"), "Enable TLS for Traefik ingress")
 
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", os.Getenv("ENABLE_WEBHOOKS") == "true", "Serve the PRStack defaulting and validating admission webhooks")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", os.Getenv("OTLP_ENDPOINT"), "OTLP gRPC endpoint (host:port) traces are exported to, tracing is disabled when empty")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", os.Getenv("OTLP_INSECURE") == "true", "Export traces to the OTLP endpoint without TLS")
+	flag.StringVar(&observability.OTLPEndpoint, "service-otlp-endpoint", os.Getenv("SERVICE_OTLP_ENDPOINT"), "OTLP endpoint the stack services export traces to, service tracing is disabled when empty")
+	flag.StringVar(&observability.SampleRate, "service-trace-sample-rate", getEnvOrDefault("SERVICE_TRACE_SAMPLE_RATE", "0.1"), "Ratio of traces sampled by the stack services")
+	flag.StringVar(&observability.LogLevel, "service-log-level", getEnvOrDefault("SERVICE_LOG_LEVEL", "info"), "Log level of the stack services")
+	flag.StringVar(&observability.MetricsScraping, "service-metrics-scraping", os.Getenv("SERVICE_METRICS_SCRAPING"), "Prometheus Operator object scraping the stack services: ServiceMonitor, PodMonitor or empty for none")
+	flag.BoolVar(&diffMode, "diff", false, "Print the changes the next reconcile would make to every PRStack and Tenant, then exit")
+
 	opts := zap.Options{
 		Development: true,
 	}
@@ -84,17 +170,99 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	// Provisioning, deployment, backup and cleanup shared by all stack kinds
+	stackEngine := &controllers.StackEngine{
+		MongoURI:             mongoURI,
+		MongoUsername:        mongoUsername,
+		MongoPassword:        mongoPassword,
+		MongoServiceURI:      mongoServiceURI,
+		NATSURL:              natsURL,
+		NATSOperatorSeed:     natsOperatorSeed,
+		NATSSystemCreds:      natsSystemCreds,
+		NATSAccountNamespace: natsAccountNamespace,
+		RedisURL:             redisURL,
+		GitHubUsername:       githubUsername,
+		GitHubToken:          githubToken,
+		GitHubEmail:          githubEmail,
+		BaseDomain:           baseDomain,
+		Registry:             registry,
+		Quota:                quota,
+		IngressClassName:     ingressClassName,
+		CertManagerIssuer:    certManagerIssuer,
+		TraefikEntrypoints:   traefikEntrypoints,
+		TraefikTLSEnabled:    traefikTLSEnabled,
+		Observability:        observability,
+		WaveTimeout:          waveTimeout,
+	}
+
+	if diffMode {
+		c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+		if err != nil {
+			setupLog.Error(err, "unable to create client")
+			os.Exit(1)
+		}
+		stackEngine.Client = c
+		stackEngine.Scheme = scheme
+		if err := stackEngine.WriteStackDiffs(context.Background(), os.Stdout); err != nil {
+			setupLog.Error(err, "unable to diff stacks")
+			os.Exit(1)
+		}
+		return
+	}
+
+	switch observability.MetricsScraping {
+	case "", controllers.MetricsScrapingServiceMonitor, controllers.MetricsScrapingPodMonitor:
+	default:
+		setupLog.Error(fmt.Errorf("unknown kind %q", observability.MetricsScraping), "invalid service-metrics-scraping")
+		os.Exit(1)
+	}
+
+	if err := quota.Validate(); err != nil {
+		setupLog.Error(err, "invalid stack quota")
+		os.Exit(1)
+	}
+
+	if registry.CredentialsSecret != "" && registry.CredentialsNamespace == "" {
+		setupLog.Error(fmt.Errorf("registry-credentials-namespace is required with registry-credentials-secret"), "unable to start manager")
+		os.Exit(1)
+	}
+
+	if githubWebhookAddr != "" && githubWebhookSecret == "" {
+		setupLog.Error(fmt.Errorf("github-webhook-secret is required to receive GitHub webhooks"), "unable to start manager")
+		os.Exit(1)
+	}
+
 	if mongoURI == "" {
 		setupLog.Error(fmt.Errorf("mongo-uri is required"), "unable to start manager")
 		os.Exit(1)
 	}
 
+	if otlpEndpoint != "" {
+		shutdownTracing, err := controllers.SetupTracing(context.Background(), otlpEndpoint, otlpInsecure, Version)
+		if err != nil {
+			setupLog.Error(err, "unable to set up tracing")
+			os.Exit(1)
+		}
+		defer func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				setupLog.Error(err, "problem flushing traces")
+			}
+		}()
+		setupLog.Info("exporting traces", "endpoint", otlpEndpoint)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		Metrics:                metricsserver.Options{BindAddress: metricsAddr},
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "pishop-provisioner.pilab.hu",
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				// Only backup pods are read, for the size of the backups
+				&corev1.Pod{}: {Label: labels.SelectorFromSet(labels.Set{"app": controllers.BackupJobApp})},
+			},
+		},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -110,27 +278,67 @@ func main() {
 		BackupPath:    "/backups",
 	}
 
-	if err = (&controllers.PRStackReconciler{
-		Client:             mgr.GetClient(),
-		Scheme:             mgr.GetScheme(),
-		Recorder:           mgr.GetEventRecorderFor("pishop-operator"),
-		MongoURI:           mongoURI,
-		MongoUsername:      mongoUsername,
-		MongoPassword:      mongoPassword,
-		BackupManager:      backupManager,
-		GitHubUsername:     githubUsername,
-		GitHubToken:        githubToken,
-		GitHubEmail:        githubEmail,
-		BaseDomain:         baseDomain,
-		IngressClassName:   ingressClassName,
-		CertManagerIssuer:  certManagerIssuer,
-		TraefikEntrypoints: traefikEntrypoints,
-		TraefikTLSEnabled:  traefikTLSEnabled,
-	}).SetupWithManager(mgr); err != nil {
+	stackEngine.Client = mgr.GetClient()
+	stackEngine.Scheme = mgr.GetScheme()
+	stackEngine.Recorder = mgr.GetEventRecorderFor("pishop-operator")
+	stackEngine.BackupManager = backupManager
+	prStackReconciler := &controllers.PRStackReconciler{StackEngine: stackEngine}
+	if githubDeployments {
+		prStackReconciler.GitHub = &controllers.GitHubReporter{
+			Client:     &controllers.GitHubClient{BaseURL: githubAPIURL, Token: githubToken},
+			Repository: githubRepository,
+			Comments:   githubPRComments,
+		}
+	}
+	if err = prStackReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PRStack")
 		os.Exit(1)
 	}
 
+	if err = (&controllers.TenantReconciler{
+		StackEngine: stackEngine,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Tenant")
+		os.Exit(1)
+	}
+
+	if githubWebhookAddr != "" {
+		receiver := &controllers.GitHubWebhookReceiver{
+			Client:      mgr.GetClient(),
+			BindAddress: githubWebhookAddr,
+			Secret:      []byte(githubWebhookSecret),
+			Labels:      splitList(githubWebhookLabels),
+			Repository:  githubRepository,
+		}
+		if err := mgr.Add(receiver); err != nil {
+			setupLog.Error(err, "unable to set up GitHub webhook receiver")
+			os.Exit(1)
+		}
+	}
+
+	if staleSweep {
+		if err := mgr.Add(&controllers.StaleStackSweeper{
+			StackEngine: stackEngine,
+			GitHub:      &controllers.GitHubClient{BaseURL: githubAPIURL, Token: githubToken},
+			Repository:  githubRepository,
+			Interval:    staleSweepInterval,
+			GracePeriod: staleGracePeriod,
+			DryRun:      staleSweepDryRun,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up stale stack sweeper")
+			os.Exit(1)
+		}
+	}
+
+	controllers.RegisterMetrics(metrics.Registry, mgr.GetClient())
+
+	if enableWebhooks {
+		if err = (&controllers.PRStackWebhook{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "PRStack")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)